@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	"github.com/lib/pq"
+
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// runInit builds a template database from migration directories or a pg_dump file.
+func runInit(ctx context.Context, env *environment, args []string) (err error) {
+	fs := env.flagSet("init")
+	templateName := fs.String("template", "", "name of the template database (required)")
+	rebuild := fs.Bool("rebuild", false, "drop and rebuild the template if it already exists")
+	var migrations stringList
+	fs.Var(&migrations, "migrations", "migration directory, may be repeated or comma-separated")
+	dump := fs.String("dump", "", "plain-format pg_dump file to build the template from")
+	variables := variableMap{}
+	fs.Var(variables, "set", "psql variable name=value of the migration files, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *templateName == "" {
+		return errors.New("-template is required")
+	}
+	if *dump != "" && len(migrations) > 0 {
+		return errors.New("-dump and -migrations are mutually exclusive")
+	}
+
+	provider := env.provider()
+	// Concurrent invocations wait for the first one to build the template.
+	unlock, err := provider.LockTemplate(ctx, *templateName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, unlock())
+	}()
+
+	if *rebuild {
+		if err := dropDatabases(ctx, env, provider, []string{*templateName}, true); err != nil {
+			return err
+		}
+	}
+
+	var migrationRunner pgdbtemplate.MigrationRunner = &pgdbtemplate.NoOpMigrationRunner{}
+	switch {
+	case *dump != "":
+		migrationRunner = pgdbtemplatepq.NewDumpMigrationRunner(*dump)
+	case len(migrations) > 0:
+		migrationRunner = pgdbtemplatepq.NewFileMigrationRunner(migrations, nil,
+			pgdbtemplatepq.WithMigrationVariables(variables))
+	}
+	tm, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{
+		MigrationRunner: migrationRunner,
+		TemplateName:    *templateName,
+	})
+	if err != nil {
+		return err
+	}
+	if err := tm.Initialize(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(env.stdout, *templateName)
+	return nil
+}
+
+// runCreate clones a test database from a template and prints its DSN.
+func runCreate(ctx context.Context, env *environment, args []string) error {
+	fs := env.flagSet("create")
+	templateName := fs.String("template", "", "name of the template database (required)")
+	dbName := fs.String("name", "", "name of the test database, generated from -prefix if empty")
+	prefix := fs.String("prefix", "testdb_", "prefix of generated test database names")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *templateName == "" {
+		return errors.New("-template is required")
+	}
+	if *dbName == "" {
+		*dbName = fmt.Sprintf("%s%d", *prefix, time.Now().UnixNano())
+	}
+
+	if err := env.provider().CloneDatabase(ctx, *dbName, *templateName); err != nil {
+		return err
+	}
+	fmt.Fprintln(env.stdout, env.connString(*dbName))
+	return nil
+}
+
+// runDrop drops the databases given as arguments.
+func runDrop(ctx context.Context, env *environment, args []string) error {
+	fs := env.flagSet("drop")
+	missingOK := fs.Bool("if-exists", false, "do not fail on databases which do not exist")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no databases given")
+	}
+	return dropDatabases(ctx, env, env.provider(), fs.Args(), *missingOK)
+}
+
+// dropDatabases drops the databases, unmarking templates and allowing
+// connections to finalized ones first.
+func dropDatabases(ctx context.Context, env *environment, provider *pgdbtemplatepq.ConnectionProvider, dbNames []string, missingOK bool) error {
+	adminConn, err := provider.Connect(ctx, env.adminDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to admin database: %w", err)
+	}
+	defer adminConn.Close()
+
+	var errs error
+	for _, dbName := range dbNames {
+		var isTemplate, allowConn bool
+		err := adminConn.QueryRowContext(ctx,
+			"SELECT datistemplate, datallowconn FROM pg_database WHERE datname = $1", dbName,
+		).Scan(&isTemplate, &allowConn)
+		if errors.Is(err, provider.GetNoRowsSentinel()) {
+			if !missingOK {
+				errs = errors.Join(errs, fmt.Errorf("database %q does not exist", dbName))
+			}
+			continue
+		}
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed to look up database %q: %w", dbName, err))
+			continue
+		}
+
+		if isTemplate || !allowConn {
+			unmarkQuery := fmt.Sprintf("ALTER DATABASE %s WITH is_template FALSE ALLOW_CONNECTIONS true", pq.QuoteIdentifier(dbName))
+			if _, err := adminConn.ExecContext(ctx, unmarkQuery); err != nil {
+				errs = errors.Join(errs, fmt.Errorf("failed to unmark template database %q: %w", dbName, err))
+				continue
+			}
+		}
+		sessions, err := provider.DropDatabase(ctx, dbName)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		fmt.Fprintf(env.stdout, "dropped %s", dbName)
+		if len(sessions) > 0 {
+			fmt.Fprintf(env.stdout, ", terminated %d sessions", len(sessions))
+		}
+		fmt.Fprintln(env.stdout)
+	}
+	return errs
+}
+
+// runList lists databases with their size, age and owner.
+func runList(ctx context.Context, env *environment, args []string) (err error) {
+	fs := env.flagSet("list")
+	var prefixes stringList
+	fs.Var(&prefixes, "prefix", "list only databases with the name prefix, may be repeated or comma-separated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	conn, err := env.provider().Connect(ctx, env.adminDB)
+	if err != nil {
+		return fmt.Errorf("failed to connect to admin database: %w", err)
+	}
+	defer conn.Close()
+	adminConn := conn.(*pgdbtemplatepq.DatabaseConnection)
+
+	rows, err := adminConn.DB.QueryContext(ctx, `
+		SELECT
+			datname,
+			pg_get_userbyid(datdba),
+			pg_size_pretty(pg_database_size(oid)),
+			datistemplate,
+			coalesce(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database
+		WHERE datname NOT IN ('template0', 'template1') AND datname <> current_database()
+		ORDER BY datname
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to list databases: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	type databaseRow struct {
+		name, owner, size, comment string
+		isTemplate                 bool
+	}
+	var databases []databaseRow
+	for rows.Next() {
+		var row databaseRow
+		if err := rows.Scan(&row.name, &row.owner, &row.size, &row.isTemplate, &row.comment); err != nil {
+			return fmt.Errorf("failed to scan database: %w", err)
+		}
+		if len(prefixes) > 0 && !hasAnyPrefix(row.name, prefixes) {
+			continue
+		}
+		databases = append(databases, row)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	w := tabwriter.NewWriter(env.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tOWNER\tSIZE\tAGE\tTEMPLATE\tCREATED BY\tNOTE")
+	for _, row := range databases {
+		age, createdBy, note := "-", "-", ""
+		if metadata, ok := pgdbtemplatepq.ParseDatabaseMetadata(row.comment); ok {
+			age = time.Since(metadata.CreatedAt).Round(time.Second).String()
+			createdBy = fmt.Sprintf("%s:%d", metadata.Hostname, metadata.PID)
+			note = strings.TrimSpace(metadata.KeptReason + " " + metadata.Test)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			row.name, row.owner, row.size, age, row.isTemplate, createdBy, note)
+	}
+	return w.Flush()
+}
+
+// runReap drops databases orphaned by crashed test runs.
+func runReap(ctx context.Context, env *environment, args []string) error {
+	fs := env.flagSet("reap")
+	var opts pgdbtemplatepq.ReapOptions
+	var prefixes stringList
+	fs.Var(&prefixes, "prefix", "consider databases with the name prefix, may be repeated or comma-separated")
+	pattern := fs.String("pattern", "", "consider databases with names matching the regular expression")
+	fs.DurationVar(&opts.OlderThan, "older-than", pgdbtemplatepq.DefaultReapOlderThan,
+		"minimal age of databases to drop whose creating process is gone, negative for any age")
+	fs.DurationVar(&opts.RemoteOlderThan, "remote-older-than", 0,
+		"minimal age of databases created on other hosts to drop, which are kept if zero")
+	fs.BoolVar(&opts.IncludeUnstamped, "include-unstamped", false, "also drop matching databases without creation metadata")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only print the plan")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts.Prefixes = prefixes
+	if *pattern != "" {
+		re, err := regexp.Compile(*pattern)
+		if err != nil {
+			return fmt.Errorf("invalid -pattern: %w", err)
+		}
+		opts.Pattern = re
+	}
+
+	plan, reapErr := env.provider().Reap(ctx, opts)
+	w := tabwriter.NewWriter(env.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tACTION\tREASON")
+	for _, db := range plan {
+		action := "keep"
+		switch {
+		case db.Dropped:
+			action = "dropped"
+		case db.Drop && opts.DryRun:
+			action = "would drop"
+		case db.Drop:
+			action = "drop failed"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", db.Name, action, db.Reason)
+	}
+	return errors.Join(reapErr, w.Flush())
+}
+
+// hasAnyPrefix reports whether the name has any of the prefixes.
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// doctorFeatures are the features reported by the doctor command.
+var doctorFeatures = []pgdbtemplatepq.Feature{
+	pgdbtemplatepq.FeatureDropDatabaseForce,
+	pgdbtemplatepq.FeatureCreateDatabaseLocale,
+	pgdbtemplatepq.FeatureCreateDatabaseStrategy,
+	pgdbtemplatepq.FeatureICULocale,
+	pgdbtemplatepq.FeatureAlterTypeAddValueInTransaction,
+	pgdbtemplatepq.FeaturePgStatStatements,
+	pgdbtemplatepq.FeaturePgPrewarm,
+}
+
+// runDoctor reports connectivity, privileges and server settings.
+func runDoctor(ctx context.Context, env *environment, args []string) error {
+	fs := env.flagSet("doctor")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	info, err := env.provider().ServerInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot connect: %w", err)
+	}
+	report := doctorReport(info)
+
+	w := tabwriter.NewWriter(env.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "connection\tok (admin database %q)\n", env.adminDB)
+	fmt.Fprintf(w, "server version\t%s (%d)\n", info.Version, info.VersionNum)
+	fmt.Fprintf(w, "role\t%s\n", info.CurrentRole)
+	fmt.Fprintf(w, "superuser\t%s\n", yesNo(info.IsSuperuser))
+	fmt.Fprintf(w, "createdb\t%s\n", yesNo(info.CanCreateDB))
+	fmt.Fprintf(w, "max_connections\t%d\n", info.MaxConnections)
+	fmt.Fprintf(w, "fsync\t%s\n", onOff(info.Fsync))
+	fmt.Fprintf(w, "synchronous_commit\t%s\n", info.SynchronousCommit)
+	for _, feature := range doctorFeatures {
+		fmt.Fprintf(w, "%s\t%s\n", feature, yesNo(info.Supports(feature)))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, hint := range report.hints {
+		fmt.Fprintf(env.stdout, "hint: %s\n", hint)
+	}
+	for _, problem := range report.problems {
+		fmt.Fprintf(env.stdout, "problem: %s\n", problem)
+	}
+	if len(report.problems) > 0 {
+		return fmt.Errorf("%d problems found", len(report.problems))
+	}
+	return nil
+}
+
+// doctorFindings holds the problems preventing the use of templates
+// and the hints for faster test runs.
+type doctorFindings struct {
+	problems []string
+	hints    []string
+}
+
+// doctorReport inspects the server information.
+func doctorReport(info *pgdbtemplatepq.ServerInfo) doctorFindings {
+	var findings doctorFindings
+	if !info.IsSuperuser && !info.CanCreateDB {
+		findings.problems = append(findings.problems,
+			fmt.Sprintf("role %q cannot create databases, grant it CREATEDB", info.CurrentRole))
+	}
+	if info.VersionNum < 90500 {
+		findings.problems = append(findings.problems,
+			fmt.Sprintf("PostgreSQL %s is not supported, 9.5 or later is required", info.Version))
+	}
+	if info.Fsync {
+		findings.hints = append(findings.hints,
+			"fsync is on, turning it off speeds up disposable test clusters")
+	}
+	if info.SynchronousCommit != "off" {
+		findings.hints = append(findings.hints, fmt.Sprintf(
+			"synchronous_commit is %s, turning it off speeds up disposable test clusters",
+			info.SynchronousCommit))
+	}
+	if !info.Supports(pgdbtemplatepq.FeatureDropDatabaseForce) {
+		findings.hints = append(findings.hints,
+			"PostgreSQL 13 or later drops databases with active sessions faster")
+	}
+	return findings
+}
+
+// yesNo formats a boolean as yes or no.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// onOff formats a boolean as on or off.
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
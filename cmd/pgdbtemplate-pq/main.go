@@ -0,0 +1,187 @@
+// Command pgdbtemplate-pq manages PostgreSQL template and test databases
+// from the command line.
+//
+// Usage:
+//
+//	pgdbtemplate-pq <command> [flags]
+//
+// Commands:
+//
+//	init    build a template database from migration directories
+//	create  clone a test database from a template and print its DSN
+//	drop    drop databases, terminating their sessions
+//	list    list test databases with size, age and owner
+//	reap    drop databases orphaned by crashed test runs
+//	doctor  report connectivity, privileges and server settings
+//
+// Connection parameters are taken from the -dsn flag. Parameters missing
+// from it, or all of them when -dsn is empty, are taken by lib/pq
+// from the standard PG* environment variables such as PGHOST and PGUSER.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// command is a subcommand of the tool.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, env *environment, args []string) error
+}
+
+// commands lists all subcommands in the order shown in the usage.
+var commands = []command{
+	{name: "init", summary: "build a template database from migration directories", run: runInit},
+	{name: "create", summary: "clone a test database from a template and print its DSN", run: runCreate},
+	{name: "drop", summary: "drop databases, terminating their sessions", run: runDrop},
+	{name: "list", summary: "list test databases with size, age and owner", run: runList},
+	{name: "reap", summary: "drop databases orphaned by crashed test runs", run: runReap},
+	{name: "doctor", summary: "report connectivity, privileges and server settings", run: runDoctor},
+}
+
+// environment holds the output streams and the connection flags shared
+// by all subcommands.
+type environment struct {
+	stdout io.Writer
+	stderr io.Writer
+
+	dsn     string
+	adminDB string
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run executes the subcommand named by the first argument
+// and returns the process exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	env := &environment{stdout: stdout, stderr: stderr}
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		env.usage()
+		return 2
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		if err := cmd.run(ctx, env, args[1:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 2
+			}
+			fmt.Fprintf(stderr, "pgdbtemplate-pq %s: %v\n", cmd.name, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "pgdbtemplate-pq: unknown command %q\n", args[0])
+	env.usage()
+	return 2
+}
+
+// usage prints the list of subcommands.
+func (env *environment) usage() {
+	fmt.Fprintln(env.stderr, "Usage: pgdbtemplate-pq <command> [flags]")
+	fmt.Fprintln(env.stderr)
+	fmt.Fprintln(env.stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(env.stderr, "  %-7s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(env.stderr)
+	fmt.Fprintln(env.stderr, "Run 'pgdbtemplate-pq <command> -h' for the flags of a command.")
+}
+
+// flagSet returns a flag set for the subcommand with the connection flags registered.
+func (env *environment) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("pgdbtemplate-pq "+name, flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	fs.StringVar(&env.dsn, "dsn", "", "connection string, PG* environment variables fill in missing parameters")
+	fs.StringVar(&env.adminDB, "admin-db", "postgres", "administrative database used to create and drop databases")
+	return fs
+}
+
+// provider returns a connection provider for the connection flags.
+func (env *environment) provider() *pgdbtemplatepq.ConnectionProvider {
+	return pgdbtemplatepq.NewConnectionProviderWithOptions(
+		env.connString,
+		pgdbtemplatepq.WithAdminDatabase(env.adminDB),
+	)
+}
+
+// connString returns the connection string for the database.
+func (env *environment) connString(dbName string) string {
+	if env.dsn == "" {
+		return "dbname=" + quoteConnValue(dbName)
+	}
+	return pgdbtemplate.ReplaceDatabaseInConnectionString(env.dsn, dbName)
+}
+
+// quoteConnValue quotes a value for key/value connection strings if needed.
+func quoteConnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + replacer.Replace(value) + "'"
+}
+
+// stringList is a flag which may be repeated or given as a comma-separated list.
+type stringList []string
+
+// String implements flag.Value.String.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value.Set.
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// variableMap is a flag setting name=value variables, which may be repeated.
+type variableMap map[string]string
+
+// String implements flag.Value.String.
+func (m variableMap) String() string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + m[name]
+	}
+	return strings.Join(names, ",")
+}
+
+// Set implements flag.Value.Set.
+func (m variableMap) Set(arg string) error {
+	name, value, ok := strings.Cut(arg, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid variable %q, want name=value", arg)
+	}
+	m[name] = value
+	return nil
+}
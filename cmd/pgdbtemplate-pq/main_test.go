@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// runCommand runs the tool with the arguments and returns its exit code and output.
+func runCommand(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// TestRun tests command dispatching and flag handling.
+func TestRun(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("No command prints usage", func(c *qt.C) {
+		code, _, stderr := runCommand()
+		c.Assert(code, qt.Equals, 2)
+		c.Assert(stderr, qt.Contains, "Usage: pgdbtemplate-pq <command> [flags]")
+		for _, cmd := range commands {
+			c.Assert(stderr, qt.Contains, cmd.name)
+		}
+	})
+
+	c.Run("Unknown command", func(c *qt.C) {
+		code, _, stderr := runCommand("explode")
+		c.Assert(code, qt.Equals, 2)
+		c.Assert(stderr, qt.Contains, `unknown command "explode"`)
+	})
+
+	c.Run("Command help", func(c *qt.C) {
+		code, _, stderr := runCommand("init", "-h")
+		c.Assert(code, qt.Equals, 2)
+		c.Assert(stderr, qt.Contains, "-migrations")
+		c.Assert(stderr, qt.Contains, "-dsn")
+	})
+
+	c.Run("Missing required flag", func(c *qt.C) {
+		code, _, stderr := runCommand("create")
+		c.Assert(code, qt.Equals, 1)
+		c.Assert(stderr, qt.Contains, "-template is required")
+	})
+
+	c.Run("Conflicting template sources", func(c *qt.C) {
+		code, _, stderr := runCommand("init", "-template", "app_template", "-dump", "schema.sql", "-migrations", "./migrations")
+		c.Assert(code, qt.Equals, 1)
+		c.Assert(stderr, qt.Contains, "-dump and -migrations are mutually exclusive")
+	})
+
+	c.Run("Invalid reap pattern", func(c *qt.C) {
+		code, _, stderr := runCommand("reap", "-pattern", "(")
+		c.Assert(code, qt.Equals, 1)
+		c.Assert(stderr, qt.Contains, "invalid -pattern")
+	})
+}
+
+// TestConnString tests deriving per-database connection strings.
+func TestConnString(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("From environment only", func(c *qt.C) {
+		env := &environment{}
+		c.Assert(env.connString("testdb_1"), qt.Equals, "dbname=testdb_1")
+		c.Assert(env.connString("it's"), qt.Equals, `dbname='it\'s'`)
+	})
+
+	c.Run("From URL", func(c *qt.C) {
+		env := &environment{dsn: "postgres://user@localhost/postgres?sslmode=disable"}
+		c.Assert(env.connString("testdb_1"), qt.Equals, "postgres://user@localhost/testdb_1?sslmode=disable")
+	})
+
+	c.Run("String list flag", func(c *qt.C) {
+		var list stringList
+		c.Assert(list.Set("a, b"), qt.IsNil)
+		c.Assert(list.Set("c"), qt.IsNil)
+		c.Assert([]string(list), qt.DeepEquals, []string{"a", "b", "c"})
+		c.Assert(list.String(), qt.Equals, "a,b,c")
+	})
+
+	c.Run("Variable map flag", func(c *qt.C) {
+		variables := variableMap{}
+		c.Assert(variables.Set("seed=on"), qt.IsNil)
+		c.Assert(variables.Set("filter=a=b"), qt.IsNil)
+		c.Assert(variables.Set("empty="), qt.IsNil)
+		c.Assert(variables.Set("seed"), qt.ErrorMatches, `invalid variable "seed", want name=value`)
+		c.Assert(variables.String(), qt.Equals, "empty=,filter=a=b,seed=on")
+	})
+}
+
+// TestDoctorReport tests the doctor findings.
+func TestDoctorReport(t *testing.T) {
+	c := qt.New(t)
+
+	findings := doctorReport(&pgdbtemplatepq.ServerInfo{
+		VersionNum:        120000,
+		Version:           "12.0",
+		CurrentRole:       "app",
+		Fsync:             true,
+		SynchronousCommit: "on",
+	})
+	c.Assert(findings.problems, qt.DeepEquals, []string{`role "app" cannot create databases, grant it CREATEDB`})
+	c.Assert(findings.hints, qt.HasLen, 3)
+
+	findings = doctorReport(&pgdbtemplatepq.ServerInfo{
+		VersionNum:        160000,
+		IsSuperuser:       true,
+		SynchronousCommit: "off",
+	})
+	c.Assert(findings.problems, qt.HasLen, 0)
+	c.Assert(findings.hints, qt.HasLen, 0)
+}
+
+// TestCommands tests the database commands end to end.
+func TestCommands(t *testing.T) {
+	c := qt.New(t)
+	dsn := os.Getenv("POSTGRES_CONNECTION_STRING")
+	if dsn == "" {
+		c.Skip("POSTGRES_CONNECTION_STRING is not set")
+	}
+
+	suffix := time.Now().UnixNano()
+	templateName := fmt.Sprintf("cli_template_%d", suffix)
+	testDBName := fmt.Sprintf("cli_testdb_%d", suffix)
+	c.Cleanup(func() {
+		runCommand("drop", "-dsn", dsn, "-if-exists", testDBName, templateName)
+	})
+
+	code, stdout, stderr := runCommand("init", "-dsn", dsn, "-template", templateName)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("stderr: %s", stderr))
+	c.Assert(strings.TrimSpace(stdout), qt.Equals, templateName)
+
+	code, stdout, stderr = runCommand("create", "-dsn", dsn, "-template", templateName, "-name", testDBName)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("stderr: %s", stderr))
+	c.Assert(stdout, qt.Contains, testDBName)
+
+	code, stdout, stderr = runCommand("list", "-dsn", dsn, "-prefix", "cli_")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("stderr: %s", stderr))
+	c.Assert(stdout, qt.Contains, testDBName)
+	c.Assert(stdout, qt.Contains, templateName)
+
+	code, stdout, stderr = runCommand("reap", "-dsn", dsn, "-prefix", testDBName, "-dry-run")
+	c.Assert(code, qt.Equals, 0, qt.Commentf("stderr: %s", stderr))
+	c.Assert(stdout, qt.Contains, "still running")
+
+	code, stdout, stderr = runCommand("drop", "-dsn", dsn, testDBName, templateName)
+	c.Assert(code, qt.Equals, 0, qt.Commentf("stderr: %s", stderr))
+	c.Assert(stdout, qt.Contains, "dropped "+testDBName)
+	c.Assert(stdout, qt.Contains, "dropped "+templateName)
+
+	code, stdout, _ = runCommand("doctor", "-dsn", dsn)
+	c.Assert(stdout, qt.Contains, "server version")
+	c.Assert(code == 0 || strings.Contains(stdout, "problem:"), qt.IsTrue)
+}
@@ -4,11 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sync"
 
 	"github.com/andrei-polukhin/pgdbtemplate"
 	_ "github.com/lib/pq"
 )
 
+// defaultAdminDBName is the default administrative database name
+// per PostgreSQL conventions.
+const defaultAdminDBName = "postgres"
+
 // DatabaseConnection wraps a standard database/sql connection.
 type DatabaseConnection struct {
 	*sql.DB
@@ -34,6 +39,15 @@ func (c *DatabaseConnection) Close() error {
 type ConnectionProvider struct {
 	connStringFunc func(databaseName string) string
 	options        []DatabaseConnectionOption
+	adminDBName    string
+	createOptions  createDatabaseOptions
+	finalization   TemplateFinalization
+
+	snapshotsMu sync.Mutex
+	snapshots   []string // Templates created by Snapshot.
+
+	serverInfoMu sync.Mutex
+	serverInfo   *ServerInfo // Cached by ServerInfo.
 }
 
 // NewConnectionProvider creates a new ConnectionProvider.
@@ -41,11 +55,45 @@ func NewConnectionProvider(connStringFunc func(databaseName string) string, opti
 	return &ConnectionProvider{
 		connStringFunc: connStringFunc,
 		options:        options,
+		adminDBName:    defaultAdminDBName,
+	}
+}
+
+// NewConnectionProviderWithOptions creates a new ConnectionProvider
+// configured with both DatabaseConnectionOption and ProviderOption values.
+func NewConnectionProviderWithOptions(connStringFunc func(databaseName string) string, options ...Option) *ConnectionProvider {
+	p := NewConnectionProvider(connStringFunc)
+	for _, option := range options {
+		option.apply(p)
 	}
+	return p
 }
 
 // Connect implements pgdbtemplate.ConnectionProvider.Connect.
 func (p *ConnectionProvider) Connect(ctx context.Context, databaseName string) (pgdbtemplate.DatabaseConnection, error) {
+	conn, err := p.connect(ctx, databaseName)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// GetNoRowsSentinel implements pgdbtemplate.ConnectionProvider.GetNoRowsSentinel.
+func (*ConnectionProvider) GetNoRowsSentinel() error {
+	return sql.ErrNoRows
+}
+
+// connectAdmin opens a connection to the administrative database.
+func (p *ConnectionProvider) connectAdmin(ctx context.Context) (*DatabaseConnection, error) {
+	conn, err := p.connect(ctx, p.adminDBName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to admin database: %w", err)
+	}
+	return conn, nil
+}
+
+// connect opens and pings a connection to the specified database.
+func (p *ConnectionProvider) connect(ctx context.Context, databaseName string) (*DatabaseConnection, error) {
 	connString := p.connStringFunc(databaseName)
 	db, err := sql.Open("postgres", connString)
 	if err != nil {
@@ -63,8 +111,3 @@ func (p *ConnectionProvider) Connect(ctx context.Context, databaseName string) (
 	}
 	return &DatabaseConnection{DB: db}, nil
 }
-
-// GetNoRowsSentinel implements pgdbtemplate.ConnectionProvider.GetNoRowsSentinel.
-func (*ConnectionProvider) GetNoRowsSentinel() error {
-	return sql.ErrNoRows
-}
@@ -76,6 +76,20 @@ func TestConnectionProvider(t *testing.T) {
 		c.Assert(err, qt.IsNotNil) // Expected to fail without real PostgreSQL.
 	})
 
+	c.Run("Connection options as a slice", func(c *qt.C) {
+		connStringFunc := func(dbName string) string {
+			return "postgres://localhost/" + dbName
+		}
+
+		// Callers building the options up front keep compiling.
+		options := []pgdbtemplatepq.DatabaseConnectionOption{
+			pgdbtemplatepq.WithMaxOpenConns(15),
+			pgdbtemplatepq.WithMaxIdleConns(5),
+		}
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc, options...)
+		c.Assert(provider, qt.IsNotNil)
+	})
+
 	c.Run("Connection provider with single options", func(c *qt.C) {
 		connStringFunc := func(dbName string) string {
 			return "postgres://localhost/" + dbName
@@ -131,6 +145,20 @@ func TestConnectionProvider(t *testing.T) {
 		c.Assert(err, qt.ErrorMatches, "failed to ping database:.*")
 	})
 
+	c.Run("Admin database option", func(c *qt.C) {
+		connStringFunc := func(dbName string) string {
+			return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+		}
+		provider := pgdbtemplatepq.NewConnectionProviderWithOptions(
+			connStringFunc,
+			pgdbtemplatepq.WithMaxOpenConns(2),
+			pgdbtemplatepq.WithAdminDatabase("nonexistent_admin_db_12345"),
+		)
+
+		_, err := provider.ServerInfo(ctx)
+		c.Assert(err, qt.ErrorMatches, "failed to connect to admin database: failed to ping database:.*")
+	})
+
 	c.Run("GetNoRowsSentinel returns sql.ErrNoRows", func(c *qt.C) {
 		provider := pgdbtemplatepq.NewConnectionProvider(nil) // connStringFunc not needed for this test.
 		sentinel := provider.GetNoRowsSentinel()
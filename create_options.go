@@ -0,0 +1,235 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// CloneStrategy is the STRATEGY used by CREATE DATABASE to copy the template.
+type CloneStrategy string
+
+const (
+	// CloneStrategyWALLog copies the template block by block through WAL.
+	// It is the server default and works best for small templates.
+	CloneStrategyWALLog CloneStrategy = "WAL_LOG"
+	// CloneStrategyFileCopy copies the template files at the file system level
+	// and forces checkpoints, which works best for large templates.
+	CloneStrategyFileCopy CloneStrategy = "FILE_COPY"
+)
+
+// createDatabaseOptions holds the options for CREATE DATABASE statements
+// issued through the provider.
+type createDatabaseOptions struct {
+	// Options applied when cloning test databases from the template.
+	strategy        CloneStrategy
+	tablespace      string
+	connectionLimit *int
+	owner           string
+
+	// Options applied when creating the template database itself.
+	// Clones inherit them, as PostgreSQL requires clones to keep
+	// the encoding and locale of their template.
+	encoding  string
+	locale    string
+	icuLocale string
+}
+
+// WithCloneStrategy sets the STRATEGY used to clone test databases
+// from the template. Requires PostgreSQL 15 or later.
+func WithCloneStrategy(strategy CloneStrategy) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.createOptions.strategy = strategy
+	}
+}
+
+// WithCloneTablespace sets the TABLESPACE test databases are cloned into,
+// e.g. one backed by tmpfs.
+func WithCloneTablespace(tablespace string) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.createOptions.tablespace = tablespace
+	}
+}
+
+// WithCloneConnectionLimit sets the CONNECTION LIMIT of cloned test databases.
+//
+// -1 means no limit.
+func WithCloneConnectionLimit(n int) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.createOptions.connectionLimit = &n
+	}
+}
+
+// WithCloneOwner sets the OWNER role of cloned test databases.
+func WithCloneOwner(role string) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.createOptions.owner = role
+	}
+}
+
+// WithTemplateEncoding sets the ENCODING of the template database.
+//
+// The template is then created from template0 and clones inherit the encoding.
+func WithTemplateEncoding(encoding string) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.createOptions.encoding = encoding
+	}
+}
+
+// WithTemplateLocale sets the LOCALE of the template database.
+//
+// The template is then created from template0 and clones inherit the locale.
+// Before PostgreSQL 13 the locale is set with LC_COLLATE and LC_CTYPE.
+func WithTemplateLocale(locale string) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.createOptions.locale = locale
+	}
+}
+
+// WithTemplateICULocale makes the template database use the ICU locale provider
+// with the given ICU_LOCALE. Requires PostgreSQL 15 or later.
+//
+// The template is then created from template0 and clones inherit the locale.
+func WithTemplateICULocale(icuLocale string) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.createOptions.icuLocale = icuLocale
+	}
+}
+
+// CloneDatabase creates the database as a copy of the template database,
+// applying the provider's clone options, and stamps it with DatabaseMetadata.
+func (p *ConnectionProvider) CloneDatabase(ctx context.Context, databaseName, templateName string) error {
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer adminConn.Close()
+
+	return p.cloneDatabase(ctx, adminConn, databaseName, templateName)
+}
+
+// cloneDatabase creates the database as a copy of the template database,
+// applying the provider's clone options, and stamps it with DatabaseMetadata.
+// The database is dropped again if it cannot be stamped.
+func (p *ConnectionProvider) cloneDatabase(ctx context.Context, adminConn *DatabaseConnection, databaseName, templateName string) error {
+	info, err := p.cachedServerInfo(ctx)
+	if err != nil {
+		return err
+	}
+	clause, err := p.createOptions.cloneClause(info)
+	if err != nil {
+		return fmt.Errorf("invalid create database options: %w", err)
+	}
+
+	query := fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s%s",
+		pq.QuoteIdentifier(databaseName), pq.QuoteIdentifier(templateName), clause)
+	if _, err := adminConn.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to clone database %q from %q: %w", databaseName, templateName, err)
+	}
+	return stampCreatedDatabase(ctx, adminConn, info, databaseName)
+}
+
+// createTemplateDatabase creates an empty template database applying
+// the provider's template options, or clones the parent template
+// if one is given, and stamps it with DatabaseMetadata.
+// The database is dropped again if it cannot be stamped.
+//
+// Clone options are not applied: they are meant for test databases.
+// Derived templates inherit the encoding and locale of their parent.
+func (p *ConnectionProvider) createTemplateDatabase(ctx context.Context, adminConn *DatabaseConnection, templateName, parent string) error {
+	info, err := p.cachedServerInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("CREATE DATABASE %s", pq.QuoteIdentifier(templateName))
+	switch {
+	case parent != "":
+		query += fmt.Sprintf(" TEMPLATE %s", pq.QuoteIdentifier(parent))
+	case p.createOptions.hasTemplateOptions():
+		clause, err := p.createOptions.templateClause(info)
+		if err != nil {
+			return fmt.Errorf("invalid create database options: %w", err)
+		}
+		query += clause
+	}
+	if _, err := adminConn.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create template database %q: %w", templateName, err)
+	}
+	return stampCreatedDatabase(ctx, adminConn, info, templateName)
+}
+
+// stampCreatedDatabase stamps the newly created database with DatabaseMetadata,
+// dropping it if that fails, so that no unidentifiable database is left behind.
+func stampCreatedDatabase(ctx context.Context, adminConn *DatabaseConnection, info *ServerInfo, databaseName string) error {
+	err := setDatabaseMetadata(ctx, adminConn, databaseName, NewDatabaseMetadata())
+	if err == nil {
+		return nil
+	}
+	if _, dropErr := dropDatabase(ctx, adminConn, info, databaseName); dropErr != nil {
+		err = errors.Join(err, dropErr)
+	}
+	return err
+}
+
+// hasTemplateOptions reports whether any template option is set.
+func (o *createDatabaseOptions) hasTemplateOptions() bool {
+	return o.encoding != "" || o.locale != "" || o.icuLocale != ""
+}
+
+// cloneClause renders the clone options as a CREATE DATABASE clause
+// and validates them against the server.
+func (o *createDatabaseOptions) cloneClause(info *ServerInfo) (string, error) {
+	var clause strings.Builder
+	if o.strategy != "" {
+		if o.strategy != CloneStrategyWALLog && o.strategy != CloneStrategyFileCopy {
+			return "", fmt.Errorf("unknown clone strategy %q", o.strategy)
+		}
+		if err := info.requireFeature(FeatureCreateDatabaseStrategy); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&clause, " STRATEGY %s", o.strategy)
+	}
+	if o.tablespace != "" {
+		fmt.Fprintf(&clause, " TABLESPACE %s", pq.QuoteIdentifier(o.tablespace))
+	}
+	if o.connectionLimit != nil {
+		if *o.connectionLimit < -1 {
+			return "", fmt.Errorf("invalid connection limit %d", *o.connectionLimit)
+		}
+		fmt.Fprintf(&clause, " CONNECTION LIMIT %d", *o.connectionLimit)
+	}
+	if o.owner != "" {
+		fmt.Fprintf(&clause, " OWNER %s", pq.QuoteIdentifier(o.owner))
+	}
+	return clause.String(), nil
+}
+
+// templateClause renders the template options as a CREATE DATABASE clause
+// and validates them against the server.
+func (o *createDatabaseOptions) templateClause(info *ServerInfo) (string, error) {
+	// Encoding and locale can only be changed when copying template0.
+	var clause strings.Builder
+	clause.WriteString(" TEMPLATE template0")
+	if o.encoding != "" {
+		fmt.Fprintf(&clause, " ENCODING %s", pq.QuoteLiteral(o.encoding))
+	}
+	if o.locale != "" {
+		if info.Supports(FeatureCreateDatabaseLocale) {
+			fmt.Fprintf(&clause, " LOCALE %s", pq.QuoteLiteral(o.locale))
+		} else {
+			fmt.Fprintf(&clause, " LC_COLLATE %s LC_CTYPE %s",
+				pq.QuoteLiteral(o.locale), pq.QuoteLiteral(o.locale))
+		}
+	}
+	if o.icuLocale != "" {
+		if err := info.requireFeature(FeatureICULocale); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&clause, " LOCALE_PROVIDER icu ICU_LOCALE %s", pq.QuoteLiteral(o.icuLocale))
+	}
+	return clause.String(), nil
+}
@@ -0,0 +1,137 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestCreateDatabaseOptions tests the CREATE DATABASE options of the provider.
+func TestCreateDatabaseOptions(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+
+	c.Run("Clone with connection limit", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "clone_options_template")
+		provider := pgdbtemplatepq.NewConnectionProviderWithOptions(
+			connStringFunc,
+			pgdbtemplatepq.WithCloneConnectionLimit(7),
+		)
+
+		cloneName := fmt.Sprintf("clone_options_test_%d", time.Now().UnixNano())
+		err := provider.CloneDatabase(ctx, cloneName, templateName)
+		c.Assert(err, qt.IsNil)
+		defer provider.DropDatabase(ctx, cloneName)
+
+		adminConn, err := provider.Connect(ctx, "postgres")
+		c.Assert(err, qt.IsNil)
+		defer adminConn.Close()
+
+		var connLimit int
+		err = adminConn.QueryRowContext(ctx,
+			"SELECT datconnlimit FROM pg_database WHERE datname = $1", cloneName,
+		).Scan(&connLimit)
+		c.Assert(err, qt.IsNil)
+		c.Assert(connLimit, qt.Equals, 7)
+	})
+
+	c.Run("Template manager applies options", func(c *qt.C) {
+		c.Parallel()
+		provider := pgdbtemplatepq.NewConnectionProviderWithOptions(
+			connStringFunc,
+			pgdbtemplatepq.WithCloneConnectionLimit(5),
+			pgdbtemplatepq.WithTemplateEncoding("UTF8"),
+		)
+		tm, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{
+			MigrationRunner: &pgdbtemplate.NoOpMigrationRunner{},
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(tm.Initialize(ctx), qt.IsNil)
+		defer func() { c.Assert(tm.Cleanup(ctx), qt.IsNil) }()
+
+		testConn, testDBName, err := tm.CreateTestDatabase(ctx)
+		c.Assert(err, qt.IsNil)
+		defer testConn.Close()
+
+		var connLimit int
+		var encoding string
+		err = testConn.QueryRowContext(ctx, `
+			SELECT datconnlimit, pg_encoding_to_char(encoding)
+			FROM pg_database WHERE datname = $1
+		`, testDBName).Scan(&connLimit, &encoding)
+		c.Assert(err, qt.IsNil)
+		c.Assert(connLimit, qt.Equals, 5)
+		c.Assert(encoding, qt.Equals, "UTF8")
+	})
+
+	c.Run("Unknown clone strategy", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "clone_strategy_template")
+		provider := pgdbtemplatepq.NewConnectionProviderWithOptions(
+			connStringFunc,
+			pgdbtemplatepq.WithCloneStrategy("TELEPORT"),
+		)
+
+		err := provider.CloneDatabase(ctx, "clone_strategy_test", templateName)
+		c.Assert(err, qt.ErrorMatches, `.*invalid create database options: unknown clone strategy "TELEPORT"`)
+	})
+
+	c.Run("Clone strategy validated against server version", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "clone_strategy_version_template")
+		provider := pgdbtemplatepq.NewConnectionProviderWithOptions(
+			connStringFunc,
+			pgdbtemplatepq.WithCloneStrategy(pgdbtemplatepq.CloneStrategyFileCopy),
+		)
+		info, err := provider.ServerInfo(ctx)
+		c.Assert(err, qt.IsNil)
+
+		cloneName := fmt.Sprintf("clone_strategy_test_%d", time.Now().UnixNano())
+		err = provider.CloneDatabase(ctx, cloneName, templateName)
+		if !info.Supports(pgdbtemplatepq.FeatureCreateDatabaseStrategy) {
+			c.Assert(err, qt.ErrorMatches, ".*requires PostgreSQL 15 or later.*")
+			return
+		}
+		c.Assert(err, qt.IsNil)
+		_, err = provider.DropDatabase(ctx, cloneName)
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Exec has no side effects", func(c *qt.C) {
+		c.Parallel()
+		provider := pgdbtemplatepq.NewConnectionProviderWithOptions(
+			connStringFunc,
+			pgdbtemplatepq.WithCloneConnectionLimit(3),
+		)
+		conn, err := provider.Connect(ctx, "postgres")
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		// Statements are executed as they are, options only apply
+		// to databases created through the provider's API.
+		dbName := fmt.Sprintf("plain_exec_test_%d", time.Now().UnixNano())
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE "%s" TEMPLATE template1`, dbName))
+		c.Assert(err, qt.IsNil)
+		defer provider.DropDatabase(ctx, dbName)
+
+		var connLimit int
+		err = conn.QueryRowContext(ctx, "SELECT datconnlimit FROM pg_database WHERE datname = $1", dbName).Scan(&connLimit)
+		c.Assert(err, qt.IsNil)
+		c.Assert(connLimit, qt.Equals, -1)
+		metadata, err := provider.DatabaseMetadata(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(metadata, qt.IsNil)
+	})
+}
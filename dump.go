@@ -0,0 +1,401 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+)
+
+// schemaDumpHeader starts every schema dump.
+const schemaDumpHeader = "-- Schema dump generated by pgdbtemplate-pq from the system catalogs.\n"
+
+// dumpSchemaQuery renders the user schema objects as SQL statements,
+// returning them as a JSON array of [section, statement, key] triples.
+//
+// Sections order the statements so that objects mostly precede their users,
+// and names order them bytewise within sections, whatever the collation
+// of the database;
+// the dependencies between types, functions, sequences, tables and views
+// are resolved with dumpDependenciesQuery, matching the keys of the objects.
+// The placeholders are replaced by version-dependent column expressions.
+const dumpSchemaQuery = `
+	SELECT coalesce(json_agg(json_build_array(section, statement, key) ORDER BY section, name COLLATE "C", statement COLLATE "C"), '[]')::text FROM (
+		SELECT 1 AS section, n.nspname AS name, 'CREATE SCHEMA ' || quote_ident(n.nspname) || ';' AS statement,
+			NULL AS key
+		FROM pg_namespace n
+		WHERE n.nspname <> 'public' AND {{userNamespace}}
+
+		UNION ALL
+		SELECT 2, e.extname, 'CREATE EXTENSION ' || quote_ident(e.extname) ||
+			' WITH SCHEMA ' || quote_ident(n.nspname) || ' VERSION ' || quote_literal(e.extversion) || ';',
+			NULL
+		FROM pg_extension e JOIN pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname <> 'plpgsql'
+
+		UNION ALL
+		SELECT 3, n.nspname || '.' || t.typname, 'CREATE ' ||
+			CASE t.typtype
+				WHEN 'e' THEN 'TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS ENUM (' || coalesce((
+					SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder)
+					FROM pg_enum e WHERE e.enumtypid = t.oid
+				), '') || ')'
+				WHEN 'd' THEN 'DOMAIN ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) ||
+					' AS ' || format_type(t.typbasetype, t.typtypmod) ||
+					coalesce(' DEFAULT ' || t.typdefault, '') ||
+					CASE WHEN t.typnotnull THEN ' NOT NULL' ELSE '' END
+				WHEN 'c' THEN 'TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS (' || coalesce((
+					SELECT string_agg(quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod), ', ' ORDER BY a.attnum)
+					FROM pg_attribute a WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+				), '') || ')'
+				WHEN 'r' THEN 'TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS RANGE (SUBTYPE = ' ||
+					(SELECT format_type(r.rngsubtype, NULL) FROM pg_range r WHERE r.rngtypid = t.oid) || ')'
+				ELSE 'TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname)
+			END || ';',
+			'pg_type:' || t.oid
+		FROM pg_type t JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE {{userNamespace}}
+			AND (t.typrelid = 0 OR (SELECT c.relkind FROM pg_class c WHERE c.oid = t.typrelid) = 'c')
+			AND NOT EXISTS (SELECT 1 FROM pg_type elem WHERE elem.typarray = t.oid)
+			AND {{notExtensionMember pg_type t.oid}}
+
+		UNION ALL
+		SELECT 4, n.nspname || '.' || p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')',
+			rtrim(pg_get_functiondef(p.oid), E'\n') || ';',
+			'pg_proc:' || p.oid
+		FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE {{userNamespace}}
+			AND NOT EXISTS (SELECT 1 FROM pg_aggregate agg WHERE agg.aggfnoid = p.oid)
+			AND {{notExtensionMember pg_proc p.oid}}
+
+		UNION ALL
+		SELECT 5, s.sequence_schema || '.' || s.sequence_name,
+			'CREATE SEQUENCE ' || quote_ident(s.sequence_schema) || '.' || quote_ident(s.sequence_name) ||
+			{{sequenceType}} ' START WITH ' || s.start_value || ' INCREMENT BY ' || s.increment ||
+			' MINVALUE ' || s.minimum_value || ' MAXVALUE ' || s.maximum_value ||
+			CASE s.cycle_option WHEN 'YES' THEN ' CYCLE' ELSE ' NO CYCLE' END || ';',
+			'pg_class:' || (quote_ident(s.sequence_schema) || '.' || quote_ident(s.sequence_name))::regclass::oid
+		FROM information_schema.sequences s
+		WHERE s.sequence_schema NOT LIKE 'pg\_%' AND NOT EXISTS (
+			SELECT 1 FROM pg_depend dep
+			WHERE dep.classid = 'pg_class'::regclass
+				AND dep.objid = (quote_ident(s.sequence_schema) || '.' || quote_ident(s.sequence_name))::regclass
+				AND dep.deptype IN ('i', 'e')
+		)
+
+		UNION ALL
+		SELECT 6, n.nspname || '.' || c.relname,
+			'CREATE ' || CASE c.relpersistence WHEN 'u' THEN 'UNLOGGED ' ELSE '' END ||
+			'TABLE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) || ' (' || coalesce(E'\n' || (
+				SELECT string_agg('    ' || quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod) ||
+					CASE
+						WHEN {{generatedColumn}} THEN ' GENERATED ALWAYS AS (' || pg_get_expr(d.adbin, d.adrelid) || ') STORED'
+						WHEN {{identityColumn}} = 'a' THEN ' GENERATED ALWAYS AS IDENTITY'
+						WHEN {{identityColumn}} = 'd' THEN ' GENERATED BY DEFAULT AS IDENTITY'
+						ELSE coalesce(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '')
+					END ||
+					CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END, E',\n' ORDER BY a.attnum)
+				FROM pg_attribute a
+				LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+				WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+			) || E'\n', '') || ')' || {{partitionKey}} || ';',
+			'pg_class:' || c.oid
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND {{userNamespace}}
+			AND {{notExtensionMember pg_class c.oid}}
+
+		UNION ALL
+		SELECT 7, n.nspname || '.' || c.relname || '.' || lpad(i.inhseqno::text, 5, '0'),
+			CASE p.relkind
+				WHEN 'p' THEN 'ALTER TABLE ' || quote_ident(pn.nspname) || '.' || quote_ident(p.relname) ||
+					' ATTACH PARTITION ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) || ' ' || {{partitionBound}}
+				ELSE 'ALTER TABLE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) ||
+					' INHERIT ' || quote_ident(pn.nspname) || '.' || quote_ident(p.relname)
+			END || ';',
+			NULL
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_class p ON p.oid = i.inhparent
+		JOIN pg_namespace pn ON pn.oid = p.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND {{userNamespace}}
+			AND {{notExtensionMember pg_class c.oid}}
+
+		UNION ALL
+		SELECT CASE con.contype WHEN 'f' THEN 9 ELSE 8 END,
+			n.nspname || '.' || c.relname || '.' || con.conname,
+			'ALTER TABLE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) ||
+			' ADD CONSTRAINT ' || quote_ident(con.conname) || ' ' || pg_get_constraintdef(con.oid) || ';',
+			NULL
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype <> 'n' AND con.conislocal AND {{userNamespace}}
+			AND {{notExtensionMember pg_class c.oid}}
+
+		UNION ALL
+		SELECT 8, n.nspname || '.' || t.typname || '.' || con.conname,
+			'ALTER DOMAIN ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) ||
+			' ADD CONSTRAINT ' || quote_ident(con.conname) || ' ' || pg_get_constraintdef(con.oid) || ';',
+			NULL
+		FROM pg_constraint con
+		JOIN pg_type t ON t.oid = con.contypid
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE con.contype <> 'n' AND {{userNamespace}}
+			AND {{notExtensionMember pg_type t.oid}}
+
+		UNION ALL
+		SELECT 10, n.nspname || '.' || c.relname, pg_get_indexdef(i.indexrelid) || ';', NULL
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE {{userNamespace}}
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_constraint con
+				WHERE con.conindid = i.indexrelid AND con.contype IN ('p', 'u', 'x')
+			)
+			AND NOT EXISTS (SELECT 1 FROM pg_inherits inh WHERE inh.inhrelid = i.indexrelid)
+			AND {{notExtensionMember pg_class i.indrelid}}
+
+		UNION ALL
+		SELECT 11, n.nspname || '.' || c.relname,
+			'CREATE ' || CASE c.relkind WHEN 'm' THEN 'MATERIALIZED ' ELSE '' END ||
+			'VIEW ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) || E' AS\n' ||
+			rtrim(ltrim(pg_get_viewdef(c.oid)), ';') ||
+			CASE c.relkind WHEN 'm' THEN E'\nWITH NO DATA' ELSE '' END || ';',
+			'pg_class:' || c.oid
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm') AND {{userNamespace}}
+			AND {{notExtensionMember pg_class c.oid}}
+
+		UNION ALL
+		SELECT 12, n.nspname || '.' || c.relname || '.' || t.tgname, pg_get_triggerdef(t.oid) || ';' ||
+			CASE t.tgenabled WHEN 'D' THEN E'\nALTER TABLE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname) ||
+				' DISABLE TRIGGER ' || quote_ident(t.tgname) || ';' ELSE '' END,
+			NULL
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal AND {{userNamespace}}
+
+		UNION ALL
+		SELECT 13, object || ' ' || grantee,
+			'GRANT ' || string_agg(privilege, ', ' ORDER BY privilege COLLATE "C") || ' ON ' || object || ' TO ' || grantee || ';',
+			NULL
+		FROM (
+			SELECT 'SCHEMA ' || quote_ident(n.nspname), acl.grantee, acl.privilege_type
+			FROM pg_namespace n, aclexplode(n.nspacl) acl
+			WHERE n.nspname <> 'public' AND acl.grantee <> n.nspowner AND {{userNamespace}}
+			UNION ALL
+			SELECT CASE c.relkind WHEN 'S' THEN 'SEQUENCE ' ELSE 'TABLE ' END ||
+				quote_ident(n.nspname) || '.' || quote_ident(c.relname), acl.grantee, acl.privilege_type
+			FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace, aclexplode(c.relacl) acl
+			WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm', 'S') AND acl.grantee <> c.relowner AND {{userNamespace}}
+			UNION ALL
+			SELECT 'FUNCTION ' || quote_ident(n.nspname) || '.' || quote_ident(p.proname) ||
+				'(' || pg_get_function_identity_arguments(p.oid) || ')', acl.grantee, acl.privilege_type
+			FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace, aclexplode(p.proacl) acl
+			WHERE acl.grantee <> p.proowner AND {{userNamespace}}
+		) grants(object, grantee_oid, privilege)
+		CROSS JOIN LATERAL (
+			SELECT CASE grantee_oid WHEN 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(grantee_oid)) END
+		) g(grantee)
+		GROUP BY object, grantee
+	) statements
+`
+
+// dumpDependenciesQuery returns the dependencies recorded in pg_depend between
+// the keys of dumpSchemaQuery as a JSON array of [dependent, referenced] pairs.
+//
+// Column defaults and view rules are attributed to their relations, row types
+// to their relations, composite type columns to their types and array types
+// to their element types.
+const dumpDependenciesQuery = `
+	SELECT coalesce(json_agg(json_build_array(dependent, referenced)), '[]')::text FROM (
+		SELECT DISTINCT
+			CASE d.classid
+				WHEN 'pg_type'::regclass THEN 'pg_type:' || d.objid
+				WHEN 'pg_proc'::regclass THEN 'pg_proc:' || d.objid
+				WHEN 'pg_class'::regclass THEN (
+					SELECT CASE c.relkind WHEN 'c' THEN 'pg_type:' || c.reltype ELSE 'pg_class:' || c.oid END
+					FROM pg_class c WHERE c.oid = d.objid
+				)
+				WHEN 'pg_attrdef'::regclass THEN (SELECT 'pg_class:' || ad.adrelid FROM pg_attrdef ad WHERE ad.oid = d.objid)
+				WHEN 'pg_rewrite'::regclass THEN (SELECT 'pg_class:' || r.ev_class FROM pg_rewrite r WHERE r.oid = d.objid)
+			END AS dependent,
+			CASE d.refclassid
+				WHEN 'pg_type'::regclass THEN (
+					SELECT CASE WHEN rel.relkind IS NULL OR rel.relkind = 'c' THEN 'pg_type:' || t.oid ELSE 'pg_class:' || rel.oid END
+					FROM pg_type t LEFT JOIN pg_class rel ON rel.oid = t.typrelid
+					WHERE t.oid = coalesce((SELECT elem.oid FROM pg_type elem WHERE elem.typarray = d.refobjid), d.refobjid)
+				)
+				WHEN 'pg_proc'::regclass THEN 'pg_proc:' || d.refobjid
+				WHEN 'pg_class'::regclass THEN (
+					SELECT CASE c.relkind WHEN 'c' THEN 'pg_type:' || c.reltype ELSE 'pg_class:' || c.oid END
+					FROM pg_class c WHERE c.oid = d.refobjid
+				)
+			END AS referenced
+		FROM pg_depend d
+		WHERE d.deptype = 'n' AND d.objid >= 16384 AND d.refobjid >= 16384
+			AND d.classid IN ('pg_type'::regclass, 'pg_proc'::regclass, 'pg_class'::regclass, 'pg_attrdef'::regclass, 'pg_rewrite'::regclass)
+			AND d.refclassid IN ('pg_type'::regclass, 'pg_proc'::regclass, 'pg_class'::regclass)
+	) dependencies
+	WHERE dependent <> referenced
+`
+
+// DumpSchema renders the user schema of the database as canonical SQL.
+//
+// The dump is built from catalog queries only, without pg_dump. Statements
+// are grouped by object kind and sorted by name, so that the same schema
+// always produces the same text and schema changes produce small diffs.
+// Types, functions, sequences, tables and views are moved after the objects
+// they depend on per pg_depend, e.g. a view selecting from a view sorted after
+// it, or a function returning the rows of a table. Function bodies are not
+// tracked by pg_depend, so the dump should be replayed with
+// check_function_bodies disabled, as pg_dump does.
+// Owners, the privileges of owners and of the public schema, comments,
+// and objects created by extensions are omitted, as they vary between
+// environments or are covered by the extension.
+func DumpSchema(ctx context.Context, conn pgdbtemplate.DatabaseConnection) (string, error) {
+	statements, err := dumpSchemaStatements(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+
+	var dump strings.Builder
+	dump.WriteString(schemaDumpHeader)
+	for _, statement := range statements {
+		dump.WriteString("\n")
+		dump.WriteString(statement.statement)
+		dump.WriteString("\n")
+	}
+	return dump.String(), nil
+}
+
+// dumpedStatement is a statement of a schema dump.
+type dumpedStatement struct {
+	section   int // Object kind, see dumpSchemaQuery.
+	statement string
+	key       string // Identifies the created object for ordering, if any.
+}
+
+// dumpSchemaStatements returns the statements of the schema dump in order.
+func dumpSchemaStatements(ctx context.Context, conn pgdbtemplate.DatabaseConnection) ([]dumpedStatement, error) {
+	var versionNum int
+	if err := conn.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum); err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+
+	var encoded string
+	if err := conn.QueryRowContext(ctx, dumpSchemaSQL(versionNum)).Scan(&encoded); err != nil {
+		return nil, fmt.Errorf("failed to dump schema: %w", err)
+	}
+	var triples [][3]json.RawMessage
+	if err := json.Unmarshal([]byte(encoded), &triples); err != nil {
+		return nil, fmt.Errorf("failed to decode schema dump: %w", err)
+	}
+	statements := make([]dumpedStatement, len(triples))
+	for i, triple := range triples {
+		err := errors.Join(
+			json.Unmarshal(triple[0], &statements[i].section),
+			json.Unmarshal(triple[1], &statements[i].statement),
+			json.Unmarshal(triple[2], &statements[i].key),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode schema dump: %w", err)
+		}
+	}
+
+	var encodedDependencies string
+	if err := conn.QueryRowContext(ctx, dumpDependenciesQuery).Scan(&encodedDependencies); err != nil {
+		return nil, fmt.Errorf("failed to query schema dependencies: %w", err)
+	}
+	var dependencies [][2]string
+	if err := json.Unmarshal([]byte(encodedDependencies), &dependencies); err != nil {
+		return nil, fmt.Errorf("failed to decode schema dependencies: %w", err)
+	}
+	return orderDumpedStatements(statements, dependencies), nil
+}
+
+// orderDumpedStatements moves the statements after the statements creating
+// the objects they depend on, keeping the order of independent statements.
+//
+// Cycles, e.g. a table whose default calls a function returning its rows,
+// cannot be ordered and are left in place.
+func orderDumpedStatements(statements []dumpedStatement, dependencies [][2]string) []dumpedStatement {
+	byKey := make(map[string]int, len(statements))
+	for i, statement := range statements {
+		if statement.key != "" {
+			byKey[statement.key] = i
+		}
+	}
+	referenced := make(map[int][]int)
+	for _, dependency := range dependencies {
+		dependent, ok := byKey[dependency[0]]
+		if !ok {
+			continue
+		}
+		if reference, ok := byKey[dependency[1]]; ok {
+			referenced[dependent] = append(referenced[dependent], reference)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(statements))
+	ordered := make([]dumpedStatement, 0, len(statements))
+	var visit func(i int)
+	visit = func(i int) {
+		if state[i] != unvisited {
+			return
+		}
+		state[i] = visiting
+		references := referenced[i]
+		sort.Ints(references)
+		for _, reference := range references {
+			visit(reference)
+		}
+		state[i] = visited
+		ordered = append(ordered, statements[i])
+	}
+	for i := range statements {
+		visit(i)
+	}
+	return ordered
+}
+
+// dumpSchemaSQL returns the schema dump query for the server version.
+func dumpSchemaSQL(versionNum int) string {
+	generatedColumn, identityColumn := "false", "''"
+	sequenceType, partitionKey, partitionBound := "", "''", "''"
+	if versionNum >= 100000 {
+		identityColumn = "a.attidentity"
+		sequenceType = "' AS ' || s.data_type ||"
+		partitionKey = "CASE c.relkind WHEN 'p' THEN ' PARTITION BY ' || pg_get_partkeydef(c.oid) ELSE '' END"
+		partitionBound = "pg_get_expr(c.relpartbound, c.oid)"
+	}
+	if versionNum >= 120000 {
+		generatedColumn = "a.attgenerated = 's'"
+	}
+
+	replacer := strings.NewReplacer(
+		"{{userNamespace}}", userNamespaceCondition,
+		"{{notExtensionMember pg_type t.oid}}", fmt.Sprintf(notExtensionMember, "pg_type", "t.oid"),
+		"{{notExtensionMember pg_proc p.oid}}", fmt.Sprintf(notExtensionMember, "pg_proc", "p.oid"),
+		"{{notExtensionMember pg_class c.oid}}", fmt.Sprintf(notExtensionMember, "pg_class", "c.oid"),
+		"{{notExtensionMember pg_class i.indrelid}}", fmt.Sprintf(notExtensionMember, "pg_class", "i.indrelid"),
+		"{{generatedColumn}}", generatedColumn,
+		"{{identityColumn}}", identityColumn,
+		"{{sequenceType}}", sequenceType,
+		"{{partitionKey}}", partitionKey,
+		"{{partitionBound}}", partitionBound,
+	)
+	return replacer.Replace(dumpSchemaQuery)
+}
@@ -0,0 +1,81 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+)
+
+// DumpMigrationRunner builds databases from the plain-format output of pg_dump,
+// e.g. a schema.sql kept instead of migrations.
+//
+// The dump runs in a single transaction. COPY ... FROM stdin data blocks are
+// streamed with the copy protocol of lib/pq. Of the psql meta-commands,
+// \restrict and \unrestrict are ignored, and \connect makes the preceding
+// statements, e.g. CREATE DATABASE of pg_dump --create, be skipped, since
+// the rest of the dump targets the database being built.
+// Other meta-commands are rejected.
+//
+// It implements Fingerprinter with the contents of the dump.
+type DumpMigrationRunner struct {
+	path string
+}
+
+// NewDumpMigrationRunner creates a new runner of the pg_dump output file.
+func NewDumpMigrationRunner(path string) *DumpMigrationRunner {
+	return &DumpMigrationRunner{path: path}
+}
+
+// RunMigrations executes the dump on the connection,
+// which must be a *DatabaseConnection.
+func (r *DumpMigrationRunner) RunMigrations(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+	if _, ok := conn.(*DatabaseConnection); !ok {
+		return fmt.Errorf("pg_dump output requires a *DatabaseConnection, got %T", conn)
+	}
+	content, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	script := splitSQLScript(content)
+	statements := make([]sqlStatement, 0, len(script.statements))
+	for _, statement := range script.statements {
+		if !statement.metaCommand {
+			statements = append(statements, statement)
+			continue
+		}
+		switch command, _, _ := strings.Cut(strings.TrimPrefix(statement.text, `\`), " "); command {
+		case "connect", "c":
+			statements = statements[:0]
+		case "restrict", "unrestrict":
+		default:
+			statements = append(statements, statement) // Rejected when executed.
+		}
+	}
+	script.statements = statements
+	return runMigrationScript(ctx, conn, &migrationSource{file: r.path, content: content}, script)
+}
+
+// Fingerprint implements Fingerprinter.
+func (r *DumpMigrationRunner) Fingerprint() (string, error) {
+	content, err := r.read()
+	if err != nil {
+		return "", err
+	}
+	fp := newFingerprint()
+	fp.add("dump", filepath.Base(r.path), content)
+	return fp.sum(), nil
+}
+
+// read returns the contents of the dump.
+func (r *DumpMigrationRunner) read() (string, error) {
+	content, err := os.ReadFile(r.path) // #nosec G304 -- Dump files are controlled by the application.
+	if err != nil {
+		return "", fmt.Errorf("failed to read dump file %q: %w", r.path, err)
+	}
+	return string(content), nil
+}
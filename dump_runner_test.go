@@ -0,0 +1,166 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// testDump is plain-format pg_dump output of pg_dump --create.
+const testDump = `--
+-- PostgreSQL database dump
+--
+
+\restrict 8kVfQ2bKxR
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+
+CREATE DATABASE app WITH TEMPLATE = template0 ENCODING = 'UTF8';
+
+\connect app
+
+\restrict 8kVfQ2bKxR
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+SELECT pg_catalog.set_config('search_path', '', false);
+
+CREATE TABLE public.notes (
+    id integer NOT NULL,
+    body text,
+    data bytea
+);
+
+CREATE SEQUENCE public.notes_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+ALTER SEQUENCE public.notes_id_seq OWNED BY public.notes.id;
+ALTER TABLE ONLY public.notes ALTER COLUMN id SET DEFAULT nextval('public.notes_id_seq'::regclass);
+
+--
+-- Data for Name: notes; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+COPY public.notes (id, body, data) FROM stdin;
+1	plain	\N
+2	tab\there\nnewline; semicolon	\\x0102
+3	backslash \\ and \303\274 and \x41	\N
+\.
+
+
+SELECT pg_catalog.setval('public.notes_id_seq', 3, true);
+
+ALTER TABLE ONLY public.notes
+    ADD CONSTRAINT notes_pkey PRIMARY KEY (id);
+
+--
+-- PostgreSQL database dump complete
+--
+
+\unrestrict 8kVfQ2bKxR
+
+`
+
+// TestDumpMigrationRunner tests building databases from pg_dump output.
+func TestDumpMigrationRunner(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// writeDump writes the dump to a new file.
+	writeDump := func(c *qt.C, content string) string {
+		path := filepath.Join(c.TempDir(), "schema.sql")
+		c.Assert(os.WriteFile(path, []byte(content), 0o600), qt.IsNil)
+		return path
+	}
+
+	// runDump runs the dump on a new database.
+	runDump := func(c *qt.C, path string) (pgdbtemplate.DatabaseConnection, error) {
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "dump_runner"))
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() { conn.Close() })
+		return conn, pgdbtemplatepq.NewDumpMigrationRunner(path).RunMigrations(ctx, conn)
+	}
+
+	c.Run("Fingerprint covers contents", func(c *qt.C) {
+		path := writeDump(c, testDump)
+		fingerprint, err := pgdbtemplatepq.NewDumpMigrationRunner(path).Fingerprint()
+		c.Assert(err, qt.IsNil)
+
+		c.Assert(os.WriteFile(path, []byte(testDump+"SELECT 1;\n"), 0o600), qt.IsNil)
+		changed, err := pgdbtemplatepq.NewDumpMigrationRunner(path).Fingerprint()
+		c.Assert(err, qt.IsNil)
+		c.Assert(changed, qt.Not(qt.Equals), fingerprint)
+	})
+
+	c.Run("Missing file", func(c *qt.C) {
+		_, err := pgdbtemplatepq.NewDumpMigrationRunner("/nonexistent.sql").Fingerprint()
+		c.Assert(err, qt.ErrorMatches, `failed to read dump file "/nonexistent.sql": .*`)
+	})
+
+	c.Run("Other connections are rejected", func(c *qt.C) {
+		err := pgdbtemplatepq.NewDumpMigrationRunner(writeDump(c, testDump)).RunMigrations(ctx, &recordingConnection{})
+		c.Assert(err, qt.ErrorMatches, `pg_dump output requires a \*DatabaseConnection, got \*pgdbtemplatepq_test.recordingConnection`)
+	})
+
+	c.Run("Dump is restored", func(c *qt.C) {
+		c.Parallel()
+		conn, err := runDump(c, writeDump(c, testDump))
+		c.Assert(err, qt.IsNil)
+
+		var notes string
+		err = conn.QueryRowContext(ctx, `
+			SELECT string_agg(format('%s|%s|%s', id, body, encode(data, 'hex')), ';' ORDER BY id) FROM public.notes
+		`).Scan(&notes)
+		c.Assert(err, qt.IsNil)
+		c.Assert(notes, qt.Equals, "1|plain|;2|tab\there\nnewline; semicolon|0102;3|backslash \\ and ü and A|")
+
+		var nextID int
+		err = conn.QueryRowContext(ctx, "SELECT nextval('public.notes_id_seq')").Scan(&nextID)
+		c.Assert(err, qt.IsNil)
+		c.Assert(nextID, qt.Equals, 4)
+	})
+
+	c.Run("Invalid data is located", func(c *qt.C) {
+		c.Parallel()
+		path := writeDump(c, "CREATE TABLE public.numbers (n integer);\n\n"+
+			"COPY public.numbers (n) FROM stdin;\n"+
+			"1\n"+
+			"two\n"+
+			"\\.\n")
+		_, err := runDump(c, path)
+		c.Assert(err, qt.ErrorMatches, `.*schema\.sql:5: ERROR: invalid input syntax for (type )?integer: "two" \(SQLSTATE 22P02\)\n`+
+			`CONTEXT: COPY numbers, line 2, column n: "two"`)
+	})
+
+	c.Run("Unsupported meta-command", func(c *qt.C) {
+		c.Parallel()
+		conn, err := runDump(c, writeDump(c, "CREATE TABLE public.numbers (n integer);\n\\! rm -rf /\n"))
+		c.Assert(err, qt.ErrorMatches, `.*schema\.sql:2: unsupported psql meta-command \\! rm -rf /`)
+
+		// The dump is restored in a single transaction.
+		var exists bool
+		err = conn.QueryRowContext(ctx, "SELECT to_regclass('public.numbers') IS NOT NULL").Scan(&exists)
+		c.Assert(err, qt.IsNil)
+		c.Assert(exists, qt.IsFalse)
+	})
+}
@@ -0,0 +1,149 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestDumpSchema tests rendering schemas as canonical SQL.
+func TestDumpSchema(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	const schemaSQL = `
+		CREATE SCHEMA billing;
+		CREATE TYPE billing.status AS ENUM ('open', 'paid');
+		CREATE DOMAIN billing.amount AS NUMERIC(12, 2) CHECK (VALUE >= 0);
+		CREATE TABLE billing.customers (id SERIAL PRIMARY KEY, email TEXT NOT NULL UNIQUE);
+		CREATE TABLE billing.invoices (
+			id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			customer_id INTEGER NOT NULL REFERENCES billing.customers (id),
+			status billing.status NOT NULL DEFAULT 'open',
+			total billing.amount,
+			total_cents BIGINT GENERATED ALWAYS AS ((total * 100)::BIGINT) STORED
+		);
+		CREATE INDEX invoices_status_idx ON billing.invoices (status);
+		CREATE VIEW billing.open_invoices AS SELECT id FROM billing.invoices WHERE status = 'open';
+		CREATE FUNCTION billing.touch() RETURNS trigger LANGUAGE plpgsql AS $$ BEGIN RETURN NEW; END $$;
+		CREATE TRIGGER invoices_touch BEFORE UPDATE ON billing.invoices
+			FOR EACH ROW EXECUTE PROCEDURE billing.touch();
+		GRANT SELECT ON billing.invoices TO PUBLIC;
+		CREATE VIEW billing.customer_totals AS SELECT id FROM billing.open_invoices;
+		CREATE FUNCTION billing.all_customers() RETURNS SETOF billing.customers LANGUAGE sql AS 'SELECT * FROM billing.customers';
+		CREATE TABLE billing.events (id INT, at DATE NOT NULL) PARTITION BY RANGE (at);
+		CREATE TABLE billing.events_2024 PARTITION OF billing.events FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+	`
+
+	// connectScratch connects to a new empty database.
+	connectScratch := func(c *qt.C, prefix string) pgdbtemplate.DatabaseConnection {
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, prefix))
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	c.Run("Dump is deterministic and replayable", func(c *qt.C) {
+		c.Parallel()
+		conn := connectScratch(c, "dump_source")
+		_, err := conn.ExecContext(ctx, schemaSQL)
+		c.Assert(err, qt.IsNil)
+
+		dump, err := pgdbtemplatepq.DumpSchema(ctx, conn)
+		c.Assert(err, qt.IsNil)
+		for _, statement := range []string{
+			"CREATE SCHEMA billing;",
+			"CREATE TYPE billing.status AS ENUM ('open', 'paid');",
+			"CREATE DOMAIN billing.amount AS numeric(12,2);",
+			"    id bigint GENERATED ALWAYS AS IDENTITY NOT NULL,",
+			"    status billing.status DEFAULT 'open'::billing.status NOT NULL,",
+			"ALTER TABLE billing.invoices ADD CONSTRAINT invoices_customer_id_fkey " +
+				"FOREIGN KEY (customer_id) REFERENCES billing.customers(id);",
+			"CREATE INDEX invoices_status_idx ON billing.invoices USING btree (status);",
+			"GRANT SELECT ON TABLE billing.invoices TO PUBLIC;",
+			"ALTER TABLE billing.events ATTACH PARTITION billing.events_2024 FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');",
+		} {
+			c.Assert(strings.Contains(dump, statement), qt.IsTrue, qt.Commentf("missing %q in:\n%s", statement, dump))
+		}
+
+		// Objects follow the objects they depend on.
+		c.Assert(strings.Index(dump, "CREATE VIEW billing.open_invoices") < strings.Index(dump, "CREATE VIEW billing.customer_totals"), qt.IsTrue)
+		c.Assert(strings.Index(dump, "CREATE TABLE billing.customers") < strings.Index(dump, "FUNCTION billing.all_customers"), qt.IsTrue)
+
+		again, err := pgdbtemplatepq.DumpSchema(ctx, conn)
+		c.Assert(err, qt.IsNil)
+		c.Assert(again, qt.Equals, dump)
+
+		// Replaying the dump produces the same schema.
+		replica := connectScratch(c, "dump_replica")
+		_, err = replica.ExecContext(ctx, dump)
+		c.Assert(err, qt.IsNil)
+		replicaDump, err := pgdbtemplatepq.DumpSchema(ctx, replica)
+		c.Assert(err, qt.IsNil)
+		c.Assert(replicaDump, qt.Equals, dump)
+	})
+
+	c.Run("Empty database", func(c *qt.C) {
+		c.Parallel()
+		dump, err := pgdbtemplatepq.DumpSchema(ctx, connectScratch(c, "dump_empty"))
+		c.Assert(err, qt.IsNil)
+		c.Assert(dump, qt.Equals, "-- Schema dump generated by pgdbtemplate-pq from the system catalogs.\n")
+	})
+
+	c.Run("Names are ordered bytewise whatever the collation", func(c *qt.C) {
+		c.Parallel()
+		const namesSQL = `
+			CREATE TABLE apple (id INT);
+			CREATE TABLE "Zebra" (id INT);
+			CREATE TABLE _underscore (id INT);
+			CREATE TABLE "apple_Pie" (id INT);
+			CREATE TABLE applepie (id INT);
+		`
+		conn := connectScratch(c, "dump_collation")
+		_, err := conn.ExecContext(ctx, namesSQL)
+		c.Assert(err, qt.IsNil)
+		dump, err := pgdbtemplatepq.DumpSchema(ctx, conn)
+		c.Assert(err, qt.IsNil)
+
+		var positions []int
+		for _, name := range []string{`public."Zebra"`, "public._underscore", "public.apple ", `public."apple_Pie"`, "public.applepie"} {
+			position := strings.Index(dump, "CREATE TABLE "+name)
+			c.Assert(position, qt.Not(qt.Equals), -1, qt.Commentf("missing table %s in:\n%s", name, dump))
+			positions = append(positions, position)
+		}
+		for i := 1; i < len(positions); i++ {
+			c.Assert(positions[i-1] < positions[i], qt.IsTrue, qt.Commentf("tables out of order in:\n%s", dump))
+		}
+
+		// A database collating with "C" dumps the same.
+		adminDB, err := sql.Open("postgres", testConnectionString)
+		c.Assert(err, qt.IsNil)
+		defer adminDB.Close()
+		dbName := fmt.Sprintf("dump_collation_c_%d", time.Now().UnixNano())
+		_, err = adminDB.ExecContext(ctx, "CREATE DATABASE "+dbName+" TEMPLATE template0 LC_COLLATE 'C' LC_CTYPE 'C'")
+		c.Assert(err, qt.IsNil)
+		defer adminDB.ExecContext(ctx, "DROP DATABASE IF EXISTS "+dbName)
+		cConn, err := provider.Connect(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		defer cConn.Close()
+		_, err = cConn.ExecContext(ctx, namesSQL)
+		c.Assert(err, qt.IsNil)
+		cDump, err := pgdbtemplatepq.DumpSchema(ctx, cConn)
+		c.Assert(err, qt.IsNil)
+		c.Assert(cDump, qt.Equals, dump)
+	})
+}
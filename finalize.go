@@ -0,0 +1,128 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// prewarmQuery loads the user tables, indexes and materialized views
+// of the database into shared buffers.
+var prewarmQuery = `
+	SELECT coalesce(sum(pg_prewarm(c.oid::regclass)), 0)
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('r', 'i', 'm') AND c.relpersistence <> 't' AND ` + userNamespaceCondition
+
+// TemplateFinalization configures the steps run on templates
+// after their migrations, when they are marked as templates.
+type TemplateFinalization struct {
+	// Vacuum runs VACUUM (FREEZE, ANALYZE) on the template, so that clones
+	// start with planner statistics and frozen tuples, and query plans
+	// in tests do not differ from run to run.
+	Vacuum bool
+	// Prewarm loads the relations of the template into shared buffers
+	// with pg_prewarm, which must be available on the server. Unless
+	// installed in the template, the extension is created for the duration
+	// of the step and dropped afterwards.
+	Prewarm bool
+	// DisallowConnections marks the template with ALLOW_CONNECTIONS false,
+	// so that nobody connects to it accidentally. Clones still allow
+	// connections. Connections are allowed again whenever the template
+	// is unmarked or dropped by this package, e.g. before it is rebuilt,
+	// by Reap or by the pgdbtemplate-pq CLI, whatever the finalization
+	// of the provider doing so.
+	//
+	// Nothing can connect to a finalized template, so Connect, RoundTrip,
+	// TemplateConfig.Source and Snapshot cannot use it as their database,
+	// and DumpSchema, CompareSchema and the pqtest schema assertions
+	// cannot inspect it; use a clone instead. DatabaseMetadata is read
+	// through the administrative database and keeps working.
+	DisallowConnections bool
+}
+
+// WithTemplateFinalization sets the steps run on templates when they are marked
+// as templates, by TemplateManager, EnsureTemplate or Snapshot.
+func WithTemplateFinalization(finalization TemplateFinalization) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.finalization = finalization
+	}
+}
+
+// markTemplate finalizes the database and marks it as a template,
+// disallowing connections to it if configured.
+func (p *ConnectionProvider) markTemplate(ctx context.Context, adminConn *DatabaseConnection, templateName string) error {
+	if err := p.finalizeTemplate(ctx, templateName); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("ALTER DATABASE %s WITH is_template TRUE", pq.QuoteIdentifier(templateName))
+	if p.finalization.DisallowConnections {
+		query += " ALLOW_CONNECTIONS false"
+	}
+	if _, err := adminConn.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to mark database %q as template: %w", templateName, err)
+	}
+	return nil
+}
+
+// unmarkTemplate unmarks the template and allows connections to it again,
+// whether or not they were disallowed by this provider's finalization.
+func unmarkTemplate(ctx context.Context, adminConn *DatabaseConnection, templateName string) error {
+	query := fmt.Sprintf("ALTER DATABASE %s WITH is_template FALSE ALLOW_CONNECTIONS true", pq.QuoteIdentifier(templateName))
+	if _, err := adminConn.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to unmark template database %q: %w", templateName, err)
+	}
+	return nil
+}
+
+// finalizeTemplate runs the vacuum and prewarm steps of the finalization
+// on the template.
+func (p *ConnectionProvider) finalizeTemplate(ctx context.Context, templateName string) error {
+	if !p.finalization.Vacuum && !p.finalization.Prewarm {
+		return nil
+	}
+
+	conn, err := p.connect(ctx, templateName)
+	if err != nil {
+		return fmt.Errorf("failed to connect to template database: %w", err)
+	}
+	defer conn.Close()
+
+	if p.finalization.Vacuum {
+		if _, err := conn.DB.ExecContext(ctx, "VACUUM (FREEZE, ANALYZE)"); err != nil {
+			return fmt.Errorf("failed to vacuum template %q: %w", templateName, err)
+		}
+	}
+	if p.finalization.Prewarm {
+		if err := prewarm(ctx, conn); err != nil {
+			return fmt.Errorf("failed to prewarm template %q: %w", templateName, err)
+		}
+	}
+	return nil
+}
+
+// prewarm loads the relations of the database into shared buffers,
+// creating the pg_prewarm extension temporarily if needed.
+func prewarm(ctx context.Context, conn *DatabaseConnection) (err error) {
+	var installed bool
+	err = conn.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_extension WHERE extname = 'pg_prewarm')").Scan(&installed)
+	if err != nil {
+		return fmt.Errorf("failed to check pg_prewarm extension: %w", err)
+	}
+	if !installed {
+		if _, err := conn.DB.ExecContext(ctx, "CREATE EXTENSION pg_prewarm"); err != nil {
+			return fmt.Errorf("failed to create pg_prewarm extension: %w", err)
+		}
+		defer func() {
+			if _, dropErr := conn.DB.ExecContext(ctx, "DROP EXTENSION pg_prewarm"); dropErr != nil && err == nil {
+				err = fmt.Errorf("failed to drop pg_prewarm extension: %w", dropErr)
+			}
+		}()
+	}
+
+	var blocks int64
+	if err := conn.DB.QueryRowContext(ctx, prewarmQuery).Scan(&blocks); err != nil {
+		return fmt.Errorf("failed to load relations: %w", err)
+	}
+	return nil
+}
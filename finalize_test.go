@@ -0,0 +1,157 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestTemplateFinalization tests finalizing templates when they are marked.
+func TestTemplateFinalization(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	newProvider := func() *pgdbtemplatepq.ConnectionProvider {
+		return pgdbtemplatepq.NewConnectionProviderWithOptions(connStringFunc, pgdbtemplatepq.WithTemplateFinalization(pgdbtemplatepq.TemplateFinalization{
+			Vacuum:              true,
+			Prewarm:             true,
+			DisallowConnections: true,
+		}))
+	}
+
+	// databaseFlags returns whether the database is a template and allows connections.
+	databaseFlags := func(c *qt.C, name string) (isTemplate, allowConn bool) {
+		adminDB, err := sql.Open("postgres", testConnectionString)
+		c.Assert(err, qt.IsNil)
+		defer adminDB.Close()
+		err = adminDB.QueryRowContext(ctx,
+			"SELECT datistemplate, datallowconn FROM pg_database WHERE datname = $1", name,
+		).Scan(&isTemplate, &allowConn)
+		c.Assert(err, qt.IsNil)
+		return isTemplate, allowConn
+	}
+
+	seeded := pgdbtemplatepq.NewSeedingMigrationRunner(nil, pgdbtemplatepq.Seeder{
+		Name: "finalized",
+		Seed: func(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+			_, err := conn.ExecContext(ctx, "CREATE TABLE finalized AS SELECT generate_series(1, 1000) AS id")
+			return err
+		},
+	})
+
+	c.Run("Template manager templates are finalized", func(c *qt.C) {
+		c.Parallel()
+		provider := newProvider()
+		templateName := fmt.Sprintf("finalized_%d", time.Now().UnixNano())
+		manager, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{
+			MigrationRunner: seeded,
+			TemplateName:    templateName,
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(manager.Initialize(ctx), qt.IsNil)
+		defer manager.Cleanup(ctx)
+
+		conn, _, err := manager.CreateTestDatabase(ctx)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		isTemplate, allowConn := databaseFlags(c, templateName)
+		c.Assert(isTemplate, qt.IsTrue)
+		c.Assert(allowConn, qt.IsFalse)
+		_, err = provider.Connect(ctx, templateName)
+		c.Assert(err, qt.ErrorMatches, ".*is not currently accepting connections")
+
+		// Clones inherit the statistics, but not the prewarm extension.
+		var tuples float64
+		c.Assert(conn.QueryRowContext(ctx, "SELECT reltuples FROM pg_class WHERE relname = 'finalized'").Scan(&tuples), qt.IsNil)
+		c.Assert(tuples, qt.Equals, float64(1000))
+		var extensions int
+		c.Assert(conn.QueryRowContext(ctx, "SELECT count(*) FROM pg_extension WHERE extname = 'pg_prewarm'").Scan(&extensions), qt.IsNil)
+		c.Assert(extensions, qt.Equals, 0)
+
+		c.Assert(manager.Cleanup(ctx), qt.IsNil)
+	})
+
+	c.Run("Unmarking allows connections again", func(c *qt.C) {
+		c.Parallel()
+		provider := newProvider()
+		prefix := fmt.Sprintf("finalized_%d_", time.Now().UnixNano())
+		c.Cleanup(func() {
+			provider.Reap(ctx, pgdbtemplatepq.ReapOptions{Prefixes: []string{prefix}, IncludeUnstamped: true})
+		})
+		template, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: seeded,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("finalized"),
+		})
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, template.Name)
+		_, allowConn := databaseFlags(c, template.Name)
+		c.Assert(allowConn, qt.IsFalse)
+
+		adminConn, err := provider.Connect(ctx, "postgres")
+		c.Assert(err, qt.IsNil)
+		defer adminConn.Close()
+		_, err = adminConn.ExecContext(ctx, fmt.Sprintf(`ALTER DATABASE "%s" WITH is_template FALSE ALLOW_CONNECTIONS true`, template.Name))
+		c.Assert(err, qt.IsNil)
+		isTemplate, allowConn := databaseFlags(c, template.Name)
+		c.Assert(isTemplate, qt.IsFalse)
+		c.Assert(allowConn, qt.IsTrue)
+
+		// The unmarked template is rebuilt.
+		rebuilt, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: seeded,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("finalized"),
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(rebuilt.Reused, qt.IsFalse)
+		isTemplate, allowConn = databaseFlags(c, template.Name)
+		c.Assert(isTemplate, qt.IsTrue)
+		c.Assert(allowConn, qt.IsFalse)
+	})
+
+	c.Run("Providers without finalization drop finalized templates", func(c *qt.C) {
+		c.Parallel()
+		prefix := fmt.Sprintf("finalized_other_%d_", time.Now().UnixNano())
+		finalizing := newProvider()
+		plain := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		c.Cleanup(func() {
+			plain.Reap(ctx, pgdbtemplatepq.ReapOptions{Prefixes: []string{prefix}, IncludeUnstamped: true})
+		})
+		finalized, err := finalizing.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: seeded,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("finalized", "v1"),
+		})
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, finalized.Name)
+
+		// The stale finalized template is dropped by a provider
+		// which does not disallow connections itself.
+		current, err := plain.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: seeded,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("finalized", "v2"),
+			DropStale:       true,
+		})
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, current.Name)
+		_, err = plain.DatabaseMetadata(ctx, finalized.Name)
+		c.Assert(err, qt.ErrorMatches, ".*does not exist")
+		isTemplate, allowConn := databaseFlags(c, current.Name)
+		c.Assert(isTemplate, qt.IsTrue)
+		c.Assert(allowConn, qt.IsTrue)
+	})
+}
@@ -0,0 +1,93 @@
+package pgdbtemplatepq
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+)
+
+// fingerprintNameLength is the number of fingerprint characters
+// used in template database names.
+const fingerprintNameLength = 16
+
+// Fingerprinter is implemented by migration runners which can describe
+// everything influencing the template database they produce.
+type Fingerprinter interface {
+	// Fingerprint returns a stable digest of the migration inputs.
+	Fingerprint() (string, error)
+}
+
+// FileMigrationFingerprint returns the fingerprint of the migrations
+// pgdbtemplate.NewFileMigrationRunner(paths, orderingFunc) executes.
+//
+// The fingerprint covers the file names, their order and contents,
+// and the extra inputs, e.g. options influencing the template.
+// Upon the nil orderingFunc, an alphabetical sorting will be used.
+func FileMigrationFingerprint(paths []string, orderingFunc func([]string) []string, extra ...string) (string, error) {
+	if orderingFunc == nil {
+		orderingFunc = pgdbtemplate.AlphabeticalMigrationFilesSorting
+	}
+
+	fp := newFingerprint()
+	for _, path := range paths {
+		files, err := collectMigrationFiles(path, orderingFunc)
+		if err != nil {
+			return "", err
+		}
+
+		fp.add("directory")
+		for _, file := range files {
+			content, err := os.ReadFile(file) // #nosec G304 -- Migration files are controlled by the application.
+			if err != nil {
+				return "", fmt.Errorf("failed to read migration file %q: %w", file, err)
+			}
+			// Only the base name is used, so that the fingerprint
+			// does not depend on the working directory.
+			fp.add("file", filepath.Base(file), string(content))
+		}
+	}
+	fp.add("extra")
+	fp.add(extra...)
+	return fp.sum(), nil
+}
+
+// CombineFingerprints returns a fingerprint covering all the given ones.
+func CombineFingerprints(fingerprints ...string) string {
+	fp := newFingerprint()
+	fp.add(fingerprints...)
+	return fp.sum()
+}
+
+// fingerprint accumulates fingerprint inputs.
+type fingerprint struct {
+	h hash.Hash
+}
+
+// newFingerprint returns an empty fingerprint.
+func newFingerprint() *fingerprint {
+	return &fingerprint{h: sha256.New()}
+}
+
+// add adds the values to the fingerprint.
+//
+// Values are length-prefixed, so that different splits
+// of the same bytes produce different fingerprints.
+func (f *fingerprint) add(values ...string) {
+	var length [8]byte
+	for _, value := range values {
+		binary.BigEndian.PutUint64(length[:], uint64(len(value)))
+		f.h.Write(length[:])
+		f.h.Write([]byte(value))
+	}
+}
+
+// sum returns the hex-encoded fingerprint.
+func (f *fingerprint) sum() string {
+	return hex.EncodeToString(f.h.Sum(nil))
+}
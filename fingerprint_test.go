@@ -0,0 +1,100 @@
+package pgdbtemplatepq_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestFileMigrationFingerprint tests fingerprinting migration files.
+func TestFileMigrationFingerprint(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+
+	// writeMigrations writes the migration files into a new directory.
+	writeMigrations := func(c *qt.C, files map[string]string) string {
+		dir := c.TempDir()
+		for name, content := range files {
+			c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600), qt.IsNil)
+		}
+		return dir
+	}
+
+	migrations := map[string]string{
+		"001_users.sql": "CREATE TABLE users (id SERIAL PRIMARY KEY);",
+		"002_posts.sql": "CREATE TABLE posts (id SERIAL PRIMARY KEY);",
+	}
+
+	c.Run("Same inputs produce the same fingerprint", func(c *qt.C) {
+		first, err := pgdbtemplatepq.FileMigrationFingerprint([]string{writeMigrations(c, migrations)}, nil)
+		c.Assert(err, qt.IsNil)
+		second, err := pgdbtemplatepq.FileMigrationFingerprint([]string{writeMigrations(c, migrations)}, nil)
+		c.Assert(err, qt.IsNil)
+		c.Assert(first, qt.Equals, second)
+		c.Assert(first, qt.HasLen, 64)
+	})
+
+	c.Run("Changed inputs change the fingerprint", func(c *qt.C) {
+		original, err := pgdbtemplatepq.FileMigrationFingerprint([]string{writeMigrations(c, migrations)}, nil)
+		c.Assert(err, qt.IsNil)
+
+		changedContent := writeMigrations(c, map[string]string{
+			"001_users.sql": "CREATE TABLE users (id BIGSERIAL PRIMARY KEY);",
+			"002_posts.sql": migrations["002_posts.sql"],
+		})
+		renamed := writeMigrations(c, map[string]string{
+			"001_users.sql": migrations["001_users.sql"],
+			"003_posts.sql": migrations["002_posts.sql"],
+		})
+		withIgnored := writeMigrations(c, map[string]string{
+			"001_users.sql": migrations["001_users.sql"],
+			"002_posts.sql": migrations["002_posts.sql"],
+			"README.md":     "ignored",
+		})
+
+		for _, dir := range []string{changedContent, renamed} {
+			changed, err := pgdbtemplatepq.FileMigrationFingerprint([]string{dir}, nil)
+			c.Assert(err, qt.IsNil)
+			c.Assert(changed, qt.Not(qt.Equals), original)
+		}
+
+		ignored, err := pgdbtemplatepq.FileMigrationFingerprint([]string{withIgnored}, nil)
+		c.Assert(err, qt.IsNil)
+		c.Assert(ignored, qt.Equals, original)
+
+		withExtra, err := pgdbtemplatepq.FileMigrationFingerprint([]string{writeMigrations(c, migrations)}, nil, "locale=C")
+		c.Assert(err, qt.IsNil)
+		c.Assert(withExtra, qt.Not(qt.Equals), original)
+	})
+
+	c.Run("Ordering changes the fingerprint", func(c *qt.C) {
+		dir := writeMigrations(c, migrations)
+		alphabetical, err := pgdbtemplatepq.FileMigrationFingerprint([]string{dir}, nil)
+		c.Assert(err, qt.IsNil)
+
+		reversed, err := pgdbtemplatepq.FileMigrationFingerprint([]string{dir}, func(files []string) []string {
+			reversed := make([]string, 0, len(files))
+			for i := len(files) - 1; i >= 0; i-- {
+				reversed = append(reversed, files[i])
+			}
+			return reversed
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(reversed, qt.Not(qt.Equals), alphabetical)
+	})
+
+	c.Run("Missing directory", func(c *qt.C) {
+		_, err := pgdbtemplatepq.FileMigrationFingerprint([]string{filepath.Join(c.TempDir(), "missing")}, nil)
+		c.Assert(err, qt.ErrorMatches, `failed to read directory .*`)
+	})
+
+	c.Run("Combined fingerprints", func(c *qt.C) {
+		c.Assert(pgdbtemplatepq.CombineFingerprints("a", "b"), qt.Equals, pgdbtemplatepq.CombineFingerprints("a", "b"))
+		c.Assert(pgdbtemplatepq.CombineFingerprints("a", "b"), qt.Not(qt.Equals), pgdbtemplatepq.CombineFingerprints("b", "a"))
+		c.Assert(pgdbtemplatepq.CombineFingerprints("ab"), qt.Not(qt.Equals), pgdbtemplatepq.CombineFingerprints("a", "b"))
+	})
+}
@@ -0,0 +1,836 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	"github.com/lib/pq"
+)
+
+// maxReferencedKeys limits the keys of a referenced table
+// that foreign key values are chosen from.
+const maxReferencedKeys = 100000
+
+// generatedNullFraction is the fraction of NULL values in nullable columns.
+const generatedNullFraction = 0.1
+
+// generatorTablesQuery returns the user tables of a database with their columns
+// and constraints as a JSON array of generatorTable objects.
+// The placeholders are replaced by version-dependent expressions.
+var generatorTablesQuery = `
+	SELECT coalesce(json_agg(json_build_object(
+		'schema', n.nspname,
+		'name', c.relname,
+		'columns', coalesce((
+			SELECT json_agg(json_build_object(
+				'name', a.attname,
+				'type', bt.typname,
+				'format', format_type(a.atttypid, a.atttypmod),
+				'category', bt.typcategory,
+				'typmod', CASE WHEN t.typtype = 'd' THEN t.typtypmod ELSE a.atttypmod END,
+				'not_null', a.attnotnull OR t.typnotnull,
+				'has_default', a.atthasdef OR {{identityColumn}} <> '',
+				'sequence', {{identityColumn}} <> '' OR coalesce(pg_get_expr(d.adbin, d.adrelid), '') LIKE 'nextval(%',
+				'generated', {{generatedColumn}} OR {{identityColumn}} = 'a',
+				'labels', (SELECT json_agg(e.enumlabel ORDER BY e.enumsortorder) FROM pg_enum e WHERE e.enumtypid = bt.oid),
+				'checks', (
+					SELECT json_agg(pg_get_constraintdef(con.oid) ORDER BY con.conname)
+					FROM pg_constraint con WHERE con.contypid = t.oid AND con.contype = 'c'
+				)
+			) ORDER BY a.attnum)
+			FROM pg_attribute a
+			JOIN pg_type t ON t.oid = a.atttypid
+			JOIN pg_type bt ON bt.oid = CASE WHEN t.typtype = 'd' THEN t.typbasetype ELSE t.oid END
+			LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+			WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+		), '[]'),
+		'uniques', coalesce((
+			SELECT json_agg((
+				SELECT json_agg(a.attname ORDER BY k.ord)
+				FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+			) ORDER BY con.conname)
+			FROM pg_constraint con WHERE con.conrelid = c.oid AND con.contype IN ('p', 'u')
+		), '[]'),
+		'checks', coalesce((
+			SELECT json_agg(pg_get_constraintdef(con.oid) ORDER BY con.conname)
+			FROM pg_constraint con WHERE con.conrelid = c.oid AND con.contype = 'c'
+		), '[]'),
+		'foreign_keys', coalesce((
+			SELECT json_agg(json_build_object(
+				'columns', (
+					SELECT json_agg(a.attname ORDER BY k.ord)
+					FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+					JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+				),
+				'ref_schema', rn.nspname,
+				'ref_table', rc.relname,
+				'ref_columns', (
+					SELECT json_agg(a.attname ORDER BY k.ord)
+					FROM unnest(con.confkey) WITH ORDINALITY k(attnum, ord)
+					JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum
+				)
+			) ORDER BY con.conname)
+			FROM pg_constraint con
+			JOIN pg_class rc ON rc.oid = con.confrelid
+			JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+			WHERE con.conrelid = c.oid AND con.contype = 'f'
+		), '[]')
+	) ORDER BY n.nspname, c.relname), '[]')::text
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE {{tableCondition}} AND ` + userNamespaceCondition + `
+		AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")
+
+// ColumnGenerator returns the value of a column in the row with the given index,
+// e.g. a string, an int64 or a time.Time, or nil for NULL.
+type ColumnGenerator func(rng *rand.Rand, row int) any
+
+// DataGeneratorConfig configures NewDataGenerator.
+type DataGeneratorConfig struct {
+	// Rows is the number of rows generated for each table not listed in TableRows.
+	Rows int
+	// TableRows sets the number of rows generated for tables,
+	// keyed by "schema.table" names. Tables mapped to 0 are not generated.
+	//
+	// Either Rows or TableRows is required.
+	TableRows map[string]int
+	// Seed seeds the random values, so that the same schema
+	// and configuration always generate the same data.
+	Seed int64
+	// Overrides generate the values of columns, keyed by "schema.table.column"
+	// names, e.g. for columns whose CHECK constraints are not understood.
+	// Overridden columns are generated even if they have defaults.
+	Overrides map[string]ColumnGenerator
+}
+
+// DataGenerator fills the tables of a database with plausible random data,
+// e.g. to build load-test templates and find slow queries
+// before production data does.
+//
+// Tables, column types and constraints are introspected from the catalogs,
+// and the tables are filled in foreign key order with pq.CopyIn,
+// in a single transaction:
+//   - NOT NULL columns are never NULL, and other columns are NULL now and then;
+//   - UNIQUE and PRIMARY KEY constraints are satisfied with sequential values,
+//     or with distinct combinations of the referenced keys for join tables;
+//   - CHECK constraints comparing a column with constants, lists of values
+//     and lengths are respected, while others, e.g. ones with OR or comparing
+//     columns, are reported before generating anything and need overrides;
+//   - foreign keys reference random existing rows of the referenced tables,
+//     and nullable foreign keys break reference cycles, e.g. self-references:
+//     they are filled by an UPDATE once the referenced rows exist;
+//   - columns with defaults, e.g. serial and identity columns, are filled
+//     by the database, and generated columns are skipped.
+//
+// Text values are chosen by column names, e.g. e-mail addresses for "email".
+type DataGenerator struct {
+	config DataGeneratorConfig
+}
+
+// NewDataGenerator creates a new generator.
+// Its Generate method is a SeedFunc, e.g. for a SeedingMigrationRunner.
+func NewDataGenerator(config DataGeneratorConfig) *DataGenerator {
+	return &DataGenerator{config: config}
+}
+
+// generatorTable is a table introspected by DataGenerator.
+type generatorTable struct {
+	Schema      string             `json:"schema"`
+	Name        string             `json:"name"`
+	Columns     []generatorColumn  `json:"columns"`
+	Uniques     [][]string         `json:"uniques"`
+	Checks      []string           `json:"checks"`
+	ForeignKeys []generatorForeign `json:"foreign_keys"`
+}
+
+// generatorColumn is a column of a generatorTable.
+type generatorColumn struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`     // Base type name, e.g. "int4".
+	Format     string   `json:"format"`   // Type as in SQL, e.g. "character varying(20)".
+	Category   string   `json:"category"` // Base type category, see pg_type.typcategory.
+	TypeMod    int      `json:"typmod"`
+	NotNull    bool     `json:"not_null"`
+	HasDefault bool     `json:"has_default"`
+	Sequence   bool     `json:"sequence"` // Filled from a sequence by default.
+	Generated  bool     `json:"generated"`
+	Labels     []string `json:"labels"` // Enum labels.
+	Checks     []string `json:"checks"` // Domain CHECK constraints.
+}
+
+// generatorForeign is a foreign key of a generatorTable.
+type generatorForeign struct {
+	Columns    []string `json:"columns"`
+	RefSchema  string   `json:"ref_schema"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+}
+
+// qualifiedName returns the "schema.table" name of the table.
+func (t *generatorTable) qualifiedName() string {
+	return t.Schema + "." + t.Name
+}
+
+// column returns the column with the name, or nil if there is none.
+func (t *generatorTable) column(name string) *generatorColumn {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
+		}
+	}
+	return nil
+}
+
+// Generate fills the tables of the database over the connection,
+// which must be a *DatabaseConnection.
+func (g *DataGenerator) Generate(ctx context.Context, conn pgdbtemplate.DatabaseConnection) (err error) {
+	pqConn, ok := conn.(*DatabaseConnection)
+	if !ok {
+		return fmt.Errorf("data generation requires a *DatabaseConnection, got %T", conn)
+	}
+	if g.config.Rows < 0 {
+		return fmt.Errorf("invalid number of rows %d", g.config.Rows)
+	}
+	if g.config.Rows == 0 && len(g.config.TableRows) == 0 {
+		return errors.New("Rows or TableRows is required")
+	}
+
+	tables, err := introspectGeneratorTables(ctx, pqConn)
+	if err != nil {
+		return err
+	}
+	if err := g.validate(tables); err != nil {
+		return err
+	}
+	ordered, err := g.order(tables)
+	if err != nil {
+		return err
+	}
+	// Unsupported constraints would only fail the copy midway.
+	var unsupported []string
+	for _, table := range ordered {
+		for _, check := range unsupportedChecks(table.table, g.config.Overrides) {
+			unsupported = append(unsupported, table.table.qualifiedName()+": "+check)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("CHECK constraints are not understood, use Overrides for their columns:\n%s", strings.Join(unsupported, "\n"))
+	}
+
+	tx, err := pqConn.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for data generation: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback() // #nosec G104 -- Rollback error in error path is not critical.
+		}
+	}()
+	// Unique values running out would fail the copy midway, too.
+	for _, table := range ordered {
+		if err := g.checkUniqueLimits(ctx, tx, table); err != nil {
+			return fmt.Errorf("cannot generate table %s: %w", table.table.qualifiedName(), err)
+		}
+	}
+	for _, table := range ordered {
+		if err := g.generateTable(ctx, tx, table.table, table.rows, table.nullForeignKeys); err != nil {
+			return fmt.Errorf("failed to generate table %s: %w", table.table.qualifiedName(), err)
+		}
+	}
+	// The referenced rows of the foreign keys breaking cycles exist now.
+	for _, table := range ordered {
+		for i := range table.nullForeignKeys {
+			if err := g.fillForeignKey(ctx, tx, table.table, i); err != nil {
+				return fmt.Errorf("failed to fill foreign key of table %s: %w", table.table.qualifiedName(), err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit generated data: %w", err)
+	}
+	return nil
+}
+
+// introspectGeneratorTables returns the user tables of the database.
+func introspectGeneratorTables(ctx context.Context, conn *DatabaseConnection) ([]*generatorTable, error) {
+	var versionNum int
+	if err := conn.DB.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum); err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+	generatedColumn, identityColumn, tableCondition := "false", "''", "c.relkind = 'r'"
+	if versionNum >= 100000 {
+		identityColumn = "a.attidentity"
+	}
+	if versionNum >= 110000 {
+		// Rows are routed to partitions through their partitioned tables.
+		tableCondition = "c.relkind IN ('r', 'p') AND NOT c.relispartition"
+	}
+	if versionNum >= 120000 {
+		generatedColumn = "a.attgenerated = 's'"
+	}
+	query := strings.NewReplacer(
+		"{{generatedColumn}}", generatedColumn,
+		"{{identityColumn}}", identityColumn,
+		"{{tableCondition}}", tableCondition,
+	).Replace(generatorTablesQuery)
+
+	var encoded string
+	if err := conn.DB.QueryRowContext(ctx, query).Scan(&encoded); err != nil {
+		return nil, fmt.Errorf("failed to introspect tables: %w", err)
+	}
+	var tables []*generatorTable
+	if err := json.Unmarshal([]byte(encoded), &tables); err != nil {
+		return nil, fmt.Errorf("failed to decode introspected tables: %w", err)
+	}
+	return tables, nil
+}
+
+// validate checks that the configuration refers to existing tables and columns.
+func (g *DataGenerator) validate(tables []*generatorTable) error {
+	columns := make(map[string]bool)
+	for _, table := range tables {
+		columns[table.qualifiedName()] = true
+		for _, column := range table.Columns {
+			columns[table.qualifiedName()+"."+column.Name] = true
+		}
+	}
+	for name, rows := range g.config.TableRows {
+		switch {
+		case !columns[name] || strings.Count(name, ".") != 1:
+			return fmt.Errorf("unknown table %q in TableRows", name)
+		case rows < 0:
+			return fmt.Errorf("invalid number of rows %d for table %q", rows, name)
+		}
+	}
+	for name, override := range g.config.Overrides {
+		switch {
+		case !columns[name] || strings.Count(name, ".") != 2:
+			return fmt.Errorf("unknown column %q in Overrides", name)
+		case override == nil:
+			return fmt.Errorf("override of column %q is nil", name)
+		}
+	}
+	return nil
+}
+
+// orderedTable is a table to generate, see DataGenerator.order.
+type orderedTable struct {
+	table *generatorTable
+	rows  int
+	// nullForeignKeys are the indexes of the foreign keys set to NULL
+	// while the table is copied to break reference cycles,
+	// and filled by fillForeignKey afterwards.
+	nullForeignKeys map[int]bool
+}
+
+// order returns the tables to generate, referenced tables first.
+// Nullable foreign keys are set to NULL when they form reference cycles,
+// e.g. self-references, until the referenced rows exist.
+func (g *DataGenerator) order(tables []*generatorTable) ([]orderedTable, error) {
+	pending := make(map[string]*orderedTable)
+	var names []string
+	for _, table := range tables {
+		rows := g.config.Rows
+		if tableRows, ok := g.config.TableRows[table.qualifiedName()]; ok {
+			rows = tableRows
+		}
+		if rows == 0 {
+			continue
+		}
+		pending[table.qualifiedName()] = &orderedTable{table: table, rows: rows, nullForeignKeys: make(map[int]bool)}
+		names = append(names, table.qualifiedName())
+	}
+	sort.Strings(names)
+
+	// blocked reports whether the table references a pending table,
+	// optionally ignoring nullable foreign keys.
+	blocked := func(table *orderedTable, ignoreNullable bool) bool {
+		for i, fk := range table.table.ForeignKeys {
+			if table.nullForeignKeys[i] || pending[fk.RefSchema+"."+fk.RefTable] == nil {
+				continue
+			}
+			if ignoreNullable && foreignKeyNullable(table.table, fk) {
+				continue
+			}
+			return true
+		}
+		return false
+	}
+
+	var ordered []orderedTable
+	for len(pending) > 0 {
+		progressed := false
+		for _, name := range names {
+			if table := pending[name]; table != nil && !blocked(table, false) {
+				ordered = append(ordered, *table)
+				delete(pending, name)
+				progressed = true
+			}
+		}
+		if progressed {
+			continue
+		}
+
+		// Every pending table is in a reference cycle: break the cycle
+		// at the first table whose blocking foreign keys are nullable.
+		var broken *orderedTable
+		for _, name := range names {
+			if table := pending[name]; table != nil && !blocked(table, true) {
+				broken = table
+				break
+			}
+		}
+		if broken == nil {
+			var cycle []string
+			for _, name := range names {
+				if pending[name] != nil {
+					cycle = append(cycle, name)
+				}
+			}
+			return nil, fmt.Errorf("tables %s reference each other through NOT NULL foreign keys; use overrides or generate them separately",
+				strings.Join(cycle, ", "))
+		}
+		for i, fk := range broken.table.ForeignKeys {
+			if pending[fk.RefSchema+"."+fk.RefTable] != nil {
+				broken.nullForeignKeys[i] = true
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// foreignKeyNullable reports whether all columns of the foreign key are nullable.
+func foreignKeyNullable(table *generatorTable, fk generatorForeign) bool {
+	for _, name := range fk.Columns {
+		for _, column := range table.Columns {
+			if column.Name == name && column.NotNull {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// foreignKeyPlan chooses the values of the columns of a foreign key.
+type foreignKeyPlan struct {
+	keys [][]any // Keys of the referenced table.
+	null bool    // Always NULL, breaking a reference cycle.
+	// nullable foreign keys are NULL now and then.
+	nullable bool
+	// radix enumerates distinct keys per row to satisfy a unique constraint,
+	// if positive: the key of row i is keys[i/radix%len(keys)].
+	radix int
+}
+
+// key returns the key for the row, or nil for NULL.
+func (p *foreignKeyPlan) key(rng *rand.Rand, row int) []any {
+	switch {
+	case p.null:
+		return nil
+	case p.radix > 0:
+		return p.keys[row/p.radix%len(p.keys)]
+	case p.nullable && rng.Float64() < generatedNullFraction:
+		return nil
+	}
+	return p.keys[rng.Intn(len(p.keys))]
+}
+
+// columnPlan generates the values of a column.
+type columnPlan struct {
+	column   generatorColumn
+	rule     *columnRule
+	unique   bool
+	override ColumnGenerator
+	// Foreign key the column is a part of, if any.
+	foreignKey      *foreignKeyPlan
+	foreignKeyIndex int
+}
+
+// planTable returns the plans of the columns and of the foreign keys of the
+// table, and the columns to copy. Unique columns are marked, while the keys
+// of the foreign keys are left to generateTable.
+func (g *DataGenerator) planTable(table *generatorTable, nullForeignKeys map[int]bool) (map[string]*columnPlan, []*foreignKeyPlan, []*columnPlan) {
+	rules := parseColumnRules(table)
+	plans := make(map[string]*columnPlan, len(table.Columns))
+	for _, column := range table.Columns {
+		plans[column.Name] = &columnPlan{column: column, rule: rules[column.Name], override: g.config.Overrides[table.qualifiedName()+"."+column.Name]}
+	}
+
+	foreignKeys := make([]*foreignKeyPlan, len(table.ForeignKeys))
+	for i, fk := range table.ForeignKeys {
+		plan := &foreignKeyPlan{null: nullForeignKeys[i], nullable: foreignKeyNullable(table, fk)}
+		foreignKeys[i] = plan
+		for j, column := range fk.Columns {
+			// The first foreign key of a column determines its values.
+			if plans[column].foreignKey == nil {
+				plans[column].foreignKey = plan
+				plans[column].foreignKeyIndex = j
+			}
+		}
+	}
+
+	// Unique constraints without a sequence or a unique column
+	// are satisfied by generateTable with distinct combinations of referenced keys.
+	for _, unique := range table.Uniques {
+		if uniqueBySequence(plans, unique) {
+			continue
+		}
+		if column := uniqueColumn(plans, unique); column != nil {
+			column.unique = true
+		}
+	}
+
+	var columns []*columnPlan
+	for _, column := range table.Columns {
+		plan := plans[column.Name]
+		switch {
+		case column.Generated:
+		case plan.override != nil, plan.foreignKey != nil, plan.unique, !column.HasDefault:
+			columns = append(columns, plan)
+		}
+	}
+	return plans, foreignKeys, columns
+}
+
+// checkUniqueLimits checks that the unique columns of the table have enough
+// distinct values left for its rows, before anything is copied.
+func (g *DataGenerator) checkUniqueLimits(ctx context.Context, tx *sql.Tx, table orderedTable) error {
+	_, _, columns := g.planTable(table.table, table.nullForeignKeys)
+	quotedName := pq.QuoteIdentifier(table.table.Schema) + "." + pq.QuoteIdentifier(table.table.Name)
+	offsets, err := uniqueOffsets(ctx, tx, quotedName, columns)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		// Overrides are responsible for their uniqueness.
+		if !column.unique || column.override != nil {
+			continue
+		}
+		limit, ok := uniqueLimit(column)
+		if !ok || offsets[column]+int64(table.rows) <= limit {
+			continue
+		}
+		left := limit - offsets[column]
+		if left < 0 {
+			left = 0
+		}
+		return fmt.Errorf("column %s allows only %d distinct values, not %d", column.column.Name, left, table.rows)
+	}
+	return nil
+}
+
+// generateTable copies the rows into the table.
+func (g *DataGenerator) generateTable(ctx context.Context, tx *sql.Tx, table *generatorTable, rows int, nullForeignKeys map[int]bool) (err error) {
+	name := table.qualifiedName()
+	quotedName := pq.QuoteIdentifier(table.Schema) + "." + pq.QuoteIdentifier(table.Name)
+	plans, foreignKeys, columns := g.planTable(table, nullForeignKeys)
+
+	for i, plan := range foreignKeys {
+		if plan.null {
+			continue
+		}
+		fk := table.ForeignKeys[i]
+		if plan.keys, err = loadReferencedKeys(ctx, tx, fk); err != nil {
+			return err
+		}
+		if len(plan.keys) == 0 {
+			if !plan.nullable {
+				return fmt.Errorf("referenced table %s.%s has no rows", fk.RefSchema, fk.RefTable)
+			}
+			plan.null = true
+		}
+	}
+
+	// The remaining unique constraints are satisfied by distinct
+	// combinations of referenced keys.
+	for _, unique := range table.Uniques {
+		if uniqueBySequence(plans, unique) || uniqueColumn(plans, unique) != nil {
+			continue
+		}
+		radix := 1
+		for _, fk := range foreignKeys {
+			if fk.radix > 0 || !foreignKeyCovers(plans, fk, unique) {
+				continue
+			}
+			if fk.null || len(fk.keys) == 0 {
+				return fmt.Errorf("unique constraint on %s cannot be satisfied without referenced rows", strings.Join(unique, ", "))
+			}
+			fk.radix = radix
+			// The product saturates at the number of rows,
+			// which is enough for distinct combinations.
+			if radix > rows/len(fk.keys) {
+				radix = rows
+			} else {
+				radix *= len(fk.keys)
+			}
+		}
+		if radix < rows {
+			return fmt.Errorf("unique constraint on %s allows only %d distinct rows, not %d", strings.Join(unique, ", "), radix, rows)
+		}
+	}
+
+	if len(columns) == 0 {
+		// Rows of defaults cannot be copied.
+		for i := 0; i < rows; i++ {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO "+quotedName+" DEFAULT VALUES"); err != nil { // #nosec G202 -- The name is quoted.
+				return err
+			}
+		}
+		return nil
+	}
+
+	offsets, err := uniqueOffsets(ctx, tx, quotedName, columns)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.column.Name
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(table.Schema, table.Name, names...))
+	if err != nil {
+		return fmt.Errorf("failed to start copy: %w", err)
+	}
+	defer stmt.Close()
+
+	// Tables are generated independently of each other and of the order.
+	hash := fnv.New64a()
+	hash.Write([]byte(name)) // #nosec G104 -- Hash writes do not fail.
+
+	rng := rand.New(rand.NewSource(g.config.Seed ^ int64(hash.Sum64()))) // #nosec G404 -- Reproducible test data.
+
+	values := make([]any, len(columns))
+	keys := make(map[*foreignKeyPlan][]any, len(foreignKeys))
+	for row := 0; row < rows; row++ {
+		for _, fk := range foreignKeys {
+			keys[fk] = fk.key(rng, row)
+		}
+		for i, column := range columns {
+			switch {
+			case column.override != nil:
+				values[i] = column.override(rng, row)
+			case column.foreignKey != nil:
+				if key := keys[column.foreignKey]; key != nil {
+					values[i] = key[column.foreignKeyIndex]
+				} else {
+					values[i] = nil
+				}
+			default:
+				if values[i], err = generateValue(rng, column, offsets[column]+int64(row)+1); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return fmt.Errorf("failed to copy row: %w", err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("failed to copy rows: %w", err)
+	}
+	return nil
+}
+
+// fillForeignKey sets the foreign key with the index, which was NULL while
+// the table was copied to break a reference cycle, in the rows copied
+// by the transaction, now that the referenced rows exist.
+func (g *DataGenerator) fillForeignKey(ctx context.Context, tx *sql.Tx, table *generatorTable, index int) (err error) {
+	fk := table.ForeignKeys[index]
+	plan := &foreignKeyPlan{nullable: true}
+	if plan.keys, err = loadReferencedKeys(ctx, tx, fk); err != nil {
+		return err
+	}
+	if len(plan.keys) == 0 {
+		return nil
+	}
+
+	quotedName := pq.QuoteIdentifier(table.Schema) + "." + pq.QuoteIdentifier(table.Name)
+	// Rows copied by the transaction have its transaction ID as xmin,
+	// and are ordered by their location to fill them reproducibly.
+	rows, err := tx.QueryContext(ctx, "SELECT tableoid::text, ctid::text FROM "+quotedName+
+		" WHERE xmin = (txid_current() % 4294967296)::text::xid ORDER BY tableoid::regclass::text, ctid") // #nosec G202 -- The name is quoted.
+	if err != nil {
+		return fmt.Errorf("failed to list copied rows: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	hash := fnv.New64a()
+	hash.Write([]byte(fmt.Sprintf("%s.%d", table.qualifiedName(), index))) // #nosec G104 -- Hash writes do not fail.
+
+	rng := rand.New(rand.NewSource(g.config.Seed ^ int64(hash.Sum64()))) // #nosec G404 -- Reproducible test data.
+
+	// Keys are assigned to the rows in a single UPDATE from arrays.
+	var tableOIDs, locations []string
+	values := make([][]string, len(fk.Columns))
+	for row := 0; rows.Next(); row++ {
+		var tableOID, location string
+		if err := rows.Scan(&tableOID, &location); err != nil {
+			return fmt.Errorf("failed to scan copied row: %w", err)
+		}
+		key := plan.key(rng, row)
+		if key == nil {
+			continue
+		}
+		tableOIDs = append(tableOIDs, tableOID)
+		locations = append(locations, location)
+		for i, value := range key {
+			values[i] = append(values[i], value.(string))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list copied rows: %w", err)
+	}
+	if len(locations) == 0 {
+		return nil
+	}
+
+	args := []any{pq.Array(tableOIDs), pq.Array(locations)}
+	arrays := []string{"$1::text[]", "$2::text[]"}
+	aliases := []string{"tableoid", "location"}
+	assignments := make([]string, len(fk.Columns))
+	for i, name := range fk.Columns {
+		args = append(args, pq.Array(values[i]))
+		arrays = append(arrays, fmt.Sprintf("$%d::text[]", len(args)))
+		aliases = append(aliases, fmt.Sprintf("key%d", i))
+		assignments[i] = fmt.Sprintf("%s = v.key%d::%s", pq.QuoteIdentifier(name), i, table.column(name).Format)
+	}
+	query := fmt.Sprintf("UPDATE %s AS t SET %s FROM unnest(%s) AS v(%s) WHERE t.tableoid = v.tableoid::oid AND t.ctid = v.location::tid",
+		quotedName, strings.Join(assignments, ", "), strings.Join(arrays, ", "), strings.Join(aliases, ", ")) // #nosec G201 -- The names are quoted.
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to update foreign key %s: %w", strings.Join(fk.Columns, ", "), err)
+	}
+	return nil
+}
+
+// uniqueBySequence reports whether a column of the unique constraint
+// is filled from a sequence.
+func uniqueBySequence(plans map[string]*columnPlan, unique []string) bool {
+	for _, name := range unique {
+		if plan := plans[name]; plan.column.Sequence && plan.override == nil && plan.foreignKey == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueColumn returns the first column of the unique constraint
+// which can hold unique values, if any.
+func uniqueColumn(plans map[string]*columnPlan, unique []string) *columnPlan {
+	for _, name := range unique {
+		if plan := plans[name]; plan.override == nil && plan.foreignKey == nil && !plan.column.Generated {
+			return plan
+		}
+	}
+	for _, name := range unique {
+		// Overrides are responsible for their uniqueness.
+		if plans[name].override != nil {
+			return plans[name]
+		}
+	}
+	return nil
+}
+
+// foreignKeyCovers reports whether the foreign key determines a column of the unique constraint.
+func foreignKeyCovers(plans map[string]*columnPlan, fk *foreignKeyPlan, unique []string) bool {
+	for _, name := range unique {
+		if plans[name].foreignKey == fk {
+			return true
+		}
+	}
+	return false
+}
+
+// loadReferencedKeys returns the keys of the table referenced by the foreign key,
+// in a stable order.
+func loadReferencedKeys(ctx context.Context, tx *sql.Tx, fk generatorForeign) (_ [][]any, err error) {
+	columns := make([]string, len(fk.RefColumns))
+	conditions := make([]string, len(fk.RefColumns))
+	for i, name := range fk.RefColumns {
+		columns[i] = pq.QuoteIdentifier(name)
+		conditions[i] = pq.QuoteIdentifier(name) + " IS NOT NULL"
+	}
+	query := fmt.Sprintf("SELECT DISTINCT %s FROM %s.%s WHERE %s ORDER BY %s LIMIT %d",
+		strings.Join(columns, ", "), pq.QuoteIdentifier(fk.RefSchema), pq.QuoteIdentifier(fk.RefTable),
+		strings.Join(conditions, " AND "), strings.Join(columns, ", "), maxReferencedKeys) // #nosec G201 -- The names are quoted.
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys of %s.%s: %w", fk.RefSchema, fk.RefTable, err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	var keys [][]any
+	for rows.Next() {
+		// Keys are copied back in their text form.
+		values := make([]string, len(columns))
+		targets := make([]any, len(columns))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, fmt.Errorf("failed to scan key of %s.%s: %w", fk.RefSchema, fk.RefTable, err)
+		}
+		key := make([]any, len(values))
+		for i, value := range values {
+			key[i] = value
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load keys of %s.%s: %w", fk.RefSchema, fk.RefTable, err)
+	}
+	return keys, nil
+}
+
+// uniqueOffsets returns the offsets of the unique values of the columns,
+// past the values of the existing rows.
+func uniqueOffsets(ctx context.Context, tx *sql.Tx, quotedName string, columns []*columnPlan) (map[*columnPlan]int64, error) {
+	var count int64
+	if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM "+quotedName).Scan(&count); err != nil { // #nosec G202 -- The name is quoted.
+		return nil, fmt.Errorf("failed to count existing rows: %w", err)
+	}
+	offsets := make(map[*columnPlan]int64, len(columns))
+	for _, column := range columns {
+		offsets[column] = count
+		if !column.unique || !isIntegerType(column.column.Type) {
+			continue
+		}
+		// Sequential integers start at the lower bound of the column.
+		if column.rule.min != nil && float64(offsets[column]+1) < column.rule.min.value {
+			offsets[column] = int64(math.Ceil(column.rule.min.value)) - 1
+			if column.rule.min.exclusive && float64(offsets[column]+1) == column.rule.min.value {
+				offsets[column]++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		// Sequential integers continue after the largest existing one.
+		var maxValue int64
+		query := fmt.Sprintf("SELECT coalesce(max(%s), 0) FROM %s", pq.QuoteIdentifier(column.column.Name), quotedName) // #nosec G201 -- The names are quoted.
+		if err := tx.QueryRowContext(ctx, query).Scan(&maxValue); err != nil {
+			return nil, fmt.Errorf("failed to query largest value of column %s: %w", column.column.Name, err)
+		}
+		if maxValue > offsets[column] {
+			offsets[column] = maxValue
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,329 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestDataGenerator tests generating synthetic data from the catalogs.
+func TestDataGenerator(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	const schemaSQL = `
+		CREATE SCHEMA shop;
+		CREATE TYPE shop.tier AS ENUM ('bronze', 'silver', 'gold');
+		CREATE DOMAIN shop.positive AS NUMERIC(10, 2) CHECK (VALUE > 0);
+		CREATE TABLE shop.customers (
+			id SERIAL PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			first_name VARCHAR(20) NOT NULL,
+			tier shop.tier NOT NULL,
+			age INTEGER CHECK (age BETWEEN 18 AND 65),
+			country_code CHAR(2) NOT NULL,
+			referrer_id INTEGER REFERENCES shop.customers (id),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE shop.products (
+			id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			sku TEXT NOT NULL UNIQUE CHECK (char_length(sku) <= 12),
+			price shop.positive NOT NULL,
+			status TEXT NOT NULL CHECK (status IN ('on_sale', 'sold_out')),
+			stock INTEGER NOT NULL CHECK (stock >= 0 AND stock < 50)
+		);
+		CREATE TABLE shop.orders (
+			id UUID PRIMARY KEY,
+			customer_id INTEGER NOT NULL REFERENCES shop.customers (id),
+			placed_on DATE NOT NULL,
+			total NUMERIC(12, 2) NOT NULL CHECK (total >= 10),
+			total_with_tax NUMERIC GENERATED ALWAYS AS (total * 1.2) STORED
+		);
+		CREATE TABLE shop.order_products (
+			order_id UUID NOT NULL REFERENCES shop.orders (id),
+			product_id BIGINT NOT NULL REFERENCES shop.products (id),
+			quantity SMALLINT NOT NULL,
+			PRIMARY KEY (order_id, product_id)
+		);
+	`
+
+	// createShop creates a database with the shop schema.
+	createShop := func(c *qt.C) pgdbtemplate.DatabaseConnection {
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "generated"))
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() { conn.Close() })
+		_, err = conn.ExecContext(ctx, schemaSQL)
+		c.Assert(err, qt.IsNil)
+		return conn
+	}
+
+	// count returns the number of rows matching the query.
+	count := func(c *qt.C, conn pgdbtemplate.DatabaseConnection, query string) int {
+		var n int
+		c.Assert(conn.QueryRowContext(ctx, query).Scan(&n), qt.IsNil)
+		return n
+	}
+
+	// checksum returns the checksum of the generated rows,
+	// excluding the columns filled by defaults.
+	checksum := func(c *qt.C, conn pgdbtemplate.DatabaseConnection) string {
+		var sum string
+		err := conn.QueryRowContext(ctx, `
+			SELECT md5(
+				(SELECT string_agg((c.id, c.email, c.first_name, c.tier, c.age, c.country_code)::text, ',' ORDER BY c.id) FROM shop.customers c) ||
+				(SELECT string_agg(p::text, ',' ORDER BY p.id) FROM shop.products p) ||
+				(SELECT string_agg(o::text, ',' ORDER BY o.id) FROM shop.orders o) ||
+				(SELECT string_agg(op::text, ',' ORDER BY op.order_id, op.product_id) FROM shop.order_products op)
+			)`).Scan(&sum)
+		c.Assert(err, qt.IsNil)
+		return sum
+	}
+
+	c.Run("Connection must be a *DatabaseConnection", func(c *qt.C) {
+		generator := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{Rows: 10})
+		err := generator.Generate(ctx, &recordingConnection{})
+		c.Assert(err, qt.ErrorMatches, `data generation requires a \*DatabaseConnection, got \*pgdbtemplatepq_test.recordingConnection`)
+	})
+
+	c.Run("Number of rows is validated", func(c *qt.C) {
+		err := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{}).Generate(ctx, &pgdbtemplatepq.DatabaseConnection{})
+		c.Assert(err, qt.ErrorMatches, "Rows or TableRows is required")
+
+		err = pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{Rows: -1}).Generate(ctx, &pgdbtemplatepq.DatabaseConnection{})
+		c.Assert(err, qt.ErrorMatches, "invalid number of rows -1")
+	})
+
+	c.Run("Tables are filled respecting constraints", func(c *qt.C) {
+		c.Parallel()
+		conn := createShop(c)
+		generator := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{Rows: 200, Seed: 1})
+		c.Assert(generator.Generate(ctx, conn), qt.IsNil)
+
+		for _, table := range []string{"customers", "products", "orders", "order_products"} {
+			c.Assert(count(c, conn, "SELECT count(*) FROM shop."+table), qt.Equals, 200, qt.Commentf("table %s", table))
+		}
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers WHERE email NOT LIKE '%@example.com'"), qt.Equals, 0)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers WHERE age IS NULL"), qt.Not(qt.Equals), 0)
+		// Self-references are reference cycles, filled after the rows are copied.
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers WHERE referrer_id IS NOT NULL"), qt.Not(qt.Equals), 0)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers WHERE referrer_id IS NULL"), qt.Not(qt.Equals), 0)
+		c.Assert(count(c, conn, "SELECT count(DISTINCT customer_id) FROM shop.orders"), qt.Not(qt.Equals), 1)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.orders WHERE total_with_tax <> total * 1.2"), qt.Equals, 0)
+	})
+
+	c.Run("The same seed generates the same data", func(c *qt.C) {
+		c.Parallel()
+		config := pgdbtemplatepq.DataGeneratorConfig{Rows: 50, Seed: 42}
+		first, second := createShop(c), createShop(c)
+		c.Assert(pgdbtemplatepq.NewDataGenerator(config).Generate(ctx, first), qt.IsNil)
+		c.Assert(pgdbtemplatepq.NewDataGenerator(config).Generate(ctx, second), qt.IsNil)
+		c.Assert(checksum(c, first), qt.Equals, checksum(c, second))
+
+		config.Seed = 43
+		third := createShop(c)
+		c.Assert(pgdbtemplatepq.NewDataGenerator(config).Generate(ctx, third), qt.IsNil)
+		c.Assert(checksum(c, third), qt.Not(qt.Equals), checksum(c, first))
+	})
+
+	c.Run("Table rows and overrides", func(c *qt.C) {
+		c.Parallel()
+		conn := createShop(c)
+		generator := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{
+			Rows: 20,
+			TableRows: map[string]int{
+				"shop.orders":         100,
+				"shop.order_products": 0,
+			},
+			Overrides: map[string]pgdbtemplatepq.ColumnGenerator{
+				"shop.customers.country_code": func(rng *rand.Rand, row int) any {
+					return []string{"NL", "DE"}[row%2]
+				},
+			},
+		})
+		c.Assert(generator.Generate(ctx, conn), qt.IsNil)
+
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers"), qt.Equals, 20)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.orders"), qt.Equals, 100)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.order_products"), qt.Equals, 0)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers WHERE country_code NOT IN ('NL', 'DE')"), qt.Equals, 0)
+	})
+
+	c.Run("Tables can be generated again", func(c *qt.C) {
+		c.Parallel()
+		conn := createShop(c)
+		generator := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{
+			Rows:      30,
+			TableRows: map[string]int{"shop.order_products": 0},
+		})
+		runner := pgdbtemplatepq.NewSeedingMigrationRunner(nil, pgdbtemplatepq.Seeder{Name: "generated", Seed: generator.Generate})
+		c.Assert(runner.RunMigrations(ctx, conn), qt.IsNil)
+		c.Assert(runner.RunMigrations(ctx, conn), qt.IsNil)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers"), qt.Equals, 60)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.orders"), qt.Equals, 60)
+	})
+
+	c.Run("Unknown tables and columns are rejected", func(c *qt.C) {
+		c.Parallel()
+		conn := createShop(c)
+		err := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{
+			TableRows: map[string]int{"shop.invoices": 10},
+		}).Generate(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, `unknown table "shop.invoices" in TableRows`)
+
+		err = pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{
+			Rows: 10,
+			Overrides: map[string]pgdbtemplatepq.ColumnGenerator{
+				"shop.customers.nickname": func(*rand.Rand, int) any { return "x" },
+			},
+		}).Generate(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, `unknown column "shop.customers.nickname" in Overrides`)
+		c.Assert(count(c, conn, "SELECT count(*) FROM shop.customers"), qt.Equals, 0)
+	})
+
+	c.Run("Reference cycles through NOT NULL foreign keys are rejected", func(c *qt.C) {
+		c.Parallel()
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "generated"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, `
+			CREATE TABLE a (id INTEGER PRIMARY KEY, b_id INTEGER NOT NULL);
+			CREATE TABLE b (id INTEGER PRIMARY KEY, a_id INTEGER NOT NULL REFERENCES a (id));
+			ALTER TABLE a ADD FOREIGN KEY (b_id) REFERENCES b (id);
+		`)
+		c.Assert(err, qt.IsNil)
+		err = pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{Rows: 10}).Generate(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, "tables public.a, public.b reference each other through NOT NULL foreign keys; .*")
+	})
+
+	c.Run("Foreign keys closing reference cycles are filled", func(c *qt.C) {
+		c.Parallel()
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "generated"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, `
+			CREATE TABLE departments (id SERIAL PRIMARY KEY, head_id INTEGER);
+			CREATE TABLE employees (
+				id SERIAL PRIMARY KEY,
+				department_id INTEGER NOT NULL REFERENCES departments (id),
+				manager_id INTEGER REFERENCES employees (id)
+			);
+			ALTER TABLE departments ADD FOREIGN KEY (head_id) REFERENCES employees (id);
+		`)
+		c.Assert(err, qt.IsNil)
+		generator := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{Rows: 100, Seed: 1})
+		c.Assert(generator.Generate(ctx, conn), qt.IsNil)
+
+		c.Assert(count(c, conn, "SELECT count(*) FROM departments WHERE head_id IS NOT NULL"), qt.Not(qt.Equals), 0)
+		c.Assert(count(c, conn, "SELECT count(*) FROM employees WHERE manager_id IS NOT NULL"), qt.Not(qt.Equals), 0)
+
+		// Rows copied before are left alone when generating again.
+		_, err = conn.ExecContext(ctx, "UPDATE employees SET manager_id = NULL")
+		c.Assert(err, qt.IsNil)
+		c.Assert(generator.Generate(ctx, conn), qt.IsNil)
+		c.Assert(count(c, conn, "SELECT count(*) FROM employees WHERE manager_id IS NOT NULL AND id <= 100"), qt.Equals, 0)
+		c.Assert(count(c, conn, "SELECT count(*) FROM employees WHERE manager_id IS NOT NULL AND id > 100"), qt.Not(qt.Equals), 0)
+	})
+
+	c.Run("Unsupported CHECK constraints are reported", func(c *qt.C) {
+		c.Parallel()
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "generated"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, `
+			CREATE TABLE events (
+				id SERIAL PRIMARY KEY,
+				kind TEXT NOT NULL CHECK (kind = 'talk' OR kind LIKE 'workshop%'),
+				start_at TIMESTAMPTZ NOT NULL,
+				end_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				CHECK (end_at > start_at),
+				CHECK (updated_at >= created_at)
+			);
+		`)
+		c.Assert(err, qt.IsNil)
+
+		err = pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{Rows: 10}).Generate(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, `(?s)CHECK constraints are not understood, use Overrides for their columns:
+public.events: CHECK \(\(end_at > start_at\)\) on columns start_at, end_at
+public.events: CHECK \(\(\(kind = 'talk'::text\) OR .*\)\) on columns kind`)
+		c.Assert(count(c, conn, "SELECT count(*) FROM events"), qt.Equals, 0)
+
+		// Columns left to their defaults need no overrides.
+		start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+		err = pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{
+			Rows: 10,
+			Overrides: map[string]pgdbtemplatepq.ColumnGenerator{
+				"public.events.kind":     func(*rand.Rand, int) any { return "talk" },
+				"public.events.start_at": func(_ *rand.Rand, row int) any { return start.Add(time.Duration(row) * time.Hour) },
+				"public.events.end_at":   func(_ *rand.Rand, row int) any { return start.Add(time.Duration(row+1) * time.Hour) },
+			},
+		}).Generate(ctx, conn)
+		c.Assert(err, qt.IsNil)
+		c.Assert(count(c, conn, "SELECT count(*) FROM events"), qt.Equals, 10)
+	})
+
+	c.Run("Unique values are spaced within their bounds", func(c *qt.C) {
+		c.Parallel()
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "generated"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, `
+			CREATE TABLE measurements (
+				reading NUMERIC NOT NULL UNIQUE,
+				small SMALLINT UNIQUE,
+				slot INTEGER UNIQUE CHECK (slot < 10),
+				at TIME UNIQUE
+			);
+		`)
+		c.Assert(err, qt.IsNil)
+
+		// Running out of unique values is reported before anything is copied.
+		for _, test := range []struct {
+			rows      int
+			overrides []string
+			err       string
+		}{{
+			rows:      40000,
+			overrides: []string{"slot", "at"},
+			err:       "cannot generate table public.measurements: column small allows only 32767 distinct values, not 40000",
+		}, {
+			rows: 10,
+			err:  "cannot generate table public.measurements: column slot allows only 9 distinct values, not 10",
+		}, {
+			rows:      90000,
+			overrides: []string{"small", "slot"},
+			err:       "cannot generate table public.measurements: column at allows only 86400 distinct values, not 90000",
+		}} {
+			overrides := make(map[string]pgdbtemplatepq.ColumnGenerator)
+			for _, column := range test.overrides {
+				overrides["public.measurements."+column] = func(*rand.Rand, int) any { return nil }
+			}
+			err := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{Rows: test.rows, Overrides: overrides}).Generate(ctx, conn)
+			c.Assert(err, qt.ErrorMatches, test.err)
+		}
+		c.Assert(count(c, conn, "SELECT count(*) FROM measurements"), qt.Equals, 0)
+
+		// Unique numbers are spaced by the scale rather than running into the upper bound.
+		generator := pgdbtemplatepq.NewDataGenerator(pgdbtemplatepq.DataGeneratorConfig{
+			Rows: 5000,
+			Overrides: map[string]pgdbtemplatepq.ColumnGenerator{
+				"public.measurements.slot": func(*rand.Rand, int) any { return nil },
+			},
+		})
+		c.Assert(generator.Generate(ctx, conn), qt.IsNil)
+		c.Assert(count(c, conn, "SELECT count(DISTINCT reading) FROM measurements"), qt.Equals, 5000)
+	})
+}
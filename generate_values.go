@@ -0,0 +1,799 @@
+package pgdbtemplatepq
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generatedTimeBase is the latest time generated, so that the generated
+// data do not depend on the current time.
+var generatedTimeBase = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Patterns of the CHECK constraint conditions understood by DataGenerator,
+// as rendered by pg_get_constraintdef.
+const (
+	checkIdentifierPattern = `\(?("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)\)?(?:::[a-z ]+(?:\([0-9, ]+\))?(?:\[\])?)?`
+	checkNumberPattern     = `\(?'?(-?[0-9]+(?:\.[0-9]+)?)'?\)?(?:::[a-z ]+)?`
+)
+
+var (
+	// checkComparisonRegexp matches comparisons with numbers, e.g. "price > (0)::numeric".
+	checkComparisonRegexp = regexp.MustCompile(`^` + checkIdentifierPattern + ` (>=|<=|>|<|=) ` + checkNumberPattern + `$`)
+	// checkAnyRegexp matches lists of values, e.g. "status = ANY (ARRAY['a'::text, 'b'::text])".
+	checkAnyRegexp = regexp.MustCompile(`^` + checkIdentifierPattern + ` = ANY \((.*)\)$`)
+	// checkLengthRegexp matches comparisons of lengths, e.g. "char_length(code) = 3".
+	checkLengthRegexp = regexp.MustCompile(`^(?:char_length|character_length|length)\(` + checkIdentifierPattern + `\) (>=|<=|>|<|=) ` + checkNumberPattern + `$`)
+	// checkNotEmptyRegexp matches comparisons with the empty string, e.g. "name <> ''::text".
+	checkNotEmptyRegexp = regexp.MustCompile(`^` + checkIdentifierPattern + ` <> ''(?:::[a-z ]+)?$`)
+	// checkNotNullRegexp matches NOT NULL conditions.
+	checkNotNullRegexp = regexp.MustCompile(`^` + checkIdentifierPattern + ` IS NOT NULL$`)
+
+	checkStringLiteralRegexp = regexp.MustCompile(`'((?:[^']|'')*)'`)
+	checkArrayRegexp         = regexp.MustCompile(`ARRAY\[(.*?)\]`)
+	checkNumberRegexp        = regexp.MustCompile(`-?[0-9]+(?:\.[0-9]+)?`)
+)
+
+// checkBound is a bound of a column rule.
+type checkBound struct {
+	value     float64
+	exclusive bool
+}
+
+// columnRule restricts the values of a column, following its type modifier
+// and CHECK constraints.
+type columnRule struct {
+	min, max  *checkBound
+	choices   []string
+	minLength int
+	maxLength int // Zero for no limit.
+	notNull   bool
+}
+
+// parseColumnRules returns the rules of the columns of the table.
+// Conditions which are not understood, e.g. ones involving several
+// columns or OR, are ignored here and reported by unsupportedChecks.
+func parseColumnRules(table *generatorTable) map[string]*columnRule {
+	rules := make(map[string]*columnRule, len(table.Columns))
+	for _, column := range table.Columns {
+		rule := &columnRule{}
+		if (column.Type == "varchar" || column.Type == "bpchar") && column.TypeMod > 4 {
+			rule.maxLength = column.TypeMod - 4
+		}
+		// Domain constraints refer to the column as VALUE.
+		for _, check := range column.Checks {
+			for _, condition := range checkConditions(check) {
+				rule.apply(condition)
+			}
+		}
+		rules[column.Name] = rule
+	}
+	for _, check := range table.Checks {
+		for _, condition := range checkConditions(check) {
+			name, ok := checkColumn(condition)
+			if !ok || rules[name] == nil {
+				continue
+			}
+			rules[name].apply(condition)
+		}
+	}
+	return rules
+}
+
+// unsupportedChecks returns the CHECK constraints of the table which are not
+// understood and constrain columns filled by the generator without overrides,
+// described with those columns.
+func unsupportedChecks(table *generatorTable, overrides map[string]ColumnGenerator) []string {
+	// needsOverride reports whether the column gets random values
+	// which may violate a constraint that is not understood.
+	needsOverride := func(column generatorColumn) bool {
+		if column.Generated || overrides[table.qualifiedName()+"."+column.Name] != nil {
+			return false
+		}
+		return !column.HasDefault || generatorFills(table, column)
+	}
+
+	var unsupported []string
+	for _, column := range table.Columns {
+		for _, check := range column.Checks {
+			if !checkUnderstood(check, func(string) (*columnRule, bool) { return &columnRule{}, true }) && needsOverride(column) {
+				unsupported = append(unsupported, fmt.Sprintf("%s on column %s", check, column.Name))
+			}
+		}
+	}
+	for _, check := range table.Checks {
+		understood := checkUnderstood(check, func(condition string) (*columnRule, bool) {
+			name, ok := checkColumn(condition)
+			if !ok || table.column(name) == nil {
+				return nil, false
+			}
+			return &columnRule{}, true
+		})
+		if understood {
+			continue
+		}
+		var columns []string
+		for _, name := range checkReferences(table, check) {
+			if needsOverride(*table.column(name)) {
+				columns = append(columns, name)
+			}
+		}
+		if len(columns) > 0 {
+			unsupported = append(unsupported, fmt.Sprintf("%s on columns %s", check, strings.Join(columns, ", ")))
+		}
+	}
+	return unsupported
+}
+
+// generatorFills reports whether the generator fills the column despite
+// its default, because it is part of a foreign key or of a unique constraint
+// without a sequence.
+func generatorFills(table *generatorTable, column generatorColumn) bool {
+	contains := func(names []string) bool {
+		for _, name := range names {
+			if name == column.Name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, fk := range table.ForeignKeys {
+		if contains(fk.Columns) {
+			return true
+		}
+	}
+	for _, unique := range table.Uniques {
+		if !contains(unique) {
+			continue
+		}
+		bySequence := false
+		for _, name := range unique {
+			if c := table.column(name); c != nil && c.Sequence {
+				bySequence = true
+			}
+		}
+		if !bySequence {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUnderstood reports whether all conditions of the CHECK constraint
+// are understood, with rule returning the rule a condition applies to.
+func checkUnderstood(check string, rule func(condition string) (*columnRule, bool)) bool {
+	conditions := checkConditions(check)
+	if len(conditions) == 0 {
+		return false
+	}
+	for _, condition := range conditions {
+		r, ok := rule(condition)
+		if !ok || !r.apply(condition) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkReferences returns the columns of the table referred to by the CHECK constraint.
+func checkReferences(table *generatorTable, check string) []string {
+	// Identifiers within string literals are no references.
+	expression := checkStringLiteralRegexp.ReplaceAllString(check, "''")
+	var names []string
+	for _, column := range table.Columns {
+		quoted := `"` + strings.ReplaceAll(column.Name, `"`, `""`) + `"`
+		bare := regexp.MustCompile(`(^|[^A-Za-z0-9_$"])` + regexp.QuoteMeta(column.Name) + `($|[^A-Za-z0-9_$"])`)
+		if strings.Contains(expression, quoted) || bare.MatchString(expression) {
+			names = append(names, column.Name)
+		}
+	}
+	return names
+}
+
+// checkConditions splits the CHECK constraint definition into the conditions
+// joined by AND. A constraint with OR at the top level has no conditions.
+func checkConditions(definition string) []string {
+	definition = strings.TrimSuffix(strings.TrimSpace(definition), " NOT VALID")
+	definition = strings.TrimSuffix(definition, " NO INHERIT")
+	expression, ok := strings.CutPrefix(definition, "CHECK ")
+	if !ok {
+		return nil
+	}
+	return splitConditions(expression)
+}
+
+// splitConditions splits the expression into the conditions joined by AND.
+func splitConditions(expression string) []string {
+	expression = trimParentheses(expression)
+	if len(splitTopLevel(expression, " OR ")) > 1 {
+		return nil
+	}
+	parts := splitTopLevel(expression, " AND ")
+	if len(parts) == 1 {
+		return parts
+	}
+	var conditions []string
+	for _, part := range parts {
+		conditions = append(conditions, splitConditions(part)...)
+	}
+	return conditions
+}
+
+// splitTopLevel splits the expression at the separators outside of parentheses and quotes.
+func splitTopLevel(expression, separator string) []string {
+	var (
+		parts []string
+		depth int
+		quote byte
+		start int
+	)
+	for i := 0; i < len(expression); i++ {
+		switch ch := expression[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(expression[i:], separator):
+			parts = append(parts, expression[start:i])
+			start = i + len(separator)
+			i = start - 1
+		}
+	}
+	return append(parts, expression[start:])
+}
+
+// trimParentheses removes the parentheses enclosing the whole expression.
+func trimParentheses(expression string) string {
+	for {
+		expression = strings.TrimSpace(expression)
+		if !strings.HasPrefix(expression, "(") || !strings.HasSuffix(expression, ")") {
+			return expression
+		}
+		depth := 0
+		var quote byte
+		for i := 0; i < len(expression); i++ {
+			switch ch := expression[i]; {
+			case quote != 0:
+				if ch == quote {
+					quote = 0
+				}
+			case ch == '\'' || ch == '"':
+				quote = ch
+			case ch == '(':
+				depth++
+			case ch == ')':
+				depth--
+				if depth == 0 && i < len(expression)-1 {
+					// The first parenthesis closes before the end.
+					return expression
+				}
+			}
+		}
+		expression = expression[1 : len(expression)-1]
+	}
+}
+
+// checkColumn returns the column the condition applies to.
+func checkColumn(condition string) (string, bool) {
+	condition = trimParentheses(condition)
+	for _, pattern := range []*regexp.Regexp{checkComparisonRegexp, checkAnyRegexp, checkLengthRegexp, checkNotEmptyRegexp, checkNotNullRegexp} {
+		if match := pattern.FindStringSubmatch(condition); match != nil {
+			return checkIdentifier(match[1]), true
+		}
+	}
+	return "", false
+}
+
+// checkIdentifier unquotes the identifier of a condition.
+func checkIdentifier(identifier string) string {
+	if strings.HasPrefix(identifier, `"`) {
+		return strings.ReplaceAll(identifier[1:len(identifier)-1], `""`, `"`)
+	}
+	return identifier
+}
+
+// apply restricts the rule by the condition,
+// reporting whether the condition is understood.
+func (r *columnRule) apply(condition string) bool {
+	condition = trimParentheses(condition)
+	if match := checkComparisonRegexp.FindStringSubmatch(condition); match != nil {
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			return false
+		}
+		switch operator := match[2]; operator {
+		case ">", ">=":
+			if r.min == nil || value > r.min.value {
+				r.min = &checkBound{value: value, exclusive: operator == ">"}
+			}
+		case "<", "<=":
+			if r.max == nil || value < r.max.value {
+				r.max = &checkBound{value: value, exclusive: operator == "<"}
+			}
+		case "=":
+			r.choices = []string{match[3]}
+		}
+		return true
+	}
+	if match := checkAnyRegexp.FindStringSubmatch(condition); match != nil {
+		var choices []string
+		for _, literal := range checkStringLiteralRegexp.FindAllStringSubmatch(match[2], -1) {
+			choices = append(choices, strings.ReplaceAll(literal[1], "''", "'"))
+		}
+		if len(choices) == 0 {
+			if array := checkArrayRegexp.FindStringSubmatch(match[2]); array != nil {
+				choices = checkNumberRegexp.FindAllString(array[1], -1)
+			}
+		}
+		if len(choices) == 0 {
+			return false
+		}
+		r.choices = choices
+		return true
+	}
+	if match := checkLengthRegexp.FindStringSubmatch(condition); match != nil {
+		length, err := strconv.Atoi(match[3])
+		if err != nil {
+			return false
+		}
+		operator := match[2]
+		if operator == ">" {
+			length++
+		} else if operator == "<" {
+			length--
+		}
+		if strings.Contains(operator, ">") || operator == "=" {
+			if length > r.minLength {
+				r.minLength = length
+			}
+		}
+		if strings.Contains(operator, "<") || operator == "=" {
+			if r.maxLength == 0 || length < r.maxLength {
+				r.maxLength = length
+			}
+		}
+		return true
+	}
+	if match := checkNotEmptyRegexp.FindStringSubmatch(condition); match != nil {
+		if r.minLength < 1 {
+			r.minLength = 1
+		}
+		return true
+	}
+	if match := checkNotNullRegexp.FindStringSubmatch(condition); match != nil {
+		r.notNull = true
+		return true
+	}
+	return false
+}
+
+// isIntegerType reports whether the type is an integer type.
+func isIntegerType(typeName string) bool {
+	switch typeName {
+	case "int2", "int4", "int8":
+		return true
+	}
+	return false
+}
+
+// uniqueLimit returns the largest index generateValue turns into
+// distinct values of the unique column, and false if there is no
+// practical limit. Unique integers are their index.
+func uniqueLimit(plan *columnPlan) (int64, bool) {
+	column, rule := plan.column, plan.rule
+	if len(rule.choices) > 0 {
+		return int64(len(rule.choices)), true
+	}
+	if len(column.Labels) > 0 {
+		return int64(len(column.Labels)), true
+	}
+	switch column.Type {
+	case "int2", "int4", "int8":
+		limit := int64(math.MaxInt64)
+		switch column.Type {
+		case "int2":
+			limit = math.MaxInt16
+		case "int4":
+			limit = math.MaxInt32
+		}
+		if rule.max != nil && rule.max.value < float64(limit) {
+			limit = int64(math.Floor(rule.max.value))
+			if rule.max.exclusive && float64(limit) == rule.max.value {
+				limit--
+			}
+		}
+		return limit, limit < math.MaxInt64
+	case "numeric", "float4", "float8", "money":
+		low, high, step, _, err := decimalRange(plan)
+		if err != nil {
+			return 0, true
+		}
+		return decimalCount(low, high, step), true
+	case "date":
+		return generatedDays, true
+	case "timestamp", "timestamptz":
+		return generatedSeconds, true
+	case "time", "timetz":
+		return generatedTimesOfDay, true
+	case "bool":
+		return 2, true
+	case "inet":
+		return 1 << 24, true
+	case "cidr":
+		return 1 << 16, true
+	}
+	return 0, false
+}
+
+// min64 returns the smaller of the numbers.
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// generateValue returns a random value for the column. Unique columns get
+// distinct values derived from index, which starts at 1.
+func generateValue(rng *rand.Rand, plan *columnPlan, index int64) (any, error) {
+	column, rule := plan.column, plan.rule
+	if !column.NotNull && !rule.notNull && !plan.unique && rng.Float64() < generatedNullFraction {
+		return nil, nil
+	}
+
+	choices := rule.choices
+	if len(choices) == 0 {
+		choices = column.Labels
+	}
+	if len(choices) > 0 {
+		if plan.unique {
+			if index > int64(len(choices)) {
+				return nil, fmt.Errorf("column %s allows only %d distinct values", column.Name, len(choices))
+			}
+			return choices[index-1], nil
+		}
+		return choices[rng.Intn(len(choices))], nil
+	}
+
+	switch {
+	case isIntegerType(column.Type):
+		return generateInteger(rng, plan, index)
+	case column.Type == "numeric", column.Type == "float4", column.Type == "float8", column.Type == "money":
+		return generateDecimal(rng, plan, index)
+	case column.Type == "bool":
+		if plan.unique {
+			return index%2 == 1, nil
+		}
+		return rng.Intn(2) == 1, nil
+	case column.Type == "date", column.Type == "timestamp", column.Type == "timestamptz",
+		column.Type == "time", column.Type == "timetz":
+		return generateTime(rng, plan, index), nil
+	case column.Type == "interval":
+		return fmt.Sprintf("%d minutes", 1+rng.Intn(7*24*60)), nil
+	case column.Type == "uuid":
+		return generateUUID(rng, plan, index), nil
+	case column.Type == "json", column.Type == "jsonb":
+		return fmt.Sprintf(`{"id": %d}`, index), nil
+	case column.Type == "bytea":
+		value := make([]byte, 16)
+		rng.Read(value) // #nosec G104 -- Reads from math/rand do not fail.
+		return value, nil
+	case column.Type == "inet":
+		return fmt.Sprintf("10.%d.%d.%d", index>>16&0xff, index>>8&0xff, index&0xff), nil
+	case column.Type == "cidr":
+		return fmt.Sprintf("10.%d.%d.0/24", index>>8&0xff, index&0xff), nil
+	case column.Category == "A":
+		return "{}", nil
+	case column.Category == "S":
+		return generateText(rng, plan, index)
+	}
+	if column.NotNull || rule.notNull {
+		return nil, fmt.Errorf("cannot generate values of type %s for column %s; use an override", column.Type, column.Name)
+	}
+	return nil, nil
+}
+
+// generateInteger returns an integer within the bounds of the column.
+func generateInteger(rng *rand.Rand, plan *columnPlan, index int64) (any, error) {
+	if plan.unique {
+		return index, nil
+	}
+
+	name := plan.column.Name
+	low, high := int64(1), int64(100000)
+	switch {
+	case nameHas(name, "age"):
+		low, high = 18, 90
+	case nameHas(name, "year"):
+		low, high = 1970, 2024
+	case nameHas(name, "quantity", "qty", "count"):
+		low, high = 1, 100
+	case nameHas(name, "percent", "percentage", "score"):
+		low, high = 0, 100
+	case nameHas(name, "rating", "stars"):
+		low, high = 1, 5
+	}
+	if plan.column.Type == "int2" && high > math.MaxInt16 {
+		high = math.MaxInt16
+	}
+
+	rule := plan.rule
+	if rule.min != nil {
+		low = int64(math.Ceil(rule.min.value))
+		if rule.min.exclusive && float64(low) == rule.min.value {
+			low++
+		}
+		if high < low {
+			high = low + 1000
+		}
+	}
+	if rule.max != nil {
+		high = int64(math.Floor(rule.max.value))
+		if rule.max.exclusive && float64(high) == rule.max.value {
+			high--
+		}
+		if rule.min == nil && low > high {
+			low = high - 1000
+		}
+	}
+	if low > high {
+		return nil, fmt.Errorf("CHECK constraints of column %s leave no values", name)
+	}
+	return low + rng.Int63n(high-low+1), nil
+}
+
+// generateDecimal returns a decimal number within the bounds and precision of the column.
+// Unique numbers are spaced by the step of the scale from the lower bound.
+func generateDecimal(rng *rand.Rand, plan *columnPlan, index int64) (any, error) {
+	low, high, step, scale, err := decimalRange(plan)
+	if err != nil {
+		return nil, err
+	}
+	if plan.unique {
+		if index > decimalCount(low, high, step) {
+			return nil, fmt.Errorf("column %s allows only %d distinct values", plan.column.Name, decimalCount(low, high, step))
+		}
+		value := math.Round((low+float64(index-1)*step)/step) * step
+		return strconv.FormatFloat(value, 'f', scale, 64), nil
+	}
+
+	value := low + rng.Float64()*(high-low)
+	// Rounding stays within the bounds, which are multiples of the step.
+	value = math.Max(low, math.Min(high, math.Round(value/step)*step))
+	return strconv.FormatFloat(value, 'f', scale, 64), nil
+}
+
+// decimalRange returns the bounds of the decimal numbers of the column,
+// the step and the scale of its precision.
+func decimalRange(plan *columnPlan) (low, high, step float64, scale int, err error) {
+	scale, precision := 2, 0
+	if plan.column.Type == "numeric" && plan.column.TypeMod >= 4 {
+		precision = (plan.column.TypeMod - 4) >> 16 & 0xffff
+		scale = (plan.column.TypeMod - 4) & 0xffff
+	}
+	step = math.Pow10(-scale)
+
+	name := plan.column.Name
+	low, high = 0.0, 1000.0
+	switch {
+	case nameHas(name, "price", "amount", "total", "cost", "balance"):
+		low, high = 1, 1000
+	case nameHas(name, "lat", "latitude"):
+		low, high = -90, 90
+	case nameHas(name, "lon", "lng", "longitude"):
+		low, high = -180, 180
+	}
+	if precision > 0 {
+		limit := math.Pow10(precision-scale) - step
+		high = math.Min(high, limit)
+		low = math.Max(low, -limit)
+	}
+
+	rule := plan.rule
+	if rule.min != nil {
+		low = rule.min.value
+		if rule.min.exclusive {
+			low += step
+		}
+		if high < low {
+			high = low + 1000
+		}
+	}
+	if rule.max != nil {
+		high = rule.max.value
+		if rule.max.exclusive {
+			high -= step
+		}
+		if rule.min == nil && low > high {
+			low = high - 1000
+		}
+	}
+	// The bounds are rounded inwards to multiples of the step,
+	// with an epsilon absorbing the rounding errors of the division.
+	low = math.Ceil(low/step-1e-9) * step
+	high = math.Floor(high/step+1e-9) * step
+	if low > high {
+		return 0, 0, 0, 0, fmt.Errorf("CHECK constraints of column %s leave no values", name)
+	}
+	return low, high, step, scale, nil
+}
+
+// decimalCount returns the number of distinct decimal numbers
+// from low to high spaced by step.
+func decimalCount(low, high, step float64) int64 {
+	// The epsilon absorbs the rounding errors of the division.
+	return int64(math.Floor((high-low)/step+1e-9)) + 1
+}
+
+// Numbers of distinct values of unique dates and times, counted back
+// from generatedTimeBase: days and seconds until year 1, which is the
+// earliest year formatted the way PostgreSQL accepts, and seconds of a day.
+var (
+	generatedDays    = (generatedTimeBase.Unix() - time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC).Unix()) / (24 * 60 * 60)
+	generatedSeconds = min64(generatedDays*24*60*60, math.MaxInt64/int64(time.Second))
+)
+
+// generatedTimesOfDay is the number of distinct unique times of day.
+const generatedTimesOfDay = 24 * 60 * 60
+
+// generateTime returns a date or time before generatedTimeBase.
+func generateTime(rng *rand.Rand, plan *columnPlan, index int64) string {
+	name := plan.column.Name
+	var value time.Time
+	switch {
+	case plan.unique && plan.column.Type == "date":
+		value = generatedTimeBase.AddDate(0, 0, -int(index))
+	case plan.unique:
+		// Unique values are within the limits of uniqueLimit.
+		value = generatedTimeBase.Add(-time.Duration(index) * time.Second)
+	case nameHas(name, "birthday", "birthdate", "dob", "born"):
+		value = generatedTimeBase.AddDate(-18, 0, -rng.Intn(60*365))
+	default:
+		value = generatedTimeBase.Add(-time.Duration(rng.Int63n(int64(365 * 24 * time.Hour))))
+	}
+	switch plan.column.Type {
+	case "date":
+		return value.Format("2006-01-02")
+	case "timestamp":
+		return value.Format("2006-01-02 15:04:05")
+	case "time", "timetz":
+		return value.Format("15:04:05")
+	}
+	return value.Format(time.RFC3339)
+}
+
+// generateUUID returns a random version 4 UUID.
+// Unique UUIDs end with the index, so that they differ from the existing ones.
+func generateUUID(rng *rand.Rand, plan *columnPlan, index int64) string {
+	var uuid [16]byte
+	rng.Read(uuid[:]) // #nosec G104 -- Reads from math/rand do not fail.
+	if plan.unique {
+		for i := 15; i >= 10; i-- {
+			uuid[i] = byte(index)
+			index >>= 8
+		}
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// Words of generated text values.
+var (
+	generatedFirstNames = []string{"Alice", "Bob", "Carol", "David", "Emma", "Frank", "Grace", "Henry", "Isabel", "Jack", "Karen", "Liam", "Maria", "Noah", "Olivia", "Peter"}
+	generatedLastNames  = []string{"Smith", "Johnson", "Garcia", "Miller", "Davis", "Lopez", "Wilson", "Anderson", "Taylor", "Moore", "Martin", "Lee", "Walker", "Young"}
+	generatedCities     = []string{"Amsterdam", "Berlin", "Chicago", "Dublin", "Lisbon", "London", "Madrid", "Oslo", "Paris", "Prague", "Tokyo", "Toronto", "Vienna"}
+	generatedCountries  = []string{"Austria", "Canada", "France", "Germany", "Ireland", "Japan", "Netherlands", "Norway", "Portugal", "Spain", "United Kingdom"}
+	generatedStatuses   = []string{"active", "pending", "archived", "draft"}
+	generatedColors     = []string{"red", "green", "blue", "black", "white", "yellow"}
+	generatedWords      = []string{"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do", "eiusmod", "tempor", "incididunt", "labore", "magna", "aliqua"}
+)
+
+// generateText returns a text value chosen by the column name,
+// within the length limits of the column.
+func generateText(rng *rand.Rand, plan *columnPlan, index int64) (any, error) {
+	name := plan.column.Name
+	pick := func(words []string) string { return words[rng.Intn(len(words))] }
+	words := func(low, high int) string {
+		n := low + rng.Intn(high-low+1)
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = pick(generatedWords)
+		}
+		return strings.Join(parts, " ")
+	}
+
+	var value string
+	suffixed := plan.unique
+	switch {
+	case nameHas(name, "email", "mail"):
+		if plan.unique {
+			value = fmt.Sprintf("user%d@example.com", index)
+		} else {
+			value = fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(pick(generatedFirstNames)), strings.ToLower(pick(generatedLastNames)), rng.Intn(1000))
+		}
+		suffixed = false
+	case nameHas(name, "username", "login", "handle"):
+		value = fmt.Sprintf("user%d", index)
+		if !plan.unique {
+			value = fmt.Sprintf("user%d", 1+rng.Intn(100000))
+		}
+		suffixed = false
+	case nameHas(name, "first", "firstname", "given"):
+		value = pick(generatedFirstNames)
+	case nameHas(name, "last", "lastname", "surname", "family"):
+		value = pick(generatedLastNames)
+	case nameHas(name, "phone", "mobile", "tel"):
+		value = fmt.Sprintf("+1-555-%03d-%04d", rng.Intn(1000), rng.Intn(10000))
+	case nameHas(name, "url", "website", "link", "homepage"):
+		value = fmt.Sprintf("https://example.com/%s/%d", pick(generatedWords), rng.Intn(10000))
+	case nameHas(name, "city", "town"):
+		value = pick(generatedCities)
+	case nameHas(name, "country"):
+		value = pick(generatedCountries)
+	case nameHas(name, "street", "address"):
+		value = fmt.Sprintf("%d %s Street", 1+rng.Intn(999), pick(generatedLastNames))
+	case nameHas(name, "zip", "postcode", "postal"):
+		value = fmt.Sprintf("%05d", rng.Intn(100000))
+	case nameHas(name, "code", "sku", "token", "reference", "ref"):
+		value = strings.ToUpper(strconv.FormatInt(rng.Int63n(1<<40), 36))
+	case nameHas(name, "description", "bio", "body", "text", "content", "comment", "notes", "summary", "message"):
+		value = words(8, 20)
+	case nameHas(name, "status", "state", "kind", "type", "category"):
+		value = pick(generatedStatuses)
+	case nameHas(name, "color", "colour"):
+		value = pick(generatedColors)
+	case nameHas(name, "name"):
+		value = pick(generatedFirstNames) + " " + pick(generatedLastNames)
+	case nameHas(name, "title", "subject", "label"):
+		value = words(2, 5)
+		value = strings.ToUpper(value[:1]) + value[1:]
+	default:
+		value = words(1, 3)
+	}
+	if suffixed {
+		value = fmt.Sprintf("%s-%d", value, index)
+	}
+
+	rule := plan.rule
+	if rule.maxLength > 0 && len(value) > rule.maxLength {
+		if plan.unique {
+			value = strconv.FormatInt(index, 36)
+			if len(value) > rule.maxLength {
+				return nil, fmt.Errorf("column %s is too short for %d distinct values", name, index)
+			}
+		} else {
+			value = value[:rule.maxLength]
+		}
+	}
+	if len(value) < rule.minLength {
+		value += strings.Repeat("x", rule.minLength-len(value))
+	}
+	if rule.maxLength > 0 && len(value) > rule.maxLength {
+		return nil, fmt.Errorf("CHECK constraints of column %s leave no values", name)
+	}
+	return value, nil
+}
+
+// nameHas reports whether one of the underscore-separated words
+// of the column name is one of the words.
+func nameHas(name string, words ...string) bool {
+	for _, part := range strings.Split(strings.ToLower(name), "_") {
+		for _, word := range words {
+			if part == word {
+				return true
+			}
+		}
+	}
+	return false
+}
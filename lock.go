@@ -0,0 +1,54 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// templateLockNamespace separates template lock keys from other advisory locks.
+const templateLockNamespace = "pgdbtemplate-pq:template:"
+
+// LockTemplate takes a session-level advisory lock on the admin database
+// keyed by the template name, waiting until it is released by other processes.
+//
+// It serializes template initialization across processes, e.g. packages
+// run in parallel by go test ./...: the first process builds the template
+// while the others wait and then find it ready. Waiting is aborted
+// when ctx is done. The returned function releases the lock and must be called.
+func (p *ConnectionProvider) LockTemplate(ctx context.Context, templateName string) (unlock func() error, err error) {
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Session-level locks must be taken and released on the same connection.
+	conn, err := adminConn.DB.Conn(ctx)
+	if err != nil {
+		adminConn.Close() // #nosec G104 -- Close error in error path is not critical.
+		return nil, fmt.Errorf("failed to connect to admin database: %w", err)
+	}
+
+	key := templateLockKey(templateName)
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		// Closing the session releases the lock should it have been granted anyway.
+		err = errors.Join(err, conn.Close(), adminConn.Close())
+		return nil, fmt.Errorf("failed to lock template %q: %w", templateName, err)
+	}
+
+	return func() error {
+		// The lock is released even if ctx is done by now.
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		if err = errors.Join(err, conn.Close(), adminConn.Close()); err != nil {
+			return fmt.Errorf("failed to unlock template %q: %w", templateName, err)
+		}
+		return nil
+	}, nil
+}
+
+// templateLockKey returns the advisory lock key of the template.
+func templateLockKey(templateName string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(templateLockNamespace + templateName))
+	return int64(h.Sum64()) // #nosec G115 -- Wrapping into negative keys is intended.
+}
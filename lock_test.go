@@ -0,0 +1,127 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestLockTemplate tests serializing template initialization with advisory locks.
+func TestLockTemplate(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	c.Run("Second lock waits for the first", func(c *qt.C) {
+		c.Parallel()
+		templateName := fmt.Sprintf("lock_wait_%d", time.Now().UnixNano())
+
+		unlock, err := provider.LockTemplate(ctx, templateName)
+		c.Assert(err, qt.IsNil)
+
+		acquired := make(chan struct{})
+		go func() {
+			defer close(acquired)
+			unlock, err := provider.LockTemplate(ctx, templateName)
+			if err != nil {
+				return
+			}
+			unlock()
+		}()
+
+		select {
+		case <-acquired:
+			c.Fatal("lock acquired while held by another session")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		c.Assert(unlock(), qt.IsNil)
+		select {
+		case <-acquired:
+		case <-time.After(10 * time.Second):
+			c.Fatal("lock not acquired after release")
+		}
+	})
+
+	c.Run("Waiting respects context cancellation", func(c *qt.C) {
+		c.Parallel()
+		templateName := fmt.Sprintf("lock_cancel_%d", time.Now().UnixNano())
+
+		unlock, err := provider.LockTemplate(ctx, templateName)
+		c.Assert(err, qt.IsNil)
+		defer unlock()
+
+		waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		_, err = provider.LockTemplate(waitCtx, templateName)
+		c.Assert(err, qt.ErrorMatches, fmt.Sprintf("failed to lock template %q: .*", templateName))
+	})
+
+	c.Run("Different templates do not block", func(c *qt.C) {
+		c.Parallel()
+		unlockFirst, err := provider.LockTemplate(ctx, fmt.Sprintf("lock_first_%d", time.Now().UnixNano()))
+		c.Assert(err, qt.IsNil)
+		defer unlockFirst()
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		unlockSecond, err := provider.LockTemplate(timeoutCtx, fmt.Sprintf("lock_second_%d", time.Now().UnixNano()))
+		c.Assert(err, qt.IsNil)
+		c.Assert(unlockSecond(), qt.IsNil)
+	})
+
+	c.Run("Concurrent EnsureTemplate builds once", func(c *qt.C) {
+		c.Parallel()
+		prefix := fmt.Sprintf("lock_build_%d_", time.Now().UnixNano())
+		runner := &countingMigrationRunner{}
+		config := pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: runner,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("concurrent"),
+		}
+
+		const callers = 4
+		var (
+			wg        sync.WaitGroup
+			mu        sync.Mutex
+			templates []*pgdbtemplatepq.Template
+			errs      []error
+		)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Separate providers behave like separate processes.
+				template, err := pgdbtemplatepq.NewConnectionProvider(connStringFunc).EnsureTemplate(ctx, config)
+				mu.Lock()
+				defer mu.Unlock()
+				templates = append(templates, template)
+				errs = append(errs, err)
+			}()
+		}
+		wg.Wait()
+
+		reused := 0
+		for i, err := range errs {
+			c.Assert(err, qt.IsNil)
+			if templates[i].Reused {
+				reused++
+			}
+		}
+		defer unmarkAndDrop(c, templates[0].Name)
+		c.Assert(reused, qt.Equals, callers-1)
+		c.Assert(runner.runs.Load(), qt.Equals, int32(1))
+	})
+}
@@ -0,0 +1,116 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// metadataCommentPrefix marks database comments holding DatabaseMetadata.
+const metadataCommentPrefix = "pgdbtemplate-pq:"
+
+// DatabaseMetadata describes who created a database and why it exists.
+//
+// It is stored as COMMENT ON DATABASE so that databases left behind
+// by crashed or failed test runs can be identified later.
+type DatabaseMetadata struct {
+	// PID is the process ID of the creating process.
+	PID int `json:"pid"`
+	// Hostname is the host the creating process ran on.
+	Hostname string `json:"hostname"`
+	// CreatedAt is the time the database was created.
+	CreatedAt time.Time `json:"created_at"`
+	// Test is the name of the test the database was created for, if any.
+	Test string `json:"test,omitempty"`
+	// KeptReason explains why the database was intentionally kept, if it was.
+	KeptReason string `json:"kept_reason,omitempty"`
+	// Fingerprint is the fingerprint of the migration inputs
+	// of reusable templates built by EnsureTemplate.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Parent is the template a template built by EnsureTemplate was derived from,
+	// or cloned from with TemplateConfig.Source, or the database a Snapshot was taken of.
+	Parent string `json:"parent,omitempty"`
+}
+
+// NewDatabaseMetadata returns metadata describing the current process.
+func NewDatabaseMetadata() DatabaseMetadata {
+	hostname, _ := os.Hostname() // Hostname is informational only.
+	return DatabaseMetadata{
+		PID:       os.Getpid(),
+		Hostname:  hostname,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// SetDatabaseMetadata stores the metadata as the comment of the database.
+func (p *ConnectionProvider) SetDatabaseMetadata(ctx context.Context, databaseName string, metadata DatabaseMetadata) error {
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer adminConn.Close()
+
+	return setDatabaseMetadata(ctx, adminConn, databaseName, metadata)
+}
+
+// DatabaseMetadata returns the metadata stored on the database.
+//
+// It returns nil if the database has no metadata stamped by this package.
+func (p *ConnectionProvider) DatabaseMetadata(ctx context.Context, databaseName string) (*DatabaseMetadata, error) {
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer adminConn.Close()
+
+	var comment sql.NullString
+	err = adminConn.DB.QueryRowContext(ctx,
+		"SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1",
+		databaseName,
+	).Scan(&comment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("database %q does not exist", databaseName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read comment of database %q: %w", databaseName, err)
+	}
+	metadata, _ := ParseDatabaseMetadata(comment.String)
+	return metadata, nil
+}
+
+// setDatabaseMetadata stores the metadata as the comment of the database.
+func setDatabaseMetadata(ctx context.Context, adminConn *DatabaseConnection, databaseName string, metadata DatabaseMetadata) error {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode database metadata: %w", err)
+	}
+	query := fmt.Sprintf("COMMENT ON DATABASE %s IS %s",
+		pq.QuoteIdentifier(databaseName), pq.QuoteLiteral(metadataCommentPrefix+string(encoded)))
+	if _, err := adminConn.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to comment on database %q: %w", databaseName, err)
+	}
+	return nil
+}
+
+// ParseDatabaseMetadata parses a database comment holding DatabaseMetadata,
+// e.g. one read with shobj_description(oid, 'pg_database').
+//
+// It reports false for comments not written by this package.
+func ParseDatabaseMetadata(comment string) (*DatabaseMetadata, bool) {
+	encoded, ok := strings.CutPrefix(comment, metadataCommentPrefix)
+	if !ok {
+		return nil, false
+	}
+	var metadata DatabaseMetadata
+	if err := json.Unmarshal([]byte(encoded), &metadata); err != nil {
+		return nil, false
+	}
+	return &metadata, true
+}
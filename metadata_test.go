@@ -0,0 +1,84 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestDatabaseMetadata tests stamping and reading database metadata.
+func TestDatabaseMetadata(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	c.Run("New metadata describes current process", func(c *qt.C) {
+		metadata := pgdbtemplatepq.NewDatabaseMetadata()
+		c.Assert(metadata.PID, qt.Equals, os.Getpid())
+		c.Assert(time.Since(metadata.CreatedAt) < time.Minute, qt.IsTrue)
+	})
+
+	c.Run("Parse comments", func(c *qt.C) {
+		metadata, ok := pgdbtemplatepq.ParseDatabaseMetadata(`pgdbtemplate-pq:{"pid":42,"hostname":"ci","created_at":"2024-01-02T03:04:05Z"}`)
+		c.Assert(ok, qt.IsTrue)
+		c.Assert(metadata.PID, qt.Equals, 42)
+		c.Assert(metadata.Hostname, qt.Equals, "ci")
+
+		for _, comment := range []string{"", "hand-made", "pgdbtemplate-pq:{"} {
+			metadata, ok := pgdbtemplatepq.ParseDatabaseMetadata(comment)
+			c.Assert(ok, qt.IsFalse)
+			c.Assert(metadata, qt.IsNil)
+		}
+	})
+
+	c.Run("Round trip", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "metadata_test")
+
+		metadata := pgdbtemplatepq.NewDatabaseMetadata()
+		metadata.Test = "TestDatabaseMetadata"
+		metadata.KeptReason = "failed"
+		err := provider.SetDatabaseMetadata(ctx, dbName, metadata)
+		c.Assert(err, qt.IsNil)
+
+		got, err := provider.DatabaseMetadata(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.IsNotNil)
+		c.Assert(got.PID, qt.Equals, metadata.PID)
+		c.Assert(got.Hostname, qt.Equals, metadata.Hostname)
+		c.Assert(got.CreatedAt.Equal(metadata.CreatedAt), qt.IsTrue)
+		c.Assert(got.Test, qt.Equals, "TestDatabaseMetadata")
+		c.Assert(got.KeptReason, qt.Equals, "failed")
+	})
+
+	c.Run("Foreign comment is ignored", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "metadata_foreign_test")
+
+		adminConn, err := provider.Connect(ctx, "postgres")
+		c.Assert(err, qt.IsNil)
+		defer adminConn.Close()
+		_, err = adminConn.ExecContext(ctx, "COMMENT ON DATABASE "+dbName+" IS 'hand-made'")
+		c.Assert(err, qt.IsNil)
+
+		got, err := provider.DatabaseMetadata(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.IsNil)
+	})
+
+	c.Run("Missing database", func(c *qt.C) {
+		_, err := provider.DatabaseMetadata(ctx, "nonexistent_db_12345")
+		c.Assert(err, qt.ErrorMatches, `database "nonexistent_db_12345" does not exist`)
+	})
+}
@@ -0,0 +1,606 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	"github.com/lib/pq"
+)
+
+// noTransactionAnnotation is the "-- +notx" annotation of migration files
+// which run outside a transaction.
+const noTransactionAnnotation = "notx"
+
+// FileMigrationRunner runs the SQL files of the migration directories,
+// like pgdbtemplate.FileMigrationRunner, reporting failed statements
+// as *MigrationError with their position in the file.
+//
+// The files are split into statements, which run in a transaction per file.
+// Files run without a transaction, statement by statement, when they are
+// annotated with a "-- +notx" line comment, when they contain statements
+// which cannot run in a transaction block, e.g. CREATE INDEX CONCURRENTLY,
+// VACUUM or, before PostgreSQL 12, ALTER TYPE ... ADD VALUE, or when they
+// control transactions themselves with BEGIN and COMMIT.
+//
+// Statements run on a single session of *DatabaseConnection connections.
+// Other connections receive transactional files as a whole, which
+// the server runs in an implicit transaction.
+//
+// The psql meta-commands \i, \ir, \set, \unset and \if are expanded
+// before, interpolating :name, :'name' and :"name" variables,
+// which can be set with WithMigrationVariables.
+//
+// It implements Fingerprinter with FileMigrationFingerprint,
+// which also covers the variables and included files.
+type FileMigrationRunner struct {
+	paths        []string
+	orderingFunc func([]string) []string
+	variables    map[string]string
+}
+
+// FileMigrationOption configures FileMigrationRunner.
+type FileMigrationOption func(*FileMigrationRunner)
+
+// WithMigrationVariables sets psql variables of the migration files,
+// as "psql -v name=value" does.
+func WithMigrationVariables(variables map[string]string) FileMigrationOption {
+	return func(r *FileMigrationRunner) {
+		for name, value := range variables {
+			r.variables[name] = value
+		}
+	}
+}
+
+// NewFileMigrationRunner creates a new file-based migration runner.
+//
+// The files of each directory are ordered by orderingFunc.
+// Upon the nil function provided, an alphabetical sorting will be used.
+func NewFileMigrationRunner(paths []string, orderingFunc func([]string) []string, opts ...FileMigrationOption) *FileMigrationRunner {
+	if orderingFunc == nil {
+		orderingFunc = pgdbtemplate.AlphabeticalMigrationFilesSorting
+	}
+	r := &FileMigrationRunner{paths: paths, orderingFunc: orderingFunc, variables: map[string]string{}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// RunMigrations executes all migration files on the connection.
+func (r *FileMigrationRunner) RunMigrations(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+	return r.expandMigrations(func(expanded *psqlScript) error {
+		return runPsqlScript(ctx, conn, expanded)
+	})
+}
+
+// Fingerprint implements Fingerprinter.
+func (r *FileMigrationRunner) Fingerprint() (string, error) {
+	var extra []string
+	names := make([]string, 0, len(r.variables))
+	for name := range r.variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		extra = append(extra, name+"="+r.variables[name])
+	}
+	err := r.expandMigrations(func(expanded *psqlScript) error {
+		for i := 0; i < len(expanded.included); i += 2 {
+			extra = append(extra, filepath.Base(expanded.included[i]), expanded.included[i+1])
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return FileMigrationFingerprint(r.paths, r.orderingFunc, extra...)
+}
+
+// expandMigrations calls fn with each migration file in order,
+// with its psql meta-commands expanded.
+func (r *FileMigrationRunner) expandMigrations(fn func(*psqlScript) error) error {
+	for _, path := range r.paths {
+		files, err := collectMigrationFiles(path, r.orderingFunc)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			content, err := os.ReadFile(file) // #nosec G304 -- Migration files are controlled by the application.
+			if err != nil {
+				return fmt.Errorf("failed to read migration file %q: %w", file, err)
+			}
+			expanded, err := expandPsqlScript(file, string(content), r.variables)
+			if err != nil {
+				return fmt.Errorf("failed to expand migration file: %w", err)
+			}
+			if err := fn(expanded); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectMigrationFiles returns the ordered SQL files of the directory.
+func collectMigrationFiles(path string, orderingFunc func([]string) []string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %q: %w", path, err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".sql") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) > 0 {
+		files = orderingFunc(files)
+	}
+	return files, nil
+}
+
+// runPsqlScript executes the statements of the expanded migration file.
+func runPsqlScript(ctx context.Context, conn pgdbtemplate.DatabaseConnection, expanded *psqlScript) error {
+	script := splitSQLScript(expanded.source.content)
+	script.annotations = expanded.annotations
+	return runMigrationScript(ctx, conn, expanded.source, script)
+}
+
+// runMigrationScript executes the statements of the script split from the source.
+func runMigrationScript(ctx context.Context, conn pgdbtemplate.DatabaseConnection, source *migrationSource, script *sqlScript) error {
+	if len(script.statements) == 0 {
+		return nil
+	}
+	transactional, err := runsInTransaction(ctx, conn, script)
+	if err != nil {
+		return fmt.Errorf("failed to inspect migration %s: %w", source.file, err)
+	}
+
+	pqConn, ok := conn.(*DatabaseConnection)
+	if !ok {
+		if transactional {
+			return execMigrationStatement(ctx, connectionExecer{conn}, source, 0, source.content)
+		}
+		return execMigrationStatements(ctx, connectionExecer{conn}, source, script.statements)
+	}
+
+	// Statements share the session, e.g. its search_path.
+	session, err := pqConn.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection for migration %s: %w", source.file, err)
+	}
+	defer session.Close()
+
+	if !transactional {
+		return execMigrationStatements(ctx, session, source, script.statements)
+	}
+	tx, err := session.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for migration %s: %w", source.file, err)
+	}
+	if err := execMigrationStatements(ctx, tx, source, script.statements); err != nil {
+		tx.Rollback() // #nosec G104 -- Rollback error in error path is not critical.
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %s: %w", source.file, err)
+	}
+	return nil
+}
+
+// runsInTransaction reports whether the migration script can run in a transaction.
+func runsInTransaction(ctx context.Context, conn pgdbtemplate.DatabaseConnection, script *sqlScript) (bool, error) {
+	for _, annotation := range script.annotations {
+		if annotation == noTransactionAnnotation {
+			return false, nil
+		}
+	}
+
+	versionNum := 0
+	for _, statement := range script.statements {
+		words := statement.words
+		switch {
+		case len(words) == 0:
+		case words[0] == "BEGIN", words[0] == "START", words[0] == "COMMIT",
+			words[0] == "END", words[0] == "ROLLBACK", words[0] == "ABORT":
+			// The file controls transactions itself.
+			return false, nil
+		case isAddEnumValue(words):
+			if versionNum == 0 {
+				err := conn.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum)
+				if err != nil {
+					return false, fmt.Errorf("failed to query server version: %w", err)
+				}
+			}
+			// Before PostgreSQL 12, ADD VALUE cannot run in a transaction block.
+			if versionNum < 120000 {
+				return false, nil
+			}
+		case cannotRunInTransaction(words):
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// cannotRunInTransaction reports whether the statement with the words
+// cannot run inside a transaction block.
+func cannotRunInTransaction(words []string) bool {
+	switch {
+	case hasWordPrefix(words, "VACUUM"),
+		hasWordPrefix(words, "ALTER", "SYSTEM"),
+		hasWordPrefix(words, "CREATE", "DATABASE"), hasWordPrefix(words, "DROP", "DATABASE"),
+		hasWordPrefix(words, "CREATE", "TABLESPACE"), hasWordPrefix(words, "DROP", "TABLESPACE"),
+		hasWordPrefix(words, "CREATE", "SUBSCRIPTION"), hasWordPrefix(words, "DROP", "SUBSCRIPTION"),
+		hasWordPrefix(words, "CREATE", "INDEX", "CONCURRENTLY"),
+		hasWordPrefix(words, "CREATE", "UNIQUE", "INDEX", "CONCURRENTLY"),
+		hasWordPrefix(words, "DROP", "INDEX", "CONCURRENTLY"),
+		hasWordPrefix(words, "REINDEX") && (hasWord(words, "CONCURRENTLY") || hasWord(words, "DATABASE") || hasWord(words, "SYSTEM")),
+		hasWordPrefix(words, "ALTER", "TABLE") && hasWord(words, "DETACH") && hasWord(words, "CONCURRENTLY"),
+		hasWordPrefix(words, "ALTER", "DATABASE") && hasWord(words, "TABLESPACE"):
+		return true
+	}
+	return false
+}
+
+// isAddEnumValue reports whether the statement with the words is ALTER TYPE ... ADD VALUE.
+func isAddEnumValue(words []string) bool {
+	if !hasWordPrefix(words, "ALTER", "TYPE") {
+		return false
+	}
+	for i := 2; i+1 < len(words); i++ {
+		if words[i] == "ADD" && words[i+1] == "VALUE" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWordPrefix reports whether the words start with the prefix.
+func hasWordPrefix(words []string, prefix ...string) bool {
+	if len(words) < len(prefix) {
+		return false
+	}
+	for i, word := range prefix {
+		if words[i] != word {
+			return false
+		}
+	}
+	return true
+}
+
+// hasWord reports whether the words contain the word.
+func hasWord(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// statementExecer executes statements, e.g. *sql.Conn and *sql.Tx.
+type statementExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// connectionExecer adapts pgdbtemplate.DatabaseConnection to statementExecer.
+type connectionExecer struct {
+	conn pgdbtemplate.DatabaseConnection
+}
+
+// ExecContext implements statementExecer.
+func (e connectionExecer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	_, err := e.conn.ExecContext(ctx, query, args...)
+	return nil, err
+}
+
+// execMigrationStatements executes the statements of the source in order.
+func execMigrationStatements(ctx context.Context, execer statementExecer, source *migrationSource, statements []sqlStatement) error {
+	for _, statement := range statements {
+		var err error
+		switch {
+		case statement.metaCommand:
+			err = fmt.Errorf("%s: unsupported psql meta-command %s", source.position(statement.offset), statement.text)
+		case statement.copiesFromStdin():
+			err = copyFromStdin(ctx, execer, source, statement)
+		default:
+			err = execMigrationStatement(ctx, execer, source, statement.offset, statement.text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDataLinePattern matches the data line number in the context of COPY errors.
+var copyDataLinePattern = regexp.MustCompile(`^COPY [^,]+, line (\d+)`)
+
+// copyFromStdin executes COPY ... FROM stdin with the data following the statement.
+func copyFromStdin(ctx context.Context, execer statementExecer, source *migrationSource, statement sqlStatement) error {
+	tx, ok := execer.(*sql.Tx)
+	if !ok {
+		return fmt.Errorf("%s: COPY ... FROM stdin requires a transaction on a *DatabaseConnection",
+			source.position(statement.offset))
+	}
+
+	// Prepared COPY statements use the copy protocol of lib/pq, like pq.CopyIn.
+	stmt, err := tx.PrepareContext(ctx, strings.TrimSuffix(statement.text, ";"))
+	if err != nil {
+		return migrationStatementError(source, statement.offset, statement.text, err)
+	}
+	defer stmt.Close()
+
+	data := strings.TrimSuffix(statement.copyData, "\n")
+	if data != "" {
+		for _, row := range strings.Split(data, "\n") {
+			if _, err = stmt.ExecContext(ctx, decodeCopyRow(strings.TrimSuffix(row, "\r"))...); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		_, err = stmt.ExecContext(ctx) // Flushes the data.
+	}
+	if err == nil {
+		return nil
+	}
+
+	migrationErr := migrationStatementError(source, statement.offset, statement.text, err)
+	// Errors in the data are located by their line.
+	var located *MigrationError
+	if errors.As(migrationErr, &located) {
+		if match := copyDataLinePattern.FindStringSubmatch(located.Err.Where); match != nil {
+			dataLine, _ := strconv.Atoi(match[1])
+			file, content, offset := source.locate(statement.copyOffset)
+			located.File = file
+			located.Line = lineNumber(content, offset) + dataLine - 1
+		}
+	}
+	return migrationErr
+}
+
+// decodeCopyRow decodes a row of the text format of COPY,
+// in which fields are separated by tabs and \N is NULL.
+func decodeCopyRow(row string) []any {
+	fields := strings.Split(row, "\t")
+	values := make([]any, len(fields))
+	for i, field := range fields {
+		if field != `\N` {
+			values[i] = unescapeCopyText(field)
+		}
+	}
+	return values
+}
+
+// unescapeCopyText decodes the backslash escapes of a COPY text field.
+func unescapeCopyText(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' || i+1 == len(field) {
+			b.WriteByte(field[i])
+			continue
+		}
+		i++
+		switch c := field[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			// Up to two hexadecimal digits, otherwise a literal x.
+			end := i + 1
+			for end < len(field) && end < i+3 && isHexDigit(field[end]) {
+				end++
+			}
+			if end == i+1 {
+				b.WriteByte(c)
+				break
+			}
+			value, _ := strconv.ParseUint(field[i+1:end], 16, 8)
+			b.WriteByte(byte(value)) // #nosec G115 -- Two hexadecimal digits fit a byte.
+			i = end - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// Up to three octal digits.
+			end := i + 1
+			for end < len(field) && end < i+3 && field[end] >= '0' && field[end] <= '7' {
+				end++
+			}
+			value, _ := strconv.ParseUint(field[i:end], 8, 16)
+			b.WriteByte(byte(value)) // #nosec G115 -- Like the server, only the low byte is kept.
+			i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// isHexDigit reports whether the byte is a hexadecimal digit.
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// lineNumber returns the line of the byte offset in the content, starting at 1.
+func lineNumber(content string, offset int) int {
+	return strings.Count(content[:offset], "\n") + 1
+}
+
+// migrationSource is the content of a migration file, which psql
+// meta-commands may have expanded from several files.
+type migrationSource struct {
+	file    string
+	content string
+	// segments map ranges of the content to the files they were expanded from,
+	// ordered by their start. If empty, the content is the file itself.
+	segments []sourceSegment
+}
+
+// sourceSegment maps the content from start onwards to the file content at offset.
+type sourceSegment struct {
+	start   int
+	file    string
+	content string
+	offset  int
+	// length is the length of the range copied from the file, beyond
+	// which offsets map to its end, e.g. for interpolated variables.
+	length int
+}
+
+// locate returns the file, its content and the offset in it
+// the byte offset of the source content was expanded from.
+func (s *migrationSource) locate(offset int) (file, content string, fileOffset int) {
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].start > offset }) - 1
+	if i < 0 {
+		return s.file, s.content, offset
+	}
+	segment := s.segments[i]
+	delta := offset - segment.start
+	if delta > segment.length {
+		delta = segment.length
+	}
+	return segment.file, segment.content, segment.offset + delta
+}
+
+// position returns the "file:line" position of the byte offset of the source content.
+func (s *migrationSource) position(offset int) string {
+	file, content, offset := s.locate(offset)
+	return fmt.Sprintf("%s:%d", file, lineNumber(content, offset))
+}
+
+// execMigrationStatement executes the statement starting at
+// the byte offset of the source content.
+func execMigrationStatement(ctx context.Context, execer statementExecer, source *migrationSource, offset int, statement string) error {
+	_, err := execer.ExecContext(ctx, statement)
+	if err == nil {
+		return nil
+	}
+	return migrationStatementError(source, offset, statement, err)
+}
+
+// migrationStatementError returns *MigrationError for errors of the server,
+// and wraps other errors of the statement.
+func migrationStatementError(source *migrationSource, offset int, statement string, err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		file, _, _ := source.locate(offset)
+		return fmt.Errorf("failed to execute migration %s: %w", file, err)
+	}
+	return newMigrationError(source, offset, statement, pqErr)
+}
+
+// MigrationError describes a migration statement rejected by the server.
+type MigrationError struct {
+	// File is the path of the migration file.
+	File string
+	// Line and Column locate the error in the file, starting at 1.
+	// They are zero when the server does not report the position;
+	// errors in COPY data only have a line.
+	Line, Column int
+	// Excerpt is the failing line and the one preceding it,
+	// followed by a caret pointing at the column.
+	Excerpt string
+	// Err is the error returned by the server.
+	Err *pq.Error
+}
+
+// newMigrationError locates the error in the migration file.
+func newMigrationError(source *migrationSource, offset int, statement string, pqErr *pq.Error) *MigrationError {
+	// The position counts characters of the statement, starting at 1.
+	position, err := strconv.Atoi(pqErr.Position)
+	if err != nil || position < 1 {
+		file, _, _ := source.locate(offset)
+		return &MigrationError{File: file, Err: pqErr}
+	}
+	errorOffset := offset + len(statement)
+	for i := range statement {
+		if position--; position == 0 {
+			errorOffset = offset + i
+			break
+		}
+	}
+	file, content, errorOffset := source.locate(errorOffset)
+	migrationErr := &MigrationError{File: file, Err: pqErr}
+
+	lineStart := strings.LastIndexByte(content[:errorOffset], '\n') + 1
+	lineEnd := strings.IndexByte(content[errorOffset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(content)
+	} else {
+		lineEnd += errorOffset
+	}
+	migrationErr.Line = lineNumber(content, lineStart)
+	prefix := content[lineStart:errorOffset]
+	migrationErr.Column = len([]rune(prefix)) + 1
+
+	var excerpt strings.Builder
+	width := len(strconv.Itoa(migrationErr.Line))
+	if lineStart > 0 {
+		previousStart := strings.LastIndexByte(content[:lineStart-1], '\n') + 1
+		fmt.Fprintf(&excerpt, "%*d | %s\n", width, migrationErr.Line-1, strings.TrimRight(content[previousStart:lineStart-1], "\r"))
+	}
+	fmt.Fprintf(&excerpt, "%*d | %s\n", width, migrationErr.Line, strings.TrimRight(content[lineStart:lineEnd], "\r"))
+	// Tabs are kept, so that the caret lines up with the failing line.
+	padding := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, prefix)
+	fmt.Fprintf(&excerpt, "%*s | %s^", width, "", padding)
+	migrationErr.Excerpt = excerpt.String()
+	return migrationErr
+}
+
+// Error implements the error interface.
+func (e *MigrationError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	if e.Column > 0 {
+		fmt.Fprintf(&b, ":%d", e.Column)
+	}
+	fmt.Fprintf(&b, ": %s: %s (SQLSTATE %s)", e.Err.Severity, e.Err.Message, e.Err.Code)
+	if e.Excerpt != "" {
+		b.WriteString("\n")
+		b.WriteString(e.Excerpt)
+	}
+	if e.Err.Detail != "" {
+		b.WriteString("\nDETAIL: " + e.Err.Detail)
+	}
+	if e.Err.Hint != "" {
+		b.WriteString("\nHINT: " + e.Err.Hint)
+	}
+	if e.Err.Where != "" {
+		b.WriteString("\nCONTEXT: " + e.Err.Where)
+	}
+	return b.String()
+}
+
+// Unwrap returns the error returned by the server.
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
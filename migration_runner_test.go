@@ -0,0 +1,358 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/lib/pq"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// failingConnection fails all statements with the error.
+type failingConnection struct {
+	pgdbtemplate.DatabaseConnection
+	err error
+}
+
+// ExecContext implements pgdbtemplate.DatabaseConnection.ExecContext.
+func (c failingConnection) ExecContext(context.Context, string, ...any) (any, error) {
+	return nil, c.err
+}
+
+// recordingConnection records the executed statements.
+type recordingConnection struct {
+	pgdbtemplate.DatabaseConnection
+	statements []string
+}
+
+// ExecContext implements pgdbtemplate.DatabaseConnection.ExecContext.
+func (c *recordingConnection) ExecContext(_ context.Context, query string, _ ...any) (any, error) {
+	c.statements = append(c.statements, query)
+	return nil, nil
+}
+
+// TestFileMigrationRunner tests running migration files with located errors.
+func TestFileMigrationRunner(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// writeMigration writes the migration file to a new directory.
+	writeMigration := func(c *qt.C, name, content string) (dir, path string) {
+		dir = c.TempDir()
+		path = filepath.Join(dir, name)
+		c.Assert(os.WriteFile(path, []byte(content), 0o600), qt.IsNil)
+		return dir, path
+	}
+
+	// runMigration runs the migration file on a new database.
+	runMigration := func(c *qt.C, content string) (string, error) {
+		dir, path := writeMigration(c, "001_init.sql", content)
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "migration_runner"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		return path, pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).RunMigrations(ctx, conn)
+	}
+
+	c.Run("Fingerprint covers migration files", func(c *qt.C) {
+		dir, _ := writeMigration(c, "001_init.sql", "CREATE TABLE users (id INT);")
+		fingerprint, err := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).Fingerprint()
+		c.Assert(err, qt.IsNil)
+		expected, err := pgdbtemplatepq.FileMigrationFingerprint([]string{dir}, nil)
+		c.Assert(err, qt.IsNil)
+		c.Assert(fingerprint, qt.Equals, expected)
+	})
+
+	c.Run("Migrations are applied", func(c *qt.C) {
+		c.Parallel()
+		_, err := runMigration(c, "CREATE TABLE users (id INT);\nINSERT INTO users VALUES (1);\n")
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Syntax error is located", func(c *qt.C) {
+		c.Parallel()
+		path, err := runMigration(c, "CREATE TABLE users (id INT);\n"+
+			"-- Ünïcödé comment.\n"+
+			"CREATE TABLE posts (\n"+
+			"\tid INT PRIMAR KEY\n"+
+			");\n")
+
+		var migrationErr *pgdbtemplatepq.MigrationError
+		c.Assert(errors.As(err, &migrationErr), qt.IsTrue, qt.Commentf("error: %v", err))
+		c.Assert(migrationErr.File, qt.Equals, path)
+		c.Assert(migrationErr.Line, qt.Equals, 4)
+		c.Assert(migrationErr.Column, qt.Equals, 9)
+		c.Assert(err.Error(), qt.Equals, path+`:4:9: ERROR: syntax error at or near "PRIMAR" (SQLSTATE 42601)`+"\n"+
+			"3 | CREATE TABLE posts (\n"+
+			"4 | \tid INT PRIMAR KEY\n"+
+			"  | \t       ^")
+
+		var pqErr *pq.Error
+		c.Assert(errors.As(err, &pqErr), qt.IsTrue)
+		c.Assert(string(pqErr.Code), qt.Equals, "42601")
+	})
+
+	c.Run("Hint and context are reported", func(c *qt.C) {
+		c.Parallel()
+		path, err := runMigration(c, "DO $$\nBEGIN\n\tRAISE EXCEPTION 'boom' USING DETAIL = 'Details.', HINT = 'Try again.';\nEND\n$$;")
+		c.Assert(err, qt.ErrorMatches, regexp.QuoteMeta(path)+`: ERROR: boom \(SQLSTATE P0001\)\n`+
+			`DETAIL: Details\.\n`+
+			`HINT: Try again\.\n`+
+			`CONTEXT: PL/pgSQL function inline_code_block line 3 at RAISE`)
+	})
+
+	c.Run("Position counts characters", func(c *qt.C) {
+		dir, path := writeMigration(c, "001_init.sql", "SELECT 'ü';\r\nSELECT 'é', nope;\r\n")
+		conn := failingConnection{err: &pq.Error{
+			Severity: "ERROR",
+			Code:     "42703",
+			Message:  `column "nope" does not exist`,
+			Position: "26",
+		}}
+		err := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).RunMigrations(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, regexp.QuoteMeta(path+`:2:13: ERROR: column "nope" does not exist (SQLSTATE 42703)`+"\n"+
+			"1 | SELECT 'ü';\n"+
+			"2 | SELECT 'é', nope;\n"+
+			"  |             ^"))
+	})
+
+	c.Run("Other errors are wrapped", func(c *qt.C) {
+		dir, path := writeMigration(c, "001_init.sql", "SELECT 1;")
+		connErr := errors.New("connection refused")
+		err := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).RunMigrations(ctx, failingConnection{err: connErr})
+		c.Assert(err, qt.ErrorIs, connErr)
+		c.Assert(err, qt.ErrorMatches, "failed to execute migration "+regexp.QuoteMeta(path)+": connection refused")
+	})
+
+	c.Run("Missing directory", func(c *qt.C) {
+		err := pgdbtemplatepq.NewFileMigrationRunner([]string{"/nonexistent"}, nil).RunMigrations(ctx, nil)
+		c.Assert(err, qt.ErrorMatches, `failed to read directory "/nonexistent": .*`)
+	})
+
+	// recordStatements runs the migration file on a recording connection.
+	recordStatements := func(c *qt.C, content string) []string {
+		dir, _ := writeMigration(c, "001_init.sql", content)
+		conn := &recordingConnection{}
+		err := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).RunMigrations(ctx, conn)
+		c.Assert(err, qt.IsNil)
+		return conn.statements
+	}
+
+	c.Run("Statements are split", func(c *qt.C) {
+		statements := recordStatements(c, `-- +notx
+-- Comments; with semicolons.
+CREATE TABLE "odd;name" (id INT DEFAULT 1); /* Block /* nested; */ comment; */
+INSERT INTO "odd;name" VALUES (E'it\'s;', 'quoted '';');
+CREATE FUNCTION f() RETURNS INT LANGUAGE plpgsql AS $body$
+BEGIN
+	RETURN $$;$$::text::int;
+END
+$body$;
+CREATE FUNCTION g(a INT) RETURNS INT LANGUAGE sql
+BEGIN ATOMIC
+	SELECT CASE WHEN a > 0 THEN a ELSE 0 END;
+	SELECT a;
+END;
+SELECT $1, a$b$ FROM t
+`)
+		c.Assert(statements, qt.DeepEquals, []string{
+			`CREATE TABLE "odd;name" (id INT DEFAULT 1);`,
+			`INSERT INTO "odd;name" VALUES (E'it\'s;', 'quoted '';');`,
+			"CREATE FUNCTION f() RETURNS INT LANGUAGE plpgsql AS $body$\nBEGIN\n\tRETURN $$;$$::text::int;\nEND\n$body$;",
+			"CREATE FUNCTION g(a INT) RETURNS INT LANGUAGE sql\nBEGIN ATOMIC\n\tSELECT CASE WHEN a > 0 THEN a ELSE 0 END;\n\tSELECT a;\nEND;",
+			"SELECT $1, a$b$ FROM t",
+		})
+	})
+
+	c.Run("Transactional files are executed as a whole", func(c *qt.C) {
+		content := "CREATE TABLE users (id INT);\nCREATE INDEX users_id_idx ON users (id);\n"
+		c.Assert(recordStatements(c, content), qt.DeepEquals, []string{content})
+	})
+
+	c.Run("Statements requiring no transaction are detected", func(c *qt.C) {
+		for _, statement := range []string{
+			"CREATE INDEX CONCURRENTLY users_id_idx ON users (id);",
+			"create unique index concurrently users_id_idx on users (id);",
+			"DROP INDEX CONCURRENTLY users_id_idx;",
+			"REINDEX TABLE CONCURRENTLY users;",
+			"VACUUM (ANALYZE) users;",
+			"ALTER SYSTEM SET work_mem = '64MB';",
+			"ALTER TABLE events DETACH PARTITION events_2020 CONCURRENTLY;",
+			"BEGIN;",
+			"COMMIT;",
+		} {
+			statements := recordStatements(c, "SELECT 1;\n"+statement)
+			c.Assert(statements, qt.DeepEquals, []string{"SELECT 1;", statement})
+		}
+	})
+
+	c.Run("Transaction is rolled back on failure", func(c *qt.C) {
+		c.Parallel()
+		dir, _ := writeMigration(c, "001_init.sql", "SET search_path TO app;\nCREATE SCHEMA app;\nCREATE TABLE users (id INT);\nSELECT nope;\n")
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "migration_runner_tx"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		err = pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).RunMigrations(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, `.*001_init\.sql:4:8: ERROR: column "nope" does not exist(?s).*`)
+
+		var exists bool
+		err = conn.QueryRowContext(ctx, "SELECT to_regnamespace('app') IS NOT NULL").Scan(&exists)
+		c.Assert(err, qt.IsNil)
+		c.Assert(exists, qt.IsFalse)
+	})
+
+	c.Run("Statements run outside a transaction", func(c *qt.C) {
+		c.Parallel()
+		dir, _ := writeMigration(c, "001_init.sql", ""+
+			"CREATE TABLE users (id INT);\n"+
+			"CREATE INDEX CONCURRENTLY users_id_idx ON users (id);\n")
+		writeFile := func(name, content string) {
+			c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600), qt.IsNil)
+		}
+		writeFile("002_own_transaction.sql", "BEGIN;\nCREATE TABLE posts (id INT);\nCOMMIT;\n")
+		writeFile("003_annotated.sql", "-- +notx\nCREATE TABLE comments (id INT);\nSELECT nope;\n")
+
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "migration_runner_notx"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		err = pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).RunMigrations(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, `.*003_annotated\.sql:3:8: ERROR: column "nope" does not exist(?s).*`)
+
+		// Statements preceding the failed one remain applied.
+		var tables int
+		err = conn.QueryRowContext(ctx, `
+			SELECT count(*) FROM pg_class
+			WHERE relname IN ('users', 'users_id_idx', 'posts', 'comments')
+		`).Scan(&tables)
+		c.Assert(err, qt.IsNil)
+		c.Assert(tables, qt.Equals, 4)
+	})
+
+	// writePsqlMigrations writes a migration using psql meta-commands
+	// and the file it includes.
+	writePsqlMigrations := func(c *qt.C) (dir, path, included string) {
+		dir, path = writeMigration(c, "001_init.sql", `\set table users
+\ir include/table.sql
+\if :seed
+INSERT INTO :"table" VALUES (:'name');
+\elif :{?other}
+SELECT 'other';
+\else
+SELECT 'unseeded';
+\endif
+SELECT :'undefined', 1::int, :count; -- :count
+`)
+		included = filepath.Join(dir, "include", "table.sql")
+		c.Assert(os.Mkdir(filepath.Dir(included), 0o700), qt.IsNil)
+		c.Assert(os.WriteFile(included, []byte("CREATE TABLE :\"table\" (name TEXT DEFAULT ':name');\n"), 0o600), qt.IsNil)
+		return dir, path, included
+	}
+
+	c.Run("psql meta-commands are expanded", func(c *qt.C) {
+		dir, _, _ := writePsqlMigrations(c)
+		conn := &recordingConnection{}
+		runner := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil, pgdbtemplatepq.WithMigrationVariables(map[string]string{
+			"seed":  "on",
+			"name":  `O'Brien\`,
+			"count": "3",
+		}))
+		c.Assert(runner.RunMigrations(ctx, conn), qt.IsNil)
+		c.Assert(conn.statements, qt.DeepEquals, []string{"\n" +
+			`CREATE TABLE "users" (name TEXT DEFAULT ':name');` + "\n\n\n" +
+			`INSERT INTO "users" VALUES (E'O''Brien\\');` + "\n\n" +
+			`SELECT :'undefined', 1::int, 3; -- :count` + "\n",
+		})
+
+		conn = &recordingConnection{}
+		runner = pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil, pgdbtemplatepq.WithMigrationVariables(map[string]string{
+			"seed":  "off",
+			"other": "",
+		}))
+		c.Assert(runner.RunMigrations(ctx, conn), qt.IsNil)
+		c.Assert(conn.statements, qt.HasLen, 1)
+		c.Assert(conn.statements[0], qt.Contains, "SELECT 'other';")
+		c.Assert(conn.statements[0], qt.Not(qt.Contains), "unseeded")
+	})
+
+	c.Run("Errors in included files are located", func(c *qt.C) {
+		dir, _, included := writePsqlMigrations(c)
+		conn := failingConnection{err: &pq.Error{
+			Severity: "ERROR",
+			Code:     "42P07",
+			Message:  `relation "users" already exists`,
+			Position: "15",
+		}}
+		runner := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil, pgdbtemplatepq.WithMigrationVariables(map[string]string{
+			"seed": "true",
+		}))
+		err := runner.RunMigrations(ctx, conn)
+		c.Assert(err, qt.ErrorMatches, regexp.QuoteMeta(included+`:1:14: ERROR: relation "users" already exists (SQLSTATE 42P07)`)+`(?s).*`)
+	})
+
+	c.Run("Invalid psql meta-commands", func(c *qt.C) {
+		for content, message := range map[string]string{
+			"SELECT 1;\n\\gexec\n":         `001_init\.sql:2: unsupported psql meta-command \\gexec`,
+			"\\if true\nSELECT 1;\n":       `.*001_init\.sql: \\if without \\endif`,
+			"\\endif\n":                    `001_init\.sql:1: \\endif without \\if`,
+			"\\if maybe\n\\endif\n":        `001_init\.sql:1: invalid boolean value "maybe"`,
+			"\\ir missing.sql\n":           `001_init\.sql:1: failed to read included file: .*`,
+			"\\ir 001_init.sql\n":          `001_init\.sql:1: .*include cycle: .*`,
+			"\\set 'bad name' 1\n":         `001_init\.sql:1: invalid variable name "bad name"`,
+			"\\else\n\\if true\n\\endif\n": `001_init\.sql:1: \\else without \\if`,
+		} {
+			dir, _ := writeMigration(c, "001_init.sql", content)
+			err := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil).RunMigrations(ctx, &recordingConnection{})
+			c.Assert(err, qt.ErrorMatches, `failed to expand migration file: .*`+message, qt.Commentf("content: %q", content))
+		}
+	})
+
+	c.Run("Fingerprint covers variables and included files", func(c *qt.C) {
+		dir, _, included := writePsqlMigrations(c)
+		fingerprint := func(variables map[string]string) string {
+			fingerprint, err := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil,
+				pgdbtemplatepq.WithMigrationVariables(variables)).Fingerprint()
+			c.Assert(err, qt.IsNil)
+			return fingerprint
+		}
+		seeded := fingerprint(map[string]string{"seed": "on"})
+		c.Assert(fingerprint(map[string]string{"seed": "on"}), qt.Equals, seeded)
+		c.Assert(fingerprint(map[string]string{"seed": "off"}), qt.Not(qt.Equals), seeded)
+
+		c.Assert(os.WriteFile(included, []byte("CREATE TABLE :\"table\" (id INT);\n"), 0o600), qt.IsNil)
+		c.Assert(fingerprint(map[string]string{"seed": "on"}), qt.Not(qt.Equals), seeded)
+	})
+
+	c.Run("psql meta-commands are applied", func(c *qt.C) {
+		c.Parallel()
+		dir, _, _ := writePsqlMigrations(c)
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, "migration_runner_psql"))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		runner := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil, pgdbtemplatepq.WithMigrationVariables(map[string]string{
+			"seed":      "yes",
+			"name":      "O'Brien",
+			"count":     "3",
+			"undefined": "defined",
+		}))
+		c.Assert(runner.RunMigrations(ctx, conn), qt.IsNil)
+
+		var name string
+		c.Assert(conn.QueryRowContext(ctx, "SELECT name FROM users").Scan(&name), qt.IsNil)
+		c.Assert(name, qt.Equals, "O'Brien")
+	})
+}
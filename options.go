@@ -5,9 +5,29 @@ import (
 	"time"
 )
 
+// Option configures a ConnectionProvider, see NewConnectionProviderWithOptions.
+//
+// Both DatabaseConnectionOption and ProviderOption implement Option.
+type Option interface {
+	apply(p *ConnectionProvider)
+}
+
 // DatabaseConnectionOption configures DatabaseConnection.
 type DatabaseConnectionOption func(*sql.DB)
 
+// apply implements Option.apply.
+func (o DatabaseConnectionOption) apply(p *ConnectionProvider) {
+	p.options = append(p.options, o)
+}
+
+// ProviderOption configures ConnectionProvider itself.
+type ProviderOption func(*ConnectionProvider)
+
+// apply implements Option.apply.
+func (o ProviderOption) apply(p *ConnectionProvider) {
+	o(p)
+}
+
 // WithMaxOpenConns sets the maximum number of open connections.
 func WithMaxOpenConns(n int) DatabaseConnectionOption {
 	return func(db *sql.DB) {
@@ -36,3 +56,13 @@ func WithConnMaxIdleTime(d time.Duration) DatabaseConnectionOption {
 		db.SetConnMaxIdleTime(d)
 	}
 }
+
+// WithAdminDatabase sets the administrative database the provider connects to
+// for creating, dropping and inspecting databases.
+//
+// If not set, "postgres" is used.
+func WithAdminDatabase(name string) ProviderOption {
+	return func(p *ConnectionProvider) {
+		p.adminDBName = name
+	}
+}
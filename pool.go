@@ -0,0 +1,482 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Default PoolConfig values.
+const (
+	defaultPoolNamePrefix    = "pooldb_"
+	defaultPoolLowWatermark  = 2
+	defaultPoolHighWatermark = 4
+)
+
+var (
+	// errPoolClosed is returned by the methods of closed pools.
+	errPoolClosed = errors.New("pool is closed")
+	// errPoolFull reports that a recycled database is not needed by the pool.
+	errPoolFull = errors.New("pool is full")
+)
+
+// PoolConfig configures ConnectionProvider.NewPool.
+type PoolConfig struct {
+	// TemplateName is the name of the template database to clone.
+	//
+	// This field is required.
+	TemplateName string
+	// NamePrefix is the prefix of the pooled database names.
+	//
+	// If empty, "pooldb_" will be used.
+	NamePrefix string
+	// LowWatermark is the number of ready databases below which
+	// the pool is refilled.
+	//
+	// If zero, 2 will be used.
+	LowWatermark int
+	// HighWatermark is the number of ready databases the pool is refilled to.
+	//
+	// If zero, the larger of 4 and LowWatermark will be used.
+	HighWatermark int
+	// MaxConnections is the connection budget of the pool.
+	//
+	// Each ready database holds one connection and each clone
+	// in progress two: one to the admin database and one to the clone.
+	// If zero, HighWatermark + 2 will be used, allowing at least one clone.
+	MaxConnections int
+	// Recycle resets released databases in place and returns them to the pool
+	// instead of dropping them.
+	//
+	// All user tables are truncated with RESTART IDENTITY CASCADE, the rows
+	// of the tables seeded in the template are restored, and sequences are
+	// reset. The seeded rows are restored from unlogged copies, made in each
+	// clone in the pgdbtemplate_baseline schema and copied back on every
+	// release, so recycling pays off while the seeded rows are small compared
+	// to the whole template. Databases whose schema no longer matches the
+	// template, e.g. after DDL in a test, are dropped instead.
+	// Materialized views, large objects and privileges are not reset.
+	Recycle bool
+}
+
+// Pool keeps cloned and connected databases ready for tests.
+//
+// Databases are cloned in the background, concurrently as far as
+// the connection budget allows. Claimed databases are used by the caller
+// until they are dropped with PooledDatabase.Release, or taken out of
+// the pool with PooledDatabase.Detach. Close drops the remaining ones.
+type Pool struct {
+	provider *ConnectionProvider
+	config   PoolConfig
+	// namePrefix makes database names unique across processes and pools.
+	namePrefix string
+
+	mu       sync.Mutex
+	ready    []*PooledDatabase
+	creating int
+	// claimed are the databases claimed and not yet released or detached.
+	claimed map[*PooledDatabase]struct{}
+	// recycling is the number of released databases being reset.
+	recycling int
+	// waiting is the number of Get calls waiting for a database.
+	waiting int
+	seq     int
+	closed  bool
+	// fillErr is the last clone error, reported to waiting callers.
+	fillErr error
+	// changed is closed and replaced whenever the pool state changes.
+	changed chan struct{}
+	// recycled and discarded count the released databases
+	// which were and which could not be recycled.
+	recycled  int
+	discarded int
+
+	// baselineMu guards baseline, captured from the first clone.
+	baselineMu sync.Mutex
+	baseline   *recycleBaseline
+
+	wg sync.WaitGroup
+}
+
+// PooledDatabase is a database claimed from a Pool.
+type PooledDatabase struct {
+	// Name is the name of the database.
+	Name string
+	// Conn is the connection to the database.
+	Conn *DatabaseConnection
+
+	pool *Pool
+}
+
+// PoolStats describes the state of a Pool.
+type PoolStats struct {
+	// Ready is the number of databases ready to be claimed.
+	Ready int
+	// Creating is the number of databases being cloned.
+	Creating int
+	// Recycled is the number of released databases reset and returned to the pool.
+	Recycled int
+	// Discarded is the number of released databases dropped
+	// because they could not be recycled.
+	Discarded int
+}
+
+// NewPool returns a pool of databases cloned from the template
+// and starts filling it in the background.
+//
+// The pool databases are stamped like any other databases created
+// through the provider, so those left behind by crashed processes
+// are found by Reap with the pool name prefix.
+func (p *ConnectionProvider) NewPool(config PoolConfig) (*Pool, error) {
+	if config.TemplateName == "" {
+		return nil, errors.New("TemplateName is required")
+	}
+	if config.NamePrefix == "" {
+		config.NamePrefix = defaultPoolNamePrefix
+	}
+	if config.LowWatermark == 0 {
+		config.LowWatermark = defaultPoolLowWatermark
+	}
+	if config.HighWatermark == 0 {
+		config.HighWatermark = defaultPoolHighWatermark
+		if config.LowWatermark > config.HighWatermark {
+			config.HighWatermark = config.LowWatermark
+		}
+	}
+	if config.MaxConnections == 0 {
+		config.MaxConnections = config.HighWatermark + 2
+	}
+	if config.LowWatermark < 1 || config.HighWatermark < config.LowWatermark {
+		return nil, fmt.Errorf("invalid watermarks %d and %d: 1 <= low <= high is required",
+			config.LowWatermark, config.HighWatermark)
+	}
+	if config.MaxConnections < 2 {
+		return nil, fmt.Errorf("connection budget %d is less than the 2 connections of a clone", config.MaxConnections)
+	}
+
+	pool := &Pool{
+		provider:   p,
+		config:     config,
+		namePrefix: fmt.Sprintf("%s%d_%d_", config.NamePrefix, os.Getpid(), time.Now().UnixNano()%1e9),
+		claimed:    make(map[*PooledDatabase]struct{}),
+		changed:    make(chan struct{}),
+	}
+	if len(pool.namePrefix)+10 > maxIdentifierLength {
+		return nil, fmt.Errorf("pool name prefix %q is too long", config.NamePrefix)
+	}
+
+	pool.mu.Lock()
+	pool.fill()
+	pool.mu.Unlock()
+	return pool, nil
+}
+
+// Get claims a ready database, waiting for one to be cloned if none is ready.
+func (pool *Pool) Get(ctx context.Context) (*PooledDatabase, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for {
+		if pool.closed {
+			return nil, errPoolClosed
+		}
+		if n := len(pool.ready); n > 0 {
+			db := pool.ready[n-1]
+			pool.ready = pool.ready[:n-1]
+			pool.claimed[db] = struct{}{}
+			pool.fill()
+			return db, nil
+		}
+		if pool.creating == 0 && pool.fillErr != nil {
+			// Report the error once, so that the next call retries.
+			err := pool.fillErr
+			pool.fillErr = nil
+			return nil, err
+		}
+		pool.waiting++
+		pool.fill()
+
+		changed := pool.changed
+		pool.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			pool.mu.Lock()
+			pool.waiting--
+			return nil, ctx.Err()
+		case <-changed:
+		}
+		pool.mu.Lock()
+		pool.waiting--
+	}
+}
+
+// Stats returns the current state of the pool.
+func (pool *Pool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return PoolStats{
+		Ready:     len(pool.ready),
+		Creating:  pool.creating,
+		Recycled:  pool.recycled,
+		Discarded: pool.discarded,
+	}
+}
+
+// Close stops refilling, waits for the clones in progress
+// and drops all ready databases and the claimed ones
+// which were neither released nor detached.
+//
+// Claimed databases must not be used afterwards;
+// releasing them is a no-op.
+func (pool *Pool) Close(ctx context.Context) error {
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		return nil
+	}
+	pool.closed = true
+	pool.broadcast()
+	pool.mu.Unlock()
+
+	pool.wg.Wait()
+
+	pool.mu.Lock()
+	databases := pool.ready
+	for db := range pool.claimed {
+		databases = append(databases, db)
+	}
+	pool.ready = nil
+	pool.claimed = make(map[*PooledDatabase]struct{})
+	pool.mu.Unlock()
+
+	var errs error
+	for _, db := range databases {
+		errs = errors.Join(errs, db.drop(ctx))
+	}
+	return errs
+}
+
+// fill starts clones until the pool reaches the high watermark,
+// if it is below the low watermark, and one clone for each waiting caller,
+// as far as the connection budget allows.
+//
+// It must be called with pool.mu held.
+func (pool *Pool) fill() {
+	if pool.closed {
+		return
+	}
+	supply := len(pool.ready) + pool.creating
+	if pool.config.Recycle {
+		// Claimed databases are expected to be returned.
+		supply += len(pool.claimed) + pool.recycling
+	}
+	clones := 0
+	if supply < pool.config.LowWatermark {
+		clones = pool.config.HighWatermark - supply
+	}
+	if demand := pool.waiting - pool.creating; demand > clones {
+		clones = demand
+	}
+	for ; clones > 0 && len(pool.ready)+2*(pool.creating+1) <= pool.config.MaxConnections; clones-- {
+		pool.seq++
+		name := fmt.Sprintf("%s%d", pool.namePrefix, pool.seq)
+		pool.creating++
+		pool.wg.Add(1)
+		go pool.create(name)
+	}
+}
+
+// create clones and connects a database and adds it to the ready ones.
+func (pool *Pool) create(name string) {
+	defer pool.wg.Done()
+
+	// Clones are not tied to any caller, so they are not cancelled.
+	ctx := context.Background()
+	db, err := pool.clone(ctx, name)
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.creating--
+	if err != nil {
+		pool.fillErr = err
+	} else {
+		pool.ready = append(pool.ready, db)
+	}
+	pool.broadcast()
+}
+
+// clone clones and connects the database.
+func (pool *Pool) clone(ctx context.Context, name string) (*PooledDatabase, error) {
+	if err := pool.provider.CloneDatabase(ctx, name, pool.config.TemplateName); err != nil {
+		return nil, err
+	}
+
+	// Connecting pings the database, so that it is ready for use.
+	conn, err := pool.provider.connect(ctx, name)
+	if err != nil {
+		_, dropErr := pool.provider.DropDatabase(ctx, name)
+		return nil, errors.Join(fmt.Errorf("failed to connect to pooled database %q: %w", name, err), dropErr)
+	}
+	db := &PooledDatabase{Name: name, Conn: conn, pool: pool}
+
+	if pool.config.Recycle {
+		if err := pool.storeBaseline(ctx, conn); err != nil {
+			return nil, errors.Join(err, db.drop(ctx))
+		}
+	}
+	return db, nil
+}
+
+// storeBaseline captures the recycling baseline from a fresh clone,
+// unless it has been captured already, and stores the copies
+// of the seeded tables in the clone.
+func (pool *Pool) storeBaseline(ctx context.Context, conn *DatabaseConnection) error {
+	pool.baselineMu.Lock()
+	baseline := pool.baseline
+	if baseline == nil {
+		var err error
+		if baseline, err = captureBaseline(ctx, conn); err != nil {
+			pool.baselineMu.Unlock()
+			return fmt.Errorf("failed to capture recycling baseline: %w", err)
+		}
+		pool.baseline = baseline
+	}
+	pool.baselineMu.Unlock()
+
+	if err := baseline.store(ctx, conn); err != nil {
+		return fmt.Errorf("failed to store recycling baseline: %w", err)
+	}
+	return nil
+}
+
+// recycle reconnects to the released database and resets it,
+// for Release to return it to the pool.
+func (pool *Pool) recycle(ctx context.Context, db *PooledDatabase) error {
+	// Avoid resetting databases the pool has no room for.
+	pool.mu.Lock()
+	err := pool.accepts()
+	pool.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Reconnecting discards the session state left by the test.
+	if err := db.Conn.Close(); err != nil {
+		return fmt.Errorf("failed to close pooled database %q: %w", db.Name, err)
+	}
+	conn, err := pool.provider.connect(ctx, db.Name)
+	if err != nil {
+		return fmt.Errorf("failed to reconnect to pooled database %q: %w", db.Name, err)
+	}
+	db.Conn = conn
+
+	pool.baselineMu.Lock()
+	baseline := pool.baseline
+	pool.baselineMu.Unlock()
+	if err := baseline.reset(ctx, conn); err != nil {
+		return fmt.Errorf("failed to reset pooled database %q: %w", db.Name, err)
+	}
+	return nil
+}
+
+// accepts reports whether a recycled database can be returned to the pool.
+//
+// It must be called with pool.mu held.
+func (pool *Pool) accepts() error {
+	if pool.closed {
+		return errPoolClosed
+	}
+	if len(pool.ready)+pool.creating >= pool.config.HighWatermark {
+		return errPoolFull
+	}
+	return nil
+}
+
+// broadcast wakes up the callers waiting for the pool state to change.
+//
+// It must be called with pool.mu held.
+func (pool *Pool) broadcast() {
+	close(pool.changed)
+	pool.changed = make(chan struct{})
+}
+
+// Release closes the connection and drops the database,
+// or returns it to the pool with PoolConfig.Recycle.
+//
+// Databases which cannot be recycled are dropped,
+// so that the pool clones a replacement.
+func (db *PooledDatabase) Release(ctx context.Context) error {
+	pool := db.pool
+	// Taking the database out of claimed ensures that neither Close
+	// nor another Release drops it, too.
+	pool.mu.Lock()
+	_, owned := pool.claimed[db]
+	delete(pool.claimed, db)
+	if owned && pool.config.Recycle {
+		pool.recycling++
+	}
+	pool.mu.Unlock()
+	if !owned {
+		return nil // Dropped by Close or released already.
+	}
+
+	if pool.config.Recycle {
+		err := pool.recycle(ctx, db)
+		pool.mu.Lock()
+		pool.recycling--
+		if err == nil {
+			err = pool.accepts()
+		}
+		if err == nil {
+			pool.ready = append(pool.ready, db)
+			pool.recycled++
+			pool.broadcast()
+			pool.mu.Unlock()
+			return nil
+		}
+		if !errors.Is(err, errPoolClosed) && !errors.Is(err, errPoolFull) {
+			pool.discarded++
+		}
+		pool.mu.Unlock()
+	}
+
+	dropErr := db.drop(ctx)
+	pool.mu.Lock()
+	pool.fill()
+	pool.mu.Unlock()
+	return dropErr
+}
+
+// Detach closes the connection and takes the database out of the pool
+// without dropping it, e.g. to keep it for debugging a failed test.
+// The pool then clones a replacement, and the database is left
+// to the caller, who must drop it eventually.
+func (db *PooledDatabase) Detach() error {
+	pool := db.pool
+	pool.mu.Lock()
+	_, owned := pool.claimed[db]
+	delete(pool.claimed, db)
+	pool.fill()
+	pool.mu.Unlock()
+	if !owned {
+		return fmt.Errorf("pooled database %q is not claimed", db.Name)
+	}
+
+	if err := db.Conn.Close(); err != nil {
+		return fmt.Errorf("failed to close pooled database %q: %w", db.Name, err)
+	}
+	return nil
+}
+
+// drop closes the connection and drops the database.
+func (db *PooledDatabase) drop(ctx context.Context) error {
+	closeErr := db.Conn.Close()
+	if closeErr != nil {
+		closeErr = fmt.Errorf("failed to close pooled database %q: %w", db.Name, closeErr)
+	}
+	_, dropErr := db.pool.provider.DropDatabase(ctx, db.Name)
+	return errors.Join(closeErr, dropErr)
+}
@@ -0,0 +1,233 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestPool tests the pool of pre-cloned databases.
+func TestPool(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// waitForStats waits until the pool reaches the state.
+	waitForStats := func(c *qt.C, pool *pgdbtemplatepq.Pool, want pgdbtemplatepq.PoolStats) {
+		deadline := time.Now().Add(30 * time.Second)
+		for pool.Stats() != want {
+			if time.Now().After(deadline) {
+				c.Fatalf("pool stats %+v, want %+v", pool.Stats(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// poolDatabases returns the number of existing databases with the prefix.
+	poolDatabases := func(c *qt.C, prefix string) int {
+		plan, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{Prefixes: []string{prefix}, DryRun: true})
+		c.Assert(err, qt.IsNil)
+		return len(plan)
+	}
+
+	c.Run("Fills to high watermark", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "pool_fill_template")
+		prefix := fmt.Sprintf("pool_fill_%d_", time.Now().UnixNano())
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName:  templateName,
+			NamePrefix:    prefix,
+			LowWatermark:  2,
+			HighWatermark: 3,
+		})
+		c.Assert(err, qt.IsNil)
+		defer pool.Close(ctx)
+
+		waitForStats(c, pool, pgdbtemplatepq.PoolStats{Ready: 3})
+
+		db, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		var name string
+		c.Assert(db.Conn.QueryRowContext(ctx, "SELECT current_database()").Scan(&name), qt.IsNil)
+		c.Assert(name, qt.Equals, db.Name)
+
+		// Two ready databases are not below the low watermark.
+		c.Assert(pool.Stats(), qt.Equals, pgdbtemplatepq.PoolStats{Ready: 2})
+		c.Assert(db.Release(ctx), qt.IsNil)
+
+		db, err = pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		defer db.Release(ctx)
+		waitForStats(c, pool, pgdbtemplatepq.PoolStats{Ready: 3})
+	})
+
+	c.Run("Concurrent claims wait for clones", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "pool_claims_template")
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName:   templateName,
+			NamePrefix:     fmt.Sprintf("pool_claims_%d_", time.Now().UnixNano()),
+			LowWatermark:   1,
+			HighWatermark:  2,
+			MaxConnections: 4,
+		})
+		c.Assert(err, qt.IsNil)
+		defer pool.Close(ctx)
+
+		const claims = 5
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			names = make(map[string]bool)
+		)
+		for i := 0; i < claims; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				db, err := pool.Get(ctx)
+				c.Check(err, qt.IsNil)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				names[db.Name] = true
+				mu.Unlock()
+				c.Check(db.Release(ctx), qt.IsNil)
+			}()
+		}
+		wg.Wait()
+		c.Assert(names, qt.HasLen, claims)
+	})
+
+	c.Run("Close drops ready and claimed databases", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "pool_close_template")
+		prefix := fmt.Sprintf("pool_close_%d_", time.Now().UnixNano())
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName: templateName,
+			NamePrefix:   prefix,
+		})
+		c.Assert(err, qt.IsNil)
+
+		claimed, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+
+		c.Assert(pool.Close(ctx), qt.IsNil)
+		c.Assert(pool.Stats(), qt.Equals, pgdbtemplatepq.PoolStats{})
+		c.Assert(poolDatabases(c, prefix), qt.Equals, 0)
+		c.Assert(claimed.Release(ctx), qt.IsNil)
+
+		_, err = pool.Get(ctx)
+		c.Assert(err, qt.ErrorMatches, "pool is closed")
+	})
+
+	c.Run("Concurrent releases and Close drop a database once", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "pool_release_template")
+		prefix := fmt.Sprintf("pool_release_%d_", time.Now().UnixNano())
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName: templateName,
+			NamePrefix:   prefix,
+		})
+		c.Assert(err, qt.IsNil)
+
+		claimed, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+
+		var wg sync.WaitGroup
+		errs := make([]error, 3)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if i == 0 {
+					errs[i] = pool.Close(ctx)
+				} else {
+					errs[i] = claimed.Release(ctx)
+				}
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			c.Assert(err, qt.IsNil)
+		}
+		c.Assert(poolDatabases(c, prefix), qt.Equals, 0)
+	})
+
+	c.Run("Detached databases are replaced and kept", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "pool_detach_template")
+		prefix := fmt.Sprintf("pool_detach_%d_", time.Now().UnixNano())
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName:  templateName,
+			NamePrefix:    prefix,
+			LowWatermark:  1,
+			HighWatermark: 1,
+			Recycle:       true,
+		})
+		c.Assert(err, qt.IsNil)
+
+		detached, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		c.Assert(detached.Detach(), qt.IsNil)
+		defer provider.DropDatabase(ctx, detached.Name)
+		c.Assert(detached.Detach(), qt.ErrorMatches, `pooled database ".*" is not claimed`)
+
+		// The detached database no longer counts as supply.
+		waitForStats(c, pool, pgdbtemplatepq.PoolStats{Ready: 1})
+		c.Assert(pool.Close(ctx), qt.IsNil)
+		c.Assert(poolDatabases(c, prefix), qt.Equals, 1)
+	})
+
+	c.Run("Clone errors are reported", func(c *qt.C) {
+		c.Parallel()
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName: fmt.Sprintf("pool_missing_%d", time.Now().UnixNano()),
+			NamePrefix:   fmt.Sprintf("pool_missing_%d_", time.Now().UnixNano()),
+		})
+		c.Assert(err, qt.IsNil)
+		defer pool.Close(ctx)
+
+		_, err = pool.Get(ctx)
+		c.Assert(err, qt.ErrorMatches, ".*does not exist.*")
+	})
+
+	c.Run("Get respects context cancellation", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "pool_cancel_template")
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName: templateName,
+			NamePrefix:   fmt.Sprintf("pool_cancel_%d_", time.Now().UnixNano()),
+		})
+		c.Assert(err, qt.IsNil)
+		defer pool.Close(ctx)
+
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = pool.Get(cancelledCtx)
+		c.Assert(err, qt.Equals, context.Canceled)
+	})
+
+	c.Run("Invalid config", func(c *qt.C) {
+		_, err := provider.NewPool(pgdbtemplatepq.PoolConfig{})
+		c.Assert(err, qt.ErrorMatches, "TemplateName is required")
+
+		_, err = provider.NewPool(pgdbtemplatepq.PoolConfig{TemplateName: "t", LowWatermark: 3, HighWatermark: 2})
+		c.Assert(err, qt.ErrorMatches, `invalid watermarks 3 and 2: 1 <= low <= high is required`)
+
+		_, err = provider.NewPool(pgdbtemplatepq.PoolConfig{TemplateName: "t", MaxConnections: 1})
+		c.Assert(err, qt.ErrorMatches, `connection budget 1 is less than the 2 connections of a clone`)
+	})
+}
@@ -0,0 +1,191 @@
+package pqtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// UpdateGoldenEnv is the environment variable which, when set to a true value,
+// makes AssertSchemaGolden write the golden files instead of comparing them.
+const UpdateGoldenEnv = "PQTEST_UPDATE_GOLDEN"
+
+// maxDiffLines limits the number of differing lines reported by AssertSchemaGolden.
+const maxDiffLines = 50
+
+// updateGoldenFlag makes AssertSchemaGolden write the golden files when set.
+var updateGoldenFlag = flag.Bool("pqtest.update-golden", false, "write schema golden files instead of comparing them")
+
+// AssertSchemaGolden compares the schema of the database, as rendered by
+// pgdbtemplatepq.DumpSchema, with the golden file and fails the test on differences.
+//
+// With the -pqtest.update-golden test flag or the UpdateGoldenEnv environment
+// variable, the golden file is written instead:
+//
+//	go test ./... -run TestSchema -pqtest.update-golden
+func AssertSchemaGolden(t testing.TB, db *sql.DB, path string) {
+	t.Helper()
+
+	dump, err := pgdbtemplatepq.DumpSchema(context.Background(), &pgdbtemplatepq.DatabaseConnection{DB: db})
+	if err != nil {
+		t.Fatalf("pqtest: failed to dump schema: %v", err)
+	}
+
+	if updateGoldenEnabled() {
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatalf("pqtest: failed to create golden file directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(dump), 0o600); err != nil {
+			t.Fatalf("pqtest: failed to write golden file: %v", err)
+		}
+		t.Logf("pqtest: updated golden file %s", path)
+		return
+	}
+
+	golden, err := os.ReadFile(path) // #nosec G304 -- Golden files are controlled by the test.
+	if errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("pqtest: golden file %s does not exist, run the test with -pqtest.update-golden to create it", path)
+	}
+	if err != nil {
+		t.Fatalf("pqtest: failed to read golden file: %v", err)
+	}
+	if diff := lineDiff(string(golden), dump); diff != "" {
+		t.Errorf("pqtest: schema differs from golden file %s (-golden +actual), "+
+			"run the test with -pqtest.update-golden to update it:\n%s", path, diff)
+	}
+}
+
+// updateGoldenEnabled reports whether golden files should be written,
+// either per the environment or the test flag.
+func updateGoldenEnabled() bool {
+	if *updateGoldenFlag {
+		return true
+	}
+	update, _ := strconv.ParseBool(os.Getenv(UpdateGoldenEnv)) // Invalid values mean false.
+	return update
+}
+
+// lineDiff returns the lines removed from and added to want in got,
+// or an empty string if they are equal.
+//
+// It uses the linear space variant of the Myers algorithm,
+// so that large schemas do not need quadratic memory.
+func lineDiff(want, got string) string {
+	if want == got {
+		return ""
+	}
+	lines := diffLines(strings.Split(want, "\n"), strings.Split(got, "\n"))
+	if len(lines) > maxDiffLines {
+		lines = append(lines[:maxDiffLines], fmt.Sprintf("... and %d more lines", len(lines)-maxDiffLines))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// diffLines returns the lines removed from a and added to b,
+// prefixed with "-" or "+" and their line numbers.
+func diffLines(a, b []string) []string {
+	size := 2*((len(a)+len(b)+1)/2) + 3
+	d := &differ{a: a, b: b, forward: make([]int, size), backward: make([]int, size)}
+	d.diff(0, len(a), 0, len(b))
+	return d.lines
+}
+
+// differ computes the differing lines of a and b.
+type differ struct {
+	a, b []string
+	// forward and backward are the furthest reaching paths per diagonal,
+	// reused by every middleSnake call.
+	forward, backward []int
+	lines             []string
+}
+
+// diff appends the differing lines of a[a0:a1] and b[b0:b1] in order.
+func (d *differ) diff(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		a0++
+		b0++
+	}
+	for a0 < a1 && b0 < b1 && d.a[a1-1] == d.b[b1-1] {
+		a1--
+		b1--
+	}
+	if a0 == a1 || b0 == b1 {
+		for i := a0; i < a1; i++ {
+			d.lines = append(d.lines, fmt.Sprintf("-%d: %s", i+1, d.a[i]))
+		}
+		for j := b0; j < b1; j++ {
+			d.lines = append(d.lines, fmt.Sprintf("+%d: %s", j+1, d.b[j]))
+		}
+		return
+	}
+
+	// Both halves around the middle snake have fewer differences.
+	x0, y0, x1, y1 := d.middleSnake(a0, a1, b0, b1)
+	d.diff(a0, x0, b0, y0)
+	d.diff(x1, a1, y1, b1)
+}
+
+// middleSnake returns the start and end of the middle snake of a shortest
+// edit script of a[a0:a1] and b[b0:b1], found by searching forward from
+// the start and backward from the end until the paths overlap.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (x0, y0, x1, y1 int) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+	// Diagonal k = x - y is stored at offset + k.
+	offset := len(d.forward) / 2
+	d.forward[offset+1] = 0
+	d.backward[offset+1] = 0
+
+	for depth := 0; depth <= maxD; depth++ {
+		for k := -depth; k <= depth; k += 2 {
+			var x int
+			if k == -depth || (k != depth && d.forward[offset+k-1] < d.forward[offset+k+1]) {
+				x = d.forward[offset+k+1]
+			} else {
+				x = d.forward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x++
+				y++
+			}
+			d.forward[offset+k] = x
+			// The backward path on the same diagonal is delta - k.
+			if odd && delta-k >= -(depth-1) && delta-k <= depth-1 && x+d.backward[offset+delta-k] >= n {
+				return a0 + startX, b0 + startY, a0 + x, b0 + y
+			}
+		}
+		for k := -depth; k <= depth; k += 2 {
+			var x int
+			if k == -depth || (k != depth && d.backward[offset+k-1] < d.backward[offset+k+1]) {
+				x = d.backward[offset+k+1]
+			} else {
+				x = d.backward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && d.a[a1-1-x] == d.b[b1-1-y] {
+				x++
+				y++
+			}
+			d.backward[offset+k] = x
+			if !odd && delta-k >= -depth && delta-k <= depth && x+d.forward[offset+delta-k] >= n {
+				return a1 - x, b1 - y, a1 - startX, b1 - startY
+			}
+		}
+	}
+	// Unreachable: the paths overlap after at most maxD steps.
+	return a0, b0, a1, b1
+}
@@ -0,0 +1,119 @@
+package pqtest
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// TestLineDiff tests reporting differing lines of golden files.
+func TestLineDiff(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Equal", func(c *qt.C) {
+		c.Assert(lineDiff("a\nb\n", "a\nb\n"), qt.Equals, "")
+	})
+
+	c.Run("Changed lines", func(c *qt.C) {
+		want := "header\nCREATE TABLE a ();\nCREATE TABLE b ();\n"
+		got := "header\nCREATE TABLE b ();\nCREATE TABLE c ();\n"
+		c.Assert(lineDiff(want, got), qt.Equals, ""+
+			"-2: CREATE TABLE a ();\n"+
+			"+3: CREATE TABLE c ();")
+	})
+
+	c.Run("Long diffs are truncated", func(c *qt.C) {
+		got := strings.Repeat("line\n", 60)
+		diff := lineDiff("", got)
+		c.Assert(strings.Count(diff, "\n"), qt.Equals, maxDiffLines)
+		c.Assert(strings.HasSuffix(diff, "... and 10 more lines"), qt.IsTrue)
+	})
+
+	c.Run("Diffs are minimal", func(c *qt.C) {
+		rng := rand.New(rand.NewSource(1))
+		randomLines := func() []string {
+			lines := make([]string, rng.Intn(12))
+			for i := range lines {
+				lines[i] = strconv.Itoa(rng.Intn(4))
+			}
+			return lines
+		}
+		for i := 0; i < 500; i++ {
+			a, b := randomLines(), randomLines()
+			diff := diffLines(a, b)
+			c.Assert(applyDiff(a, diff), qt.DeepEquals, b, qt.Commentf("%q -> %q", a, b))
+			c.Assert(len(diff), qt.Equals, len(a)+len(b)-2*lcsLength(a, b), qt.Commentf("%q -> %q", a, b))
+		}
+	})
+
+	c.Run("Large inputs", func(c *qt.C) {
+		var want, got strings.Builder
+		for i := 0; i < 100000; i++ {
+			fmt.Fprintf(&want, "line %d\n", i)
+			if i%10000 != 0 {
+				fmt.Fprintf(&got, "line %d\n", i)
+			}
+		}
+		diff := lineDiff(want.String(), got.String())
+		c.Assert(strings.Split(diff, "\n"), qt.HasLen, 10)
+		c.Assert(strings.HasPrefix(diff, "-1: line 0\n-10001: line 10000"), qt.IsTrue)
+	})
+}
+
+// applyDiff applies the lines reported by lineDiff to a.
+func applyDiff(a, diff []string) []string {
+	removed := make(map[int]bool)
+	added := make(map[int]string)
+	for _, line := range diff {
+		number, text, _ := strings.Cut(line[1:], ": ")
+		n, _ := strconv.Atoi(number)
+		if line[0] == '-' {
+			removed[n-1] = true
+		} else {
+			added[n-1] = text
+		}
+	}
+	b := []string{}
+	i := 0
+	for j := 0; i < len(a) || len(added) > 0; j++ {
+		if text, ok := added[j]; ok {
+			b = append(b, text)
+			delete(added, j)
+			continue
+		}
+		for removed[i] {
+			i++
+		}
+		if i == len(a) {
+			break
+		}
+		b = append(b, a[i])
+		i++
+	}
+	return b
+}
+
+// lcsLength returns the length of the longest common subsequence of a and b.
+func lcsLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
@@ -0,0 +1,186 @@
+package pqtest
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// KeepFailedEnv is the environment variable which, when set to a true value,
+// keeps the databases of failed tests.
+const KeepFailedEnv = "PQTEST_KEEP_FAILED"
+
+// keepFailedReason is stored in the metadata of kept databases.
+const keepFailedReason = "test failed"
+
+// keepFailedFlag keeps the databases of failed tests when set.
+var keepFailedFlag = flag.Bool("pqtest.keep-failed", false, "keep databases of failed tests for debugging")
+
+// keepFailedEnabled reports whether databases of failed tests should be kept,
+// either per Options.KeepFailed, the environment or the test flag.
+func keepFailedEnabled(keepFailedOption bool) bool {
+	if keepFailedOption || *keepFailedFlag {
+		return true
+	}
+	keep, _ := strconv.ParseBool(os.Getenv(KeepFailedEnv)) // Invalid values mean false.
+	return keep
+}
+
+// keepDatabase tags the database of the failed test and logs how to connect to it.
+func keepDatabase(ctx context.Context, t testing.TB, e *environment, dbName string) {
+	// Preserve the creation metadata stamped by the provider.
+	metadata := pgdbtemplatepq.NewDatabaseMetadata()
+	if stamped, err := e.provider.DatabaseMetadata(ctx, dbName); err == nil && stamped != nil {
+		metadata = *stamped
+	}
+	metadata.Test = t.Name()
+	metadata.KeptReason = keepFailedReason
+	if err := e.provider.SetDatabaseMetadata(ctx, dbName, metadata); err != nil {
+		t.Errorf("pqtest: failed to tag kept database %q: %v", dbName, err)
+	}
+
+	connString := pgdbtemplate.ReplaceDatabaseInConnectionString(e.connString, dbName)
+	t.Logf("pqtest: test failed, keeping database %q for debugging\n"+
+		"\tpsql %s\n"+
+		"\tconnection string: %s",
+		dbName, shellQuote(withoutPassword(connString)), redactPassword(connString))
+}
+
+// redactPassword replaces the password in the connection string with "xxxxx".
+func redactPassword(connString string) string {
+	return replacePassword(connString, "xxxxx")
+}
+
+// withoutPassword removes the password from the connection string,
+// leaving it to psql to look the password up or prompt for it.
+func withoutPassword(connString string) string {
+	return replacePassword(connString, "")
+}
+
+// replacePassword replaces the password in a URL or key/value connection string.
+//
+// An empty replacement removes the password.
+func replacePassword(connString, replacement string) string {
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		u, err := url.Parse(connString)
+		if err != nil {
+			return "<unparsable connection string>"
+		}
+		if _, ok := u.User.Password(); ok {
+			if replacement == "" {
+				u.User = url.User(u.User.Username())
+			} else {
+				u.User = url.UserPassword(u.User.Username(), replacement)
+			}
+		}
+		query := u.Query()
+		if query.Has("password") {
+			if replacement == "" {
+				query.Del("password")
+			} else {
+				query.Set("password", replacement)
+			}
+			u.RawQuery = query.Encode()
+		}
+		return u.String()
+	}
+
+	// Key/value format.
+	pairs, err := splitKeyValues(connString)
+	if err != nil {
+		return "<unparsable connection string>"
+	}
+	kept := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.key == "password" {
+			if replacement == "" {
+				continue
+			}
+			pair.raw = "password=" + replacement
+		}
+		kept = append(kept, pair.raw)
+	}
+	return strings.Join(kept, " ")
+}
+
+// keyValue is a parameter of a key/value connection string.
+type keyValue struct {
+	key string
+	raw string // The parameter as written, e.g. password='a b'.
+}
+
+// splitKeyValues splits a key/value connection string into its parameters
+// following the libpq rules: values may be single-quoted, and backslashes
+// escape the next character in quoted and unquoted values.
+func splitKeyValues(connString string) ([]keyValue, error) {
+	var pairs []keyValue
+	i := 0
+	skipSpaces := func() {
+		for i < len(connString) && isConnSpace(connString[i]) {
+			i++
+		}
+	}
+	for {
+		skipSpaces()
+		if i == len(connString) {
+			return pairs, nil
+		}
+		start := i
+		for i < len(connString) && connString[i] != '=' && !isConnSpace(connString[i]) {
+			i++
+		}
+		key := connString[start:i]
+		skipSpaces()
+		if key == "" || i == len(connString) || connString[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q", key)
+		}
+		i++
+		skipSpaces()
+
+		if i < len(connString) && connString[i] == '\'' {
+			i++
+			for ; ; i++ {
+				if i >= len(connString) {
+					return nil, fmt.Errorf("unterminated quoted value of %q", key)
+				}
+				if connString[i] == '\\' {
+					i++
+					continue
+				}
+				if connString[i] == '\'' {
+					i++
+					break
+				}
+			}
+		} else {
+			for i < len(connString) && !isConnSpace(connString[i]) {
+				if connString[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i > len(connString) {
+				i = len(connString)
+			}
+		}
+		pairs = append(pairs, keyValue{key: key, raw: connString[start:i]})
+	}
+}
+
+// isConnSpace reports whether the byte separates connection string parameters.
+func isConnSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f' || b == '\v'
+}
+
+// shellQuote quotes the string for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
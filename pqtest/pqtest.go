@@ -0,0 +1,421 @@
+// Package pqtest provides testing helpers which create isolated PostgreSQL
+// databases from a shared template using pgdbtemplate and lib/pq.
+//
+// Call Setup from TestMain once per package and NewDB from each test:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(pqtest.Setup(m, pqtest.Options{
+//			MigrationPaths: []string{"./testdata/migrations"},
+//		}))
+//	}
+//
+//	func TestUsers(t *testing.T) {
+//		db := pqtest.NewDB(t)
+//		// Use db, it is closed and dropped when the test ends.
+//	}
+package pqtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// ConnectionStringEnv is the environment variable holding the connection string
+// used when Options.ConnectionString is empty.
+const ConnectionStringEnv = "POSTGRES_CONNECTION_STRING"
+
+// maxIdentifierLength is the maximal length of PostgreSQL identifiers.
+const maxIdentifierLength = 63
+
+// Options configures Setup.
+type Options struct {
+	// ConnectionString is the connection string to the administrative database.
+	//
+	// If empty, the value of ConnectionStringEnv is used. If both are empty,
+	// tests calling NewDB are skipped.
+	ConnectionString string
+	// MigrationPaths are the directories with SQL migration files
+	// applied to the template database.
+	MigrationPaths []string
+	// MigrationVariables are the psql variables of the migration files
+	// in MigrationPaths, e.g. to build a template with or without seed data.
+	MigrationVariables map[string]string
+	// MigrationRunner runs migrations on the template database.
+	//
+	// If nil, a pgdbtemplatepq.FileMigrationRunner over MigrationPaths is used.
+	MigrationRunner pgdbtemplate.MigrationRunner
+	// Seeders seed the template database after the migrations,
+	// see pgdbtemplatepq.NewSeedingMigrationRunner.
+	Seeders []pgdbtemplatepq.Seeder
+	// ProviderOptions configure the connection provider.
+	ProviderOptions []pgdbtemplatepq.Option
+	// TemplateName is the name of the template database.
+	// With ReuseTemplate, it is the prefix of the template name.
+	//
+	// If empty, a unique name or "pqtest_template_" will be used.
+	TemplateName string
+	// ReuseTemplate keeps the template database after the tests and reuses it
+	// in later runs while the migrations are unchanged.
+	//
+	// The migrations are fingerprinted by their files in MigrationPaths,
+	// or by MigrationRunner if it implements pgdbtemplatepq.Fingerprinter,
+	// and by the names and versions of the Seeders.
+	ReuseTemplate bool
+	// TestDBPrefix is the prefix for test database names.
+	//
+	// If empty, "testdb_" will be used.
+	TestDBPrefix string
+	// KeepFailed keeps the databases of failed tests instead of dropping them,
+	// logging how to connect to them.
+	//
+	// It can also be enabled with the KeepFailedEnv environment variable
+	// or the -pqtest.keep-failed test flag.
+	KeepFailed bool
+	// PoolSize is the number of test databases cloned ahead of time
+	// in the background, so that NewDB returns them instantly.
+	//
+	// If zero, NewDB clones each database on demand.
+	PoolSize int
+	// RecycleDatabases resets the databases of passed tests in place
+	// and reuses them instead of dropping them, see pgdbtemplatepq.PoolConfig.Recycle.
+	//
+	// It requires PoolSize.
+	RecycleDatabases bool
+}
+
+// environment is the state shared by Setup and NewDB.
+type environment struct {
+	connString   string
+	provider     *pgdbtemplatepq.ConnectionProvider
+	templateName string
+	testPrefix   string
+	keepFailed   bool
+	pool         *pgdbtemplatepq.Pool
+	skipReason   string
+}
+
+var (
+	// envMu guards env.
+	envMu sync.Mutex
+	// env is set by Setup for the duration of m.Run.
+	env *environment
+	// dbCounter makes database names unique within the process.
+	dbCounter int64
+)
+
+// Setup creates the template database, runs the tests and drops
+// the template afterwards, unless Options.ReuseTemplate is set.
+// Test databases are dropped by NewDB, and snapshots taken
+// with Snapshot are dropped when the tests complete.
+//
+// It returns the exit code to be passed to os.Exit.
+func Setup(m *testing.M, opts Options) int {
+	ctx := context.Background()
+
+	connString := opts.ConnectionString
+	if connString == "" {
+		connString = os.Getenv(ConnectionStringEnv)
+	}
+	if connString == "" {
+		setEnvironment(&environment{
+			skipReason: fmt.Sprintf("pqtest: %s is not set, skipping database tests", ConnectionStringEnv),
+		})
+		defer setEnvironment(nil)
+		return m.Run()
+	}
+
+	testPrefix := opts.TestDBPrefix
+	if testPrefix == "" {
+		testPrefix = "testdb_"
+	}
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(connString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProviderWithOptions(connStringFunc, opts.ProviderOptions...)
+
+	migrationRunner := opts.MigrationRunner
+	if migrationRunner == nil {
+		migrationRunner = pgdbtemplatepq.NewFileMigrationRunner(opts.MigrationPaths, nil,
+			pgdbtemplatepq.WithMigrationVariables(opts.MigrationVariables))
+	}
+	if len(opts.Seeders) > 0 {
+		migrationRunner = pgdbtemplatepq.NewSeedingMigrationRunner(migrationRunner, opts.Seeders...)
+	}
+
+	var (
+		templateName string
+		cleanup      func() error
+		err          error
+	)
+	if opts.ReuseTemplate {
+		templateName, err = reuseTemplate(ctx, provider, opts, migrationRunner)
+		cleanup = func() error { return nil } // The template is kept for later runs.
+	} else {
+		templateName, cleanup, err = createTemplate(ctx, provider, opts, migrationRunner, testPrefix)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pqtest: failed to initialize template: %v\n", err)
+		return 1
+	}
+
+	var pool *pgdbtemplatepq.Pool
+	if opts.PoolSize > 0 {
+		pool, err = provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName:  templateName,
+			NamePrefix:    testPrefix + "pool_",
+			LowWatermark:  (opts.PoolSize + 1) / 2,
+			HighWatermark: opts.PoolSize,
+			Recycle:       opts.RecycleDatabases,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pqtest: failed to create database pool: %v\n", err)
+			if err := cleanup(); err != nil {
+				fmt.Fprintf(os.Stderr, "pqtest: failed to clean up: %v\n", err)
+			}
+			return 1
+		}
+		templateCleanup := cleanup
+		cleanup = func() error {
+			// Pooled databases must be dropped before their template.
+			return errors.Join(pool.Close(ctx), templateCleanup())
+		}
+	}
+
+	setEnvironment(&environment{
+		connString:   connString,
+		provider:     provider,
+		templateName: templateName,
+		testPrefix:   testPrefix,
+		keepFailed:   opts.KeepFailed,
+		pool:         pool,
+	})
+	code := m.Run()
+	setEnvironment(nil)
+
+	if err := errors.Join(provider.DropSnapshots(ctx), cleanup()); err != nil {
+		fmt.Fprintf(os.Stderr, "pqtest: failed to clean up: %v\n", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// createTemplate creates a template database for this run
+// and returns its name and the function dropping it.
+func createTemplate(ctx context.Context, provider *pgdbtemplatepq.ConnectionProvider, opts Options, migrationRunner pgdbtemplate.MigrationRunner, testPrefix string) (string, func() error, error) {
+	templateName := opts.TemplateName
+	if templateName == "" {
+		templateName = fmt.Sprintf("pqtest_template_%d_%d", time.Now().UnixNano(), os.Getpid())
+	}
+
+	tm, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{
+		MigrationRunner: migrationRunner,
+		TemplateName:    templateName,
+		TestDBPrefix:    testPrefix,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := tm.Initialize(ctx); err != nil {
+		return "", nil, err
+	}
+	return templateName, func() error { return tm.Cleanup(ctx) }, nil
+}
+
+// reuseTemplate returns the name of a template database built
+// from the current migrations, reusing one from an earlier run.
+func reuseTemplate(ctx context.Context, provider *pgdbtemplatepq.ConnectionProvider, opts Options, migrationRunner pgdbtemplate.MigrationRunner) (string, error) {
+	prefix := opts.TemplateName
+	if prefix == "" {
+		prefix = "pqtest_template_"
+	}
+
+	template, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+		NamePrefix:      prefix,
+		MigrationRunner: migrationRunner,
+	})
+	if err != nil {
+		return "", err
+	}
+	return template.Name, nil
+}
+
+// NewDB creates a test database from the template and returns a connection to it.
+//
+// The database is named after t.Name(), unless it is claimed from
+// the pool of Options.PoolSize databases. It is closed and dropped when the test
+// and all its subtests complete, unless the test failed and Options.KeepFailed
+// is enabled. The test is skipped when no PostgreSQL connection string
+// is configured.
+func NewDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	e := requireEnvironment(t, "NewDB")
+	ctx := context.Background()
+	if e.pool != nil {
+		return claimDatabase(ctx, t, e)
+	}
+	return newDB(ctx, t, e, e.templateName)
+}
+
+// NewDBFromTemplate is NewDB cloning the given template,
+// e.g. one created by Snapshot, instead of the template of Setup.
+func NewDBFromTemplate(t testing.TB, templateName string) *sql.DB {
+	t.Helper()
+
+	e := requireEnvironment(t, "NewDBFromTemplate")
+	return newDB(context.Background(), t, e, templateName)
+}
+
+// requireEnvironment returns the environment set by Setup, skipping the test
+// when no PostgreSQL connection string is configured.
+func requireEnvironment(t testing.TB, function string) *environment {
+	t.Helper()
+
+	e := currentEnvironment()
+	if e == nil {
+		t.Fatalf("pqtest: %s called outside of pqtest.Setup", function)
+	}
+	if e.skipReason != "" {
+		t.Skip(e.skipReason)
+	}
+	return e
+}
+
+// newDB creates a test database from the template
+// and drops it when the test completes.
+func newDB(ctx context.Context, t testing.TB, e *environment, templateName string) *sql.DB {
+	t.Helper()
+
+	dbName, conn := createDatabase(ctx, t, e, templateName)
+
+	t.Cleanup(func() {
+		if err := conn.Close(); err != nil {
+			t.Errorf("pqtest: failed to close test database %q: %v", dbName, err)
+		}
+		if t.Failed() && keepFailedEnabled(e.keepFailed) {
+			keepDatabase(ctx, t, e, dbName)
+			return
+		}
+		if _, err := e.provider.DropDatabase(ctx, dbName); err != nil {
+			t.Errorf("pqtest: failed to drop test database %q: %v", dbName, err)
+		}
+	})
+	return conn.DB
+}
+
+// claimDatabase claims a test database from the pool
+// and releases it back when the test completes.
+func claimDatabase(ctx context.Context, t testing.TB, e *environment) *sql.DB {
+	t.Helper()
+
+	db, err := e.pool.Get(ctx)
+	if err != nil {
+		t.Fatalf("pqtest: failed to get test database from pool: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if t.Failed() && keepFailedEnabled(e.keepFailed) {
+			// Detaching lets the pool clone a replacement.
+			if err := db.Detach(); err != nil {
+				t.Errorf("pqtest: failed to detach test database %q: %v", db.Name, err)
+			}
+			keepDatabase(ctx, t, e, db.Name)
+			return
+		}
+		if err := db.Release(ctx); err != nil {
+			t.Errorf("pqtest: failed to release test database %q: %v", db.Name, err)
+		}
+	})
+	return db.Conn.DB
+}
+
+// createDatabase clones a test database named after the test from the template.
+func createDatabase(ctx context.Context, t testing.TB, e *environment, templateName string) (string, *pgdbtemplatepq.DatabaseConnection) {
+	t.Helper()
+
+	dbName := databaseName(e.testPrefix, t.Name(), atomic.AddInt64(&dbCounter, 1))
+	if err := e.provider.CloneDatabase(ctx, dbName, templateName); err != nil {
+		t.Fatalf("pqtest: failed to create test database: %v", err)
+	}
+	conn, err := e.provider.Connect(ctx, dbName)
+	if err != nil {
+		if _, dropErr := e.provider.DropDatabase(ctx, dbName); dropErr != nil {
+			t.Errorf("pqtest: failed to drop test database %q: %v", dbName, dropErr)
+		}
+		t.Fatalf("pqtest: failed to connect to test database: %v", err)
+	}
+	return dbName, conn.(*pgdbtemplatepq.DatabaseConnection)
+}
+
+// Provider returns the connection provider created by Setup,
+// or nil when called outside of Setup or without a configured database.
+func Provider() *pgdbtemplatepq.ConnectionProvider {
+	if e := currentEnvironment(); e != nil {
+		return e.provider
+	}
+	return nil
+}
+
+// setEnvironment replaces the shared environment.
+func setEnvironment(e *environment) {
+	envMu.Lock()
+	defer envMu.Unlock()
+	env = e
+}
+
+// currentEnvironment returns the shared environment.
+func currentEnvironment() *environment {
+	envMu.Lock()
+	defer envMu.Unlock()
+	return env
+}
+
+// databaseName derives a valid and unique database name from the test name.
+//
+// Names exceeding the identifier length limit are truncated
+// and suffixed with a hash of the full test name.
+func databaseName(prefix, testName string, seq int64) string {
+	var sanitized strings.Builder
+	lastUnderscore := false
+	for _, r := range strings.ToLower(testName) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			sanitized.WriteRune(r)
+			lastUnderscore = false
+			continue
+		}
+		if !lastUnderscore {
+			sanitized.WriteByte('_')
+			lastUnderscore = true
+		}
+	}
+	name := strings.Trim(sanitized.String(), "_")
+
+	suffix := fmt.Sprintf("_%d_%d", os.Getpid(), seq)
+	available := maxIdentifierLength - len(prefix) - len(suffix)
+	if len(name) > available {
+		sum := sha256.Sum256([]byte(testName))
+		hash := hex.EncodeToString(sum[:4])
+		if cut := available - len(hash) - 1; cut > 0 {
+			name = name[:cut] + "_" + hash
+		} else {
+			name = hash
+		}
+	}
+	return prefix + name + suffix
+}
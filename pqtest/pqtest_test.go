@@ -0,0 +1,179 @@
+package pqtest_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate-pq/pqtest"
+)
+
+// failedTB reports the test as failed, so that NewDB treats it as such.
+type failedTB struct {
+	testing.TB
+}
+
+// Failed implements testing.TB.Failed.
+func (failedTB) Failed() bool {
+	return true
+}
+
+// recordingTB records errors instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+// Errorf implements testing.TB.Errorf.
+func (tb *recordingTB) Errorf(format string, args ...any) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(pqtest.Setup(m, pqtest.Options{
+		TestDBPrefix: "pqtest_",
+	}))
+}
+
+// TestNewDB tests creating test databases from the shared template.
+func TestNewDB(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	c.Run("Database is named after the test", func(c *qt.C) {
+		db := pqtest.NewDB(c.TB)
+
+		var name string
+		err := db.QueryRowContext(ctx, "SELECT current_database()").Scan(&name)
+		c.Assert(err, qt.IsNil)
+		c.Assert(strings.HasPrefix(name, "pqtest_testnewdb_database_is_named_after_the_test_"), qt.IsTrue,
+			qt.Commentf("database name: %s", name))
+	})
+
+	c.Run("Databases are isolated", func(c *qt.C) {
+		db1 := pqtest.NewDB(c.TB)
+		db2 := pqtest.NewDB(c.TB)
+
+		_, err := db1.ExecContext(ctx, "CREATE TABLE isolated (id INT)")
+		c.Assert(err, qt.IsNil)
+
+		var exists bool
+		err = db2.QueryRowContext(ctx, "SELECT to_regclass('isolated') IS NOT NULL").Scan(&exists)
+		c.Assert(err, qt.IsNil)
+		c.Assert(exists, qt.IsFalse)
+	})
+
+	c.Run("Long test names fit identifier limit", func(c *qt.C) {
+		c.Run(strings.Repeat("very long subtest name ", 10), func(c *qt.C) {
+			db := pqtest.NewDB(c.TB)
+
+			var name string
+			err := db.QueryRowContext(ctx, "SELECT current_database()").Scan(&name)
+			c.Assert(err, qt.IsNil)
+			c.Assert(len(name) <= 63, qt.IsTrue)
+		})
+	})
+
+	c.Run("Database of failed test is kept", func(c *qt.C) {
+		c.Setenv(pqtest.KeepFailedEnv, "true")
+
+		var dbName string
+		c.Cleanup(func() {
+			if dbName == "" {
+				return // Skipped or failed before the database was created.
+			}
+			provider := pqtest.Provider()
+			metadata, err := provider.DatabaseMetadata(ctx, dbName)
+			c.Check(err, qt.IsNil)
+			c.Check(metadata, qt.IsNotNil)
+			if metadata != nil {
+				c.Check(metadata.KeptReason, qt.Equals, "test failed")
+				c.Check(metadata.Test, qt.Equals, c.Name())
+			}
+			_, err = provider.DropDatabase(ctx, dbName)
+			c.Check(err, qt.IsNil)
+		})
+
+		db := pqtest.NewDB(failedTB{TB: c.TB})
+		err := db.QueryRowContext(ctx, "SELECT current_database()").Scan(&dbName)
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Provider is available", func(c *qt.C) {
+		if os.Getenv(pqtest.ConnectionStringEnv) == "" {
+			c.Assert(pqtest.Provider(), qt.IsNil)
+			return
+		}
+		c.Assert(pqtest.Provider(), qt.IsNotNil)
+	})
+}
+
+// TestAssertSchemaGolden tests comparing schemas with golden files.
+func TestAssertSchemaGolden(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	db := pqtest.NewDB(c.TB)
+	_, err := db.ExecContext(ctx, "CREATE TABLE accounts (id SERIAL PRIMARY KEY, name TEXT NOT NULL)")
+	c.Assert(err, qt.IsNil)
+	path := filepath.Join(c.TempDir(), "testdata", "schema.sql")
+
+	c.Run("Golden file is written on update", func(c *qt.C) {
+		c.Setenv(pqtest.UpdateGoldenEnv, "true")
+		pqtest.AssertSchemaGolden(c.TB, db, path)
+
+		golden, err := os.ReadFile(path)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(golden), qt.Contains, "CREATE TABLE public.accounts (")
+	})
+
+	c.Run("Matching schema passes", func(c *qt.C) {
+		tb := &recordingTB{TB: c.TB}
+		pqtest.AssertSchemaGolden(tb, db, path)
+		c.Assert(tb.errors, qt.HasLen, 0)
+	})
+
+	c.Run("Schema drift is reported", func(c *qt.C) {
+		_, err := db.ExecContext(ctx, "ALTER TABLE accounts ADD COLUMN email TEXT")
+		c.Assert(err, qt.IsNil)
+
+		tb := &recordingTB{TB: c.TB}
+		pqtest.AssertSchemaGolden(tb, db, path)
+		c.Assert(tb.errors, qt.HasLen, 1)
+		c.Assert(tb.errors[0], qt.Contains, "schema differs from golden file")
+		c.Assert(tb.errors[0], qt.Matches, `(?s).*\+\d+:     email text\n?.*`)
+	})
+}
+
+// TestSnapshot tests branching test databases from a snapshot.
+func TestSnapshot(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	db := pqtest.NewDB(c.TB)
+	_, err := db.ExecContext(ctx, "CREATE TABLE stages (stage INT); INSERT INTO stages VALUES (1)")
+	c.Assert(err, qt.IsNil)
+
+	templateName := fmt.Sprintf("pqtest_snapshot_%d", os.Getpid())
+	pqtest.Snapshot(c.TB, db, templateName)
+
+	// The source database remains usable.
+	_, err = db.ExecContext(ctx, "INSERT INTO stages VALUES (2)")
+	c.Assert(err, qt.IsNil)
+
+	for _, name := range []string{"First branch", "Second branch"} {
+		c.Run(name, func(c *qt.C) {
+			branch := pqtest.NewDBFromTemplate(c.TB, templateName)
+			var stages int
+			c.Assert(branch.QueryRowContext(ctx, "SELECT count(*) FROM stages").Scan(&stages), qt.IsNil)
+			c.Assert(stages, qt.Equals, 1)
+			_, err := branch.ExecContext(ctx, "INSERT INTO stages VALUES (2)")
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package pqtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// Snapshot clones the test database into a new template named templateName,
+// so that later tests branch from its current state with NewDBFromTemplate.
+//
+// The sessions of db are terminated while the database is copied;
+// database/sql reconnects on the next query. The snapshot is dropped
+// when Setup returns, see pgdbtemplatepq.ConnectionProvider.Snapshot.
+func Snapshot(t testing.TB, db *sql.DB, templateName string) {
+	t.Helper()
+
+	e := requireEnvironment(t, "Snapshot")
+	ctx := context.Background()
+
+	var dbName string
+	if err := db.QueryRowContext(ctx, "SELECT current_database()").Scan(&dbName); err != nil {
+		t.Fatalf("pqtest: failed to get name of test database: %v", err)
+	}
+	// The sessions of the source are the test's own connections.
+	if err := e.provider.Snapshot(ctx, dbName, templateName, pgdbtemplatepq.WithTerminateSessions()); err != nil {
+		t.Fatalf("pqtest: failed to snapshot test database: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package pgdbtemplatepq
+
+import "os"
+
+// processAlive reports whether a process with the PID runs on this host.
+func processAlive(pid int) bool {
+	// FindProcess opens the process on Windows and fails if it does not exist.
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release() // #nosec G104 -- Release error is not actionable.
+	return true
+}
@@ -0,0 +1,417 @@
+package pgdbtemplatepq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// psqlScript is a migration file with its psql meta-commands expanded.
+type psqlScript struct {
+	source *migrationSource
+	// annotations are the annotations of the file and the included files.
+	annotations []string
+	// included are the paths and contents of the included files, in pairs.
+	included []string
+}
+
+// psqlCondition is the state of an \if block.
+type psqlCondition struct {
+	parentActive bool // Whether the block is in an active branch.
+	active       bool // Whether the current branch is active.
+	taken        bool // Whether a branch was active.
+	inElse       bool // Whether the current branch is \else.
+}
+
+// psqlPreprocessor expands the psql meta-commands of migration files.
+type psqlPreprocessor struct {
+	variables  map[string]string
+	out        strings.Builder
+	script     *psqlScript
+	conditions []psqlCondition
+	including  []string // Files being expanded, for detecting include cycles.
+}
+
+// expandPsqlScript expands the supported psql meta-commands of the migration file,
+// interpolating the variables:
+//
+//   - \i and \include include a file relative to the working directory,
+//     \ir and \include_relative relative to the including file;
+//   - \set sets a variable to its concatenated arguments, \unset removes it;
+//   - \if, \elif, \else and \endif include statements conditionally
+//     on boolean values, e.g. \if :seed or \if :{?seed};
+//   - :name, :'name' and :"name" are replaced with the variable value
+//     as is, as a literal or as an identifier. References to undefined
+//     variables are kept, like in psql.
+//
+// Other meta-commands are rejected.
+func expandPsqlScript(file, content string, variables map[string]string) (*psqlScript, error) {
+	p := &psqlPreprocessor{
+		variables: make(map[string]string, len(variables)),
+		script:    &psqlScript{source: &migrationSource{file: file}},
+	}
+	for name, value := range variables {
+		p.variables[name] = value
+	}
+	if err := p.expand(file, content); err != nil {
+		return nil, err
+	}
+	p.script.source.content = p.out.String()
+	return p.script, nil
+}
+
+// expand expands the file into the output.
+func (p *psqlPreprocessor) expand(file, content string) error {
+	for _, including := range p.including {
+		if including == file {
+			return fmt.Errorf("%s: include cycle: %s", file, strings.Join(append(p.including, file), " -> "))
+		}
+	}
+	p.including = append(p.including, file)
+	defer func() { p.including = p.including[:len(p.including)-1] }()
+
+	depth := len(p.conditions)
+	script := splitSQLScript(content)
+	p.script.annotations = append(p.script.annotations, script.annotations...)
+	// The content between statements, e.g. comments, is kept,
+	// so that the expansion of plain files is the files themselves.
+	copied := 0
+	for _, statement := range script.statements {
+		end := statement.offset + len(statement.text)
+		if statement.copiesFromStdin() {
+			// The data and the "\." line are kept verbatim.
+			end = indexOrEnd(content, statement.copyOffset+len(statement.copyData), "\n")
+		}
+		if !p.active() && !statement.metaCommand {
+			copied = end
+			continue
+		}
+		if p.active() {
+			p.copyVerbatim(file, content, copied, content[copied:statement.offset])
+		}
+		copied = end
+		if statement.metaCommand {
+			if err := p.metaCommand(file, content, statement); err != nil {
+				return fmt.Errorf("%s:%d: %w", file, lineNumber(content, statement.offset), err)
+			}
+			continue
+		}
+		p.interpolate(file, content, statement)
+		if statement.copiesFromStdin() {
+			p.copyVerbatim(file, content, statement.offset+len(statement.text), content[statement.offset+len(statement.text):end])
+		}
+	}
+	if len(p.conditions) > depth {
+		return fmt.Errorf("%s: \\if without \\endif", file)
+	}
+	p.copyVerbatim(file, content, copied, content[copied:])
+	return nil
+}
+
+// active reports whether statements are in an active branch.
+func (p *psqlPreprocessor) active() bool {
+	return len(p.conditions) == 0 || p.conditions[len(p.conditions)-1].active
+}
+
+// metaCommand executes the meta-command of the file.
+func (p *psqlPreprocessor) metaCommand(file, content string, statement sqlStatement) error {
+	command, rest, _ := strings.Cut(strings.TrimPrefix(statement.text, `\`), " ")
+	rest = strings.TrimSpace(rest)
+
+	// Conditionals are tracked in inactive branches as well.
+	switch command {
+	case "if":
+		condition := psqlCondition{parentActive: p.active()}
+		if condition.parentActive {
+			value, err := p.evaluate(rest)
+			if err != nil {
+				return err
+			}
+			condition.active, condition.taken = value, value
+		}
+		p.conditions = append(p.conditions, condition)
+		return nil
+	case "elif", "else", "endif":
+		if len(p.conditions) == 0 {
+			return fmt.Errorf("\\%s without \\if", command)
+		}
+		condition := &p.conditions[len(p.conditions)-1]
+		if command == "endif" {
+			p.conditions = p.conditions[:len(p.conditions)-1]
+			return nil
+		}
+		if condition.inElse {
+			return fmt.Errorf("\\%s after \\else", command)
+		}
+		condition.active = false
+		if command == "else" {
+			condition.inElse = true
+			condition.active = condition.parentActive && !condition.taken
+		} else if condition.parentActive && !condition.taken {
+			value, err := p.evaluate(rest)
+			if err != nil {
+				return err
+			}
+			condition.active = value
+		}
+		condition.taken = condition.taken || condition.active
+		return nil
+	}
+	if !p.active() {
+		return nil
+	}
+
+	args, err := p.arguments(rest)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "set":
+		if len(args) == 0 {
+			return errors.New("\\set requires a variable name")
+		}
+		if !isPsqlVariableName(args[0]) {
+			return fmt.Errorf("invalid variable name %q", args[0])
+		}
+		p.variables[args[0]] = strings.Join(args[1:], "")
+	case "unset":
+		if len(args) != 1 {
+			return errors.New("\\unset requires a variable name")
+		}
+		delete(p.variables, args[0])
+	case "i", "include", "ir", "include_relative":
+		if len(args) != 1 {
+			return fmt.Errorf("\\%s requires a file name", command)
+		}
+		path := filepath.Clean(args[0])
+		if (command == "ir" || command == "include_relative") && !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+		included, err := os.ReadFile(path) // #nosec G304 -- Included files are controlled by the application.
+		if err != nil {
+			return fmt.Errorf("failed to read included file: %w", err)
+		}
+		p.script.included = append(p.script.included, path, string(included))
+		return p.expand(path, string(included))
+	default:
+		return fmt.Errorf("unsupported psql meta-command \\%s", command)
+	}
+	return nil
+}
+
+// evaluate evaluates the boolean expression of \if and \elif.
+func (p *psqlPreprocessor) evaluate(expression string) (bool, error) {
+	args, err := p.arguments(expression)
+	if err != nil {
+		return false, err
+	}
+	if len(args) != 1 {
+		return false, fmt.Errorf("invalid boolean expression %q", expression)
+	}
+	switch strings.ToLower(args[0]) {
+	case "true", "on", "yes", "1":
+		return true, nil
+	case "false", "off", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean value %q", args[0])
+}
+
+// arguments splits the meta-command arguments at whitespace, interpolating
+// variables and unquoting 'quoted' parts, in which quotes are doubled
+// or escaped with backslashes. "Quoted" parts are kept as they are.
+func (p *psqlPreprocessor) arguments(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+	)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case isSQLSpace(c):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+			i++
+			continue
+		case c == '\'':
+			end := i + 1
+			for ; end < len(s); end++ {
+				if s[end] == '\\' && end+1 < len(s) {
+					end++
+					current.WriteByte(unescapePsqlByte(s[end]))
+					continue
+				}
+				if s[end] == '\'' {
+					if end+1 < len(s) && s[end+1] == '\'' {
+						current.WriteByte('\'')
+						end++
+						continue
+					}
+					break
+				}
+				current.WriteByte(s[end])
+			}
+			if end >= len(s) {
+				return nil, errors.New("unterminated quoted string")
+			}
+			i = end + 1
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated quoted identifier")
+			}
+			current.WriteString(s[i : i+end+2])
+			i += end + 2
+		case c == ':':
+			value, length, ok := p.reference(s[i:])
+			if ok {
+				current.WriteString(value)
+				i += length
+			} else {
+				current.WriteByte(c)
+				i++
+			}
+		default:
+			current.WriteByte(c)
+			i++
+		}
+		inArg = true
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// unescapePsqlByte returns the byte escaped with a backslash in 'quoted' arguments.
+func unescapePsqlByte(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	}
+	return c
+}
+
+// interpolate writes the statement of the file with variables interpolated.
+func (p *psqlPreprocessor) interpolate(file, content string, statement sqlStatement) {
+	lexer := &sqlLexer{src: statement.text}
+	copied := 0
+	for {
+		token, ok := lexer.next()
+		if !ok {
+			break
+		}
+		if token.kind != sqlTokenPunctuation || statement.text[token.start] != ':' {
+			continue
+		}
+		rest := statement.text[token.start:]
+		if strings.HasPrefix(rest, "::") {
+			lexer.pos++ // Type cast.
+			continue
+		}
+		value, length, ok := p.reference(rest)
+		if !ok {
+			continue
+		}
+		p.copyVerbatim(file, content, statement.offset+copied, statement.text[copied:token.start])
+		p.script.source.segments = append(p.script.source.segments, sourceSegment{
+			start:   p.out.Len(),
+			file:    file,
+			content: content,
+			offset:  statement.offset + token.start,
+		})
+		p.out.WriteString(value)
+		copied = token.start + length
+		lexer.pos = copied
+	}
+	p.copyVerbatim(file, content, statement.offset+copied, statement.text[copied:])
+}
+
+// copyVerbatim writes the text at the offset of the file content.
+func (p *psqlPreprocessor) copyVerbatim(file, content string, offset int, text string) {
+	if text == "" {
+		return
+	}
+	p.script.source.segments = append(p.script.source.segments, sourceSegment{
+		start:   p.out.Len(),
+		file:    file,
+		content: content,
+		offset:  offset,
+		length:  len(text),
+	})
+	p.out.WriteString(text)
+}
+
+// reference returns the value of the variable reference at the start of s,
+// i.e. :name, :'name', :"name" or :{?name}, and the length of the reference.
+// It returns false if s does not start with a reference to a defined variable,
+// except for :{?name}, which tests whether the variable is defined.
+func (p *psqlPreprocessor) reference(s string) (string, int, bool) {
+	rest := s[1:]
+	switch {
+	case strings.HasPrefix(rest, "{?"):
+		end := strings.IndexByte(rest, '}')
+		if end < 0 || !isPsqlVariableName(rest[2:end]) {
+			return "", 0, false
+		}
+		if _, ok := p.variables[rest[2:end]]; ok {
+			return "TRUE", end + 2, true
+		}
+		return "FALSE", end + 2, true
+	case strings.HasPrefix(rest, "'"), strings.HasPrefix(rest, `"`):
+		quote := rest[:1]
+		end := strings.Index(rest[1:], quote)
+		if end < 0 {
+			return "", 0, false
+		}
+		value, ok := p.variables[rest[1:end+1]]
+		if !ok || !isPsqlVariableName(rest[1:end+1]) {
+			return "", 0, false
+		}
+		if quote == "'" {
+			// Values with backslashes are quoted as escape strings,
+			// which pq.QuoteLiteral precedes with a space.
+			return strings.TrimPrefix(pq.QuoteLiteral(value), " "), end + 3, true
+		}
+		return pq.QuoteIdentifier(value), end + 3, true
+	}
+	end := 0
+	for end < len(rest) && isPsqlVariableByte(rest[end]) {
+		end++
+	}
+	value, ok := p.variables[rest[:end]]
+	if end == 0 || !ok {
+		return "", 0, false
+	}
+	return value, end + 1, true
+}
+
+// isPsqlVariableName reports whether the name is a valid psql variable name.
+func isPsqlVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isPsqlVariableByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPsqlVariableByte reports whether the byte can be part of a psql variable name.
+func isPsqlVariableByte(c byte) bool {
+	return isSQLIdentifierStart(c) || c >= '0' && c <= '9'
+}
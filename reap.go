@@ -0,0 +1,206 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultReapOlderThan is the minimal age of databases dropped by
+// ConnectionProvider.Reap when ReapOptions.OlderThan is zero.
+const DefaultReapOlderThan = time.Hour
+
+// ReapOptions configures ConnectionProvider.Reap.
+type ReapOptions struct {
+	// Prefixes are the database name prefixes to consider, e.g. "testdb_".
+	Prefixes []string
+	// Pattern is a regular expression database names to consider must match.
+	//
+	// At least one of Prefixes and Pattern is required.
+	// When both are set, a database matching either is considered.
+	Pattern *regexp.Regexp
+	// OlderThan is the minimal age of databases to drop
+	// whose creating process ran on this host and is gone.
+	//
+	// If zero, DefaultReapOlderThan is used.
+	// If negative, such databases of any age are dropped.
+	OlderThan time.Duration
+	// RemoteOlderThan is the minimal age of databases to drop
+	// which were created on another host, e.g. by CI jobs in other containers.
+	// Whether their creating process still runs cannot be checked,
+	// so it should exceed the duration of the longest test run.
+	//
+	// If zero, databases created on other hosts are kept.
+	RemoteOlderThan time.Duration
+	// IncludeUnstamped also drops matching databases without metadata,
+	// whose age and creating process are unknown.
+	IncludeUnstamped bool
+	// DryRun only returns the plan without dropping anything.
+	DryRun bool
+}
+
+// ReapedDatabase describes a database considered by ConnectionProvider.Reap.
+type ReapedDatabase struct {
+	// Name is the name of the database.
+	Name string
+	// Metadata is the metadata stamped on the database, nil if none.
+	Metadata *DatabaseMetadata
+	// Drop reports whether the database is orphaned and is to be dropped.
+	Drop bool
+	// Reason explains the decision.
+	Reason string
+	// Dropped reports whether the database was actually dropped.
+	Dropped bool
+}
+
+// Reap finds databases left behind by crashed or interrupted test runs
+// and drops them.
+//
+// Databases are considered when their names match opts.Prefixes or opts.Pattern.
+// A database created on this host is dropped when its creating process
+// is no longer running and it is older than opts.OlderThan. A database
+// created on another host is dropped only when it is older than
+// opts.RemoteOlderThan, since its creating process cannot be checked.
+// Templates are unmarked before being dropped, except for reusable templates
+// built by EnsureTemplate, which are kept. The returned plan lists
+// all considered databases; errors for individual databases are joined
+// and do not stop the others from being dropped.
+func (p *ConnectionProvider) Reap(ctx context.Context, opts ReapOptions) ([]ReapedDatabase, error) {
+	if len(opts.Prefixes) == 0 && opts.Pattern == nil {
+		return nil, errors.New("at least one prefix or a pattern is required")
+	}
+
+	info, err := p.cachedServerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer adminConn.Close()
+
+	candidates, err := listReapCandidates(ctx, adminConn, opts)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname() // An unknown hostname makes every process look remote.
+	now := time.Now()
+
+	var errs error
+	plan := make([]ReapedDatabase, 0, len(candidates))
+	for _, candidate := range candidates {
+		reaped := ReapedDatabase{Name: candidate.name, Metadata: candidate.metadata}
+		reaped.Drop, reaped.Reason = reapDecision(candidate.metadata, opts, hostname, now)
+		if reaped.Drop && !opts.DryRun {
+			if err := p.dropTemplate(ctx, adminConn, info, candidate.name); err != nil {
+				errs = errors.Join(errs, err)
+			} else {
+				reaped.Dropped = true
+			}
+		}
+		plan = append(plan, reaped)
+	}
+	return plan, errs
+}
+
+// reapCandidate is a database matching ReapOptions.
+type reapCandidate struct {
+	name     string
+	metadata *DatabaseMetadata
+}
+
+// listReapCandidates lists the databases matching the options, sorted by name.
+func listReapCandidates(ctx context.Context, adminConn *DatabaseConnection, opts ReapOptions) (_ []reapCandidate, err error) {
+	rows, err := adminConn.DB.QueryContext(ctx, `
+		SELECT datname, coalesce(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database
+		WHERE datname NOT IN ('template0', 'template1') AND datname <> current_database()
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	var candidates []reapCandidate
+	for rows.Next() {
+		var (
+			candidate reapCandidate
+			comment   string
+		)
+		if err := rows.Scan(&candidate.name, &comment); err != nil {
+			return nil, fmt.Errorf("failed to scan database: %w", err)
+		}
+		if !reapMatches(candidate.name, opts) {
+			continue
+		}
+		candidate.metadata, _ = ParseDatabaseMetadata(comment)
+		candidates = append(candidates, candidate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].name < candidates[j].name
+	})
+	return candidates, nil
+}
+
+// reapMatches reports whether the database name matches the prefixes or the pattern.
+func reapMatches(name string, opts ReapOptions) bool {
+	for _, prefix := range opts.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return opts.Pattern != nil && opts.Pattern.MatchString(name)
+}
+
+// reapDecision decides whether a matching database is orphaned.
+func reapDecision(metadata *DatabaseMetadata, opts ReapOptions, hostname string, now time.Time) (bool, string) {
+	if metadata == nil {
+		if opts.IncludeUnstamped {
+			return true, "no metadata, unstamped databases included"
+		}
+		return false, "no metadata"
+	}
+
+	if metadata.Fingerprint != "" {
+		return false, "reusable template, see EnsureTemplate"
+	}
+
+	age := now.Sub(metadata.CreatedAt)
+	if metadata.Hostname != hostname {
+		if opts.RemoteOlderThan <= 0 {
+			return false, fmt.Sprintf("created on host %q, remote databases not reaped", metadata.Hostname)
+		}
+		if age < opts.RemoteOlderThan {
+			return false, fmt.Sprintf("created %s ago on host %q, younger than %s",
+				age.Round(time.Second), metadata.Hostname, opts.RemoteOlderThan)
+		}
+		return true, fmt.Sprintf("created %s ago on host %q", age.Round(time.Second), metadata.Hostname)
+	}
+
+	olderThan := opts.OlderThan
+	if olderThan == 0 {
+		olderThan = DefaultReapOlderThan
+	}
+	if age < olderThan {
+		return false, fmt.Sprintf("created %s ago, younger than %s", age.Round(time.Second), olderThan)
+	}
+	if metadata.PID == os.Getpid() || processAlive(metadata.PID) {
+		return false, fmt.Sprintf("creating process %d is still running", metadata.PID)
+	}
+	return true, fmt.Sprintf("created %s ago, creating process %d is gone", age.Round(time.Second), metadata.PID)
+}
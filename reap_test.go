@@ -0,0 +1,163 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// deadPID is a process ID above the Linux pid_max limit.
+const deadPID = 1<<31 - 1
+
+// TestReap tests dropping databases left behind by crashed test runs.
+func TestReap(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// stampDatabase stamps the database as created by the process at the time.
+	stampDatabase := func(c *qt.C, dbName string, pid int, createdAt time.Time) {
+		metadata := pgdbtemplatepq.NewDatabaseMetadata()
+		metadata.PID = pid
+		metadata.CreatedAt = createdAt
+		c.Assert(provider.SetDatabaseMetadata(ctx, dbName, metadata), qt.IsNil)
+	}
+
+	c.Run("Requires prefix or pattern", func(c *qt.C) {
+		_, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{})
+		c.Assert(err, qt.ErrorMatches, "at least one prefix or a pattern is required")
+	})
+
+	c.Run("Orphaned database is dropped", func(c *qt.C) {
+		c.Parallel()
+		orphaned := createScratchDatabase(c, "reap_orphan_test")
+		stampDatabase(c, orphaned, deadPID, time.Now().Add(-2*time.Hour))
+		alive := createScratchDatabase(c, "reap_orphan_test")
+		stampDatabase(c, alive, os.Getpid(), time.Now().Add(-2*time.Hour))
+		unstamped := createScratchDatabase(c, "reap_orphan_test")
+
+		plan, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{
+			Prefixes:  []string{"reap_orphan_test_"},
+			OlderThan: time.Hour,
+		})
+		c.Assert(err, qt.IsNil)
+
+		decisions := make(map[string]pgdbtemplatepq.ReapedDatabase)
+		for _, reaped := range plan {
+			decisions[reaped.Name] = reaped
+		}
+		c.Assert(decisions[orphaned].Drop, qt.IsTrue)
+		c.Assert(decisions[orphaned].Dropped, qt.IsTrue)
+		c.Assert(decisions[alive].Drop, qt.IsFalse)
+		c.Assert(decisions[alive].Reason, qt.Matches, "creating process .* is still running")
+		c.Assert(decisions[unstamped].Drop, qt.IsFalse)
+		c.Assert(decisions[unstamped].Metadata, qt.IsNil)
+
+		_, err = provider.DatabaseMetadata(ctx, orphaned)
+		c.Assert(err, qt.ErrorMatches, ".*does not exist")
+	})
+
+	c.Run("Young database is kept", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "reap_young_test")
+		stampDatabase(c, dbName, deadPID, time.Now())
+
+		plan, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{
+			Pattern:   regexp.MustCompile(`^reap_young_test_\d+$`),
+			OlderThan: time.Hour,
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(plan, qt.HasLen, 1)
+		c.Assert(plan[0].Drop, qt.IsFalse)
+		c.Assert(plan[0].Reason, qt.Matches, "created .* ago, younger than 1h0m0s")
+	})
+
+	c.Run("Dry run only plans", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "reap_dry_run_test")
+		stampDatabase(c, dbName, deadPID, time.Now().Add(-2*time.Hour))
+
+		plan, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{
+			Prefixes: []string{"reap_dry_run_test_"},
+			DryRun:   true,
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(plan, qt.HasLen, 1)
+		c.Assert(plan[0].Drop, qt.IsTrue)
+		c.Assert(plan[0].Dropped, qt.IsFalse)
+
+		metadata, err := provider.DatabaseMetadata(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(metadata.PID, qt.Equals, deadPID)
+	})
+
+	c.Run("Remote databases are kept unless old enough", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "reap_remote_test")
+		metadata := pgdbtemplatepq.NewDatabaseMetadata()
+		metadata.Hostname = "ci-runner-elsewhere"
+		metadata.CreatedAt = time.Now().Add(-2 * time.Hour)
+		c.Assert(provider.SetDatabaseMetadata(ctx, dbName, metadata), qt.IsNil)
+
+		for _, test := range []struct {
+			remoteOlderThan time.Duration
+			drop            bool
+			reason          string
+		}{
+			{0, false, `created on host "ci-runner-elsewhere", remote databases not reaped`},
+			{3 * time.Hour, false, `created .* ago on host "ci-runner-elsewhere", younger than 3h0m0s`},
+			{time.Hour, true, `created .* ago on host "ci-runner-elsewhere"`},
+		} {
+			plan, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{
+				Prefixes:        []string{"reap_remote_test_"},
+				OlderThan:       -1,
+				RemoteOlderThan: test.remoteOlderThan,
+				DryRun:          true,
+			})
+			c.Assert(err, qt.IsNil)
+			c.Assert(plan, qt.HasLen, 1)
+			c.Assert(plan[0].Drop, qt.Equals, test.drop)
+			c.Assert(plan[0].Reason, qt.Matches, test.reason)
+		}
+	})
+
+	c.Run("Unstamped databases included on request", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "reap_unstamped_test")
+
+		plan, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{
+			Prefixes:         []string{"reap_unstamped_test_"},
+			IncludeUnstamped: true,
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(plan, qt.HasLen, 1)
+		c.Assert(plan[0].Name, qt.Equals, dbName)
+		c.Assert(plan[0].Dropped, qt.IsTrue)
+	})
+
+	c.Run("Cloned databases are stamped", func(c *qt.C) {
+		c.Parallel()
+		templateName := createScratchDatabase(c, "reap_stamp_template")
+		cloneName := fmt.Sprintf("reap_stamp_test_%d", time.Now().UnixNano())
+		c.Assert(provider.CloneDatabase(ctx, cloneName, templateName), qt.IsNil)
+		defer provider.DropDatabase(ctx, cloneName)
+
+		metadata, err := provider.DatabaseMetadata(ctx, cloneName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(metadata, qt.IsNotNil)
+		c.Assert(metadata.PID, qt.Equals, os.Getpid())
+	})
+}
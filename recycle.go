@@ -0,0 +1,403 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// recycleBaselineSchema is the schema holding the copies of the seeded tables
+// of recycled databases, which their rows are restored from.
+const recycleBaselineSchema = "pgdbtemplate_baseline"
+
+// catalogDigestQuery returns a digest of the user-visible schema of a database.
+const catalogDigestQuery = `
+	SELECT md5(coalesce(string_agg(line, E'\n' ORDER BY line), '')) FROM (
+		SELECT 'namespace ' || n.nspname AS line
+		FROM pg_namespace n
+		WHERE ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'relation ' || n.nspname || '.' || c.relname || ' ' || c.relkind || ' ' ||
+			CASE WHEN c.relkind IN ('v', 'm') THEN md5(pg_get_viewdef(c.oid)) ELSE '' END
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'column ' || n.nspname || '.' || c.relname || ' ' || a.attnum || ' ' || a.attname || ' ' ||
+			format_type(a.atttypid, a.atttypmod) || ' ' || a.attnotnull || ' ' ||
+			coalesce(pg_get_expr(d.adbin, d.adrelid), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attnum > 0 AND NOT a.attisdropped AND ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'constraint ' || n.nspname || ' ' || con.conname || ' ' || pg_get_constraintdef(con.oid)
+		FROM pg_constraint con JOIN pg_namespace n ON n.oid = con.connamespace
+		WHERE ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'index ' || pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'function ' || n.nspname || '.' || p.proname || '(' ||
+			pg_get_function_identity_arguments(p.oid) || ') ' || md5(coalesce(p.prosrc, ''))
+		FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'trigger ' || n.nspname || '.' || c.relname || ' ' || t.tgname || ' ' || t.tgenabled
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal AND ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'type ' || n.nspname || '.' || t.typname || ' ' || t.typtype
+		FROM pg_type t JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE ` + userNamespaceCondition + `
+		UNION ALL
+		SELECT 'enum ' || n.nspname || '.' || t.typname || ' ' || e.enumsortorder || ' ' || e.enumlabel
+		FROM pg_enum e
+		JOIN pg_type t ON t.oid = e.enumtypid
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE ` + userNamespaceCondition + `
+	) lines
+`
+
+// errSchemaChanged reports that a recycled database no longer matches its template.
+var errSchemaChanged = errors.New("schema differs from the template")
+
+// recycleBaseline is the state a recycled database is reset to,
+// captured from a fresh clone of the template.
+type recycleBaseline struct {
+	// digest is the catalog digest of the template.
+	digest string
+	// tables are all user tables, seeded ones in the order they are restored in.
+	tables []baselineTable
+	// sequences are all user sequences.
+	sequences []baselineSequence
+	// overriding inserts values into identity columns, on PostgreSQL 10 and later.
+	overriding bool
+	// err is set if the baseline cannot be restored.
+	err error
+}
+
+// baselineTable is a user table, with the copy of its rows if it is seeded.
+type baselineTable struct {
+	name    string
+	columns string // Quoted columns the rows are restored into.
+	seeded  bool
+	copy    string // Quoted name of the copy in recycleBaselineSchema.
+}
+
+// baselineSequence is a user sequence with its state.
+type baselineSequence struct {
+	name      string
+	lastValue int64
+	isCalled  bool
+}
+
+// captureBaseline captures the schema digest, the seeded tables and the
+// sequence state of a freshly cloned database.
+func captureBaseline(ctx context.Context, conn *DatabaseConnection) (*recycleBaseline, error) {
+	digest, err := catalogDigest(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var versionNum int
+	if err := conn.DB.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum); err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+	baseline := &recycleBaseline{digest: digest, overriding: versionNum >= 100000}
+
+	tables, dependencies, err := listBaselineTables(ctx, conn, versionNum)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tables {
+		query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM ONLY %s)", tables[i].name)
+		if err := conn.DB.QueryRowContext(ctx, query).Scan(&tables[i].seeded); err != nil {
+			return nil, fmt.Errorf("failed to check rows of %s: %w", tables[i].name, err)
+		}
+		tables[i].copy = pq.QuoteIdentifier(recycleBaselineSchema) + "." + pq.QuoteIdentifier(fmt.Sprintf("table_%d", i))
+	}
+	// Such databases are not recycled, but they can still be pooled.
+	baseline.tables, baseline.err = orderBaselineTables(tables, dependencies)
+
+	if baseline.sequences, err = listBaselineSequences(ctx, conn); err != nil {
+		return nil, err
+	}
+	return baseline, nil
+}
+
+// catalogDigest returns the digest of the user schema of the database.
+func catalogDigest(ctx context.Context, conn *DatabaseConnection) (string, error) {
+	var digest string
+	if err := conn.DB.QueryRowContext(ctx, catalogDigestQuery).Scan(&digest); err != nil {
+		return "", fmt.Errorf("failed to compute catalog digest: %w", err)
+	}
+	return digest, nil
+}
+
+// listBaselineTables lists the user tables with the columns their rows are
+// restored into, and the tables each one references, including the partitions
+// and inheritance children of referenced tables.
+func listBaselineTables(ctx context.Context, conn *DatabaseConnection, versionNum int) (_ []baselineTable, _ map[string][]string, err error) {
+	// Generated columns are computed again when the rows are restored.
+	insertable := "true"
+	if versionNum >= 120000 {
+		insertable = "a.attgenerated = ''"
+	}
+	rows, err := conn.DB.QueryContext(ctx, `
+		SELECT
+			quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+			coalesce((
+				SELECT string_agg(quote_ident(a.attname), ', ' ORDER BY a.attnum)
+				FROM pg_attribute a
+				WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped AND `+insertable+`
+			), ''),
+			coalesce((
+				SELECT json_agg(DISTINCT quote_ident(rn.nspname) || '.' || quote_ident(r.relname))
+				FROM pg_constraint con
+				JOIN pg_class r ON r.oid = con.confrelid OR r.oid IN (
+					SELECT inhrelid FROM pg_inherits WHERE inhparent = con.confrelid
+				)
+				JOIN pg_namespace rn ON rn.oid = r.relnamespace
+				WHERE con.contype = 'f' AND con.conrelid = c.oid AND r.oid <> c.oid
+			), '[]')::text
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'r' AND `+userNamespaceCondition+`
+		ORDER BY 1
+	`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	var tables []baselineTable
+	dependencies := make(map[string][]string)
+	for rows.Next() {
+		var (
+			table          baselineTable
+			referencedJSON string
+			referenced     []string
+		)
+		if err := rows.Scan(&table.name, &table.columns, &referencedJSON); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan table: %w", err)
+		}
+		if err := json.Unmarshal([]byte(referencedJSON), &referenced); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode references of %s: %w", table.name, err)
+		}
+		tables = append(tables, table)
+		dependencies[table.name] = referenced
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	return tables, dependencies, nil
+}
+
+// orderBaselineTables orders the tables so that seeded tables come after the
+// seeded tables they reference, reporting an error if seeded tables reference
+// each other, as their rows cannot be restored one table after another.
+func orderBaselineTables(tables []baselineTable, dependencies map[string][]string) ([]baselineTable, error) {
+	seeded := make(map[string]int, len(tables))
+	for i, table := range tables {
+		if table.seeded {
+			seeded[table.name] = i
+		}
+	}
+
+	var (
+		ordered []baselineTable
+		visit   func(i int, path []string) error
+	)
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[int]int, len(tables))
+	visit = func(i int, path []string) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("seeded tables %s reference each other", strings.Join(append(path, tables[i].name), ", "))
+		}
+		state[i] = visiting
+		for _, referenced := range dependencies[tables[i].name] {
+			if j, ok := seeded[referenced]; ok {
+				if err := visit(j, append(path, tables[i].name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = visited
+		ordered = append(ordered, tables[i])
+		return nil
+	}
+	for i, table := range tables {
+		if table.seeded && table.columns == "" {
+			return tables, fmt.Errorf("seeded table %s has no columns to restore", table.name)
+		}
+		if err := visit(i, nil); err != nil {
+			return tables, err
+		}
+	}
+	return ordered, nil
+}
+
+// listBaselineSequences lists the user sequences with their state.
+func listBaselineSequences(ctx context.Context, conn *DatabaseConnection) (_ []baselineSequence, err error) {
+	rows, err := conn.DB.QueryContext(ctx, `
+		SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'S' AND `+userNamespaceCondition+`
+		ORDER BY 1
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sequences: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	var sequences []baselineSequence
+	for rows.Next() {
+		var sequence baselineSequence
+		if err := rows.Scan(&sequence.name); err != nil {
+			return nil, fmt.Errorf("failed to scan sequence: %w", err)
+		}
+		sequences = append(sequences, sequence)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list sequences: %w", err)
+	}
+
+	for i := range sequences {
+		query := fmt.Sprintf("SELECT last_value, is_called FROM %s", sequences[i].name)
+		if err := conn.DB.QueryRowContext(ctx, query).Scan(&sequences[i].lastValue, &sequences[i].isCalled); err != nil {
+			return nil, fmt.Errorf("failed to read sequence %s: %w", sequences[i].name, err)
+		}
+	}
+	return sequences, nil
+}
+
+// store copies the seeded tables of a fresh clone of the template into
+// recycleBaselineSchema, where reset restores their rows from.
+// The copies are unlogged and hidden from the introspection of the package.
+func (b *recycleBaseline) store(ctx context.Context, conn *DatabaseConnection) (err error) {
+	if b.err != nil {
+		return nil
+	}
+
+	tx, err := conn.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin baseline transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback() // #nosec G104 -- Rollback error in error path is not critical.
+		}
+	}()
+
+	// The template may be a snapshot of a recycled database.
+	schema := pq.QuoteIdentifier(recycleBaselineSchema)
+	if _, err := tx.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+schema+" CASCADE; CREATE SCHEMA "+schema); err != nil {
+		return fmt.Errorf("failed to create baseline schema: %w", err)
+	}
+	for _, table := range b.tables {
+		if !table.seeded {
+			continue
+		}
+		query := fmt.Sprintf("CREATE UNLOGGED TABLE %s AS SELECT %s FROM ONLY %s", table.copy, table.columns, table.name)
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to copy rows of %s: %w", table.name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit baseline transaction: %w", err)
+	}
+	return nil
+}
+
+// reset verifies the schema of the database, truncates all user tables,
+// restores the rows of the seeded ones from their copies and resets
+// the sequences to the baseline.
+//
+// The seeded rows are copied back on every reset, so that the cost of
+// recycling grows with the seeded data, unlike the cost of cloning.
+// It returns errSchemaChanged if the schema was changed, e.g. by DDL in a test.
+func (b *recycleBaseline) reset(ctx context.Context, conn *DatabaseConnection) (err error) {
+	if b.err != nil {
+		return b.err
+	}
+	digest, err := catalogDigest(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if digest != b.digest {
+		return errSchemaChanged
+	}
+
+	tx, err := conn.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin reset transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+				err = errors.Join(err, rollbackErr)
+			}
+		}
+	}()
+
+	if len(b.tables) > 0 {
+		names := make([]string, len(b.tables))
+		for i, table := range b.tables {
+			names[i] = table.name
+		}
+		query := "TRUNCATE " + strings.Join(names, ", ") + " RESTART IDENTITY CASCADE"
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to truncate tables: %w", err)
+		}
+	}
+
+	overriding := ""
+	if b.overriding {
+		overriding = " OVERRIDING SYSTEM VALUE"
+	}
+	for _, table := range b.tables {
+		if !table.seeded {
+			continue
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s)%s SELECT %s FROM %s", table.name, table.columns, overriding, table.columns, table.copy)
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to restore rows of %s: %w", table.name, err)
+		}
+	}
+
+	for _, sequence := range b.sequences {
+		if _, err := tx.ExecContext(ctx, "SELECT setval($1::regclass, $2, $3)",
+			sequence.name, sequence.lastValue, sequence.isCalled); err != nil {
+			return fmt.Errorf("failed to reset sequence %s: %w", sequence.name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit reset transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestPoolRecycle tests resetting released databases in place.
+func TestPoolRecycle(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// createSeededTemplate creates a template with seeded tables.
+	createSeededTemplate := func(c *qt.C, prefix string) string {
+		templateName := createScratchDatabase(c, prefix)
+		conn, err := provider.Connect(ctx, templateName)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		_, err = conn.ExecContext(ctx, `
+			CREATE TABLE accounts (id SERIAL PRIMARY KEY, name TEXT NOT NULL);
+			CREATE TABLE posts (
+				id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+				account_id INTEGER NOT NULL REFERENCES accounts (id),
+				title TEXT NOT NULL,
+				slug TEXT GENERATED ALWAYS AS (lower(title)) STORED
+			);
+			CREATE TABLE comments (id SERIAL PRIMARY KEY, post_id INTEGER REFERENCES posts (id));
+			INSERT INTO accounts (name) VALUES ('admin'), ('guest');
+			INSERT INTO posts (account_id, title) VALUES (1, 'Welcome');
+		`)
+		c.Assert(err, qt.IsNil)
+		return templateName
+	}
+
+	// newRecyclingPool returns a recycling pool of one database.
+	newRecyclingPool := func(c *qt.C, templateName string) *pgdbtemplatepq.Pool {
+		pool, err := provider.NewPool(pgdbtemplatepq.PoolConfig{
+			TemplateName:  templateName,
+			NamePrefix:    fmt.Sprintf("recycle_%d_", time.Now().UnixNano()),
+			LowWatermark:  1,
+			HighWatermark: 1,
+			Recycle:       true,
+		})
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() { pool.Close(ctx) })
+		return pool
+	}
+
+	c.Run("Data is reset", func(c *qt.C) {
+		c.Parallel()
+		pool := newRecyclingPool(c, createSeededTemplate(c, "recycle_data_template"))
+
+		db, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		name := db.Name
+		_, err = db.Conn.ExecContext(ctx, `
+			INSERT INTO accounts (name) VALUES ('temporary');
+			DELETE FROM accounts WHERE name = 'temporary';
+			INSERT INTO comments (post_id) VALUES (1), (1);
+			SET search_path TO nowhere;
+		`)
+		c.Assert(err, qt.IsNil)
+		c.Assert(db.Release(ctx), qt.IsNil)
+
+		db, err = pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		defer db.Release(ctx)
+		c.Assert(db.Name, qt.Equals, name)
+		c.Assert(pool.Stats().Recycled, qt.Equals, 1)
+
+		var accounts, posts, comments int
+		err = db.Conn.QueryRowContext(ctx, `
+			SELECT (SELECT count(*) FROM accounts WHERE name IN ('admin', 'guest')),
+				(SELECT count(*) FROM posts WHERE slug = 'welcome'),
+				(SELECT count(*) FROM comments)
+		`).Scan(&accounts, &posts, &comments)
+		c.Assert(err, qt.IsNil)
+		c.Assert([]int{accounts, posts, comments}, qt.DeepEquals, []int{2, 1, 0})
+
+		// Sequences continue where the template left them.
+		var accountID, postID, commentID int
+		c.Assert(db.Conn.QueryRowContext(ctx,
+			"INSERT INTO accounts (name) VALUES ('next') RETURNING id").Scan(&accountID), qt.IsNil)
+		c.Assert(db.Conn.QueryRowContext(ctx,
+			"INSERT INTO posts (account_id, title) VALUES (1, 'Next') RETURNING id").Scan(&postID), qt.IsNil)
+		c.Assert(db.Conn.QueryRowContext(ctx,
+			"INSERT INTO comments (post_id) VALUES (1) RETURNING id").Scan(&commentID), qt.IsNil)
+		c.Assert([]int{accountID, postID, commentID}, qt.DeepEquals, []int{3, 2, 1})
+	})
+
+	c.Run("Seeded data is restored", func(c *qt.C) {
+		c.Parallel()
+		pool := newRecyclingPool(c, createSeededTemplate(c, "recycle_seed_template"))
+
+		db, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		name := db.Name
+		_, err = db.Conn.ExecContext(ctx, `
+			UPDATE accounts SET name = 'changed' WHERE id = 1;
+			DELETE FROM posts;
+			INSERT INTO posts (account_id, title) VALUES (2, 'Other');
+		`)
+		c.Assert(err, qt.IsNil)
+		c.Assert(db.Release(ctx), qt.IsNil)
+		c.Assert(pool.Stats().Discarded, qt.Equals, 0)
+
+		db, err = pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		defer db.Release(ctx)
+		c.Assert(db.Name, qt.Equals, name)
+
+		var accounts, posts string
+		err = db.Conn.QueryRowContext(ctx, `
+			SELECT (SELECT string_agg(id || ' ' || name, ', ' ORDER BY id) FROM accounts),
+				(SELECT string_agg(id || ' ' || account_id || ' ' || slug, ', ' ORDER BY id) FROM posts)
+		`).Scan(&accounts, &posts)
+		c.Assert(err, qt.IsNil)
+		c.Assert(accounts, qt.Equals, "1 admin, 2 guest")
+		c.Assert(posts, qt.Equals, "1 1 welcome")
+
+		// The copies of the seeded rows are not part of the schema.
+		schema, err := pgdbtemplatepq.InspectSchema(ctx, db.Conn)
+		c.Assert(err, qt.IsNil)
+		for _, object := range schema.Objects {
+			c.Assert(object.Name, qt.Not(qt.Contains), "pgdbtemplate_baseline")
+		}
+	})
+
+	c.Run("Schema changes are not recycled", func(c *qt.C) {
+		c.Parallel()
+		pool := newRecyclingPool(c, createSeededTemplate(c, "recycle_ddl_template"))
+
+		db, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		name := db.Name
+		_, err = db.Conn.ExecContext(ctx, "ALTER TABLE accounts ADD COLUMN email TEXT")
+		c.Assert(err, qt.IsNil)
+		c.Assert(db.Release(ctx), qt.IsNil)
+		c.Assert(pool.Stats().Discarded, qt.Equals, 1)
+
+		_, err = provider.DatabaseMetadata(ctx, name)
+		c.Assert(err, qt.ErrorMatches, ".*does not exist")
+
+		db, err = pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		defer db.Release(ctx)
+		c.Assert(db.Name, qt.Not(qt.Equals), name)
+	})
+
+	c.Run("Temporary tables do not prevent recycling", func(c *qt.C) {
+		c.Parallel()
+		pool := newRecyclingPool(c, createSeededTemplate(c, "recycle_temp_template"))
+
+		db, err := pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		name := db.Name
+		_, err = db.Conn.ExecContext(ctx, "CREATE TEMPORARY TABLE scratch (id INT)")
+		c.Assert(err, qt.IsNil)
+		c.Assert(db.Release(ctx), qt.IsNil)
+
+		db, err = pool.Get(ctx)
+		c.Assert(err, qt.IsNil)
+		defer db.Release(ctx)
+		c.Assert(db.Name, qt.Equals, name)
+	})
+}
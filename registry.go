@@ -0,0 +1,254 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+)
+
+// Default TemplateRegistryConfig values.
+const (
+	defaultRegistryTemplatePrefix = "registry_"
+	defaultRegistryTestDBPrefix   = "testdb_"
+)
+
+// testDBSuffixLength is the length of the suffix TemplateManager appends to
+// test database prefixes, allowing for a counter of up to 4 digits.
+const testDBSuffixLength = 24
+
+// variantNamePattern matches the names of template variants,
+// which are part of database names.
+var variantNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// TemplateVariant declares a template of a TemplateRegistry.
+type TemplateVariant struct {
+	// Name identifies the variant, e.g. "empty" or "seeded".
+	// It consists of lower-case letters, digits and underscores.
+	//
+	// This field is required and must be unique in the registry.
+	Name string
+	// MigrationRunner builds the template,
+	// e.g. a SeedingMigrationRunner for a seeded variant.
+	//
+	// This field is required.
+	MigrationRunner pgdbtemplate.MigrationRunner
+	// Parent is the name of the variant this one is derived from.
+	// The template is then cloned from the template of the parent,
+	// which is built first, and MigrationRunner only runs the extra
+	// migrations and seeders.
+	Parent string
+}
+
+// TemplateRegistryConfig configures ConnectionProvider.NewTemplateRegistry.
+type TemplateRegistryConfig struct {
+	// Variants are the templates of the registry.
+	//
+	// At least one variant is required.
+	Variants []TemplateVariant
+	// TemplatePrefix is the prefix of the template database names,
+	// which are followed by the variant name and a unique suffix.
+	//
+	// If empty, "registry_" will be used.
+	TemplatePrefix string
+	// TestDBPrefix is the prefix of the test database names,
+	// which are followed by the variant name and a unique suffix.
+	//
+	// If empty, "testdb_" will be used.
+	TestDBPrefix string
+}
+
+// TemplateRegistry manages named template variants built from one provider.
+//
+// Each variant is built by its own TemplateManager when it is
+// first needed, so that unused variants cost nothing. Different variants
+// are built concurrently, while concurrent callers of one variant wait for
+// its single build. A failed build is retried by the next caller.
+type TemplateRegistry struct {
+	variants map[string]*registeredVariant
+	names    []string // Sorted variant names.
+}
+
+// registeredVariant is a variant of a TemplateRegistry.
+type registeredVariant struct {
+	templateName string
+	testDBPrefix string
+	parent       string
+	manager      *TemplateManager
+}
+
+// NewTemplateRegistry returns a registry of the template variants.
+// No template is built until it is needed.
+func (p *ConnectionProvider) NewTemplateRegistry(config TemplateRegistryConfig) (*TemplateRegistry, error) {
+	if len(config.Variants) == 0 {
+		return nil, errors.New("at least one template variant is required")
+	}
+	if config.TemplatePrefix == "" {
+		config.TemplatePrefix = defaultRegistryTemplatePrefix
+	}
+	if config.TestDBPrefix == "" {
+		config.TestDBPrefix = defaultRegistryTestDBPrefix
+	}
+
+	registry := &TemplateRegistry{variants: make(map[string]*registeredVariant, len(config.Variants))}
+	for _, variant := range config.Variants {
+		switch {
+		case !variantNamePattern.MatchString(variant.Name):
+			return nil, fmt.Errorf("invalid template variant name %q: lower-case letters, digits and underscores are required",
+				variant.Name)
+		case registry.variants[variant.Name] != nil:
+			return nil, fmt.Errorf("template variant %q is declared more than once", variant.Name)
+		case variant.MigrationRunner == nil:
+			return nil, fmt.Errorf("template variant %q has no MigrationRunner", variant.Name)
+		}
+
+		// Template names are unique across processes and registries.
+		templateName := fmt.Sprintf("%s%s_%d_%d", config.TemplatePrefix, variant.Name, os.Getpid(), time.Now().UnixNano()%1e9)
+		if len(templateName) > maxIdentifierLength {
+			return nil, fmt.Errorf("template name %q exceeds %d characters", templateName, maxIdentifierLength)
+		}
+		// TemplateManager appends a timestamp and a counter to the prefix.
+		testDBPrefix := config.TestDBPrefix + variant.Name + "_"
+		if len(testDBPrefix)+testDBSuffixLength > maxIdentifierLength {
+			return nil, fmt.Errorf("test database prefix %q is too long", testDBPrefix)
+		}
+		registry.variants[variant.Name] = &registeredVariant{templateName: templateName, testDBPrefix: testDBPrefix, parent: variant.Parent}
+		registry.names = append(registry.names, variant.Name)
+	}
+	sort.Strings(registry.names)
+
+	for _, variant := range config.Variants {
+		if variant.Parent == "" {
+			continue
+		}
+		if registry.variants[variant.Parent] == nil {
+			return nil, fmt.Errorf("parent %q of template variant %q is not declared", variant.Parent, variant.Name)
+		}
+		// A chain longer than the number of variants is a cycle.
+		ancestor := variant.Parent
+		for depth := 0; ancestor != ""; depth++ {
+			if depth == len(config.Variants) {
+				return nil, fmt.Errorf("template variant %q is derived from itself", variant.Name)
+			}
+			ancestor = registry.variants[ancestor].parent
+		}
+	}
+	for _, variant := range config.Variants {
+		registered := registry.variants[variant.Name]
+		// Derived variants are cloned from the templates of their parents.
+		var parentTemplate string
+		if registered.parent != "" {
+			parentTemplate = registry.variants[registered.parent].templateName
+		}
+		manager, err := p.NewTemplateManager(TemplateManagerConfig{
+			MigrationRunner: variant.MigrationRunner,
+			TemplateName:    registered.templateName,
+			TestDBPrefix:    registered.testDBPrefix,
+			Parent:          parentTemplate,
+		})
+		if err != nil {
+			return nil, err
+		}
+		registered.manager = manager
+	}
+	return registry, nil
+}
+
+// Initialize builds the templates of the variants concurrently,
+// or of all variants if none are given. Derived variants are built
+// after their parents. Built templates are not rebuilt.
+func (r *TemplateRegistry) Initialize(ctx context.Context, variants ...string) error {
+	if len(variants) == 0 {
+		variants = r.names
+	}
+	for _, variant := range variants {
+		if _, err := r.variant(variant); err != nil {
+			return err
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(variants))
+	)
+	for i, variant := range variants {
+		wg.Add(1)
+		go func(i int, variant string) {
+			defer wg.Done()
+			errs[i] = r.build(ctx, variant)
+		}(i, variant)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// build builds the template of the variant after the templates of its ancestors.
+func (r *TemplateRegistry) build(ctx context.Context, variant string) error {
+	registered := r.variants[variant]
+	if registered.parent != "" {
+		if err := r.build(ctx, registered.parent); err != nil {
+			return err
+		}
+	}
+	if err := registered.manager.Initialize(ctx); err != nil {
+		return fmt.Errorf("failed to build template variant %q: %w", variant, err)
+	}
+	return nil
+}
+
+// CreateTestDatabase creates a test database from the template of the variant,
+// building the template first if needed.
+//
+// Like TemplateManager.CreateTestDatabase, it returns
+// the connection to the test database and its name, which may be given.
+func (r *TemplateRegistry) CreateTestDatabase(ctx context.Context, variant string, testDBName ...string) (pgdbtemplate.DatabaseConnection, string, error) {
+	if err := r.Initialize(ctx, variant); err != nil {
+		return nil, "", err
+	}
+	return r.variants[variant].manager.CreateTestDatabase(ctx, testDBName...)
+}
+
+// TemplateName returns the name of the template database of the variant,
+// building the template first if needed, e.g. for ConnectionProvider.NewPool.
+func (r *TemplateRegistry) TemplateName(ctx context.Context, variant string) (string, error) {
+	if err := r.Initialize(ctx, variant); err != nil {
+		return "", err
+	}
+	return r.variants[variant].templateName, nil
+}
+
+// DropTestDatabase drops a test database created from the template of the variant.
+func (r *TemplateRegistry) DropTestDatabase(ctx context.Context, variant, dbName string) error {
+	registered, err := r.variant(variant)
+	if err != nil {
+		return err
+	}
+	return registered.manager.DropTestDatabase(ctx, dbName)
+}
+
+// Cleanup drops the test databases and templates of all variants.
+// Variants which were not built are skipped.
+func (r *TemplateRegistry) Cleanup(ctx context.Context) error {
+	var errs []error
+	for _, variant := range r.names {
+		if err := r.variants[variant].manager.Cleanup(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up template variant %q: %w", variant, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// variant returns the registered variant.
+func (r *TemplateRegistry) variant(variant string) (*registeredVariant, error) {
+	registered, ok := r.variants[variant]
+	if !ok {
+		return nil, fmt.Errorf("unknown template variant %q", variant)
+	}
+	return registered, nil
+}
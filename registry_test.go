@@ -0,0 +1,227 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestTemplateRegistry tests building named template variants.
+func TestTemplateRegistry(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// databaseExists reports whether the database exists.
+	databaseExists := func(c *qt.C, name string) bool {
+		adminDB, err := sql.Open("postgres", testConnectionString)
+		c.Assert(err, qt.IsNil)
+		defer adminDB.Close()
+		var exists bool
+		err = adminDB.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_database WHERE datname = $1)", name).Scan(&exists)
+		c.Assert(err, qt.IsNil)
+		return exists
+	}
+
+	c.Run("Invalid configurations", func(c *qt.C) {
+		runner := &countingMigrationRunner{}
+		for _, test := range []struct {
+			config  pgdbtemplatepq.TemplateRegistryConfig
+			message string
+		}{{
+			config:  pgdbtemplatepq.TemplateRegistryConfig{},
+			message: "at least one template variant is required",
+		}, {
+			config: pgdbtemplatepq.TemplateRegistryConfig{
+				Variants: []pgdbtemplatepq.TemplateVariant{{Name: "Seeded", MigrationRunner: runner}},
+			},
+			message: `invalid template variant name "Seeded": .*`,
+		}, {
+			config: pgdbtemplatepq.TemplateRegistryConfig{
+				Variants: []pgdbtemplatepq.TemplateVariant{{Name: "seeded", MigrationRunner: runner}, {Name: "seeded", MigrationRunner: runner}},
+			},
+			message: `template variant "seeded" is declared more than once`,
+		}, {
+			config: pgdbtemplatepq.TemplateRegistryConfig{
+				Variants: []pgdbtemplatepq.TemplateVariant{{Name: "seeded"}},
+			},
+			message: `template variant "seeded" has no MigrationRunner`,
+		}, {
+			config: pgdbtemplatepq.TemplateRegistryConfig{
+				Variants: []pgdbtemplatepq.TemplateVariant{{Name: strings.Repeat("x", 40), MigrationRunner: runner}},
+			},
+			message: `template name "registry_x+_.*" exceeds 63 characters`,
+		}, {
+			config: pgdbtemplatepq.TemplateRegistryConfig{
+				Variants:     []pgdbtemplatepq.TemplateVariant{{Name: "seeded", MigrationRunner: runner}},
+				TestDBPrefix: strings.Repeat("x", 40),
+			},
+			message: `test database prefix "x+seeded_" is too long`,
+		}, {
+			config: pgdbtemplatepq.TemplateRegistryConfig{
+				Variants: []pgdbtemplatepq.TemplateVariant{{Name: "large", MigrationRunner: runner, Parent: "base"}},
+			},
+			message: `parent "base" of template variant "large" is not declared`,
+		}, {
+			config: pgdbtemplatepq.TemplateRegistryConfig{
+				Variants: []pgdbtemplatepq.TemplateVariant{
+					{Name: "a", MigrationRunner: runner, Parent: "b"},
+					{Name: "b", MigrationRunner: runner, Parent: "a"},
+				},
+			},
+			message: `template variant "a" is derived from itself`,
+		}} {
+			_, err := provider.NewTemplateRegistry(test.config)
+			c.Assert(err, qt.ErrorMatches, test.message)
+		}
+	})
+
+	c.Run("Unknown variant", func(c *qt.C) {
+		registry, err := provider.NewTemplateRegistry(pgdbtemplatepq.TemplateRegistryConfig{
+			Variants: []pgdbtemplatepq.TemplateVariant{{Name: "empty", MigrationRunner: &countingMigrationRunner{}}},
+		})
+		c.Assert(err, qt.IsNil)
+		_, _, err = registry.CreateTestDatabase(ctx, "seeded")
+		c.Assert(err, qt.ErrorMatches, `unknown template variant "seeded"`)
+		c.Assert(registry.DropTestDatabase(ctx, "seeded", "testdb_1"), qt.ErrorMatches, `unknown template variant "seeded"`)
+		// Nothing was built, so there is nothing to clean up.
+		c.Assert(registry.Cleanup(ctx), qt.IsNil)
+	})
+
+	c.Run("Variants are built lazily and cleaned up together", func(c *qt.C) {
+		c.Parallel()
+		empty := &countingMigrationRunner{}
+		seeded := &countingMigrationRunner{}
+		large := &countingMigrationRunner{}
+		registry, err := provider.NewTemplateRegistry(pgdbtemplatepq.TemplateRegistryConfig{
+			Variants: []pgdbtemplatepq.TemplateVariant{
+				{Name: "empty", MigrationRunner: empty},
+				{Name: "seeded", MigrationRunner: seeded},
+				{Name: "large", MigrationRunner: large},
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		defer registry.Cleanup(ctx)
+
+		// Concurrent callers wait for a single build of their variant.
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			dbNames []string
+		)
+		for i := 0; i < 4; i++ {
+			variant := []string{"empty", "seeded"}[i%2]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, dbName, err := registry.CreateTestDatabase(ctx, variant)
+				c.Check(err, qt.IsNil)
+				if err != nil {
+					return
+				}
+				conn.Close()
+				mu.Lock()
+				dbNames = append(dbNames, dbName)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		c.Assert(dbNames, qt.HasLen, 4)
+		c.Assert(empty.runs.Load(), qt.Equals, int32(1))
+		c.Assert(seeded.runs.Load(), qt.Equals, int32(1))
+		c.Assert(large.runs.Load(), qt.Equals, int32(0))
+		for _, dbName := range dbNames {
+			c.Assert(dbName, qt.Matches, `testdb_(empty|seeded)_.*`)
+		}
+
+		templateName, err := registry.TemplateName(ctx, "seeded")
+		c.Assert(err, qt.IsNil)
+		c.Assert(templateName, qt.Matches, `registry_seeded_.*`)
+		c.Assert(seeded.runs.Load(), qt.Equals, int32(1))
+
+		c.Assert(registry.Cleanup(ctx), qt.IsNil)
+		c.Assert(databaseExists(c, templateName), qt.IsFalse)
+		for _, dbName := range dbNames {
+			c.Assert(databaseExists(c, dbName), qt.IsFalse)
+		}
+	})
+
+	c.Run("Failed builds are reported and retried", func(c *qt.C) {
+		c.Parallel()
+		migrationErr := errors.New("boom")
+		failing := &countingMigrationRunner{err: migrationErr}
+		registry, err := provider.NewTemplateRegistry(pgdbtemplatepq.TemplateRegistryConfig{
+			Variants: []pgdbtemplatepq.TemplateVariant{
+				{Name: "empty", MigrationRunner: &countingMigrationRunner{}},
+				{Name: "broken", MigrationRunner: failing},
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		defer registry.Cleanup(ctx)
+
+		err = registry.Initialize(ctx)
+		c.Assert(err, qt.ErrorIs, migrationErr)
+		c.Assert(err, qt.ErrorMatches, `failed to build template variant "broken": .*boom`)
+
+		// The other variant was built.
+		conn, _, err := registry.CreateTestDatabase(ctx, "empty")
+		c.Assert(err, qt.IsNil)
+		conn.Close()
+
+		_, _, err = registry.CreateTestDatabase(ctx, "broken")
+		c.Assert(err, qt.ErrorIs, migrationErr)
+		c.Assert(failing.runs.Load(), qt.Equals, int32(2))
+	})
+
+	c.Run("Derived variants are cloned from their parents", func(c *qt.C) {
+		c.Parallel()
+		base := &countingMigrationRunner{}
+		registry, err := provider.NewTemplateRegistry(pgdbtemplatepq.TemplateRegistryConfig{
+			Variants: []pgdbtemplatepq.TemplateVariant{
+				{Name: "base", MigrationRunner: base},
+				{
+					Name:   "large",
+					Parent: "base",
+					MigrationRunner: pgdbtemplatepq.NewSeedingMigrationRunner(nil, pgdbtemplatepq.Seeder{
+						Name: "large",
+						Seed: func(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+							_, err := conn.ExecContext(ctx, "INSERT INTO fingerprinted SELECT generate_series(1, 100)")
+							return err
+						},
+					}),
+				},
+			},
+		})
+		c.Assert(err, qt.IsNil)
+		defer registry.Cleanup(ctx)
+
+		conn, _, err := registry.CreateTestDatabase(ctx, "large")
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		var rows int
+		c.Assert(conn.QueryRowContext(ctx, "SELECT count(*) FROM fingerprinted").Scan(&rows), qt.IsNil)
+		c.Assert(rows, qt.Equals, 100)
+
+		// The parent was built once, and is not affected by the child.
+		c.Assert(base.runs.Load(), qt.Equals, int32(1))
+		baseConn, _, err := registry.CreateTestDatabase(ctx, "base")
+		c.Assert(err, qt.IsNil)
+		defer baseConn.Close()
+		c.Assert(baseConn.QueryRowContext(ctx, "SELECT count(*) FROM fingerprinted").Scan(&rows), qt.IsNil)
+		c.Assert(rows, qt.Equals, 0)
+		c.Assert(base.runs.Load(), qt.Equals, int32(1))
+	})
+}
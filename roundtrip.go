@@ -0,0 +1,217 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffixes of the files read by LoadMigrations.
+const (
+	upMigrationSuffix   = ".up.sql"
+	downMigrationSuffix = ".down.sql"
+)
+
+// defaultRoundTripTemplate is the default database the round-trip
+// scratch database is cloned from.
+const defaultRoundTripTemplate = "template0"
+
+// Migration is a reversible migration.
+type Migration struct {
+	// Name identifies the migration in errors.
+	Name string
+	// Up is the SQL applying the migration.
+	Up string
+	// Down is the SQL reverting the migration.
+	Down string
+	// Dir is the directory of the migration files, which \ir includes
+	// are relative to. If empty, the working directory is used.
+	Dir string
+}
+
+// LoadMigrations reads the reversible migrations from the directory,
+// pairing "<name>.up.sql" with "<name>.down.sql" files, ordered by name.
+// Empty files are valid, e.g. a down file of a migration which only
+// changes data.
+func LoadMigrations(dir string) ([]Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %q: %w", dir, err)
+	}
+
+	byName := map[string]*Migration{}
+	// found records the up and down files per migration, which may be empty.
+	found := map[string]*[2]bool{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var name string
+		switch {
+		case entry.IsDir():
+			continue
+		case strings.HasSuffix(fileName, upMigrationSuffix):
+			name = strings.TrimSuffix(fileName, upMigrationSuffix)
+		case strings.HasSuffix(fileName, downMigrationSuffix):
+			name = strings.TrimSuffix(fileName, downMigrationSuffix)
+		default:
+			continue
+		}
+
+		path := filepath.Join(dir, fileName)
+		content, err := os.ReadFile(path) // #nosec G304 -- Migration files are controlled by the application.
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration file %q: %w", path, err)
+		}
+		migration := byName[name]
+		if migration == nil {
+			migration = &Migration{Name: name, Dir: dir}
+			byName[name] = migration
+			found[name] = &[2]bool{}
+		}
+		if strings.HasSuffix(fileName, upMigrationSuffix) {
+			migration.Up = string(content)
+			found[name][0] = true
+		} else {
+			migration.Down = string(content)
+			found[name][1] = true
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byName))
+	for name, migration := range byName {
+		if !found[name][0] {
+			return nil, fmt.Errorf("migration %q has no up file", name)
+		}
+		if !found[name][1] {
+			return nil, fmt.Errorf("migration %q has no down file", name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Name < migrations[j].Name
+	})
+	return migrations, nil
+}
+
+// RoundTripConfig configures ConnectionProvider.VerifyRoundTrip.
+type RoundTripConfig struct {
+	// TemplateName is the database the scratch database is cloned from.
+	//
+	// If empty, "template0" will be used.
+	TemplateName string
+	// Migrations are the migrations to verify, in the order of application.
+	Migrations []Migration
+	// Variables are the psql variables of the migrations,
+	// as set by WithMigrationVariables.
+	Variables map[string]string
+}
+
+// RoundTripError reports a migration whose down migration
+// does not exactly revert its up migration.
+type RoundTripError struct {
+	// Migration is the name of the migration.
+	Migration string
+	// Stage is "down" when the down migration did not restore the schema
+	// preceding the up migration, or "up" when reapplying the up migration
+	// did not reproduce the schema of its first application.
+	Stage string
+	// Diff is the difference from the expected schema to the actual one.
+	Diff *SchemaDiff
+}
+
+// Error implements the error interface.
+func (e *RoundTripError) Error() string {
+	if e.Stage == "up" {
+		return fmt.Sprintf("migration %q produces a different schema when reapplied after its down migration:\n%s",
+			e.Migration, e.Diff)
+	}
+	return fmt.Sprintf("down migration of %q does not revert its up migration:\n%s", e.Migration, e.Diff)
+}
+
+// VerifyRoundTrip verifies that the down migrations revert their up migrations.
+//
+// The migrations are applied one at a time on a scratch database cloned
+// from the template, like FileMigrationRunner applies migration files:
+// in a transaction per step unless annotated with "-- +notx",
+// with psql meta-commands expanded and COPY FROM stdin data loaded. Each migration is applied up, down and up again,
+// comparing the schema after every step with InspectSchema. The first
+// mismatch is returned as a *RoundTripError. The scratch database is
+// dropped afterwards.
+func (p *ConnectionProvider) VerifyRoundTrip(ctx context.Context, config RoundTripConfig) (err error) {
+	templateName := config.TemplateName
+	if templateName == "" {
+		templateName = defaultRoundTripTemplate
+	}
+
+	databaseName := fmt.Sprintf("pgdbtemplate_roundtrip_%d", time.Now().UnixNano())
+	if err := p.CloneDatabase(ctx, databaseName, templateName); err != nil {
+		return err
+	}
+	defer func() {
+		if _, dropErr := p.DropDatabase(context.Background(), databaseName); dropErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to drop scratch database: %w", dropErr))
+		}
+	}()
+
+	conn, err := p.connect(ctx, databaseName)
+	if err != nil {
+		return fmt.Errorf("failed to connect to scratch database: %w", err)
+	}
+	defer conn.Close()
+
+	before, err := InspectSchema(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, migration := range config.Migrations {
+		if err := runMigrationStep(ctx, conn, migration, upMigrationSuffix, config.Variables); err != nil {
+			return fmt.Errorf("failed to apply up migration %q: %w", migration.Name, err)
+		}
+		after, err := InspectSchema(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if err := runMigrationStep(ctx, conn, migration, downMigrationSuffix, config.Variables); err != nil {
+			return fmt.Errorf("failed to apply down migration %q: %w", migration.Name, err)
+		}
+		reverted, err := InspectSchema(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if diff := before.Diff(reverted); !diff.Empty() {
+			return &RoundTripError{Migration: migration.Name, Stage: "down", Diff: diff}
+		}
+
+		if err := runMigrationStep(ctx, conn, migration, upMigrationSuffix, config.Variables); err != nil {
+			return fmt.Errorf("failed to reapply up migration %q: %w", migration.Name, err)
+		}
+		reapplied, err := InspectSchema(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if diff := after.Diff(reapplied); !diff.Empty() {
+			return &RoundTripError{Migration: migration.Name, Stage: "up", Diff: diff}
+		}
+		before = reapplied
+	}
+	return nil
+}
+
+// runMigrationStep runs the up or down SQL of the migration, per its file suffix,
+// with the statement executor of FileMigrationRunner.
+func runMigrationStep(ctx context.Context, conn *DatabaseConnection, migration Migration, suffix string, variables map[string]string) error {
+	content := migration.Up
+	if suffix == downMigrationSuffix {
+		content = migration.Down
+	}
+	expanded, err := expandPsqlScript(filepath.Join(migration.Dir, migration.Name+suffix), content, variables)
+	if err != nil {
+		return fmt.Errorf("failed to expand migration file: %w", err)
+	}
+	return runPsqlScript(ctx, conn, expanded)
+}
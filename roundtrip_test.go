@@ -0,0 +1,168 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestVerifyRoundTrip tests verifying that down migrations revert up migrations.
+func TestVerifyRoundTrip(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// writeMigrations writes the migration files to a new directory.
+	writeMigrations := func(c *qt.C, files map[string]string) string {
+		dir := c.TempDir()
+		for name, content := range files {
+			c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600), qt.IsNil)
+		}
+		return dir
+	}
+
+	c.Run("Migrations are loaded in order", func(c *qt.C) {
+		dir := writeMigrations(c, map[string]string{
+			"002_posts.up.sql":   "CREATE TABLE posts (id INT);",
+			"002_posts.down.sql": "DROP TABLE posts;",
+			"001_users.up.sql":   "CREATE TABLE users (id INT);",
+			"001_users.down.sql": "DROP TABLE users;",
+			"README.md":          "Not a migration.",
+		})
+		migrations, err := pgdbtemplatepq.LoadMigrations(dir)
+		c.Assert(err, qt.IsNil)
+		c.Assert(migrations, qt.DeepEquals, []pgdbtemplatepq.Migration{
+			{Name: "001_users", Up: "CREATE TABLE users (id INT);", Down: "DROP TABLE users;", Dir: dir},
+			{Name: "002_posts", Up: "CREATE TABLE posts (id INT);", Down: "DROP TABLE posts;", Dir: dir},
+		})
+	})
+
+	c.Run("Empty down file", func(c *qt.C) {
+		dir := writeMigrations(c, map[string]string{
+			"001_backfill.up.sql":   "UPDATE users SET name = lower(name);",
+			"001_backfill.down.sql": "",
+		})
+		migrations, err := pgdbtemplatepq.LoadMigrations(dir)
+		c.Assert(err, qt.IsNil)
+		c.Assert(migrations, qt.DeepEquals, []pgdbtemplatepq.Migration{
+			{Name: "001_backfill", Up: "UPDATE users SET name = lower(name);", Dir: dir},
+		})
+	})
+
+	c.Run("Migration without down file", func(c *qt.C) {
+		dir := writeMigrations(c, map[string]string{"001_users.up.sql": "CREATE TABLE users (id INT);"})
+		_, err := pgdbtemplatepq.LoadMigrations(dir)
+		c.Assert(err, qt.ErrorMatches, `migration "001_users" has no down file`)
+	})
+
+	c.Run("Reversible migrations", func(c *qt.C) {
+		c.Parallel()
+		err := provider.VerifyRoundTrip(ctx, pgdbtemplatepq.RoundTripConfig{
+			Migrations: []pgdbtemplatepq.Migration{{
+				Name: "001_users",
+				Up:   "CREATE TABLE users (id SERIAL PRIMARY KEY, email TEXT NOT NULL UNIQUE);",
+				Down: "DROP TABLE users;",
+			}, {
+				Name: "002_status",
+				Up: `CREATE TYPE status AS ENUM ('active', 'banned');
+					ALTER TABLE users ADD COLUMN status status NOT NULL DEFAULT 'active';`,
+				Down: "ALTER TABLE users DROP COLUMN status; DROP TYPE status;",
+			}},
+		})
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Incomplete down migration", func(c *qt.C) {
+		c.Parallel()
+		err := provider.VerifyRoundTrip(ctx, pgdbtemplatepq.RoundTripConfig{
+			Migrations: []pgdbtemplatepq.Migration{{
+				Name: "001_users",
+				Up:   "CREATE TABLE users (id INT);",
+				Down: "DROP TABLE users;",
+			}, {
+				Name: "002_users_email",
+				Up:   "ALTER TABLE users ADD COLUMN email TEXT; CREATE INDEX users_email_idx ON users (email);",
+				Down: "DROP INDEX users_email_idx;",
+			}, {
+				Name: "003_posts",
+				Up:   "CREATE TABLE posts (id INT);",
+				Down: "SELECT 1;",
+			}},
+		})
+		var roundTripErr *pgdbtemplatepq.RoundTripError
+		c.Assert(errors.As(err, &roundTripErr), qt.IsTrue, qt.Commentf("error: %v", err))
+		c.Assert(roundTripErr.Migration, qt.Equals, "002_users_email")
+		c.Assert(roundTripErr.Stage, qt.Equals, "down")
+		c.Assert(roundTripErr.Diff.Removed, qt.HasLen, 0)
+		c.Assert(roundTripErr.Diff.Added, qt.HasLen, 1)
+		c.Assert(roundTripErr.Diff.Added[0].Kind, qt.Equals, pgdbtemplatepq.SchemaObjectColumn)
+		c.Assert(roundTripErr.Diff.Added[0].Name, qt.Equals, "public.users.email")
+	})
+
+	c.Run("Up migration is not reproducible", func(c *qt.C) {
+		c.Parallel()
+		// The up migration names its table after a counter its down migration does not reset.
+		err := provider.VerifyRoundTrip(ctx, pgdbtemplatepq.RoundTripConfig{
+			Migrations: []pgdbtemplatepq.Migration{{
+				Name: "001_counter",
+				Up:   "CREATE TABLE counter (n INT NOT NULL); INSERT INTO counter VALUES (0);",
+				Down: "DROP TABLE counter;",
+			}, {
+				Name: "002_partition",
+				Up: `UPDATE counter SET n = n + 1;
+					DO $$ BEGIN EXECUTE format('CREATE TABLE part_%s (id INT)', (SELECT n FROM counter)); END $$;`,
+				Down: "DO $$ BEGIN EXECUTE format('DROP TABLE part_%s', (SELECT n FROM counter)); END $$;",
+			}},
+		})
+		var roundTripErr *pgdbtemplatepq.RoundTripError
+		c.Assert(errors.As(err, &roundTripErr), qt.IsTrue, qt.Commentf("error: %v", err))
+		c.Assert(roundTripErr.Migration, qt.Equals, "002_partition")
+		c.Assert(roundTripErr.Stage, qt.Equals, "up")
+		c.Assert(err, qt.ErrorMatches, `(?s)migration "002_partition" produces a different schema when reapplied.*`)
+	})
+
+	c.Run("Migrations run like migration files", func(c *qt.C) {
+		c.Parallel()
+		dir := writeMigrations(c, map[string]string{
+			"users.sql": "CREATE TABLE :table (id INT, name TEXT);\n",
+		})
+		err := provider.VerifyRoundTrip(ctx, pgdbtemplatepq.RoundTripConfig{
+			Variables: map[string]string{"table": "users"},
+			Migrations: []pgdbtemplatepq.Migration{{
+				Name: "001_users",
+				Dir:  dir,
+				Up:   "\\ir users.sql\nCOPY users (id, name) FROM stdin;\n1\tadmin\n\\.\n",
+				Down: "DROP TABLE users;",
+			}, {
+				Name: "002_index",
+				Up:   "-- +notx\nCREATE INDEX CONCURRENTLY users_name ON users (name);",
+				Down: "-- +notx\nDROP INDEX CONCURRENTLY users_name;",
+			}},
+		})
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("Failing down migration", func(c *qt.C) {
+		c.Parallel()
+		err := provider.VerifyRoundTrip(ctx, pgdbtemplatepq.RoundTripConfig{
+			Migrations: []pgdbtemplatepq.Migration{{
+				Name: "001_users",
+				Up:   "CREATE TABLE users (id INT);",
+				Down: "DROP TABLE accounts;",
+			}},
+		})
+		c.Assert(err, qt.ErrorMatches, `(?s)failed to apply down migration "001_users": 001_users.down.sql:1:.*does not exist.*`)
+	})
+}
@@ -0,0 +1,318 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+)
+
+// SchemaObjectKind is the kind of a schema object.
+type SchemaObjectKind string
+
+// Schema object kinds reported by InspectSchema.
+const (
+	SchemaObjectSchema     SchemaObjectKind = "schema"
+	SchemaObjectExtension  SchemaObjectKind = "extension"
+	SchemaObjectType       SchemaObjectKind = "type"
+	SchemaObjectTable      SchemaObjectKind = "table"
+	SchemaObjectColumn     SchemaObjectKind = "column"
+	SchemaObjectConstraint SchemaObjectKind = "constraint"
+	SchemaObjectIndex      SchemaObjectKind = "index"
+	SchemaObjectView       SchemaObjectKind = "view"
+	SchemaObjectSequence   SchemaObjectKind = "sequence"
+	SchemaObjectFunction   SchemaObjectKind = "function"
+	SchemaObjectTrigger    SchemaObjectKind = "trigger"
+	SchemaObjectGrant      SchemaObjectKind = "grant"
+)
+
+// userNamespaceCondition restricts catalog queries to user schemas,
+// excluding system, TOAST and temporary ones, and the copies of the seeded
+// tables of recycled databases.
+const userNamespaceCondition = `n.nspname NOT IN ('pg_catalog', 'information_schema', '` + recycleBaselineSchema + `') AND n.nspname NOT LIKE 'pg\_%'`
+
+// notExtensionMember excludes the objects created by extensions,
+// which are covered by the extension itself.
+const notExtensionMember = `NOT EXISTS (
+	SELECT 1 FROM pg_depend dep
+	WHERE dep.classid = '%s'::regclass AND dep.objid = %s AND dep.deptype = 'e'
+)`
+
+// inspectSchemaQuery returns the user schema objects of a database
+// as a JSON array of [kind, name, definition] triples.
+var inspectSchemaQuery = `
+	SELECT coalesce(json_agg(json_build_array(kind, name, definition) ORDER BY kind, name), '[]')::text FROM (
+		SELECT 'schema' AS kind, n.nspname AS name, '' AS definition
+		FROM pg_namespace n
+		WHERE ` + userNamespaceCondition + `
+
+		UNION ALL
+		SELECT 'extension', e.extname, e.extversion || ' in schema ' || n.nspname
+		FROM pg_extension e JOIN pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname <> 'plpgsql'
+
+		UNION ALL
+		SELECT 'type', n.nspname || '.' || t.typname,
+			CASE t.typtype
+				WHEN 'e' THEN 'enum (' || (
+					SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder)
+					FROM pg_enum e WHERE e.enumtypid = t.oid
+				) || ')'
+				WHEN 'd' THEN 'domain ' || format_type(t.typbasetype, t.typtypmod) ||
+					CASE WHEN t.typnotnull THEN ' NOT NULL' ELSE '' END ||
+					coalesce(' DEFAULT ' || t.typdefault, '')
+				WHEN 'c' THEN 'composite (' || (
+					SELECT string_agg(quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod), ', ' ORDER BY a.attnum)
+					FROM pg_attribute a WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+				) || ')'
+				WHEN 'r' THEN 'range'
+				ELSE 'base'
+			END
+		FROM pg_type t JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE ` + userNamespaceCondition + `
+			AND (t.typrelid = 0 OR (SELECT c.relkind FROM pg_class c WHERE c.oid = t.typrelid) = 'c')
+			AND NOT EXISTS (SELECT 1 FROM pg_type elem WHERE elem.typarray = t.oid)
+			AND ` + fmt.Sprintf(notExtensionMember, "pg_type", "t.oid") + `
+
+		UNION ALL
+		SELECT 'table', n.nspname || '.' || c.relname,
+			CASE c.relkind WHEN 'p' THEN 'partitioned' WHEN 'f' THEN 'foreign' ELSE 'ordinary' END ||
+			CASE c.relpersistence WHEN 'u' THEN ' unlogged' ELSE '' END
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'f') AND ` + userNamespaceCondition + `
+			AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid") + `
+
+		UNION ALL
+		SELECT 'column', n.nspname || '.' || c.relname || '.' || a.attname,
+			format_type(a.atttypid, a.atttypmod) ||
+			CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END ||
+			coalesce(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm') AND a.attnum > 0 AND NOT a.attisdropped
+			AND ` + userNamespaceCondition + `
+			AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid") + `
+
+		UNION ALL
+		SELECT 'constraint', n.nspname || '.' || coalesce(c.relname, t.typname) || '.' || con.conname,
+			pg_get_constraintdef(con.oid)
+		FROM pg_constraint con
+		JOIN pg_namespace n ON n.oid = con.connamespace
+		LEFT JOIN pg_class c ON c.oid = con.conrelid
+		LEFT JOIN pg_type t ON t.oid = con.contypid
+		WHERE ` + userNamespaceCondition + `
+
+		UNION ALL
+		SELECT 'index', n.nspname || '.' || c.relname, pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE ` + userNamespaceCondition + `
+			AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "i.indrelid") + `
+
+		UNION ALL
+		SELECT 'view', n.nspname || '.' || c.relname,
+			CASE c.relkind WHEN 'm' THEN 'materialized ' ELSE '' END || pg_get_viewdef(c.oid)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm') AND ` + userNamespaceCondition + `
+			AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid") + `
+
+		UNION ALL
+		SELECT 'sequence', s.sequence_schema || '.' || s.sequence_name,
+			s.data_type || ' START ' || s.start_value || ' MINVALUE ' || s.minimum_value ||
+			' MAXVALUE ' || s.maximum_value || ' INCREMENT ' || s.increment ||
+			CASE s.cycle_option WHEN 'YES' THEN ' CYCLE' ELSE '' END
+		FROM information_schema.sequences s
+		WHERE s.sequence_schema NOT LIKE 'pg\_%'
+
+		UNION ALL
+		SELECT 'function', n.nspname || '.' || p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')',
+			'RETURNS ' || coalesce(pg_get_function_result(p.oid), '') || ' LANGUAGE ' || l.lanname ||
+			' AS ' || coalesce(p.prosrc, '')
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		JOIN pg_language l ON l.oid = p.prolang
+		WHERE ` + userNamespaceCondition + `
+			AND ` + fmt.Sprintf(notExtensionMember, "pg_proc", "p.oid") + `
+
+		UNION ALL
+		SELECT 'trigger', n.nspname || '.' || c.relname || '.' || t.tgname,
+			pg_get_triggerdef(t.oid) || CASE t.tgenabled WHEN 'D' THEN ' DISABLED' ELSE '' END
+		FROM pg_trigger t
+		JOIN pg_class c ON c.oid = t.tgrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal AND ` + userNamespaceCondition + `
+
+		UNION ALL
+		SELECT 'grant', object || ' TO ' || grantee, string_agg(privilege, ', ' ORDER BY privilege)
+		FROM (
+			SELECT 'schema ' || n.nspname AS object, acl.grantee, acl.privilege_type AS privilege
+			FROM pg_namespace n, aclexplode(n.nspacl) acl
+			WHERE ` + userNamespaceCondition + `
+			UNION ALL
+			SELECT 'relation ' || n.nspname || '.' || c.relname, acl.grantee, acl.privilege_type
+			FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace, aclexplode(c.relacl) acl
+			WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm', 'S') AND ` + userNamespaceCondition + `
+			UNION ALL
+			SELECT 'function ' || n.nspname || '.' || p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')',
+				acl.grantee, acl.privilege_type
+			FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace, aclexplode(p.proacl) acl
+			WHERE ` + userNamespaceCondition + `
+		) grants(object, grantee_oid, privilege)
+		CROSS JOIN LATERAL (
+			SELECT CASE grantee_oid WHEN 0 THEN 'PUBLIC' ELSE pg_get_userbyid(grantee_oid)::text END
+		) g(grantee)
+		GROUP BY object, grantee
+	) objects
+`
+
+// SchemaObject is an object of a database schema.
+type SchemaObject struct {
+	// Kind is the kind of the object.
+	Kind SchemaObjectKind
+	// Name identifies the object, qualified by its schema
+	// and, for columns, constraints and triggers, by its table.
+	Name string
+	// Definition describes the object; objects with the same
+	// kind, name and definition are considered equal.
+	Definition string
+}
+
+// String returns the kind, name and definition of the object.
+func (o SchemaObject) String() string {
+	if o.Definition == "" {
+		return fmt.Sprintf("%s %s", o.Kind, o.Name)
+	}
+	return fmt.Sprintf("%s %s: %s", o.Kind, o.Name, o.Definition)
+}
+
+// Schema is the user schema of a database as seen by InspectSchema.
+type Schema struct {
+	// Objects are the schema objects sorted by kind and name.
+	Objects []SchemaObject
+}
+
+// SchemaChange is an object whose definition differs between two schemas.
+type SchemaChange struct {
+	// Kind is the kind of the object.
+	Kind SchemaObjectKind
+	// Name identifies the object.
+	Name string
+	// From is the definition in the first schema.
+	From string
+	// To is the definition in the second schema.
+	To string
+}
+
+// SchemaDiff is the difference between two schemas.
+type SchemaDiff struct {
+	// Added are the objects only in the second schema.
+	Added []SchemaObject
+	// Removed are the objects only in the first schema.
+	Removed []SchemaObject
+	// Changed are the objects whose definitions differ.
+	Changed []SchemaChange
+}
+
+// InspectSchema returns the user schema of the database.
+//
+// It covers schemas, extensions, types, tables, columns with their types
+// and defaults, constraints, indexes, views, sequences, functions, triggers
+// and grants. System schemas, temporary objects and objects created by
+// extensions are excluded.
+func InspectSchema(ctx context.Context, conn pgdbtemplate.DatabaseConnection) (*Schema, error) {
+	var encoded string
+	if err := conn.QueryRowContext(ctx, inspectSchemaQuery).Scan(&encoded); err != nil {
+		return nil, fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	var triples [][3]string
+	if err := json.Unmarshal([]byte(encoded), &triples); err != nil {
+		return nil, fmt.Errorf("failed to decode schema: %w", err)
+	}
+
+	schema := &Schema{Objects: make([]SchemaObject, len(triples))}
+	for i, triple := range triples {
+		schema.Objects[i] = SchemaObject{Kind: SchemaObjectKind(triple[0]), Name: triple[1], Definition: triple[2]}
+	}
+	return schema, nil
+}
+
+// CompareSchema compares the user schemas of two databases,
+// e.g. of a test database and a fresh clone of its template.
+func CompareSchema(ctx context.Context, a, b pgdbtemplate.DatabaseConnection) (*SchemaDiff, error) {
+	schemaA, err := InspectSchema(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	schemaB, err := InspectSchema(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	return schemaA.Diff(schemaB), nil
+}
+
+// Diff returns the difference from the schema to the other one.
+func (s *Schema) Diff(other *Schema) *SchemaDiff {
+	type key struct {
+		kind SchemaObjectKind
+		name string
+	}
+	theirs := make(map[key]SchemaObject, len(other.Objects))
+	for _, object := range other.Objects {
+		theirs[key{object.Kind, object.Name}] = object
+	}
+
+	diff := &SchemaDiff{}
+	ours := make(map[key]bool, len(s.Objects))
+	for _, object := range s.Objects {
+		k := key{object.Kind, object.Name}
+		ours[k] = true
+		otherObject, ok := theirs[k]
+		switch {
+		case !ok:
+			diff.Removed = append(diff.Removed, object)
+		case otherObject.Definition != object.Definition:
+			diff.Changed = append(diff.Changed, SchemaChange{
+				Kind: object.Kind,
+				Name: object.Name,
+				From: object.Definition,
+				To:   otherObject.Definition,
+			})
+		}
+	}
+	for _, object := range other.Objects {
+		if !ours[key{object.Kind, object.Name}] {
+			diff.Added = append(diff.Added, object)
+		}
+	}
+	return diff
+}
+
+// Empty reports whether the schemas are equal.
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String returns a human-readable description of the difference,
+// one object per line sorted by kind and name.
+func (d *SchemaDiff) String() string {
+	var lines []string
+	for _, object := range d.Removed {
+		lines = append(lines, "- "+object.String())
+	}
+	for _, object := range d.Added {
+		lines = append(lines, "+ "+object.String())
+	}
+	for _, change := range d.Changed {
+		lines = append(lines, fmt.Sprintf("~ %s %s: %s -> %s", change.Kind, change.Name, change.From, change.To))
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i][2:] < lines[j][2:]
+	})
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,146 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestCompareSchema tests comparing the schemas of two databases.
+func TestCompareSchema(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	const schemaSQL = `
+		CREATE TYPE mood AS ENUM ('sad', 'happy');
+		CREATE TABLE users (
+			id SERIAL PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			mood mood DEFAULT 'happy'
+		);
+		CREATE INDEX users_mood_idx ON users (mood);
+		CREATE VIEW happy_users AS SELECT id FROM users WHERE mood = 'happy';
+		CREATE FUNCTION touch() RETURNS trigger LANGUAGE plpgsql AS $$ BEGIN RETURN NEW; END $$;
+		CREATE TRIGGER users_touch BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE touch();
+		GRANT SELECT ON users TO PUBLIC;
+	`
+
+	// createDatabase creates a database with the schema.
+	createDatabase := func(c *qt.C, prefix string) pgdbtemplate.DatabaseConnection {
+		conn, err := provider.Connect(ctx, createScratchDatabase(c, prefix))
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() { conn.Close() })
+		_, err = conn.ExecContext(ctx, schemaSQL)
+		c.Assert(err, qt.IsNil)
+		return conn
+	}
+
+	c.Run("Equal schemas", func(c *qt.C) {
+		c.Parallel()
+		a := createDatabase(c, "schema_equal_a")
+		b := createDatabase(c, "schema_equal_b")
+
+		// Data and temporary objects do not matter.
+		_, err := b.ExecContext(ctx, `
+			INSERT INTO users (email) VALUES ('user@example.com');
+			CREATE TEMPORARY TABLE scratch (id INT);
+		`)
+		c.Assert(err, qt.IsNil)
+
+		diff, err := pgdbtemplatepq.CompareSchema(ctx, a, b)
+		c.Assert(err, qt.IsNil)
+		c.Assert(diff.Empty(), qt.IsTrue, qt.Commentf("%s", diff))
+	})
+
+	c.Run("Changed schemas", func(c *qt.C) {
+		c.Parallel()
+		a := createDatabase(c, "schema_changed_a")
+		b := createDatabase(c, "schema_changed_b")
+		_, err := b.ExecContext(ctx, `
+			ALTER TABLE users ALTER COLUMN email TYPE VARCHAR(255);
+			ALTER TABLE users ADD COLUMN name TEXT;
+			DROP INDEX users_mood_idx;
+			REVOKE SELECT ON users FROM PUBLIC;
+		`)
+		c.Assert(err, qt.IsNil)
+
+		diff, err := pgdbtemplatepq.CompareSchema(ctx, a, b)
+		c.Assert(err, qt.IsNil)
+		c.Assert(diff.Empty(), qt.IsFalse)
+		c.Assert(diff.Added, qt.DeepEquals, []pgdbtemplatepq.SchemaObject{{
+			Kind:       pgdbtemplatepq.SchemaObjectColumn,
+			Name:       "public.users.name",
+			Definition: "text",
+		}})
+		c.Assert(diff.Changed, qt.DeepEquals, []pgdbtemplatepq.SchemaChange{{
+			Kind: pgdbtemplatepq.SchemaObjectColumn,
+			Name: "public.users.email",
+			From: "text NOT NULL",
+			To:   "character varying(255) NOT NULL",
+		}})
+
+		removed := make(map[pgdbtemplatepq.SchemaObjectKind]string)
+		for _, object := range diff.Removed {
+			removed[object.Kind] = object.Name
+		}
+		c.Assert(removed, qt.DeepEquals, map[pgdbtemplatepq.SchemaObjectKind]string{
+			pgdbtemplatepq.SchemaObjectIndex: "public.users_mood_idx",
+			pgdbtemplatepq.SchemaObjectGrant: "relation public.users TO PUBLIC",
+		})
+	})
+
+	c.Run("Inspected objects", func(c *qt.C) {
+		c.Parallel()
+		schema, err := pgdbtemplatepq.InspectSchema(ctx, createDatabase(c, "schema_inspect"))
+		c.Assert(err, qt.IsNil)
+
+		kinds := make(map[pgdbtemplatepq.SchemaObjectKind]bool)
+		for _, object := range schema.Objects {
+			kinds[object.Kind] = true
+		}
+		for _, kind := range []pgdbtemplatepq.SchemaObjectKind{
+			pgdbtemplatepq.SchemaObjectSchema,
+			pgdbtemplatepq.SchemaObjectType,
+			pgdbtemplatepq.SchemaObjectTable,
+			pgdbtemplatepq.SchemaObjectColumn,
+			pgdbtemplatepq.SchemaObjectConstraint,
+			pgdbtemplatepq.SchemaObjectIndex,
+			pgdbtemplatepq.SchemaObjectView,
+			pgdbtemplatepq.SchemaObjectSequence,
+			pgdbtemplatepq.SchemaObjectFunction,
+			pgdbtemplatepq.SchemaObjectTrigger,
+			pgdbtemplatepq.SchemaObjectGrant,
+		} {
+			c.Assert(kinds[kind], qt.IsTrue, qt.Commentf("kind %s", kind))
+		}
+	})
+
+	c.Run("Diff string", func(c *qt.C) {
+		before := &pgdbtemplatepq.Schema{Objects: []pgdbtemplatepq.SchemaObject{
+			{Kind: pgdbtemplatepq.SchemaObjectSchema, Name: "public"},
+			{Kind: pgdbtemplatepq.SchemaObjectTable, Name: "public.a", Definition: "ordinary"},
+			{Kind: pgdbtemplatepq.SchemaObjectColumn, Name: "public.a.id", Definition: "integer"},
+		}}
+		after := &pgdbtemplatepq.Schema{Objects: []pgdbtemplatepq.SchemaObject{
+			{Kind: pgdbtemplatepq.SchemaObjectSchema, Name: "public"},
+			{Kind: pgdbtemplatepq.SchemaObjectTable, Name: "public.b", Definition: "ordinary"},
+			{Kind: pgdbtemplatepq.SchemaObjectColumn, Name: "public.a.id", Definition: "bigint"},
+		}}
+
+		c.Assert(before.Diff(before).Empty(), qt.IsTrue)
+		c.Assert(before.Diff(after).String(), qt.Equals, ""+
+			"~ column public.a.id: integer -> bigint\n"+
+			"- table public.a: ordinary\n"+
+			"+ table public.b: ordinary")
+	})
+}
@@ -0,0 +1,110 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+)
+
+// SeedFunc seeds a database with data generated in Go,
+// e.g. hashed passwords or rows built from Go structs.
+type SeedFunc func(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error
+
+// Seeder is a named SeedFunc.
+type Seeder struct {
+	// Name identifies the seeder in errors and in the fingerprint.
+	//
+	// This field is required and must be unique among the seeders.
+	Name string
+	// Version is part of the fingerprint, since the code of SeedFunc is not.
+	// Change it whenever the seeded data change, so that templates
+	// seeded by earlier versions are rebuilt.
+	Version string
+	// Seed seeds the database.
+	//
+	// This field is required.
+	Seed SeedFunc
+}
+
+// SeedingMigrationRunner runs seeders after the migrations of another runner,
+// so that templates are seeded once, when they are built.
+//
+// It implements Fingerprinter when the migration runner does,
+// combining its fingerprint with the names and versions of the seeders.
+type SeedingMigrationRunner struct {
+	migrationRunner pgdbtemplate.MigrationRunner
+	seeders         []Seeder
+	// kind names the seeders in errors and in the fingerprint,
+	// e.g. "sanitizer" for a SanitizingMigrationRunner.
+	kind string
+}
+
+// NewSeedingMigrationRunner creates a runner of the migrations followed by the seeders,
+// which run in order.
+//
+// Upon the nil migrationRunner provided, only the seeders will be run.
+func NewSeedingMigrationRunner(migrationRunner pgdbtemplate.MigrationRunner, seeders ...Seeder) *SeedingMigrationRunner {
+	if migrationRunner == nil {
+		migrationRunner = &pgdbtemplate.NoOpMigrationRunner{}
+	}
+	return &SeedingMigrationRunner{migrationRunner: migrationRunner, seeders: seeders, kind: "seeder"}
+}
+
+// RunMigrations runs the migrations, then the seeders, on the connection.
+func (r *SeedingMigrationRunner) RunMigrations(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if err := r.migrationRunner.RunMigrations(ctx, conn); err != nil {
+		return err
+	}
+	for _, seeder := range r.seeders {
+		if err := seeder.Seed(ctx, conn); err != nil {
+			return fmt.Errorf("failed to run %s %q: %w", r.kind, seeder.Name, err)
+		}
+	}
+	return nil
+}
+
+// Fingerprint implements Fingerprinter.
+func (r *SeedingMigrationRunner) Fingerprint() (string, error) {
+	if err := r.validate(); err != nil {
+		return "", err
+	}
+	var migrationsFingerprint string
+	switch runner := r.migrationRunner.(type) {
+	case Fingerprinter:
+		var err error
+		if migrationsFingerprint, err = runner.Fingerprint(); err != nil {
+			return "", err
+		}
+	case *pgdbtemplate.NoOpMigrationRunner:
+	default:
+		return "", fmt.Errorf("migration runner %T does not implement Fingerprinter", r.migrationRunner)
+	}
+
+	fp := newFingerprint()
+	fp.add("migrations", migrationsFingerprint)
+	for _, seeder := range r.seeders {
+		fp.add(r.kind, seeder.Name, seeder.Version)
+	}
+	return fp.sum(), nil
+}
+
+// validate checks that the seeders are named uniquely and have functions.
+func (r *SeedingMigrationRunner) validate() error {
+	names := make(map[string]bool, len(r.seeders))
+	for _, seeder := range r.seeders {
+		switch {
+		case seeder.Name == "":
+			return fmt.Errorf("%s name is required", r.kind)
+		case seeder.Seed == nil:
+			return fmt.Errorf("%s %q has no Seed function", r.kind, seeder.Name)
+		case names[seeder.Name]:
+			return fmt.Errorf("%s %q is defined more than once", r.kind, seeder.Name)
+		}
+		names[seeder.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestSeedingMigrationRunner tests seeding templates after migrations.
+func TestSeedingMigrationRunner(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	// execSeeder returns a seeder executing the query.
+	execSeeder := func(name, version, query string) pgdbtemplatepq.Seeder {
+		return pgdbtemplatepq.Seeder{
+			Name:    name,
+			Version: version,
+			Seed: func(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+				_, err := conn.ExecContext(ctx, query)
+				return err
+			},
+		}
+	}
+
+	// writeMigrations writes a migration file to a new directory.
+	writeMigrations := func(c *qt.C, content string) string {
+		dir := c.TempDir()
+		c.Assert(os.WriteFile(filepath.Join(dir, "001_init.sql"), []byte(content), 0o600), qt.IsNil)
+		return dir
+	}
+
+	c.Run("Seeders run in order after migrations", func(c *qt.C) {
+		dir := writeMigrations(c, "-- +notx\nCREATE TABLE users (name TEXT);\n")
+		runner := pgdbtemplatepq.NewSeedingMigrationRunner(
+			pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil),
+			execSeeder("admins", "1", "INSERT INTO users VALUES ('admin')"),
+			execSeeder("guests", "1", "INSERT INTO users VALUES ('guest')"),
+		)
+		conn := &recordingConnection{}
+		c.Assert(runner.RunMigrations(ctx, conn), qt.IsNil)
+		c.Assert(conn.statements, qt.DeepEquals, []string{
+			"CREATE TABLE users (name TEXT);",
+			"INSERT INTO users VALUES ('admin')",
+			"INSERT INTO users VALUES ('guest')",
+		})
+	})
+
+	c.Run("Seeder errors are wrapped", func(c *qt.C) {
+		seedErr := errors.New("boom")
+		runner := pgdbtemplatepq.NewSeedingMigrationRunner(nil, pgdbtemplatepq.Seeder{
+			Name: "failing",
+			Seed: func(context.Context, pgdbtemplate.DatabaseConnection) error { return seedErr },
+		})
+		err := runner.RunMigrations(ctx, &recordingConnection{})
+		c.Assert(err, qt.ErrorIs, seedErr)
+		c.Assert(err, qt.ErrorMatches, `failed to run seeder "failing": boom`)
+	})
+
+	c.Run("Invalid seeders", func(c *qt.C) {
+		seed := func(context.Context, pgdbtemplate.DatabaseConnection) error { return nil }
+		for _, test := range []struct {
+			seeders []pgdbtemplatepq.Seeder
+			message string
+		}{
+			{[]pgdbtemplatepq.Seeder{{Seed: seed}}, "seeder name is required"},
+			{[]pgdbtemplatepq.Seeder{{Name: "users"}}, `seeder "users" has no Seed function`},
+			{[]pgdbtemplatepq.Seeder{{Name: "users", Seed: seed}, {Name: "users", Seed: seed}}, `seeder "users" is defined more than once`},
+		} {
+			runner := pgdbtemplatepq.NewSeedingMigrationRunner(nil, test.seeders...)
+			c.Assert(runner.RunMigrations(ctx, &recordingConnection{}), qt.ErrorMatches, test.message)
+			_, err := runner.Fingerprint()
+			c.Assert(err, qt.ErrorMatches, test.message)
+		}
+	})
+
+	c.Run("Fingerprint covers migrations and seeders", func(c *qt.C) {
+		dir := writeMigrations(c, "CREATE TABLE users (name TEXT);")
+		fingerprint := func(c *qt.C, migrationRunner pgdbtemplate.MigrationRunner, seeders ...pgdbtemplatepq.Seeder) string {
+			fingerprint, err := pgdbtemplatepq.NewSeedingMigrationRunner(migrationRunner, seeders...).Fingerprint()
+			c.Assert(err, qt.IsNil)
+			return fingerprint
+		}
+		migrations := pgdbtemplatepq.NewFileMigrationRunner([]string{dir}, nil)
+		admins := execSeeder("admins", "1", "INSERT INTO users VALUES ('admin')")
+		guests := execSeeder("guests", "1", "INSERT INTO users VALUES ('guest')")
+
+		original := fingerprint(c, migrations, admins, guests)
+		c.Assert(fingerprint(c, migrations, admins, guests), qt.Equals, original)
+
+		// The code of seeders is not fingerprinted, only their names and versions.
+		c.Assert(fingerprint(c, migrations, admins, execSeeder("guests", "1", "SELECT 1")), qt.Equals, original)
+		for _, changed := range []string{
+			fingerprint(c, migrations, admins, execSeeder("guests", "2", "")),
+			fingerprint(c, migrations, guests, admins),
+			fingerprint(c, migrations, admins),
+			fingerprint(c, nil, admins, guests),
+			fingerprint(c, pgdbtemplatepq.NewFileMigrationRunner([]string{writeMigrations(c, "SELECT 1;")}, nil), admins, guests),
+		} {
+			c.Assert(changed, qt.Not(qt.Equals), original)
+		}
+	})
+
+	c.Run("Fingerprint requires a fingerprinted migration runner", func(c *qt.C) {
+		runner := pgdbtemplatepq.NewSeedingMigrationRunner(&countingMigrationRunner{})
+		_, err := runner.Fingerprint()
+		c.Assert(err, qt.ErrorMatches, `migration runner \*pgdbtemplatepq_test.countingMigrationRunner does not implement Fingerprinter`)
+	})
+
+	c.Run("Template is seeded once", func(c *qt.C) {
+		c.Parallel()
+		connStringFunc := func(dbName string) string {
+			return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+		}
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		prefix := fmt.Sprintf("seed_%d_", time.Now().UnixNano())
+		c.Cleanup(func() {
+			provider.Reap(ctx, pgdbtemplatepq.ReapOptions{Prefixes: []string{prefix}, IncludeUnstamped: true})
+		})
+
+		seeds := 0
+		config := pgdbtemplatepq.TemplateConfig{
+			NamePrefix: prefix,
+			MigrationRunner: pgdbtemplatepq.NewSeedingMigrationRunner(
+				pgdbtemplatepq.NewFileMigrationRunner([]string{writeMigrations(c, "CREATE TABLE users (name TEXT);")}, nil),
+				pgdbtemplatepq.Seeder{
+					Name:    "users",
+					Version: "1",
+					Seed: func(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+						seeds++
+						_, err := conn.ExecContext(ctx, "INSERT INTO users VALUES ($1)", "admin")
+						return err
+					},
+				},
+			),
+		}
+		built, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, built.Name)
+		reused, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		c.Assert(reused.Reused, qt.IsTrue)
+		c.Assert(seeds, qt.Equals, 1)
+
+		cloneName := fmt.Sprintf("seed_clone_%d", time.Now().UnixNano())
+		c.Assert(provider.CloneDatabase(ctx, cloneName, built.Name), qt.IsNil)
+		defer provider.DropDatabase(ctx, cloneName)
+		conn, err := provider.Connect(ctx, cloneName)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		var name string
+		c.Assert(conn.QueryRowContext(ctx, "SELECT name FROM users").Scan(&name), qt.IsNil)
+		c.Assert(name, qt.Equals, "admin")
+	})
+}
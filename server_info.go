@@ -0,0 +1,200 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Feature is a server capability that depends on the PostgreSQL version
+// or on the available extensions.
+type Feature string
+
+// Features known to ServerInfo.Supports.
+const (
+	// FeatureDropDatabaseForce is DROP DATABASE ... WITH (FORCE), PostgreSQL 13+.
+	FeatureDropDatabaseForce Feature = "DROP DATABASE WITH (FORCE)"
+	// FeatureCreateDatabaseLocale is CREATE DATABASE ... LOCALE, PostgreSQL 13+.
+	FeatureCreateDatabaseLocale Feature = "CREATE DATABASE LOCALE"
+	// FeatureCreateDatabaseStrategy is CREATE DATABASE ... STRATEGY, PostgreSQL 15+.
+	FeatureCreateDatabaseStrategy Feature = "CREATE DATABASE STRATEGY"
+	// FeatureICULocale is CREATE DATABASE ... ICU_LOCALE and LOCALE_PROVIDER, PostgreSQL 15+.
+	FeatureICULocale Feature = "CREATE DATABASE ICU_LOCALE"
+	// FeatureAlterTypeAddValueInTransaction is ALTER TYPE ... ADD VALUE
+	// inside a transaction block, PostgreSQL 12+.
+	FeatureAlterTypeAddValueInTransaction Feature = "ALTER TYPE ADD VALUE in transaction"
+	// FeaturePgStatStatements is the pg_stat_statements extension being available.
+	FeaturePgStatStatements Feature = "pg_stat_statements"
+	// FeaturePgPrewarm is the pg_prewarm extension being available.
+	FeaturePgPrewarm Feature = "pg_prewarm"
+)
+
+// featureMinVersions maps version-dependent features to the minimal
+// server_version_num supporting them.
+var featureMinVersions = map[Feature]int{
+	FeatureDropDatabaseForce:              130000,
+	FeatureCreateDatabaseLocale:           130000,
+	FeatureCreateDatabaseStrategy:         150000,
+	FeatureICULocale:                      150000,
+	FeatureAlterTypeAddValueInTransaction: 120000,
+}
+
+// featureExtensions maps extension-dependent features to the extension names.
+var featureExtensions = map[Feature]string{
+	FeaturePgStatStatements: "pg_stat_statements",
+	FeaturePgPrewarm:        "pg_prewarm",
+}
+
+// ServerInfo describes the PostgreSQL server and the role
+// the provider connects as.
+type ServerInfo struct {
+	// VersionNum is server_version_num, e.g. 150004.
+	VersionNum int
+	// Version is the human-readable server_version, e.g. "15.4".
+	Version string
+	// CurrentRole is the role the provider connects as.
+	CurrentRole string
+	// IsSuperuser reports whether CurrentRole is a superuser.
+	IsSuperuser bool
+	// CanCreateDB reports whether CurrentRole may create databases.
+	CanCreateDB bool
+	// MaxConnections is the max_connections setting.
+	MaxConnections int
+	// Fsync reports whether the fsync setting is on.
+	Fsync bool
+	// SynchronousCommit is the synchronous_commit setting.
+	SynchronousCommit string
+	// AvailableExtensions maps names of extensions available
+	// for installation to their default versions.
+	AvailableExtensions map[string]string
+}
+
+// Supports reports whether the server supports the feature.
+//
+// Unknown features are reported as unsupported.
+func (i *ServerInfo) Supports(feature Feature) bool {
+	if minVersion, ok := featureMinVersions[feature]; ok {
+		return i.VersionNum >= minVersion
+	}
+	if extension, ok := featureExtensions[feature]; ok {
+		return i.HasExtension(extension)
+	}
+	return false
+}
+
+// HasExtension reports whether the extension is available for installation.
+func (i *ServerInfo) HasExtension(name string) bool {
+	_, ok := i.AvailableExtensions[name]
+	return ok
+}
+
+// requireFeature returns an error describing the missing feature
+// if the server does not support it.
+func (i *ServerInfo) requireFeature(feature Feature) error {
+	if i.Supports(feature) {
+		return nil
+	}
+	if minVersion, ok := featureMinVersions[feature]; ok {
+		return fmt.Errorf("%s requires PostgreSQL %d or later, server version is %s",
+			feature, minVersion/10000, i.Version)
+	}
+	return fmt.Errorf("%s is not available on the server", feature)
+}
+
+// ServerInfo returns information about the server the provider connects to.
+//
+// The information is queried through the administrative database once
+// and cached for the lifetime of the provider. Failed queries are not cached.
+// Each call returns a copy, which the caller may modify.
+func (p *ConnectionProvider) ServerInfo(ctx context.Context) (*ServerInfo, error) {
+	info, err := p.cachedServerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return info.clone(), nil
+}
+
+// clone returns a deep copy of the server information.
+func (i *ServerInfo) clone() *ServerInfo {
+	clone := *i
+	clone.AvailableExtensions = make(map[string]string, len(i.AvailableExtensions))
+	for name, version := range i.AvailableExtensions {
+		clone.AvailableExtensions[name] = version
+	}
+	return &clone
+}
+
+// cachedServerInfo returns the cached server information, querying it first
+// if needed. The returned value is shared and must not be modified.
+func (p *ConnectionProvider) cachedServerInfo(ctx context.Context) (*ServerInfo, error) {
+	p.serverInfoMu.Lock()
+	defer p.serverInfoMu.Unlock()
+
+	if p.serverInfo != nil {
+		return p.serverInfo, nil
+	}
+
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer adminConn.Close()
+
+	info, err := queryServerInfo(ctx, adminConn)
+	if err != nil {
+		return nil, err
+	}
+	p.serverInfo = info
+	return info, nil
+}
+
+// queryServerInfo queries the server information over the connection.
+func queryServerInfo(ctx context.Context, conn *DatabaseConnection) (_ *ServerInfo, err error) {
+	info := &ServerInfo{AvailableExtensions: make(map[string]string)}
+	err = conn.DB.QueryRowContext(ctx, `
+		SELECT
+			current_setting('server_version_num')::int,
+			current_setting('server_version'),
+			current_user,
+			r.rolsuper,
+			r.rolcreatedb,
+			current_setting('max_connections')::int,
+			current_setting('fsync') = 'on',
+			current_setting('synchronous_commit')
+		FROM pg_roles r
+		WHERE r.rolname = current_user
+	`).Scan(
+		&info.VersionNum,
+		&info.Version,
+		&info.CurrentRole,
+		&info.IsSuperuser,
+		&info.CanCreateDB,
+		&info.MaxConnections,
+		&info.Fsync,
+		&info.SynchronousCommit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query server settings: %w", err)
+	}
+
+	rows, err := conn.DB.QueryContext(ctx, "SELECT name, coalesce(default_version, '') FROM pg_available_extensions")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query available extensions: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+	for rows.Next() {
+		var name, version string
+		if err := rows.Scan(&name, &version); err != nil {
+			return nil, fmt.Errorf("failed to scan extension: %w", err)
+		}
+		info.AvailableExtensions[name] = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query available extensions: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,78 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestServerInfo tests server version and capability detection.
+func TestServerInfo(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	c.Run("Supports version-dependent features", func(c *qt.C) {
+		info := &pgdbtemplatepq.ServerInfo{VersionNum: 130011, Version: "13.11"}
+		c.Assert(info.Supports(pgdbtemplatepq.FeatureDropDatabaseForce), qt.IsTrue)
+		c.Assert(info.Supports(pgdbtemplatepq.FeatureAlterTypeAddValueInTransaction), qt.IsTrue)
+		c.Assert(info.Supports(pgdbtemplatepq.FeatureCreateDatabaseStrategy), qt.IsFalse)
+		c.Assert(info.Supports(pgdbtemplatepq.FeatureICULocale), qt.IsFalse)
+	})
+
+	c.Run("Supports extension-dependent features", func(c *qt.C) {
+		info := &pgdbtemplatepq.ServerInfo{
+			VersionNum:          160000,
+			AvailableExtensions: map[string]string{"pg_stat_statements": "1.10"},
+		}
+		c.Assert(info.Supports(pgdbtemplatepq.FeaturePgStatStatements), qt.IsTrue)
+		c.Assert(info.Supports(pgdbtemplatepq.FeaturePgPrewarm), qt.IsFalse)
+		c.Assert(info.HasExtension("pg_stat_statements"), qt.IsTrue)
+	})
+
+	c.Run("Unknown feature is unsupported", func(c *qt.C) {
+		info := &pgdbtemplatepq.ServerInfo{VersionNum: 999999}
+		c.Assert(info.Supports(pgdbtemplatepq.Feature("time travel")), qt.IsFalse)
+	})
+
+	c.Run("Query and cache server info", func(c *qt.C) {
+		c.Parallel()
+		connStringFunc := func(dbName string) string {
+			return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+		}
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+		info, err := provider.ServerInfo(ctx)
+		c.Assert(err, qt.IsNil)
+		c.Assert(info.VersionNum >= 90500, qt.IsTrue)
+		c.Assert(info.Version, qt.Not(qt.Equals), "")
+		c.Assert(info.CurrentRole, qt.Not(qt.Equals), "")
+		c.Assert(info.MaxConnections > 0, qt.IsTrue)
+		c.Assert(info.SynchronousCommit, qt.Not(qt.Equals), "")
+		c.Assert(info.HasExtension("plpgsql"), qt.IsTrue)
+
+		// Callers get copies, so they cannot change what other callers see.
+		info.VersionNum = 0
+		delete(info.AvailableExtensions, "plpgsql")
+		cached, err := provider.ServerInfo(ctx)
+		c.Assert(err, qt.IsNil)
+		c.Assert(cached, qt.Not(qt.Equals), info)
+		c.Assert(cached.VersionNum >= 90500, qt.IsTrue)
+		c.Assert(cached.HasExtension("plpgsql"), qt.IsTrue)
+	})
+
+	c.Run("Failed query is reported", func(c *qt.C) {
+		c.Parallel()
+		connStringFunc := func(dbName string) string {
+			return "postgres://localhost:1/" + dbName
+		}
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+		_, err := provider.ServerInfo(ctx)
+		c.Assert(err, qt.ErrorMatches, "failed to connect to admin database:.*")
+	})
+}
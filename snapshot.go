@@ -0,0 +1,146 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// SnapshotOption configures ConnectionProvider.Snapshot.
+type SnapshotOption func(*snapshotOptions)
+
+// snapshotOptions are the options of ConnectionProvider.Snapshot.
+type snapshotOptions struct {
+	terminateSessions bool
+}
+
+// WithTerminateSessions terminates the sessions connected to the source
+// database before it is copied, e.g. the idle connections of the test's
+// own *sql.DB. Without it, Snapshot fails if the source is in use.
+func WithTerminateSessions() SnapshotOption {
+	return func(o *snapshotOptions) {
+		o.terminateSessions = true
+	}
+}
+
+// Snapshot clones the database into a new template, e.g. to branch many tests
+// from a state reached by the first stages of an integration scenario.
+//
+// PostgreSQL cannot copy a database in use, so Snapshot fails if sessions are
+// connected to the source, unless WithTerminateSessions is given. Callers must
+// then reconnect afterwards; database/sql does it on the next query.
+// The snapshot is marked as a template and stamped with the source as
+// its parent. Test databases are cloned from it like from any other template,
+// e.g. with CloneDatabase.
+//
+// The snapshot is registered with the provider and dropped by DropSnapshots.
+func (p *ConnectionProvider) Snapshot(ctx context.Context, fromDB, newTemplateName string, opts ...SnapshotOption) error {
+	if fromDB == p.adminDBName {
+		return fmt.Errorf("cannot snapshot the administrative database %q", fromDB)
+	}
+	var options snapshotOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer adminConn.Close()
+
+	if err := cloneDatabaseInUse(ctx, adminConn, newTemplateName, fromDB, options.terminateSessions); err != nil {
+		return fmt.Errorf("failed to snapshot database %q into %q: %w", fromDB, newTemplateName, err)
+	}
+
+	// The snapshot is registered first, so that DropSnapshots
+	// drops it even if the following steps fail.
+	p.snapshotsMu.Lock()
+	p.snapshots = append(p.snapshots, newTemplateName)
+	p.snapshotsMu.Unlock()
+
+	metadata := NewDatabaseMetadata()
+	metadata.Parent = fromDB
+	if err := setDatabaseMetadata(ctx, adminConn, newTemplateName, metadata); err != nil {
+		return err
+	}
+	return p.markTemplate(ctx, adminConn, newTemplateName)
+}
+
+// cloneDatabaseInUse clones the source database, terminating its sessions
+// first if terminate is set. Otherwise a source in use is reported as an error.
+//
+// CONNECT is revoked from PUBLIC only while the sessions are terminated,
+// and granted back only if PUBLIC had it before.
+func cloneDatabaseInUse(ctx context.Context, adminConn *DatabaseConnection, databaseName, source string, terminate bool) (err error) {
+	if terminate {
+		var publicConnect, grantable bool
+		err := adminConn.DB.QueryRowContext(ctx, `
+			SELECT count(acl.privilege_type) > 0, coalesce(bool_or(acl.is_grantable), false)
+			FROM pg_database d
+			LEFT JOIN LATERAL aclexplode(coalesce(d.datacl, acldefault('d', d.datdba))) acl
+				ON acl.grantee = 0 AND acl.privilege_type = 'CONNECT'
+			WHERE d.datname = $1
+		`, source).Scan(&publicConnect, &grantable)
+		if err != nil {
+			return fmt.Errorf("failed to read privileges of database %q: %w", source, err)
+		}
+		if publicConnect {
+			defer func() {
+				grantQuery := fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO PUBLIC", pq.QuoteIdentifier(source))
+				if grantable {
+					grantQuery += " WITH GRANT OPTION"
+				}
+				if _, grantErr := adminConn.DB.ExecContext(ctx, grantQuery); grantErr != nil {
+					err = errors.Join(err, fmt.Errorf("failed to grant CONNECT on database %q: %w", source, grantErr))
+				}
+			}()
+		}
+		if _, err := terminateConnections(ctx, adminConn, source); err != nil {
+			return err
+		}
+	}
+
+	// Clone options are meant for test databases, not for templates.
+	createQuery := fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", pq.QuoteIdentifier(databaseName), pq.QuoteIdentifier(source))
+	_, err = adminConn.DB.ExecContext(ctx, createQuery)
+	var pqErr *pq.Error
+	if !terminate && errors.As(err, &pqErr) && pqErr.Code.Name() == "object_in_use" {
+		return fmt.Errorf("database %q has active sessions, close them or allow terminating them: %w", source, err)
+	}
+	return err
+}
+
+// DropSnapshots drops the templates created by Snapshot,
+// terminating the sessions connected to them.
+//
+// Databases cloned from the snapshots are not dropped.
+func (p *ConnectionProvider) DropSnapshots(ctx context.Context) error {
+	p.snapshotsMu.Lock()
+	snapshots := p.snapshots
+	p.snapshots = nil
+	p.snapshotsMu.Unlock()
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	info, err := p.cachedServerInfo(ctx)
+	if err != nil {
+		return err
+	}
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer adminConn.Close()
+
+	var errs []error
+	for _, name := range snapshots {
+		if err := p.dropTemplate(ctx, adminConn, info, name); err != nil {
+			errs = append(errs, fmt.Errorf("failed to drop snapshot %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,105 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestSnapshot tests snapshotting databases into templates.
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+
+	c.Run("Snapshot is cloned and dropped", func(c *qt.C) {
+		c.Parallel()
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		source := createScratchDatabase(c, "snapshot_source")
+		conn, err := provider.Connect(ctx, source)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, "CREATE TABLE stages (stage INT); INSERT INTO stages VALUES (1)")
+		c.Assert(err, qt.IsNil)
+
+		snapshot := fmt.Sprintf("snapshot_%d", time.Now().UnixNano())
+		c.Assert(provider.Snapshot(ctx, source, snapshot, pgdbtemplatepq.WithTerminateSessions()), qt.IsNil)
+		defer unmarkAndDrop(c, snapshot)
+
+		metadata, err := provider.DatabaseMetadata(ctx, snapshot)
+		c.Assert(err, qt.IsNil)
+		c.Assert(metadata.Parent, qt.Equals, source)
+
+		// The source remains usable after its sessions were terminated.
+		_, err = conn.ExecContext(ctx, "INSERT INTO stages VALUES (2)")
+		c.Assert(err, qt.IsNil)
+
+		clone := fmt.Sprintf("snapshot_clone_%d", time.Now().UnixNano())
+		c.Assert(provider.CloneDatabase(ctx, clone, snapshot), qt.IsNil)
+		defer provider.DropDatabase(ctx, clone)
+		cloneConn, err := provider.Connect(ctx, clone)
+		c.Assert(err, qt.IsNil)
+		var stages int
+		c.Assert(cloneConn.QueryRowContext(ctx, "SELECT count(*) FROM stages").Scan(&stages), qt.IsNil)
+		c.Assert(cloneConn.Close(), qt.IsNil)
+		c.Assert(stages, qt.Equals, 1)
+
+		c.Assert(provider.DropSnapshots(ctx), qt.IsNil)
+		_, err = provider.DatabaseMetadata(ctx, snapshot)
+		c.Assert(err, qt.ErrorMatches, ".*does not exist")
+		// Dropped snapshots are forgotten.
+		c.Assert(provider.DropSnapshots(ctx), qt.IsNil)
+	})
+
+	c.Run("Source in use", func(c *qt.C) {
+		c.Parallel()
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		source := createScratchDatabase(c, "snapshot_in_use")
+		conn, err := provider.Connect(ctx, source)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		c.Assert(conn.(*pgdbtemplatepq.DatabaseConnection).DB.PingContext(ctx), qt.IsNil)
+
+		snapshot := fmt.Sprintf("snapshot_%d", time.Now().UnixNano())
+		err = provider.Snapshot(ctx, source, snapshot)
+		c.Assert(err, qt.ErrorMatches, `.*database "snapshot_in_use.*" has active sessions.*`)
+	})
+
+	c.Run("Privileges of the source are kept", func(c *qt.C) {
+		c.Parallel()
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		source := createScratchDatabase(c, "snapshot_revoked")
+
+		adminDB, err := sql.Open("postgres", testConnectionString)
+		c.Assert(err, qt.IsNil)
+		defer adminDB.Close()
+		_, err = adminDB.ExecContext(ctx, fmt.Sprintf("REVOKE CONNECT ON DATABASE %s FROM PUBLIC", source))
+		c.Assert(err, qt.IsNil)
+
+		snapshot := fmt.Sprintf("snapshot_%d", time.Now().UnixNano())
+		c.Assert(provider.Snapshot(ctx, source, snapshot, pgdbtemplatepq.WithTerminateSessions()), qt.IsNil)
+		defer unmarkAndDrop(c, snapshot)
+
+		var publicConnect bool
+		err = adminDB.QueryRowContext(ctx, "SELECT has_database_privilege('public', $1, 'CONNECT')", source).Scan(&publicConnect)
+		c.Assert(err, qt.IsNil)
+		c.Assert(publicConnect, qt.IsFalse)
+	})
+
+	c.Run("Administrative database cannot be snapshotted", func(c *qt.C) {
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		err := provider.Snapshot(ctx, "postgres", "snapshot_of_postgres")
+		c.Assert(err, qt.ErrorMatches, `cannot snapshot the administrative database "postgres"`)
+	})
+}
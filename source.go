@@ -0,0 +1,491 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	"github.com/lib/pq"
+)
+
+// tablesDumpSection is the last section of the schema dump creating tables,
+// attaching partitions and inheriting from parents. As with pg_dump,
+// constraints, indexes and triggers are created after the data are copied.
+const tablesDumpSection = 7
+
+// copyBatchRows is the number of rows read per query from sources
+// which cannot stream rows, i.e. which are not a *DatabaseConnection.
+const copyBatchRows = 1000
+
+// tidRangeScanVersion is the first server version scanning ranges of row
+// locations without reading the whole table, i.e. PostgreSQL 14.
+const tidRangeScanVersion = 140000
+
+// copiedTablesQuery returns the tables of a database to copy as a JSON array
+// of [schema, table, columns, key] quadruples, where the key lists the names
+// and types of the primary key columns. The placeholder is replaced
+// by a condition excluding generated columns, which cannot be inserted.
+var copiedTablesQuery = `
+	SELECT coalesce(json_agg(json_build_array(
+		n.nspname,
+		c.relname,
+		coalesce((
+			SELECT json_agg(a.attname ORDER BY a.attnum)
+			FROM pg_attribute a
+			WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped AND {{insertableColumn}}
+		), '[]'),
+		coalesce((
+			SELECT json_agg(json_build_array(a.attname, format_type(a.atttypid, a.atttypmod)) ORDER BY k.position)
+			FROM pg_index i
+			CROSS JOIN LATERAL unnest(i.indkey::int2[]) WITH ORDINALITY k(attnum, position)
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+			WHERE i.indrelid = c.oid AND i.indisprimary
+		), '[]')
+	) ORDER BY n.nspname, c.relname), '[]')::text
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind = 'r' AND ` + userNamespaceCondition + `
+		AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")
+
+// copiedSequencesQuery returns the quoted names of the sequences of a database
+// as a JSON array.
+var copiedSequencesQuery = `
+	SELECT coalesce(json_agg(quote_ident(n.nspname) || '.' || quote_ident(c.relname) ORDER BY n.nspname, c.relname), '[]')::text
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind = 'S' AND ` + userNamespaceCondition + `
+		AND ` + fmt.Sprintf(notExtensionMember, "pg_class", "c.oid")
+
+// DatabaseCopyMigrationRunner builds databases by copying the schema and data
+// of an existing database, e.g. a shared "golden" development database
+// on another server. Databases on the same server are cloned faster
+// with TemplateConfig.Source.
+//
+// The schema is exported with DumpSchema, so its limitations apply.
+// The rows of each table are streamed into the built database with COPY,
+// from *DatabaseConnection sources row by row, from other connections in
+// batches ordered by primary key, so that tables do not need to fit
+// in memory. Tables without a primary key are read in batches ordered
+// by row location from PostgreSQL 14, and in a single query from older
+// servers, which would scan the whole table for every batch. Sequences
+// are set to their current values. The copy runs in a single transaction
+// on the built database; the source is only read, but should not be
+// written to meanwhile, since the tables are not read from one snapshot.
+//
+// It does not implement Fingerprinter, since the source changes without
+// notice: use it with TemplateManager, or pass
+// TemplateConfig.Fingerprint to EnsureTemplate.
+type DatabaseCopyMigrationRunner struct {
+	source pgdbtemplate.DatabaseConnection
+}
+
+// NewDatabaseCopyMigrationRunner creates a runner copying the source database.
+// The connection is not closed by the runner.
+func NewDatabaseCopyMigrationRunner(source pgdbtemplate.DatabaseConnection) *DatabaseCopyMigrationRunner {
+	return &DatabaseCopyMigrationRunner{source: source}
+}
+
+// copiedTable is a table copied by DatabaseCopyMigrationRunner.
+type copiedTable struct {
+	schema  string
+	name    string
+	columns []string
+	// key lists the names and types of the columns ordering the batches
+	// read by readTableRows; if empty, the table is read at once.
+	key [][2]string
+}
+
+// qualifiedName returns the quoted name of the table.
+func (t copiedTable) qualifiedName() string {
+	return pq.QuoteIdentifier(t.schema) + "." + pq.QuoteIdentifier(t.name)
+}
+
+// textColumns returns the quoted columns of the table cast to text,
+// qualified with the alias.
+func (t copiedTable) textColumns(alias string) string {
+	columns := make([]string, len(t.columns))
+	for i, column := range t.columns {
+		columns[i] = alias + "." + pq.QuoteIdentifier(column) + "::text"
+	}
+	return strings.Join(columns, ", ")
+}
+
+// RunMigrations copies the source database over the connection,
+// which must be a *DatabaseConnection.
+func (r *DatabaseCopyMigrationRunner) RunMigrations(ctx context.Context, conn pgdbtemplate.DatabaseConnection) (err error) {
+	pqConn, ok := conn.(*DatabaseConnection)
+	if !ok {
+		return fmt.Errorf("database copies require a *DatabaseConnection, got %T", conn)
+	}
+
+	statements, err := dumpSchemaStatements(ctx, r.source)
+	if err != nil {
+		return fmt.Errorf("failed to export source schema: %w", err)
+	}
+	tables, sequences, err := r.listObjects(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pqConn.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for database copy: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback() // #nosec G104 -- Rollback error in error path is not critical.
+		}
+	}()
+
+	// Function bodies may refer to tables created after them, as in pg_dump.
+	if _, err := tx.ExecContext(ctx, "SET LOCAL check_function_bodies = false"); err != nil {
+		return fmt.Errorf("failed to disable function body checks: %w", err)
+	}
+
+	// Statements ordered by dependencies, e.g. views a function returns
+	// the rows of, may precede the last table, and run before the data.
+	split := 0
+	for i, statement := range statements {
+		if statement.section <= tablesDumpSection {
+			split = i + 1
+		}
+	}
+	for _, statement := range statements[:split] {
+		if err := execCopiedStatement(ctx, tx, statement.statement); err != nil {
+			return err
+		}
+	}
+	for _, table := range tables {
+		if err := r.copyTable(ctx, tx, table); err != nil {
+			return err
+		}
+	}
+	for _, statement := range statements[split:] {
+		if err := execCopiedStatement(ctx, tx, statement.statement); err != nil {
+			return err
+		}
+	}
+	for _, sequence := range sequences {
+		if err := r.copySequence(ctx, tx, sequence); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit database copy: %w", err)
+	}
+	return nil
+}
+
+// listObjects returns the tables and sequences of the source database.
+func (r *DatabaseCopyMigrationRunner) listObjects(ctx context.Context) ([]copiedTable, []string, error) {
+	var versionNum int
+	if err := r.source.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum); err != nil {
+		return nil, nil, fmt.Errorf("failed to query source server version: %w", err)
+	}
+	insertableColumn := "true"
+	if versionNum >= 120000 {
+		insertableColumn = "a.attgenerated = ''"
+	}
+
+	var encodedTables string
+	if err := r.source.QueryRowContext(ctx, strings.ReplaceAll(copiedTablesQuery, "{{insertableColumn}}", insertableColumn)).Scan(&encodedTables); err != nil {
+		return nil, nil, fmt.Errorf("failed to list source tables: %w", err)
+	}
+	var quadruples [][4]json.RawMessage
+	if err := json.Unmarshal([]byte(encodedTables), &quadruples); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode source tables: %w", err)
+	}
+	tables := make([]copiedTable, len(quadruples))
+	for i, quadruple := range quadruples {
+		err := errors.Join(
+			json.Unmarshal(quadruple[0], &tables[i].schema),
+			json.Unmarshal(quadruple[1], &tables[i].name),
+			json.Unmarshal(quadruple[2], &tables[i].columns),
+			json.Unmarshal(quadruple[3], &tables[i].key),
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode source tables: %w", err)
+		}
+		if len(tables[i].key) == 0 && versionNum >= tidRangeScanVersion {
+			tables[i].key = [][2]string{{"ctid", "tid"}}
+		}
+	}
+
+	var encodedSequences string
+	if err := r.source.QueryRowContext(ctx, copiedSequencesQuery).Scan(&encodedSequences); err != nil {
+		return nil, nil, fmt.Errorf("failed to list source sequences: %w", err)
+	}
+	var sequences []string
+	if err := json.Unmarshal([]byte(encodedSequences), &sequences); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode source sequences: %w", err)
+	}
+	return tables, sequences, nil
+}
+
+// copyTable copies the rows of the table with COPY.
+func (r *DatabaseCopyMigrationRunner) copyTable(ctx context.Context, tx *sql.Tx, table copiedTable) (err error) {
+	if len(table.columns) == 0 {
+		return nil
+	}
+
+	// COPY keeps the values of identity columns, like OVERRIDING SYSTEM VALUE.
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(table.schema, table.name, table.columns...))
+	if err != nil {
+		return fmt.Errorf("failed to start copy of table %s: %w", table.qualifiedName(), err)
+	}
+	defer func() {
+		if closeErr := stmt.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	copyRow := func(values []any) error {
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return fmt.Errorf("failed to copy row of table %s: %w", table.qualifiedName(), err)
+		}
+		return nil
+	}
+	if source, ok := r.source.(*DatabaseConnection); ok {
+		err = streamTableRows(ctx, source, table, copyRow)
+	} else {
+		err = r.readTableRows(ctx, table, copyRow)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("failed to copy table %s: %w", table.qualifiedName(), err)
+	}
+	return nil
+}
+
+// streamTableRows calls copyRow with the text values of each row of the table,
+// read with a single query.
+func streamTableRows(ctx context.Context, source *DatabaseConnection, table copiedTable, copyRow func([]any) error) (err error) {
+	selectQuery := fmt.Sprintf("SELECT %s FROM ONLY %s t", table.textColumns("t"), table.qualifiedName()) // #nosec G201 -- The names are quoted.
+	rows, err := source.DB.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return fmt.Errorf("failed to read table %s: %w", table.qualifiedName(), err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	fields := make([]sql.NullString, len(table.columns))
+	dest := make([]any, len(fields))
+	for i := range fields {
+		dest[i] = &fields[i]
+	}
+	values := make([]any, len(fields))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to read table %s: %w", table.qualifiedName(), err)
+		}
+		for i, field := range fields {
+			values[i] = nil
+			if field.Valid {
+				values[i] = field.String
+			}
+		}
+		if err := copyRow(values); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read table %s: %w", table.qualifiedName(), err)
+	}
+	return nil
+}
+
+// readTableRows calls copyRow with the text values of each row of the table,
+// read in batches of copyBatchRows rows ordered by the key of the table,
+// each batch starting after the key of the last row of the previous one.
+func (r *DatabaseCopyMigrationRunner) readTableRows(ctx context.Context, table copiedTable, copyRow func([]any) error) error {
+	keyColumns := make([]string, len(table.key))
+	keyTexts := make([]string, len(table.key))
+	lastKey := make([]string, len(table.key))
+	for i, column := range table.key {
+		keyColumns[i] = "t." + pq.QuoteIdentifier(column[0])
+		keyTexts[i] = keyColumns[i] + "::text"
+		lastKey[i] = fmt.Sprintf("$%d::%s", i+1, column[1])
+	}
+	order, limit := "", ""
+	if len(table.key) > 0 {
+		order = "ORDER BY " + strings.Join(keyColumns, ", ")
+		limit = fmt.Sprintf("LIMIT %d", copyBatchRows)
+	}
+	selectQuery := func(condition string) string {
+		return fmt.Sprintf(`
+			SELECT coalesce(json_agg(p.fields ORDER BY p.n), '[]')::text,
+				coalesce((array_agg(p.key ORDER BY p.n DESC))[1], '[]')
+			FROM (
+				SELECT json_build_array(%s) AS fields, json_build_array(%s)::text AS key, row_number() OVER (%s) AS n
+				FROM ONLY %s t %s %s %s
+			) p
+		`, table.textColumns("t"), strings.Join(keyTexts, ", "), order, table.qualifiedName(), condition, order, limit) // #nosec G201 -- The names are quoted.
+	}
+	firstQuery := selectQuery("")
+	nextQuery := selectQuery(fmt.Sprintf("WHERE (%s) > (%s)", strings.Join(keyColumns, ", "), strings.Join(lastKey, ", ")))
+
+	var after []any
+	for {
+		query := firstQuery
+		if after != nil {
+			query = nextQuery
+		}
+		var encodedRows, encodedKey string
+		if err := r.source.QueryRowContext(ctx, query, after...).Scan(&encodedRows, &encodedKey); err != nil {
+			return fmt.Errorf("failed to read table %s: %w", table.qualifiedName(), err)
+		}
+		var (
+			rows [][]*string
+			key  []string
+		)
+		if err := errors.Join(json.Unmarshal([]byte(encodedRows), &rows), json.Unmarshal([]byte(encodedKey), &key)); err != nil {
+			return fmt.Errorf("failed to decode rows of table %s: %w", table.qualifiedName(), err)
+		}
+		values := make([]any, len(table.columns))
+		for _, row := range rows {
+			for i, field := range row {
+				values[i] = nil
+				if field != nil {
+					values[i] = *field
+				}
+			}
+			if err := copyRow(values); err != nil {
+				return err
+			}
+		}
+		if len(table.key) == 0 || len(rows) < copyBatchRows {
+			return nil
+		}
+		after = make([]any, len(key))
+		for i, value := range key {
+			after[i] = value
+		}
+	}
+}
+
+// copySequence sets the sequence to the value of the source sequence.
+func (r *DatabaseCopyMigrationRunner) copySequence(ctx context.Context, tx *sql.Tx, sequence string) error {
+	var (
+		lastValue int64
+		isCalled  bool
+	)
+	selectQuery := fmt.Sprintf("SELECT last_value, is_called FROM %s", sequence) // #nosec G201 -- The name is quoted by the source server.
+	if err := r.source.QueryRowContext(ctx, selectQuery).Scan(&lastValue, &isCalled); err != nil {
+		return fmt.Errorf("failed to read sequence %s: %w", sequence, err)
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT setval($1::regclass, $2, $3)", sequence, lastValue, isCalled); err != nil {
+		return fmt.Errorf("failed to copy sequence %s: %w", sequence, err)
+	}
+	return nil
+}
+
+// execCopiedStatement executes a statement of the source schema.
+func execCopiedStatement(ctx context.Context, tx *sql.Tx, statement string) error {
+	if _, err := tx.ExecContext(ctx, statement); err != nil {
+		firstLine, _, _ := strings.Cut(statement, "\n")
+		return fmt.Errorf("failed to copy schema statement %q: %w", firstLine, err)
+	}
+	return nil
+}
+
+// sourceFingerprint fingerprints the name and the schema of the source database
+// of TemplateConfig.Source.
+func (p *ConnectionProvider) sourceFingerprint(ctx context.Context, source string) (string, error) {
+	conn, err := p.connect(ctx, source)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to source database: %w", err)
+	}
+	defer conn.Close()
+
+	schema, err := DumpSchema(ctx, conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to fingerprint source database: %w", err)
+	}
+	fp := newFingerprint()
+	fp.add("source", source, schema)
+	return fp.sum(), nil
+}
+
+// Sanitizer scrubs sensitive data from templates built from existing databases.
+type Sanitizer struct {
+	// Name identifies the sanitizer in errors and in the fingerprint.
+	//
+	// This field is required and must be unique among the sanitizers.
+	Name string
+	// SQL is executed on the template, e.g.
+	// "UPDATE users SET email = 'user' || id || '@example.com'".
+	// It may consist of several statements.
+	//
+	// This field is required.
+	SQL string
+}
+
+// SanitizingMigrationRunner runs sanitizers after the migrations of another runner,
+// e.g. a DatabaseCopyMigrationRunner, so that sensitive data are scrubbed
+// before the database is marked as a template.
+//
+// It implements Fingerprinter when the migration runner does,
+// combining its fingerprint with the names and SQL of the sanitizers.
+type SanitizingMigrationRunner struct {
+	sanitizers []Sanitizer
+	// seeding runs the sanitizers as seeders versioned by their SQL.
+	seeding *SeedingMigrationRunner
+}
+
+// NewSanitizingMigrationRunner creates a runner of the migrations followed by the sanitizers,
+// which run in order.
+//
+// Upon the nil migrationRunner provided, only the sanitizers will be run,
+// e.g. on a template cloned with TemplateConfig.Source.
+func NewSanitizingMigrationRunner(migrationRunner pgdbtemplate.MigrationRunner, sanitizers ...Sanitizer) *SanitizingMigrationRunner {
+	seeders := make([]Seeder, len(sanitizers))
+	for i, sanitizer := range sanitizers {
+		query := sanitizer.SQL
+		seeders[i] = Seeder{
+			Name:    sanitizer.Name,
+			Version: sanitizer.SQL,
+			Seed: func(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+				_, err := conn.ExecContext(ctx, query)
+				return err
+			},
+		}
+	}
+	seeding := NewSeedingMigrationRunner(migrationRunner, seeders...)
+	seeding.kind = "sanitizer"
+	return &SanitizingMigrationRunner{sanitizers: sanitizers, seeding: seeding}
+}
+
+// RunMigrations runs the migrations, then the sanitizers, on the connection.
+func (r *SanitizingMigrationRunner) RunMigrations(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	return r.seeding.RunMigrations(ctx, conn)
+}
+
+// Fingerprint implements Fingerprinter.
+func (r *SanitizingMigrationRunner) Fingerprint() (string, error) {
+	if err := r.validate(); err != nil {
+		return "", err
+	}
+	return r.seeding.Fingerprint()
+}
+
+// validate checks that the named sanitizers have SQL. The seeders running
+// them check the names.
+func (r *SanitizingMigrationRunner) validate() error {
+	for _, sanitizer := range r.sanitizers {
+		if sanitizer.Name != "" && strings.TrimSpace(sanitizer.SQL) == "" {
+			return fmt.Errorf("sanitizer %q has no SQL", sanitizer.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestDatabaseSource tests building templates from existing databases.
+func TestDatabaseSource(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	const goldenSQL = `
+		CREATE SCHEMA crm;
+		CREATE TABLE crm.customers (
+			id SERIAL PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			email_domain TEXT GENERATED ALWAYS AS (split_part(email, '@', 2)) STORED
+		);
+		CREATE TABLE crm.orders (
+			id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			customer_id INTEGER NOT NULL REFERENCES crm.customers (id),
+			total NUMERIC(12, 2) NOT NULL
+		);
+		CREATE FUNCTION crm.order_count() RETURNS BIGINT LANGUAGE sql AS 'SELECT count(*) FROM crm.orders';
+		CREATE FUNCTION crm.big_orders() RETURNS SETOF crm.orders LANGUAGE sql AS 'SELECT * FROM crm.orders WHERE total > 15';
+		CREATE VIEW crm.order_totals AS SELECT customer_id, sum(total) AS total FROM crm.orders GROUP BY customer_id;
+		CREATE VIEW crm.big_customers AS SELECT customer_id FROM crm.order_totals WHERE total > 15;
+		CREATE TABLE crm.events (id INT, at DATE NOT NULL) PARTITION BY RANGE (at);
+		CREATE TABLE crm.events_2024 PARTITION OF crm.events FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+		INSERT INTO crm.customers (email) VALUES ('alice@example.org'), ('bob@example.net');
+		INSERT INTO crm.orders (customer_id, total) VALUES (1, 10.50), (2, 20), (2, 30);
+		INSERT INTO crm.events VALUES (1, '2024-05-01');
+	`
+
+	// createGolden creates a database with the golden schema and data.
+	createGolden := func(c *qt.C) (string, pgdbtemplate.DatabaseConnection) {
+		name := createScratchDatabase(c, "golden")
+		conn, err := provider.Connect(ctx, name)
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() { conn.Close() })
+		_, err = conn.ExecContext(ctx, goldenSQL)
+		c.Assert(err, qt.IsNil)
+		return name, conn
+	}
+
+	// scrubEmails replaces the e-mail addresses of the customers.
+	scrubEmails := pgdbtemplatepq.Sanitizer{
+		Name: "emails",
+		SQL:  "UPDATE crm.customers SET email = 'customer' || id || '@example.com'",
+	}
+
+	// assertSanitized checks the copied and sanitized data.
+	assertSanitized := func(c *qt.C, conn pgdbtemplate.DatabaseConnection) {
+		var emails, domains string
+		err := conn.QueryRowContext(ctx,
+			"SELECT string_agg(email, ',' ORDER BY id), string_agg(email_domain, ',' ORDER BY id) FROM crm.customers",
+		).Scan(&emails, &domains)
+		c.Assert(err, qt.IsNil)
+		c.Assert(emails, qt.Equals, "customer1@example.com,customer2@example.com")
+		c.Assert(domains, qt.Equals, "example.com,example.com")
+
+		var orders int
+		c.Assert(conn.QueryRowContext(ctx, "SELECT crm.order_count()").Scan(&orders), qt.IsNil)
+		c.Assert(orders, qt.Equals, 3)
+	}
+
+	c.Run("Sanitizers run after migrations", func(c *qt.C) {
+		runner := pgdbtemplatepq.NewSanitizingMigrationRunner(&countingMigrationRunner{}, scrubEmails, pgdbtemplatepq.Sanitizer{
+			Name: "tokens",
+			SQL:  "TRUNCATE api_tokens",
+		})
+		conn := &recordingConnection{}
+		c.Assert(runner.RunMigrations(ctx, conn), qt.IsNil)
+		c.Assert(conn.statements, qt.DeepEquals, []string{
+			"CREATE TABLE fingerprinted (id INTEGER)",
+			scrubEmails.SQL,
+			"TRUNCATE api_tokens",
+		})
+	})
+
+	c.Run("Sanitizer errors are wrapped", func(c *qt.C) {
+		execErr := errors.New("boom")
+		runner := pgdbtemplatepq.NewSanitizingMigrationRunner(nil, scrubEmails)
+		err := runner.RunMigrations(ctx, failingConnection{err: execErr})
+		c.Assert(err, qt.ErrorIs, execErr)
+		c.Assert(err, qt.ErrorMatches, `failed to run sanitizer "emails": boom`)
+	})
+
+	c.Run("Invalid sanitizers", func(c *qt.C) {
+		for _, test := range []struct {
+			sanitizers []pgdbtemplatepq.Sanitizer
+			message    string
+		}{
+			{[]pgdbtemplatepq.Sanitizer{{SQL: "SELECT 1"}}, "sanitizer name is required"},
+			{[]pgdbtemplatepq.Sanitizer{{Name: "emails", SQL: " "}}, `sanitizer "emails" has no SQL`},
+			{[]pgdbtemplatepq.Sanitizer{scrubEmails, scrubEmails}, `sanitizer "emails" is defined more than once`},
+		} {
+			runner := pgdbtemplatepq.NewSanitizingMigrationRunner(nil, test.sanitizers...)
+			c.Assert(runner.RunMigrations(ctx, &recordingConnection{}), qt.ErrorMatches, test.message)
+			_, err := runner.Fingerprint()
+			c.Assert(err, qt.ErrorMatches, test.message)
+		}
+	})
+
+	c.Run("Fingerprint covers sanitizers", func(c *qt.C) {
+		fingerprint := func(c *qt.C, sanitizers ...pgdbtemplatepq.Sanitizer) string {
+			fingerprint, err := pgdbtemplatepq.NewSanitizingMigrationRunner(nil, sanitizers...).Fingerprint()
+			c.Assert(err, qt.IsNil)
+			return fingerprint
+		}
+		original := fingerprint(c, scrubEmails)
+		c.Assert(fingerprint(c, scrubEmails), qt.Equals, original)
+		c.Assert(fingerprint(c), qt.Not(qt.Equals), original)
+		c.Assert(fingerprint(c, pgdbtemplatepq.Sanitizer{Name: "emails", SQL: "UPDATE crm.customers SET email = ''"}), qt.Not(qt.Equals), original)
+
+		_, err := pgdbtemplatepq.NewSanitizingMigrationRunner(&countingMigrationRunner{}).Fingerprint()
+		c.Assert(err, qt.ErrorMatches, `migration runner \*pgdbtemplatepq_test.countingMigrationRunner does not implement Fingerprinter`)
+	})
+
+	c.Run("Copies require a *DatabaseConnection", func(c *qt.C) {
+		runner := pgdbtemplatepq.NewDatabaseCopyMigrationRunner(&recordingConnection{})
+		err := runner.RunMigrations(ctx, &recordingConnection{})
+		c.Assert(err, qt.ErrorMatches, `database copies require a \*DatabaseConnection, got \*pgdbtemplatepq_test.recordingConnection`)
+	})
+
+	c.Run("Source and Parent are exclusive", func(c *qt.C) {
+		_, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			MigrationRunner: pgdbtemplatepq.NewSanitizingMigrationRunner(nil),
+			Parent:          "base",
+			Source:          "golden",
+		})
+		c.Assert(err, qt.ErrorMatches, "Parent and Source are exclusive")
+
+		_, err = provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			MigrationRunner: pgdbtemplatepq.NewSanitizingMigrationRunner(nil),
+			Source:          "postgres",
+		})
+		c.Assert(err, qt.ErrorMatches, `cannot clone the administrative database "postgres"`)
+	})
+
+	c.Run("Database is copied and sanitized", func(c *qt.C) {
+		c.Parallel()
+		_, source := createGolden(c)
+
+		manager, err := pgdbtemplate.NewTemplateManager(pgdbtemplate.Config{
+			ConnectionProvider: provider,
+			MigrationRunner: pgdbtemplatepq.NewSanitizingMigrationRunner(
+				pgdbtemplatepq.NewDatabaseCopyMigrationRunner(source),
+				scrubEmails,
+			),
+			TemplateName: fmt.Sprintf("copied_%d", time.Now().UnixNano()),
+		})
+		c.Assert(err, qt.IsNil)
+		defer manager.Cleanup(ctx)
+
+		conn, _, err := manager.CreateTestDatabase(ctx)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertSanitized(c, conn)
+
+		// Sequences continue from the values of the source.
+		var customerID, orderID int
+		c.Assert(conn.QueryRowContext(ctx, "INSERT INTO crm.customers (email) VALUES ('carol@example.com') RETURNING id").Scan(&customerID), qt.IsNil)
+		c.Assert(customerID, qt.Equals, 3)
+		c.Assert(conn.QueryRowContext(ctx, "INSERT INTO crm.orders (customer_id, total) VALUES (3, 1) RETURNING id").Scan(&orderID), qt.IsNil)
+		c.Assert(orderID, qt.Equals, 4)
+
+		// Objects depending on objects sorted after them are copied,
+		// and partitions are attached to their parents.
+		var bigOrders, bigCustomers, events int
+		err = conn.QueryRowContext(ctx, `
+			SELECT (SELECT count(*) FROM crm.big_orders()),
+				(SELECT count(*) FROM crm.big_customers),
+				(SELECT count(*) FROM crm.events WHERE at = '2024-05-01')
+		`).Scan(&bigOrders, &bigCustomers, &events)
+		c.Assert(err, qt.IsNil)
+		c.Assert([]int{bigOrders, bigCustomers, events}, qt.DeepEquals, []int{2, 1, 1})
+
+		// Constraints were created after the data.
+		_, err = conn.ExecContext(ctx, "INSERT INTO crm.orders (customer_id, total) VALUES (42, 1)")
+		c.Assert(err, qt.ErrorMatches, ".*violates foreign key constraint.*")
+
+		// The source is not sanitized.
+		var email string
+		c.Assert(source.QueryRowContext(ctx, "SELECT email FROM crm.customers WHERE id = 1").Scan(&email), qt.IsNil)
+		c.Assert(email, qt.Equals, "alice@example.org")
+	})
+
+	c.Run("Other sources are read in batches", func(c *qt.C) {
+		c.Parallel()
+		_, source := createGolden(c)
+		_, err := source.ExecContext(ctx, `
+			CREATE TABLE crm.visits (day DATE, customer_id INTEGER, count INTEGER NOT NULL, PRIMARY KEY (customer_id, day));
+			INSERT INTO crm.visits SELECT DATE '2024-01-01' + i % 1000, i / 1000, i FROM generate_series(0, 2499) i;
+			CREATE TABLE crm.log (line TEXT);
+			INSERT INTO crm.log SELECT 'line ' || i FROM generate_series(1, 2500) i;
+		`)
+		c.Assert(err, qt.IsNil)
+
+		// Wrapping hides the *DatabaseConnection, which streams rows.
+		wrapped := struct {
+			pgdbtemplate.DatabaseConnection
+		}{source}
+		manager, err := pgdbtemplate.NewTemplateManager(pgdbtemplate.Config{
+			ConnectionProvider: provider,
+			MigrationRunner:    pgdbtemplatepq.NewDatabaseCopyMigrationRunner(wrapped),
+			TemplateName:       fmt.Sprintf("batched_%d", time.Now().UnixNano()),
+		})
+		c.Assert(err, qt.IsNil)
+		defer manager.Cleanup(ctx)
+
+		conn, _, err := manager.CreateTestDatabase(ctx)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		var visits, visitSum, lines, distinctLines int
+		err = conn.QueryRowContext(ctx, `
+			SELECT (SELECT count(*) FROM crm.visits), (SELECT sum(count) FROM crm.visits),
+				(SELECT count(*) FROM crm.log), (SELECT count(DISTINCT line) FROM crm.log)
+		`).Scan(&visits, &visitSum, &lines, &distinctLines)
+		c.Assert(err, qt.IsNil)
+		c.Assert([]int{visits, visitSum, lines, distinctLines}, qt.DeepEquals, []int{2500, 2499 * 2500 / 2, 2500, 2500})
+	})
+
+	c.Run("Template is cloned from the source", func(c *qt.C) {
+		c.Parallel()
+		sourceName, source := createGolden(c)
+		prefix := fmt.Sprintf("golden_%d_", time.Now().UnixNano())
+		c.Cleanup(func() {
+			provider.Reap(ctx, pgdbtemplatepq.ReapOptions{Prefixes: []string{prefix}, IncludeUnstamped: true})
+		})
+
+		config := pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: pgdbtemplatepq.NewSanitizingMigrationRunner(nil, scrubEmails),
+			Source:          sourceName,
+		}
+		// The source is in use by its connection.
+		_, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.ErrorMatches, `.*database ".*" has active sessions.*`)
+
+		config.TerminateSourceSessions = true
+		built, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, built.Name)
+		c.Assert(built.Source, qt.Equals, sourceName)
+		metadata, err := provider.DatabaseMetadata(ctx, built.Name)
+		c.Assert(err, qt.IsNil)
+		c.Assert(metadata.Parent, qt.Equals, sourceName)
+
+		// The source remains usable after its sessions were terminated.
+		_, err = source.ExecContext(ctx, "INSERT INTO crm.customers (email) VALUES ('carol@example.com')")
+		c.Assert(err, qt.IsNil)
+
+		// Data changes do not rebuild the template, schema changes do.
+		reused, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		c.Assert(reused.Reused, qt.IsTrue)
+		c.Assert(reused.Name, qt.Equals, built.Name)
+		_, err = source.ExecContext(ctx, "ALTER TABLE crm.customers ADD COLUMN phone TEXT")
+		c.Assert(err, qt.IsNil)
+		rebuilt, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, rebuilt.Name)
+		c.Assert(rebuilt.Name, qt.Not(qt.Equals), built.Name)
+
+		cloneName := fmt.Sprintf("golden_clone_%d", time.Now().UnixNano())
+		c.Assert(provider.CloneDatabase(ctx, cloneName, built.Name), qt.IsNil)
+		defer provider.DropDatabase(ctx, cloneName)
+		conn, err := provider.Connect(ctx, cloneName)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertSanitized(c, conn)
+	})
+}
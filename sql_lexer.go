@@ -0,0 +1,330 @@
+package pgdbtemplatepq
+
+import "strings"
+
+// sqlTokenKind is the kind of a lexical SQL token.
+type sqlTokenKind int
+
+// Kinds of SQL tokens.
+const (
+	sqlTokenWord         sqlTokenKind = iota // Keyword or unquoted identifier.
+	sqlTokenString                           // '...', E'...' or $tag$...$tag$ string.
+	sqlTokenIdentifier                       // "..." identifier.
+	sqlTokenLineComment                      // -- comment.
+	sqlTokenBlockComment                     // /* comment */, possibly nested.
+	sqlTokenPunctuation                      // Any other character.
+)
+
+// sqlToken is a lexical SQL token.
+type sqlToken struct {
+	kind       sqlTokenKind
+	start, end int // Byte offsets of the token in the source.
+}
+
+// sqlLexer splits SQL into tokens, following the lexical rules of the server
+// with standard_conforming_strings on.
+type sqlLexer struct {
+	src string
+	pos int
+}
+
+// next returns the next token, skipping whitespace,
+// or false at the end of the source.
+//
+// Unterminated strings, identifiers and comments extend to the end of the source.
+func (l *sqlLexer) next() (sqlToken, bool) {
+	for l.pos < len(l.src) && isSQLSpace(l.src[l.pos]) {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return sqlToken{}, false
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	kind := sqlTokenPunctuation
+	switch {
+	case c == '-' && strings.HasPrefix(l.src[l.pos:], "--"):
+		kind = sqlTokenLineComment
+		l.pos = indexOrEnd(l.src, l.pos, "\n")
+	case c == '/' && strings.HasPrefix(l.src[l.pos:], "/*"):
+		kind = sqlTokenBlockComment
+		l.scanBlockComment()
+	case c == '\'':
+		kind = sqlTokenString
+		l.scanString(false)
+	case c == '"':
+		kind = sqlTokenIdentifier
+		l.scanQuoted('"')
+	case c == '$':
+		if tag, ok := dollarQuoteTag(l.src[l.pos:]); ok {
+			kind = sqlTokenString
+			l.pos = indexOrEnd(l.src, l.pos+len(tag), tag)
+			if l.pos < len(l.src) {
+				l.pos += len(tag)
+			}
+		} else {
+			l.pos++
+		}
+	case isSQLIdentifierStart(c):
+		kind = sqlTokenWord
+		for l.pos < len(l.src) && isSQLIdentifierPart(l.src[l.pos]) {
+			l.pos++
+		}
+		// E'...' strings allow backslash escapes.
+		if l.pos-start == 1 && (c == 'E' || c == 'e') && l.pos < len(l.src) && l.src[l.pos] == '\'' {
+			kind = sqlTokenString
+			l.scanString(true)
+		}
+	default:
+		l.pos++
+	}
+	return sqlToken{kind: kind, start: start, end: l.pos}, true
+}
+
+// scanCopyData returns the data lines of COPY ... FROM stdin and their offset.
+// The data start on the line following the statement and end before a "\." line.
+func (l *sqlLexer) scanCopyData() (string, int) {
+	start := indexOrEnd(l.src, l.pos, "\n")
+	if start < len(l.src) {
+		start++
+	}
+	for l.pos = start; l.pos < len(l.src); {
+		lineEnd := indexOrEnd(l.src, l.pos, "\n")
+		if strings.TrimRight(l.src[l.pos:lineEnd], "\r") == `\.` {
+			data := l.src[start:l.pos]
+			l.pos = lineEnd
+			return data, start
+		}
+		l.pos = lineEnd + 1
+	}
+	l.pos = len(l.src)
+	return l.src[start:], start
+}
+
+// scanBlockComment skips a block comment, which may be nested.
+func (l *sqlLexer) scanBlockComment() {
+	depth := 0
+	for l.pos < len(l.src) {
+		switch {
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			depth++
+			l.pos += 2
+		case strings.HasPrefix(l.src[l.pos:], "*/"):
+			depth--
+			l.pos += 2
+			if depth == 0 {
+				return
+			}
+		default:
+			l.pos++
+		}
+	}
+}
+
+// scanString skips a single-quoted string, in which quotes are doubled,
+// and backslashes escape the next character if escapes is true.
+func (l *sqlLexer) scanString(escapes bool) {
+	l.pos++ // Opening quote.
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			if escapes {
+				l.pos++
+			}
+		case '\'':
+			if l.pos+1 < len(l.src) && l.src[l.pos+1] == '\'' {
+				l.pos++
+				break
+			}
+			l.pos++
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.src)
+}
+
+// scanQuoted skips a string quoted with the character, in which quotes are doubled.
+func (l *sqlLexer) scanQuoted(quote byte) {
+	l.pos++ // Opening quote.
+	for l.pos < len(l.src) {
+		if l.src[l.pos] == quote {
+			if l.pos+1 < len(l.src) && l.src[l.pos+1] == quote {
+				l.pos += 2
+				continue
+			}
+			l.pos++
+			return
+		}
+		l.pos++
+	}
+}
+
+// dollarQuoteTag returns the opening $tag$ of a dollar-quoted string
+// at the start of s.
+func dollarQuoteTag(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1], true
+		case i == 1 && !isSQLIdentifierStart(c), !isSQLIdentifierPart(c):
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// indexOrEnd returns the index of substr in s at or after the offset,
+// or the length of s if there is none.
+func indexOrEnd(s string, offset int, substr string) int {
+	if i := strings.Index(s[offset:], substr); i >= 0 {
+		return offset + i
+	}
+	return len(s)
+}
+
+// isSQLSpace reports whether the byte is SQL whitespace.
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// isSQLIdentifierStart reports whether the byte can start an unquoted identifier.
+// Bytes of multibyte characters are letters.
+func isSQLIdentifierStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80
+}
+
+// isSQLIdentifierPart reports whether the byte can continue an unquoted identifier.
+func isSQLIdentifierPart(c byte) bool {
+	return isSQLIdentifierStart(c) || c >= '0' && c <= '9' || c == '$'
+}
+
+// sqlStatement is a statement of an SQL script.
+type sqlStatement struct {
+	// offset is the byte offset of the statement in the script.
+	offset int
+	// text is the statement, including the terminating semicolon if any.
+	text string
+	// words are the upper-cased keywords and unquoted identifiers of the statement.
+	words []string
+	// metaCommand reports whether the statement is a psql meta-command,
+	// e.g. "\connect db", spanning the rest of the line.
+	metaCommand bool
+	// copyData are the data lines following COPY ... FROM stdin,
+	// without the terminating "\." line, starting at copyOffset.
+	copyData   string
+	copyOffset int
+}
+
+// copiesFromStdin reports whether the statement is COPY ... FROM stdin.
+func (s *sqlStatement) copiesFromStdin() bool {
+	return hasWordPrefix(s.words, "COPY") && hasWord(s.words, "FROM") && hasWord(s.words, "STDIN")
+}
+
+// sqlScript is an SQL script split into statements.
+type sqlScript struct {
+	statements []sqlStatement
+	// annotations are the texts of "-- +annotation" line comments.
+	annotations []string
+}
+
+// splitSQLScript splits the script into statements terminated by semicolons.
+//
+// Like psql, semicolons inside parentheses and inside the BEGIN ... END
+// bodies of CREATE FUNCTION and CREATE PROCEDURE do not terminate statements.
+// Backslashes starting a statement start meta-commands, and the lines
+// following COPY ... FROM stdin up to a "\." line are its data.
+func splitSQLScript(src string) *sqlScript {
+	script := &sqlScript{}
+	lexer := &sqlLexer{src: src}
+
+	var (
+		current    *sqlStatement
+		parenDepth int
+		beginDepth int
+	)
+	for {
+		token, ok := lexer.next()
+		if !ok {
+			break
+		}
+		text := src[token.start:token.end]
+
+		switch token.kind {
+		case sqlTokenLineComment:
+			if annotation, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(text, "--")), "+"); ok {
+				script.annotations = append(script.annotations, strings.TrimSpace(annotation))
+			}
+			continue
+		case sqlTokenBlockComment:
+			continue
+		}
+
+		if current == nil && text == "\\" {
+			lexer.pos = indexOrEnd(src, token.start, "\n")
+			script.statements = append(script.statements, sqlStatement{
+				offset:      token.start,
+				text:        strings.TrimRight(src[token.start:lexer.pos], " \t\r"),
+				metaCommand: true,
+			})
+			continue
+		}
+		if current == nil {
+			script.statements = append(script.statements, sqlStatement{offset: token.start})
+			current = &script.statements[len(script.statements)-1]
+			parenDepth, beginDepth = 0, 0
+		}
+		current.text = src[current.offset:token.end]
+
+		switch {
+		case token.kind == sqlTokenWord:
+			word := strings.ToUpper(text)
+			current.words = append(current.words, word)
+			if parenDepth > 0 || !isRoutineDefinition(current.words) {
+				break
+			}
+			switch word {
+			case "BEGIN":
+				beginDepth++
+			case "CASE":
+				// CASE also ends with END, which only matters inside BEGIN.
+				if beginDepth > 0 {
+					beginDepth++
+				}
+			case "END":
+				if beginDepth > 0 {
+					beginDepth--
+				}
+			}
+		case text == "(":
+			parenDepth++
+		case text == ")":
+			if parenDepth > 0 {
+				parenDepth--
+			}
+		case text == ";":
+			if parenDepth > 0 || beginDepth > 0 {
+				break
+			}
+			if current.copiesFromStdin() {
+				current.copyData, current.copyOffset = lexer.scanCopyData()
+			}
+			current = nil
+		}
+	}
+	return script
+}
+
+// isRoutineDefinition reports whether the statement words start with
+// CREATE [OR REPLACE] FUNCTION or CREATE [OR REPLACE] PROCEDURE.
+func isRoutineDefinition(words []string) bool {
+	if len(words) < 2 || words[0] != "CREATE" {
+		return false
+	}
+	kind := words[1]
+	if kind == "OR" && len(words) >= 4 && words[2] == "REPLACE" {
+		kind = words[3]
+	}
+	return kind == "FUNCTION" || kind == "PROCEDURE"
+}
@@ -0,0 +1,350 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	"github.com/lib/pq"
+)
+
+// defaultTemplatePrefix is the default prefix of fingerprinted template names.
+const defaultTemplatePrefix = "pgdbtemplate_"
+
+// maxIdentifierLength is the maximal length of PostgreSQL identifiers.
+const maxIdentifierLength = 63
+
+// TemplateConfig configures ConnectionProvider.EnsureTemplate.
+type TemplateConfig struct {
+	// NamePrefix is the prefix of the template database name,
+	// to which the fingerprint is appended.
+	//
+	// If empty, "pgdbtemplate_" will be used.
+	NamePrefix string
+	// MigrationRunner runs migrations on the template database.
+	//
+	// This field is required.
+	MigrationRunner pgdbtemplate.MigrationRunner
+	// Fingerprint identifies the migration inputs, see FileMigrationFingerprint.
+	//
+	// If empty, MigrationRunner must implement Fingerprinter.
+	Fingerprint string
+	// Parent is the name of a template built by EnsureTemplate
+	// to derive the template from. The template is then cloned from
+	// the parent and MigrationRunner only runs the extra migrations
+	// and seeders, e.g. loading a large dataset into the base schema.
+	//
+	// The fingerprint of the parent is part of the template fingerprint,
+	// so the template is rebuilt when the parent changes.
+	Parent string
+	// Source is the name of an existing database on the same server,
+	// e.g. a shared "golden" development database, to clone the template
+	// from instead of building it from scratch. PostgreSQL cannot copy
+	// a database in use, so building fails while sessions are connected to
+	// the source, see TerminateSourceSessions. MigrationRunner then runs
+	// on the clone, e.g. a SanitizingMigrationRunner scrubbing sensitive columns.
+	//
+	// The name and the schema of the source are part of the template
+	// fingerprint, so the template is rebuilt when the schema changes,
+	// but not when only the data do. Source and Parent are exclusive.
+	Source string
+	// TerminateSourceSessions terminates the sessions connected to Source
+	// while it is cloned, instead of failing.
+	TerminateSourceSessions bool
+	// DropStale drops the templates with NamePrefix
+	// whose fingerprint differs from the current one.
+	//
+	// Templates built from different migration sets should then
+	// use different prefixes, so that they do not drop each other.
+	DropStale bool
+}
+
+// Template describes a template database built by ConnectionProvider.EnsureTemplate.
+type Template struct {
+	// Name is the name of the template database.
+	Name string
+	// Fingerprint is the fingerprint of the migration inputs,
+	// including those of the parent template or source database,
+	// and of the provider options influencing the template.
+	Fingerprint string
+	// Parent is the name of the parent template, if any.
+	Parent string
+	// Source is the name of the database the template was cloned from, if any.
+	Source string
+	// Reused reports whether an existing template was reused.
+	Reused bool
+}
+
+// EnsureTemplate returns a template database built from the migrations,
+// reusing an existing one built from the same inputs.
+//
+// The template is named after the fingerprint of the migration inputs
+// and of the provider's template options and finalization,
+// which is also stored in its DatabaseMetadata. A template is reused only
+// when it is marked as a template and its stored fingerprint matches,
+// otherwise it is rebuilt. The build is serialized across processes
+// with LockTemplate, so concurrent callers build the template only once.
+// Reused templates are meant to outlive the process,
+// so they are not dropped by TemplateManager-style cleanups: pass the name
+// to pgdbtemplate.Config.TemplateName together with pgdbtemplate.NoOpMigrationRunner,
+// or clone it with CloneDatabase.
+func (p *ConnectionProvider) EnsureTemplate(ctx context.Context, config TemplateConfig) (_ *Template, err error) {
+	if config.MigrationRunner == nil {
+		return nil, errors.New("MigrationRunner is required")
+	}
+	if config.Parent != "" && config.Source != "" {
+		return nil, errors.New("Parent and Source are exclusive")
+	}
+	if config.Source == p.adminDBName {
+		return nil, fmt.Errorf("cannot clone the administrative database %q", config.Source)
+	}
+
+	fingerprint := config.Fingerprint
+	if fingerprint == "" {
+		fingerprinter, ok := config.MigrationRunner.(Fingerprinter)
+		if !ok {
+			return nil, errors.New("Fingerprint is required when MigrationRunner does not implement Fingerprinter")
+		}
+		if fingerprint, err = fingerprinter.Fingerprint(); err != nil {
+			return nil, fmt.Errorf("failed to fingerprint migrations: %w", err)
+		}
+	}
+	if config.Parent != "" {
+		parentMetadata, err := p.DatabaseMetadata(ctx, config.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read parent template: %w", err)
+		}
+		if parentMetadata == nil || parentMetadata.Fingerprint == "" {
+			return nil, fmt.Errorf("parent %q is not a template built by EnsureTemplate", config.Parent)
+		}
+		fingerprint = CombineFingerprints(parentMetadata.Fingerprint, fingerprint)
+	}
+	if config.Source != "" {
+		sourceFingerprint, err := p.sourceFingerprint(ctx, config.Source)
+		if err != nil {
+			return nil, err
+		}
+		fingerprint = CombineFingerprints(sourceFingerprint, fingerprint)
+	}
+
+	if optionsFingerprint := p.templateOptionsFingerprint(config); optionsFingerprint != "" {
+		fingerprint = CombineFingerprints(fingerprint, optionsFingerprint)
+	}
+
+	prefix := config.NamePrefix
+	if prefix == "" {
+		prefix = defaultTemplatePrefix
+	}
+	nameFingerprint := fingerprint
+	if len(nameFingerprint) > fingerprintNameLength {
+		nameFingerprint = nameFingerprint[:fingerprintNameLength]
+	}
+	templateName := prefix + nameFingerprint
+	if len(templateName) > maxIdentifierLength {
+		return nil, fmt.Errorf("template name %q exceeds %d characters", templateName, maxIdentifierLength)
+	}
+
+	info, err := p.cachedServerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Concurrent processes wait for the first one to build the template.
+	unlock, err := p.LockTemplate(ctx, templateName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unlockErr := unlock(); unlockErr != nil {
+			err = errors.Join(err, unlockErr)
+		}
+	}()
+
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer adminConn.Close()
+
+	template := &Template{Name: templateName, Fingerprint: fingerprint, Parent: config.Parent, Source: config.Source}
+	template.Reused, err = p.reuseTemplate(ctx, adminConn, info, templateName, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if !template.Reused {
+		if err := p.buildTemplate(ctx, adminConn, templateName, fingerprint, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.DropStale {
+		if err := p.dropStaleTemplates(ctx, adminConn, info, prefix, templateName); err != nil {
+			return template, err
+		}
+	}
+	return template, nil
+}
+
+// templateOptionsFingerprint returns the fingerprint of the provider options
+// influencing the template built for the config, or an empty string
+// if none are set, so that templates built without options keep their names.
+//
+// Template options only apply to templates created from scratch, as derived
+// templates inherit them. Clone options are applied to each clone instead,
+// so they do not influence the template.
+func (p *ConnectionProvider) templateOptionsFingerprint(config TemplateConfig) string {
+	var inputs []string
+	if config.Parent == "" && config.Source == "" && p.createOptions.hasTemplateOptions() {
+		// Encoding names are matched ignoring case and punctuation, e.g. UTF-8 and utf8.
+		encoding := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, p.createOptions.encoding)
+		inputs = append(inputs,
+			"encoding", encoding,
+			"locale", p.createOptions.locale,
+			"icu_locale", p.createOptions.icuLocale,
+		)
+	}
+	if finalization := p.finalization; finalization != (TemplateFinalization{}) {
+		inputs = append(inputs,
+			"vacuum", strconv.FormatBool(finalization.Vacuum),
+			"prewarm", strconv.FormatBool(finalization.Prewarm),
+			"disallow_connections", strconv.FormatBool(finalization.DisallowConnections),
+		)
+	}
+	if len(inputs) == 0 {
+		return ""
+	}
+	return CombineFingerprints(inputs...)
+}
+
+// reuseTemplate reports whether the existing template database can be reused,
+// dropping it if it is left over from an incomplete or different build.
+func (p *ConnectionProvider) reuseTemplate(ctx context.Context, adminConn *DatabaseConnection, info *ServerInfo, templateName, fingerprint string) (bool, error) {
+	var (
+		isTemplate bool
+		comment    sql.NullString
+	)
+	err := adminConn.DB.QueryRowContext(ctx,
+		"SELECT datistemplate, shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1",
+		templateName,
+	).Scan(&isTemplate, &comment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check if template exists: %w", err)
+	}
+
+	metadata, _ := ParseDatabaseMetadata(comment.String)
+	if isTemplate && metadata != nil && metadata.Fingerprint == fingerprint {
+		return true, nil
+	}
+
+	// The template is incomplete, e.g. its build was interrupted.
+	if err := p.dropTemplate(ctx, adminConn, info, templateName); err != nil {
+		return false, fmt.Errorf("failed to drop incomplete template: %w", err)
+	}
+	return false, nil
+}
+
+// buildTemplate creates the template database, cloning the parent or source
+// if any, and runs migrations on it.
+func (p *ConnectionProvider) buildTemplate(ctx context.Context, adminConn *DatabaseConnection, templateName, fingerprint string, config TemplateConfig) (err error) {
+	if config.Source != "" {
+		if err := cloneDatabaseInUse(ctx, adminConn, templateName, config.Source, config.TerminateSourceSessions); err != nil {
+			return fmt.Errorf("failed to clone source database: %w", err)
+		}
+	} else if err := p.createTemplateDatabase(ctx, adminConn, templateName, config.Parent); err != nil {
+		return err
+	}
+
+	// Should any further steps fail, ensure we drop the created template database.
+	defer func() {
+		if err == nil {
+			return
+		}
+		dropQuery := fmt.Sprintf("DROP DATABASE %s", pq.QuoteIdentifier(templateName))
+		if _, dropErr := adminConn.DB.ExecContext(ctx, dropQuery); dropErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to drop template database: %w", dropErr))
+		}
+	}()
+
+	templateConn, err := p.connect(ctx, templateName)
+	if err != nil {
+		return fmt.Errorf("failed to connect to template database: %w", err)
+	}
+	if err := config.MigrationRunner.RunMigrations(ctx, templateConn); err != nil {
+		templateConn.Close() // #nosec G104 -- Close error in error path is not critical.
+		return fmt.Errorf("failed to run migrations on template: %w", err)
+	}
+	// The template cannot be cloned while connected to.
+	if err := templateConn.Close(); err != nil {
+		return fmt.Errorf("failed to close template connection: %w", err)
+	}
+
+	// The fingerprint is stored last, so that only complete builds are reused.
+	metadata := NewDatabaseMetadata()
+	metadata.Fingerprint = fingerprint
+	metadata.Parent = config.Parent
+	if config.Source != "" {
+		metadata.Parent = config.Source
+	}
+	if err := setDatabaseMetadata(ctx, adminConn, templateName, metadata); err != nil {
+		return err
+	}
+	return p.markTemplate(ctx, adminConn, templateName)
+}
+
+// dropStaleTemplates drops the templates with the prefix other than the current one.
+func (p *ConnectionProvider) dropStaleTemplates(ctx context.Context, adminConn *DatabaseConnection, info *ServerInfo, prefix, currentName string) (err error) {
+	rows, err := adminConn.DB.QueryContext(ctx, `
+		SELECT datname, coalesce(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database
+		WHERE datistemplate AND left(datname, length($1)) = $1 AND datname <> $2
+	`, prefix, currentName)
+	if err != nil {
+		return fmt.Errorf("failed to list stale templates: %w", err)
+	}
+	var stale []string
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			rows.Close() // #nosec G104 -- Close error in error path is not critical.
+			return fmt.Errorf("failed to scan stale template: %w", err)
+		}
+		// Only fingerprinted templates are ours to drop.
+		if metadata, ok := ParseDatabaseMetadata(comment); ok && metadata.Fingerprint != "" {
+			stale = append(stale, name)
+		}
+	}
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("failed to list stale templates: %w", err)
+	}
+
+	for _, name := range stale {
+		if dropErr := p.dropTemplate(ctx, adminConn, info, name); dropErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to drop stale template %q: %w", name, dropErr))
+		}
+	}
+	return err
+}
+
+// dropTemplate drops the database after unmarking it as a template and
+// allowing connections to it again, so that a failed drop does not leave
+// behind a database nobody can connect to.
+func (p *ConnectionProvider) dropTemplate(ctx context.Context, adminConn *DatabaseConnection, info *ServerInfo, templateName string) error {
+	if err := unmarkTemplate(ctx, adminConn, templateName); err != nil {
+		return err
+	}
+	_, err := dropDatabase(ctx, adminConn, info, templateName)
+	return err
+}
@@ -0,0 +1,254 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	"github.com/lib/pq"
+)
+
+// defaultTestDBPrefix is the default prefix of test database names,
+// the same as pgdbtemplate.TemplateManager uses.
+const defaultTestDBPrefix = "test_"
+
+// Counters keeping generated database names unique within the process.
+var (
+	templateManagerCounter atomic.Int64
+	testDBCounter          atomic.Int64
+)
+
+// TemplateManagerConfig configures ConnectionProvider.NewTemplateManager.
+type TemplateManagerConfig struct {
+	// MigrationRunner runs migrations on the template database.
+	//
+	// This field is required.
+	MigrationRunner pgdbtemplate.MigrationRunner
+	// TemplateName is the name of the template database.
+	//
+	// If empty, a unique name will be generated.
+	TemplateName string
+	// TestDBPrefix is the prefix for test database names.
+	//
+	// If empty, "test_" will be used.
+	TestDBPrefix string
+	// Parent is the name of an existing template to clone the template from.
+	// MigrationRunner then only runs the extra migrations and seeders.
+	Parent string
+}
+
+// TemplateManager manages a template database and the test databases
+// cloned from it, like pgdbtemplate.TemplateManager.
+//
+// Unlike pgdbtemplate.TemplateManager, it creates databases through
+// the provider, so the template is created with the template options
+// of the provider, e.g. WithTemplateEncoding, test databases are cloned
+// with its clone options, e.g. WithCloneStrategy, and the template is
+// finalized with WithTemplateFinalization. All databases are stamped
+// with DatabaseMetadata.
+type TemplateManager struct {
+	provider *ConnectionProvider
+	migrator pgdbtemplate.MigrationRunner
+
+	templateName string
+	testPrefix   string
+	parent       string
+
+	mu          sync.Mutex
+	initialized bool
+
+	createdTestDBs sync.Map // Tracks created test databases for cleanup.
+}
+
+// NewTemplateManager creates a new template manager creating databases
+// through the provider.
+func (p *ConnectionProvider) NewTemplateManager(config TemplateManagerConfig) (*TemplateManager, error) {
+	if config.MigrationRunner == nil {
+		return nil, errors.New("MigrationRunner is required")
+	}
+
+	templateName := config.TemplateName
+	if templateName == "" {
+		templateName = fmt.Sprintf("template_db_%d_%d", time.Now().UnixNano(), templateManagerCounter.Add(1))
+	}
+	testPrefix := config.TestDBPrefix
+	if testPrefix == "" {
+		testPrefix = defaultTestDBPrefix
+	}
+
+	return &TemplateManager{
+		provider:     p,
+		migrator:     config.MigrationRunner,
+		templateName: templateName,
+		testPrefix:   testPrefix,
+		parent:       config.Parent,
+	}, nil
+}
+
+// TemplateName returns the name of the template database.
+func (tm *TemplateManager) TemplateName() string {
+	return tm.templateName
+}
+
+// Initialize sets up the template database with all migrations.
+//
+// An existing database with the template name is used as it is.
+func (tm *TemplateManager) Initialize(ctx context.Context) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.initialized {
+		return nil
+	}
+	if err := tm.createTemplateDatabase(ctx); err != nil {
+		return fmt.Errorf("failed to create template database: %w", err)
+	}
+	tm.initialized = true
+	return nil
+}
+
+// createTemplateDatabase creates the template database, runs migrations
+// on it and marks it as a template.
+func (tm *TemplateManager) createTemplateDatabase(ctx context.Context) (err error) {
+	adminConn, err := tm.provider.connectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer adminConn.Close()
+
+	var exists bool
+	err = adminConn.DB.QueryRowContext(ctx,
+		"SELECT TRUE FROM pg_database WHERE datname = $1", tm.templateName,
+	).Scan(&exists)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to check if template exists: %w", err)
+	}
+
+	if err := tm.provider.createTemplateDatabase(ctx, adminConn, tm.templateName, tm.parent); err != nil {
+		return err
+	}
+
+	// Should any further steps fail, ensure we drop the created template database.
+	defer func() {
+		if err == nil {
+			return
+		}
+		dropQuery := fmt.Sprintf("DROP DATABASE %s", pq.QuoteIdentifier(tm.templateName))
+		if _, dropErr := adminConn.DB.ExecContext(ctx, dropQuery); dropErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to drop template database: %w", dropErr))
+		}
+	}()
+
+	templateConn, err := tm.provider.connect(ctx, tm.templateName)
+	if err != nil {
+		return fmt.Errorf("failed to connect to template database: %w", err)
+	}
+	if err := tm.migrator.RunMigrations(ctx, templateConn); err != nil {
+		templateConn.Close() // #nosec G104 -- Close error in error path is not critical.
+		return fmt.Errorf("failed to run migrations on template: %w", err)
+	}
+	// The template cannot be finalized or cloned while connected to.
+	if err := templateConn.Close(); err != nil {
+		return fmt.Errorf("failed to close template connection: %w", err)
+	}
+	return tm.provider.markTemplate(ctx, adminConn, tm.templateName)
+}
+
+// CreateTestDatabase creates a new test database from the template
+// and returns a connection to it with its name, which may be given.
+//
+// The caller is expected to call Initialize() before using this method.
+func (tm *TemplateManager) CreateTestDatabase(ctx context.Context, testDBName ...string) (_ pgdbtemplate.DatabaseConnection, _ string, err error) {
+	var dbName string
+	if len(testDBName) > 0 && testDBName[0] != "" {
+		dbName = testDBName[0]
+	} else {
+		dbName = fmt.Sprintf("%s%d_%d", tm.testPrefix, time.Now().UnixNano(), testDBCounter.Add(1))
+	}
+
+	adminConn, err := tm.provider.connectAdmin(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer adminConn.Close()
+
+	if err := tm.provider.cloneDatabase(ctx, adminConn, dbName, tm.templateName); err != nil {
+		return nil, "", err
+	}
+
+	// Drop the test database if any further steps fail.
+	defer func() {
+		if err == nil {
+			return
+		}
+		dropQuery := fmt.Sprintf("DROP DATABASE %s", pq.QuoteIdentifier(dbName))
+		if _, dropErr := adminConn.DB.ExecContext(ctx, dropQuery); dropErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to drop test database %q: %w", dbName, dropErr))
+		}
+	}()
+
+	testConn, err := tm.provider.connect(ctx, dbName)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to test database: %w", err)
+	}
+	tm.createdTestDBs.Store(dbName, true)
+	return testConn, dbName, nil
+}
+
+// DropTestDatabase drops a test database, terminating its sessions.
+func (tm *TemplateManager) DropTestDatabase(ctx context.Context, dbName string) error {
+	if _, err := tm.provider.DropDatabase(ctx, dbName); err != nil {
+		return err
+	}
+	tm.createdTestDBs.Delete(dbName)
+	return nil
+}
+
+// Cleanup drops all tracked test databases and the template database.
+func (tm *TemplateManager) Cleanup(ctx context.Context) (errs error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if !tm.initialized {
+		return nil
+	}
+
+	info, err := tm.provider.cachedServerInfo(ctx)
+	if err != nil {
+		return err
+	}
+	adminConn, err := tm.provider.connectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer adminConn.Close()
+
+	// Test databases must be dropped first,
+	// errors are collected and returned after attempting to drop the template.
+	tm.createdTestDBs.Range(func(key, _ any) bool {
+		dbName := key.(string)
+		if _, err := dropDatabase(ctx, adminConn, info, dbName); err != nil {
+			errs = errors.Join(errs, err)
+		} else {
+			tm.createdTestDBs.Delete(dbName)
+		}
+		return true
+	})
+	if errs != nil {
+		errs = fmt.Errorf("failed to clean up tracked test databases: %w", errs)
+	}
+
+	if err := tm.provider.dropTemplate(ctx, adminConn, info, tm.templateName); err != nil {
+		errs = errors.Join(errs, fmt.Errorf("failed to drop template database: %w", err))
+	}
+	tm.initialized = false
+	return errs
+}
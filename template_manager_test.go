@@ -0,0 +1,104 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// TestTemplateManager tests managing templates through the provider.
+func TestTemplateManager(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+
+	// databaseExists reports whether the database exists.
+	databaseExists := func(c *qt.C, name string) bool {
+		adminDB, err := sql.Open("postgres", testConnectionString)
+		c.Assert(err, qt.IsNil)
+		defer adminDB.Close()
+		var exists bool
+		err = adminDB.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_database WHERE datname = $1)", name).Scan(&exists)
+		c.Assert(err, qt.IsNil)
+		return exists
+	}
+
+	c.Run("MigrationRunner is required", func(c *qt.C) {
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		_, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{})
+		c.Assert(err, qt.ErrorMatches, "MigrationRunner is required")
+	})
+
+	c.Run("Databases are stamped and cleaned up", func(c *qt.C) {
+		c.Parallel()
+		provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+		tm, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{
+			MigrationRunner: &countingMigrationRunner{},
+			TestDBPrefix:    "tm_stamped_",
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(tm.Initialize(ctx), qt.IsNil)
+
+		conn, dbName, err := tm.CreateTestDatabase(ctx)
+		c.Assert(err, qt.IsNil)
+		c.Assert(conn.Close(), qt.IsNil)
+
+		for _, name := range []string{tm.TemplateName(), dbName} {
+			metadata, err := provider.DatabaseMetadata(ctx, name)
+			c.Assert(err, qt.IsNil)
+			c.Assert(metadata, qt.IsNotNil)
+		}
+
+		c.Assert(tm.Cleanup(ctx), qt.IsNil)
+		c.Assert(databaseExists(c, dbName), qt.IsFalse)
+		c.Assert(databaseExists(c, tm.TemplateName()), qt.IsFalse)
+	})
+
+	c.Run("Derived template does not get clone options", func(c *qt.C) {
+		c.Parallel()
+		provider := pgdbtemplatepq.NewConnectionProviderWithOptions(connStringFunc, pgdbtemplatepq.WithCloneConnectionLimit(4))
+		parent, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{
+			MigrationRunner: &countingMigrationRunner{},
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(parent.Initialize(ctx), qt.IsNil)
+		defer parent.Cleanup(ctx)
+
+		childName := fmt.Sprintf("tm_child_%d", time.Now().UnixNano())
+		child, err := provider.NewTemplateManager(pgdbtemplatepq.TemplateManagerConfig{
+			MigrationRunner: &pgdbtemplate.NoOpMigrationRunner{},
+			TemplateName:    childName,
+			Parent:          parent.TemplateName(),
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(child.Initialize(ctx), qt.IsNil)
+		defer child.Cleanup(ctx)
+
+		conn, dbName, err := child.CreateTestDatabase(ctx)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		var childLimit, cloneLimit, tables int
+		err = conn.QueryRowContext(ctx, `
+			SELECT
+				(SELECT datconnlimit FROM pg_database WHERE datname = $1),
+				(SELECT datconnlimit FROM pg_database WHERE datname = $2),
+				(SELECT count(*) FROM pg_tables WHERE tablename = 'fingerprinted')
+		`, childName, dbName).Scan(&childLimit, &cloneLimit, &tables)
+		c.Assert(err, qt.IsNil)
+		c.Assert(childLimit, qt.Equals, -1)
+		c.Assert(cloneLimit, qt.Equals, 4)
+		c.Assert(tables, qt.Equals, 1)
+	})
+}
@@ -0,0 +1,277 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// countingMigrationRunner counts migration runs and creates a table.
+type countingMigrationRunner struct {
+	runs atomic.Int32
+	err  error
+}
+
+// RunMigrations implements pgdbtemplate.MigrationRunner.
+func (r *countingMigrationRunner) RunMigrations(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+	r.runs.Add(1)
+	if r.err != nil {
+		return r.err
+	}
+	_, err := conn.ExecContext(ctx, "CREATE TABLE fingerprinted (id INTEGER)")
+	return err
+}
+
+// unmarkAndDrop drops the template database.
+func unmarkAndDrop(c *qt.C, templateName string) {
+	ctx := context.Background()
+	adminDB, err := sql.Open("postgres", testConnectionString)
+	c.Assert(err, qt.IsNil)
+	defer adminDB.Close()
+	adminDB.ExecContext(ctx, fmt.Sprintf(`ALTER DATABASE "%s" WITH is_template FALSE`, templateName))
+	adminDB.ExecContext(ctx, fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, templateName))
+}
+
+// TestEnsureTemplate tests building and reusing fingerprinted templates.
+func TestEnsureTemplate(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	// uniquePrefix returns a template name prefix unique to the subtest.
+	uniquePrefix := func(c *qt.C) string {
+		prefix := fmt.Sprintf("fp_%d_", time.Now().UnixNano())
+		c.Cleanup(func() {
+			provider.Reap(ctx, pgdbtemplatepq.ReapOptions{Prefixes: []string{prefix}, IncludeUnstamped: true})
+		})
+		return prefix
+	}
+
+	c.Run("Build and reuse", func(c *qt.C) {
+		c.Parallel()
+		prefix := uniquePrefix(c)
+		runner := &countingMigrationRunner{}
+		config := pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: runner,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("build and reuse"),
+		}
+
+		built, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, built.Name)
+		c.Assert(built.Reused, qt.IsFalse)
+		c.Assert(built.Name, qt.Equals, prefix+built.Fingerprint[:16])
+		c.Assert(runner.runs.Load(), qt.Equals, int32(1))
+
+		metadata, err := provider.DatabaseMetadata(ctx, built.Name)
+		c.Assert(err, qt.IsNil)
+		c.Assert(metadata.Fingerprint, qt.Equals, built.Fingerprint)
+
+		reused, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		c.Assert(reused.Reused, qt.IsTrue)
+		c.Assert(reused.Name, qt.Equals, built.Name)
+		c.Assert(runner.runs.Load(), qt.Equals, int32(1))
+
+		cloneName := fmt.Sprintf("fp_clone_%d", time.Now().UnixNano())
+		c.Assert(provider.CloneDatabase(ctx, cloneName, reused.Name), qt.IsNil)
+		defer provider.DropDatabase(ctx, cloneName)
+
+		cloneConn, err := provider.Connect(ctx, cloneName)
+		c.Assert(err, qt.IsNil)
+		defer cloneConn.Close()
+		var count int
+		c.Assert(cloneConn.QueryRowContext(ctx, "SELECT count(*) FROM fingerprinted").Scan(&count), qt.IsNil)
+	})
+
+	c.Run("Provider options are part of the fingerprint", func(c *qt.C) {
+		c.Parallel()
+		prefix := uniquePrefix(c)
+		config := pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: &countingMigrationRunner{},
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("options"),
+		}
+
+		plain, err := provider.EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, plain.Name)
+		c.Assert(plain.Fingerprint, qt.Equals, config.Fingerprint)
+
+		encoded, err := pgdbtemplatepq.NewConnectionProviderWithOptions(connStringFunc,
+			pgdbtemplatepq.WithTemplateEncoding("UTF8"),
+		).EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, encoded.Name)
+		c.Assert(encoded.Reused, qt.IsFalse)
+		c.Assert(encoded.Name, qt.Not(qt.Equals), plain.Name)
+
+		// Encoding names are normalized like PostgreSQL does.
+		sameEncoding, err := pgdbtemplatepq.NewConnectionProviderWithOptions(connStringFunc,
+			pgdbtemplatepq.WithTemplateEncoding("utf-8"),
+		).EnsureTemplate(ctx, config)
+		c.Assert(err, qt.IsNil)
+		c.Assert(sameEncoding.Reused, qt.IsTrue)
+		c.Assert(sameEncoding.Name, qt.Equals, encoded.Name)
+	})
+
+	c.Run("Changed fingerprint builds a new template", func(c *qt.C) {
+		c.Parallel()
+		prefix := uniquePrefix(c)
+		runner := &countingMigrationRunner{}
+
+		first, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: runner,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("first"),
+		})
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, first.Name)
+
+		second, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: runner,
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("second"),
+			DropStale:       true,
+		})
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, second.Name)
+		c.Assert(second.Reused, qt.IsFalse)
+		c.Assert(second.Name, qt.Not(qt.Equals), first.Name)
+		c.Assert(runner.runs.Load(), qt.Equals, int32(2))
+
+		_, err = provider.DatabaseMetadata(ctx, first.Name)
+		c.Assert(err, qt.ErrorMatches, ".*does not exist")
+	})
+
+	c.Run("Derived templates track their parent", func(c *qt.C) {
+		c.Parallel()
+		prefix := uniquePrefix(c)
+		ensureParent := func(fingerprint string) *pgdbtemplatepq.Template {
+			parent, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+				NamePrefix:      prefix + "base_",
+				MigrationRunner: &countingMigrationRunner{},
+				Fingerprint:     pgdbtemplatepq.CombineFingerprints(fingerprint),
+			})
+			c.Assert(err, qt.IsNil)
+			c.Cleanup(func() { unmarkAndDrop(c, parent.Name) })
+			return parent
+		}
+		seeds := 0
+		childConfig := func(parent string) pgdbtemplatepq.TemplateConfig {
+			return pgdbtemplatepq.TemplateConfig{
+				NamePrefix: prefix + "large_",
+				Parent:     parent,
+				MigrationRunner: pgdbtemplatepq.NewSeedingMigrationRunner(nil, pgdbtemplatepq.Seeder{
+					Name: "large",
+					Seed: func(ctx context.Context, conn pgdbtemplate.DatabaseConnection) error {
+						seeds++
+						_, err := conn.ExecContext(ctx, "INSERT INTO fingerprinted SELECT generate_series(1, 100)")
+						return err
+					},
+				}),
+			}
+		}
+
+		parent := ensureParent("base")
+		child, err := provider.EnsureTemplate(ctx, childConfig(parent.Name))
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, child.Name)
+		c.Assert(child.Parent, qt.Equals, parent.Name)
+
+		metadata, err := provider.DatabaseMetadata(ctx, child.Name)
+		c.Assert(err, qt.IsNil)
+		c.Assert(metadata.Parent, qt.Equals, parent.Name)
+
+		// The child is cloned from the parent, so the table of the parent exists.
+		conn, err := provider.Connect(ctx, child.Name)
+		c.Assert(err, qt.IsNil)
+		var rows int
+		c.Assert(conn.QueryRowContext(ctx, "SELECT count(*) FROM fingerprinted").Scan(&rows), qt.IsNil)
+		c.Assert(conn.Close(), qt.IsNil)
+		c.Assert(rows, qt.Equals, 100)
+
+		reused, err := provider.EnsureTemplate(ctx, childConfig(parent.Name))
+		c.Assert(err, qt.IsNil)
+		c.Assert(reused.Reused, qt.IsTrue)
+		c.Assert(seeds, qt.Equals, 1)
+
+		// A changed parent changes the fingerprint of the child.
+		changedParent := ensureParent("changed base")
+		rebuilt, err := provider.EnsureTemplate(ctx, childConfig(changedParent.Name))
+		c.Assert(err, qt.IsNil)
+		defer unmarkAndDrop(c, rebuilt.Name)
+		c.Assert(rebuilt.Reused, qt.IsFalse)
+		c.Assert(rebuilt.Name, qt.Not(qt.Equals), child.Name)
+		c.Assert(seeds, qt.Equals, 2)
+	})
+
+	c.Run("Parent must be built by EnsureTemplate", func(c *qt.C) {
+		c.Parallel()
+		_, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			MigrationRunner: &countingMigrationRunner{},
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("orphan"),
+			Parent:          "pgdbtemplate_missing_parent",
+		})
+		c.Assert(err, qt.ErrorMatches, `failed to read parent template: database "pgdbtemplate_missing_parent" does not exist`)
+
+		_, err = provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			MigrationRunner: &countingMigrationRunner{},
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("orphan"),
+			Parent:          "template1",
+		})
+		c.Assert(err, qt.ErrorMatches, `parent "template1" is not a template built by EnsureTemplate`)
+	})
+
+	c.Run("Failed build leaves no template", func(c *qt.C) {
+		c.Parallel()
+		prefix := uniquePrefix(c)
+		template, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      prefix,
+			MigrationRunner: &countingMigrationRunner{err: errors.New("migration failed")},
+			Fingerprint:     pgdbtemplatepq.CombineFingerprints("failed build"),
+		})
+		c.Assert(err, qt.ErrorMatches, "failed to run migrations on template: migration failed")
+		c.Assert(template, qt.IsNil)
+
+		plan, err := provider.Reap(ctx, pgdbtemplatepq.ReapOptions{Prefixes: []string{prefix}, DryRun: true})
+		c.Assert(err, qt.IsNil)
+		c.Assert(plan, qt.HasLen, 0)
+	})
+
+	c.Run("Fingerprint is required", func(c *qt.C) {
+		_, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			MigrationRunner: &countingMigrationRunner{},
+		})
+		c.Assert(err, qt.ErrorMatches, "Fingerprint is required when MigrationRunner does not implement Fingerprinter")
+	})
+
+	c.Run("MigrationRunner is required", func(c *qt.C) {
+		_, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{Fingerprint: "abc"})
+		c.Assert(err, qt.ErrorMatches, "MigrationRunner is required")
+	})
+
+	c.Run("Too long name", func(c *qt.C) {
+		_, err := provider.EnsureTemplate(ctx, pgdbtemplatepq.TemplateConfig{
+			NamePrefix:      fmt.Sprintf("%060d", 0),
+			MigrationRunner: &countingMigrationRunner{},
+			Fingerprint:     "abcdef",
+		})
+		c.Assert(err, qt.ErrorMatches, `template name .* exceeds 63 characters`)
+	})
+}
@@ -0,0 +1,201 @@
+package pgdbtemplatepq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// terminateWaitInterval is the delay between checks for remaining sessions
+// after pg_terminate_backend has been called.
+const terminateWaitInterval = 10 * time.Millisecond
+
+// TerminatedSession describes a backend session that was terminated
+// because it was connected to a database being closed or dropped.
+type TerminatedSession struct {
+	// PID is the process ID of the backend.
+	PID int
+	// Username is the name of the role the session was logged in as.
+	Username string
+	// ApplicationName is the application_name reported by the client.
+	ApplicationName string
+	// ClientAddr is the client address, empty for Unix socket connections.
+	ClientAddr string
+	// State is the session state at the time it was terminated.
+	State string
+	// BackendStart is the time the backend process was started, zero if
+	// it is not visible, e.g. for sessions of other roles when the caller
+	// lacks pg_read_all_stats.
+	BackendStart time.Time
+}
+
+// TerminateConnections terminates all sessions connected to the database,
+// except the session used to issue the termination.
+//
+// CONNECT is revoked from PUBLIC before the sessions are terminated so that
+// no new sessions can appear, and it is not granted back: the method is meant
+// to be followed by DROP DATABASE. The method waits until all terminated
+// sessions are gone or ctx is done.
+func (p *ConnectionProvider) TerminateConnections(ctx context.Context, databaseName string) ([]TerminatedSession, error) {
+	if databaseName == p.adminDBName {
+		return nil, fmt.Errorf("cannot terminate connections to the administrative database %q", databaseName)
+	}
+
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer adminConn.Close()
+
+	return terminateConnections(ctx, adminConn, databaseName)
+}
+
+// DropDatabase drops the database, terminating all sessions connected to it.
+//
+// On PostgreSQL 13 and later DROP DATABASE ... WITH (FORCE) is used,
+// otherwise the sessions are terminated with TerminateConnections first.
+// The returned sessions are the ones that were connected at the time of the drop.
+func (p *ConnectionProvider) DropDatabase(ctx context.Context, databaseName string) ([]TerminatedSession, error) {
+	if databaseName == p.adminDBName {
+		return nil, fmt.Errorf("cannot drop the administrative database %q", databaseName)
+	}
+
+	info, err := p.cachedServerInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	adminConn, err := p.connectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer adminConn.Close()
+
+	return dropDatabase(ctx, adminConn, info, databaseName)
+}
+
+// dropDatabase drops the database, terminating all sessions connected to it.
+func dropDatabase(ctx context.Context, adminConn *DatabaseConnection, info *ServerInfo, databaseName string) ([]TerminatedSession, error) {
+	// Older servers need the sessions to be terminated by hand.
+	if !info.Supports(FeatureDropDatabaseForce) {
+		sessions, err := terminateConnections(ctx, adminConn, databaseName)
+		if err != nil {
+			return sessions, err
+		}
+		dropQuery := fmt.Sprintf("DROP DATABASE %s", pq.QuoteIdentifier(databaseName))
+		if _, err := adminConn.DB.ExecContext(ctx, dropQuery); err != nil {
+			return sessions, fmt.Errorf("failed to drop database %q: %w", databaseName, err)
+		}
+		return sessions, nil
+	}
+
+	// Record the sessions first: WITH (FORCE) does not report what it terminated.
+	sessions, err := listSessions(ctx, adminConn, databaseName, false)
+	if err != nil {
+		return nil, err
+	}
+	dropQuery := fmt.Sprintf("DROP DATABASE %s WITH (FORCE)", pq.QuoteIdentifier(databaseName))
+	if _, err := adminConn.DB.ExecContext(ctx, dropQuery); err != nil {
+		return nil, fmt.Errorf("failed to drop database %q: %w", databaseName, err)
+	}
+	return sessions, nil
+}
+
+// terminateConnections revokes CONNECT on the database, terminates its sessions
+// and waits for them to go away.
+func terminateConnections(ctx context.Context, adminConn *DatabaseConnection, databaseName string) ([]TerminatedSession, error) {
+	revokeQuery := fmt.Sprintf("REVOKE CONNECT ON DATABASE %s FROM PUBLIC", pq.QuoteIdentifier(databaseName))
+	if _, err := adminConn.DB.ExecContext(ctx, revokeQuery); err != nil {
+		return nil, fmt.Errorf("failed to revoke CONNECT on database %q: %w", databaseName, err)
+	}
+
+	sessions, err := listSessions(ctx, adminConn, databaseName, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// pg_terminate_backend only signals the backends, so wait
+	// until they have actually exited.
+	ticker := time.NewTicker(terminateWaitInterval)
+	defer ticker.Stop()
+	for {
+		var remaining int
+		err := adminConn.DB.QueryRowContext(ctx, `
+			SELECT count(*)
+			FROM pg_stat_activity
+			WHERE datname = $1 AND pid <> pg_backend_pid()
+		`, databaseName).Scan(&remaining)
+		if err != nil {
+			return sessions, fmt.Errorf("failed to count sessions on database %q: %w", databaseName, err)
+		}
+		if remaining == 0 {
+			return sessions, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return sessions, fmt.Errorf("waiting for %d sessions on database %q to terminate: %w", remaining, databaseName, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// listSessions returns the sessions connected to the database,
+// optionally terminating each of them.
+func listSessions(ctx context.Context, adminConn *DatabaseConnection, databaseName string, terminate bool) (_ []TerminatedSession, err error) {
+	rows, err := adminConn.DB.QueryContext(ctx, `
+		SELECT
+			pid,
+			coalesce(usename, ''),
+			coalesce(application_name, ''),
+			coalesce(host(client_addr), ''),
+			coalesce(state, ''),
+			backend_start,
+			CASE WHEN $2 THEN pg_terminate_backend(pid) ELSE TRUE END
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()
+		ORDER BY pid
+	`, databaseName, terminate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions on database %q: %w", databaseName, err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}()
+
+	var sessions []TerminatedSession
+	for rows.Next() {
+		var (
+			session      TerminatedSession
+			backendStart sql.NullTime
+			terminated   bool
+		)
+		err := rows.Scan(
+			&session.PID,
+			&session.Username,
+			&session.ApplicationName,
+			&session.ClientAddr,
+			&session.State,
+			&backendStart,
+			&terminated,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		session.BackendStart = backendStart.Time
+		// The session may have exited on its own in the meantime.
+		if terminated {
+			sessions = append(sessions, session)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list sessions on database %q: %w", databaseName, err)
+	}
+	return sessions, nil
+}
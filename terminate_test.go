@@ -0,0 +1,94 @@
+package pgdbtemplatepq_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/andrei-polukhin/pgdbtemplate"
+	pgdbtemplatepq "github.com/andrei-polukhin/pgdbtemplate-pq"
+)
+
+// createScratchDatabase creates an empty database and registers its removal.
+func createScratchDatabase(c *qt.C, prefix string) string {
+	ctx := context.Background()
+	adminDB, err := sql.Open("postgres", testConnectionString)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { adminDB.Close() })
+
+	dbName := fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano())
+	_, err = adminDB.ExecContext(ctx, "CREATE DATABASE "+dbName)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() {
+		adminDB.ExecContext(ctx, "DROP DATABASE IF EXISTS "+dbName)
+	})
+	return dbName
+}
+
+// TestTerminateConnections tests terminating sessions and dropping databases.
+func TestTerminateConnections(t *testing.T) {
+	t.Parallel()
+	c := qt.New(t)
+	ctx := context.Background()
+
+	connStringFunc := func(dbName string) string {
+		return pgdbtemplate.ReplaceDatabaseInConnectionString(testConnectionString, dbName)
+	}
+	provider := pgdbtemplatepq.NewConnectionProvider(connStringFunc)
+
+	c.Run("Terminate reports killed sessions", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "terminate_test")
+
+		conn, err := provider.Connect(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		sessions, err := provider.TerminateConnections(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(sessions, qt.HasLen, 1)
+		c.Assert(sessions[0].PID, qt.Not(qt.Equals), 0)
+
+		// The terminated session must not be usable anymore.
+		var value int
+		err = conn.QueryRowContext(ctx, "SELECT 1").Scan(&value)
+		c.Assert(err, qt.IsNotNil)
+	})
+
+	c.Run("Terminate without sessions", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "terminate_empty_test")
+
+		sessions, err := provider.TerminateConnections(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(sessions, qt.HasLen, 0)
+	})
+
+	c.Run("Drop database with active session", func(c *qt.C) {
+		c.Parallel()
+		dbName := createScratchDatabase(c, "drop_test")
+
+		conn, err := provider.Connect(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		sessions, err := provider.DropDatabase(ctx, dbName)
+		c.Assert(err, qt.IsNil)
+		c.Assert(sessions, qt.HasLen, 1)
+
+		_, err = provider.Connect(ctx, dbName)
+		c.Assert(err, qt.ErrorMatches, "failed to ping database:.*")
+	})
+
+	c.Run("Administrative database is refused", func(c *qt.C) {
+		_, err := provider.TerminateConnections(ctx, "postgres")
+		c.Assert(err, qt.ErrorMatches, "cannot terminate connections to the administrative database.*")
+
+		_, err = provider.DropDatabase(ctx, "postgres")
+		c.Assert(err, qt.ErrorMatches, "cannot drop the administrative database.*")
+	})
+}